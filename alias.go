@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// aliasLabel is the project file label that gives a project an alias.
+const aliasLabel = "alias"
+
+// projectAliases maps project IDs to the friendly names shown in
+// notifications, from --alias and the config file. They take precedence
+// over an alias label in the project file.
+var projectAliases = map[string]string{}
+
+// aliasKeys stores backups under each project's alias instead of its ID.
+var aliasKeys bool
+
+// parseAlias splits a --alias value of the form projectID=friendly.
+func parseAlias(value string) (string, string, error) {
+	project, alias, ok := strings.Cut(value, "=")
+	project, alias = strings.TrimSpace(project), strings.TrimSpace(alias)
+	if !ok || project == "" || alias == "" {
+		return "", "", fmt.Errorf("invalid alias %q, expected projectID=friendly", value)
+	}
+	return project, alias, nil
+}
+
+// projectAlias returns project's alias, or "" if it has none.
+func projectAlias(project string) string {
+	if alias, ok := projectAliases[project]; ok {
+		return alias
+	}
+	return projectLabels[project][aliasLabel]
+}
+
+// displayName is the name a project is shown under in notifications.
+func displayName(project, alias string) string {
+	if alias != "" {
+		return alias
+	}
+	return project
+}
+
+// storageEnv is the env that project's backups are stored under: its
+// alias with --alias-keys, otherwise its ID. apigeecli always gets the ID.
+func storageEnv(project string) string {
+	if alias := projectAlias(project); aliasKeys && alias != "" {
+		return alias
+	}
+	return project
+}
+
+// checkAliases makes sure that with --alias-keys every project is stored
+// under a distinct env, so one project's backups can't replace another's.
+func checkAliases(projects []string) error {
+	if !aliasKeys {
+		return nil
+	}
+	owners := make(map[string]string, len(projects))
+	for _, project := range projects {
+		env := storageEnv(project)
+		if strings.ContainsAny(env, "/ \t") {
+			return fmt.Errorf("alias %q of %s can't be used in an object key", env, project)
+		}
+		if env == combinedEnv {
+			return fmt.Errorf("alias %q of %s is reserved for --combined-archive", env, project)
+		}
+		if owner, ok := owners[env]; ok && owner != project {
+			return fmt.Errorf("%s and %s would both be stored under %q", owner, project, env)
+		}
+		owners[env] = project
+	}
+	return nil
+}
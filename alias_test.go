@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProjectAlias(t *testing.T) {
+	setGlobal(t, &projectAliases, map[string]string{"company-apigee-prod-4821": "prod"})
+	setGlobal(t, &projectLabels, map[string]map[string]string{
+		"company-apigee-prod-4821": {"alias": "ignored"},
+		"company-apigee-dev-1234":  {"alias": "dev"},
+	})
+	setGlobal(t, &aliasKeys, false)
+
+	tests := []struct {
+		project, alias string
+	}{
+		{"company-apigee-prod-4821", "prod"}, // --alias wins over the label
+		{"company-apigee-dev-1234", "dev"},
+		{"other-org", ""},
+	}
+	for _, tt := range tests {
+		if got := projectAlias(tt.project); got != tt.alias {
+			t.Errorf("projectAlias(%q) = %q, want %q", tt.project, got, tt.alias)
+		}
+		if got := storageEnv(tt.project); got != tt.project {
+			t.Errorf("storageEnv(%q) without --alias-keys = %q, want the project ID", tt.project, got)
+		}
+	}
+
+	aliasKeys = true
+	if got := storageEnv("company-apigee-prod-4821"); got != "prod" {
+		t.Errorf("storageEnv() with --alias-keys = %q, want prod", got)
+	}
+	if got := storageEnv("other-org"); got != "other-org" {
+		t.Errorf("storageEnv() without an alias = %q, want other-org", got)
+	}
+}
+
+func TestParseAlias(t *testing.T) {
+	project, alias, err := parseAlias("company-apigee-prod-4821=prod")
+	if err != nil || project != "company-apigee-prod-4821" || alias != "prod" {
+		t.Errorf("parseAlias() = %q, %q, %v", project, alias, err)
+	}
+	for _, value := range []string{"prod", "=prod", "company-apigee-prod-4821="} {
+		if _, _, err := parseAlias(value); err == nil {
+			t.Errorf("parseAlias(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestCheckAliases(t *testing.T) {
+	setGlobal(t, &projectLabels, map[string]map[string]string{})
+	setGlobal(t, &aliasKeys, true)
+	tests := []struct {
+		aliases map[string]string
+		wantErr string
+	}{
+		{map[string]string{"org-a": "a", "org-b": "b"}, ""},
+		{map[string]string{"org-a": "shared", "org-b": "shared"}, "both be stored under"},
+		{map[string]string{"org-a": "org-b"}, "both be stored under"},
+		{map[string]string{"org-a": "team/a"}, "object key"},
+		{map[string]string{"org-a": combinedEnv}, "reserved"},
+	}
+	for _, tt := range tests {
+		setGlobal(t, &projectAliases, tt.aliases)
+		err := checkAliases([]string{"org-a", "org-b"})
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkAliases() with %v = %v, want error containing %q", tt.aliases, err, tt.wantErr)
+		}
+	}
+
+	// Collisions don't matter when backups are stored under project IDs
+	aliasKeys = false
+	setGlobal(t, &projectAliases, map[string]string{"org-a": "shared", "org-b": "shared"})
+	if err := checkAliases([]string{"org-a", "org-b"}); err != nil {
+		t.Errorf("checkAliases() without --alias-keys = %v", err)
+	}
+}
+
+func TestBackupWithAliasKeys(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	setGlobal(t, &projectAliases, map[string]string{"company-apigee-prod-4821": "prod"})
+	setGlobal(t, &projectLabels, map[string]map[string]string{})
+	setGlobal(t, &aliasKeys, true)
+	var orgs []string
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if i := slices.Index(args, "-o"); i >= 0 {
+			orgs = append(orgs, args[i+1])
+		}
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	status := backupProject(context.Background(), "company-apigee-prod-4821", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	if status.Project != "company-apigee-prod-4821" || status.Alias != "prod" || status.Name() != "prod" {
+		t.Errorf("status project = %q, alias = %q, name = %q", status.Project, status.Alias, status.Name())
+	}
+	if status.Object != backupObjectName("prod", backupDate()) || !store.has(testBucket, status.Object) {
+		t.Errorf("backup stored as %q, want it under the alias", status.Object)
+	}
+	for _, org := range orgs {
+		if org != "company-apigee-prod-4821" {
+			t.Errorf("apigeecli was run against %q, want the project ID", org)
+		}
+	}
+	if len(orgs) == 0 {
+		t.Error("apigeecli was never given an org")
+	}
+
+	summary := compactSummary("Summary", newSummaryTemplateData(backupDate(), []ProjectStatus{{Project: "company-apigee-prod-4821", Alias: "prod", Status: "Failed"}}, false, nil))
+	if !strings.Contains(summary, "Failed: prod") {
+		t.Errorf("compactSummary() = %q, want the alias", summary)
+	}
+}
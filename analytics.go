@@ -0,0 +1,76 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exportAnalytics also exports the analytics configuration that
+// organizations export --all leaves out in some apigeecli versions.
+var exportAnalytics bool
+
+// analyticsTypes are exported with --export-analytics. apigeecli has no
+// export subcommand for them, so their list output, which holds the full
+// definitions, is saved with one file per entity.
+var analyticsTypes = []entityType{
+	{Name: "datacollectors", Label: "data collectors", List: []string{"datacollectors", "list"}},
+	{Name: "reports", Label: "custom reports", List: []string{"reports", "list"}},
+}
+
+// exportAnalyticsConfig writes each analytics type's definitions into its
+// own folder of exportFolder, e.g. reports/<name>.json, so they are counted
+// in the manifest like any other entity type.
+func exportAnalyticsConfig(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	for _, et := range analyticsTypes {
+		unit := entityUnit{Type: et}
+		out, stderr, err := runApigeecli("", token, unit.args(et.List, project)...)
+		if err != nil {
+			var cliErr *apigeecliError
+			if errors.As(err, &cliErr) && ignoredStatuses[cliErr.Status] {
+				warnProject(status, "Continuing despite %s error exporting %s: %v", cliErr.Status, et.Label, cliErr.Message)
+				continue
+			}
+			status.FailureLog = saveFailureLog(gcsBucket, project, date, out, stderr)
+			return exportError("Failed to export "+et.Label, err)
+		}
+
+		entities, err := parseEntityList(out)
+		if err != nil {
+			return exportError("Failed to export "+et.Label, err)
+		}
+		if err := writeEntityFiles(filepath.Join(exportFolder, et.Name), entities); err != nil {
+			return newBackupError(ErrLocal, "Failed to write "+et.Label, err)
+		}
+	}
+	return nil
+}
+
+// writeEntityFiles writes each entity to dir as <name>.json, falling back to
+// its position in the list if it has no usable name.
+func writeEntityFiles(dir string, entities []json.RawMessage) error {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	for i, entity := range entities {
+		// A deployment is named by its proxy
+		var named struct {
+			Name     string `json:"name"`
+			APIProxy string `json:"apiProxy"`
+		}
+		json.Unmarshal(entity, &named)
+		name := cmp.Or(named.Name, named.APIProxy)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			name = strconv.Itoa(i)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".json"), entity, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
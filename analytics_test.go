@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExportAnalytics(t *testing.T) {
+	tests := []struct {
+		name       string
+		reports    func() (string, string, error)
+		wantStatus string
+		wantCounts map[string]int
+	}{
+		{
+			name: "exported",
+			reports: func() (string, string, error) {
+				return `[{"name": "r-1", "displayName": "Latency"}, {"displayName": "No name"}]`, "", nil
+			},
+			wantStatus: "Complete",
+			wantCounts: map[string]int{"datacollectors": 1, "proxies": 1, "reports": 2},
+		},
+		{
+			name: "ignored status",
+			reports: func() (string, string, error) {
+				return "", `{"error": {"code": 400, "message": "not enabled", "status": "FAILED_PRECONDITION"}}`, errors.New("exit status 1")
+			},
+			wantStatus: "Complete",
+			wantCounts: map[string]int{"datacollectors": 1, "proxies": 1},
+		},
+		{
+			name: "failed",
+			reports: func() (string, string, error) {
+				return "", `{"error": {"code": 500, "message": "internal error", "status": "INTERNAL"}}`, errors.New("exit status 1")
+			},
+			wantStatus: "Failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, _ := setupBackupTest(t)
+			exportAnalytics = true
+			runner.apigeecli = func(dir string, args []string) (string, string, error) {
+				switch args[0] {
+				case "organizations":
+					return "", "", writeExport(dir, "proxies/a.zip")
+				case "datacollectors":
+					return `{"dataCollectors": [{"name": "dc_region"}]}`, "", nil
+				case "reports":
+					return tt.reports()
+				}
+				return "", "", fmt.Errorf("unexpected apigeecli %v", args)
+			}
+
+			status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+			if status.Status != tt.wantStatus {
+				t.Fatalf("status = %q (%s), want %q", status.Status, status.Reason, tt.wantStatus)
+			}
+			if tt.wantCounts != nil && fmt.Sprint(status.EntityCounts) != fmt.Sprint(tt.wantCounts) {
+				t.Errorf("EntityCounts = %v, want %v", status.EntityCounts, tt.wantCounts)
+			}
+		})
+	}
+}
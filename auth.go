@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// adcScope is the OAuth scope requested for Apigee tokens from Application
+// Default Credentials.
+const adcScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// adcTokens supplies Apigee tokens from Application Default Credentials
+// with --use-adc. It caches each token and fetches a new one shortly before
+// it expires, so long runs never use an expired token.
+var adcTokens oauth2.TokenSource
+
+// setupADC finds Application Default Credentials, e.g. from gcloud auth
+// application-default login or the metadata server, and sets adcTokens.
+func setupADC(ctx context.Context) error {
+	source, err := google.DefaultTokenSource(ctx, adcScope)
+	if err != nil {
+		return fmt.Errorf("failed to find application default credentials: %w", err)
+	}
+	adcTokens = source
+	return nil
+}
+
+// freshToken returns a current token from adcTokens with --use-adc, or token
+// otherwise. It is called before each export, so a run that outlives a
+// token's lifetime switches to a new one.
+func freshToken(token string) (string, error) {
+	if adcTokens == nil {
+		return token, nil
+	}
+	t, err := adcTokens.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to get a token from application default credentials: %w", err)
+	}
+	return t.AccessToken, nil
+}
+
+// loadToken resolves the Apigee bearer token from exactly one of the
+// supported sources: the -token flag, a file, stdin, or Application Default
+// Credentials, which must already be set up with setupADC.
+func loadToken(token, tokenFile string, tokenStdin, useADC bool) (string, error) {
+	sources := 0
+	if token != "" {
+		sources++
+	}
+	if tokenFile != "" {
+		sources++
+	}
+	if tokenStdin {
+		sources++
+	}
+	if useADC {
+		sources++
+	}
+	if sources != 1 {
+		return "", errors.New("exactly one of --token, --token-file, --token-stdin or --use-adc must be set")
+	}
+
+	switch {
+	case useADC:
+		return freshToken("")
+	case tokenFile != "":
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %w", err)
+		}
+		token = string(data)
+	case tokenStdin:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token from stdin: %w", err)
+		}
+		token = string(data)
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("token is empty")
+	}
+	return token, nil
+}
+
+// apigeecliTokenHome creates a private directory to run apigeecli in as its
+// HOME, with token in apigeecli's token cache there, .apigeecli/config.json.
+// apigeecli uses a cached token when it isn't given -t, so the token never
+// appears in its command line, where ps would show it to other users. The
+// caller removes the directory once apigeecli has exited.
+func apigeecliTokenHome(token string) (string, error) {
+	home, err := os.MkdirTemp("", "apigee_backup-home-")
+	if err != nil {
+		return "", err
+	}
+	// nocheck stops apigeecli looking for a newer release on every run
+	data, err := json.Marshal(map[string]any{"token": token, "nocheck": true})
+	if err == nil {
+		err = os.Mkdir(filepath.Join(home, ".apigeecli"), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(home, ".apigeecli", "config.json"), data, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(home)
+		return "", err
+	}
+	return home, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenSourceFunc adapts a func to oauth2.TokenSource.
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) { return f() }
+
+func TestLoadToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token.txt")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setGlobal[oauth2.TokenSource](t, &adcTokens, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "adc-token"}))
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenFile string
+		useADC    bool
+		want      string
+		wantErr   bool
+	}{
+		{name: "flag", token: " flag-token ", want: "flag-token"},
+		{name: "file", tokenFile: tokenFile, want: "file-token"},
+		{name: "adc", useADC: true, want: "adc-token"},
+		{name: "none", wantErr: true},
+		{name: "two sources", token: "flag-token", useADC: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadToken(tt.token, tt.tokenFile, false, tt.useADC)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("loadToken() = %q, %v, want %q, error: %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFreshToken(t *testing.T) {
+	setGlobal[oauth2.TokenSource](t, &adcTokens, nil)
+	if got, err := freshToken("static"); got != "static" || err != nil {
+		t.Errorf("freshToken() without ADC = %q, %v, want the given token", got, err)
+	}
+
+	// Each export asks the source again, so a refreshed token is picked up
+	var calls int
+	adcTokens = tokenSourceFunc(func() (*oauth2.Token, error) {
+		calls++
+		if calls == 3 {
+			return nil, errors.New("metadata server unavailable")
+		}
+		return &oauth2.Token{AccessToken: "token-" + string(rune('0'+calls))}, nil
+	})
+	for _, want := range []string{"token-1", "token-2"} {
+		if got, err := freshToken("ignored"); got != want || err != nil {
+			t.Errorf("freshToken() = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := freshToken("ignored"); err == nil {
+		t.Error("freshToken() didn't return the source's error")
+	}
+}
+
+func TestApigeecliToken(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "ya29.secret", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	for _, call := range runner.calls {
+		if slices.Contains(call, "-t") || strings.Contains(strings.Join(call, " "), "ya29.secret") {
+			t.Errorf("token passed in the command line %v", call)
+		}
+	}
+	if len(runner.tokens) == 0 {
+		t.Fatal("apigeecli wasn't run with a token cache")
+	}
+	for _, token := range runner.tokens {
+		if token != "ya29.secret" {
+			t.Errorf("apigeecli found token %q in its cache, want ya29.secret", token)
+		}
+	}
+	if homes, _ := filepath.Glob(filepath.Join(os.TempDir(), "apigee_backup-home-*")); len(homes) != 0 {
+		t.Errorf("token caches left behind: %v", homes)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxRuntime, when set, is how long a run may take. Once the time left is
+// less than the longest project has taken so far, no more projects are
+// started, so a run ends cleanly within its cron window instead of being
+// killed mid-upload.
+var maxRuntime time.Duration
+
+// statusSkipped is the status of a project a run didn't get to.
+const statusSkipped = "Skipped"
+
+// runBudget tracks a run against maxRuntime while its projects are backed up.
+type runBudget struct {
+	mu        sync.Mutex
+	longest   time.Duration // the longest project backed up so far
+	exhausted bool          // a project has already been skipped
+}
+
+// allows reports whether there is time left to start another project. The
+// longest project so far is the estimate of how long the next one takes.
+func (b *runBudget) allows() bool {
+	if maxRuntime <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.exhausted && time.Since(runStart)+b.longest >= maxRuntime {
+		b.exhausted = true
+		log.Printf("Less than %s of the %s --max-runtime left, not starting any more projects\n", b.longest.Round(time.Second), maxRuntime)
+	}
+	return !b.exhausted
+}
+
+// record notes how long a project took to back up.
+func (b *runBudget) record(took time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.longest = max(b.longest, took)
+}
+
+// skippedProject is the status of project when the run's time budget ran
+// out before it was started.
+func skippedProject(project string) ProjectStatus {
+	return ProjectStatus{Project: project, Status: statusSkipped, Reason: "Skipped (time budget)", Alias: projectAlias(project), Labels: projectLabels[project]}
+}
+
+// countSkipped returns how many of statuses were skipped.
+func countSkipped(statuses []ProjectStatus) int {
+	var skipped int
+	for _, status := range statuses {
+		if status.Status == statusSkipped {
+			skipped++
+		}
+	}
+	return skipped
+}
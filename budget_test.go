@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxRuntime(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	maxRuntime = time.Hour
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if args[0] != "organizations" {
+			return "", "", nil
+		}
+		// The first project uses up the budget
+		runStart = time.Now().Add(-maxRuntime)
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	cfg := defaultConfig()
+	cfg.GCSBucket = testBucket
+	statuses, err := runBackup(cfg, []string{"org-a", "org-b", "org-c"}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].Status != "Complete" {
+		t.Errorf("org-a: status = %q (%s), want Complete", statuses[0].Status, statuses[0].Reason)
+	}
+	for _, status := range statuses[1:] {
+		if status.Status != statusSkipped || status.Reason != "Skipped (time budget)" {
+			t.Errorf("%s: status = %q (%s), want skipped for the time budget", status.Project, status.Status, status.Reason)
+		}
+	}
+
+	// Skipped projects weren't backed up, so the catalog doesn't list them
+	catalog, _, err := readCatalog(testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Entries) != 1 || catalog.Entries[0].Org != "org-a" {
+		t.Errorf("catalog = %+v, want only org-a", catalog.Entries)
+	}
+	summary := compactSummary("Summary", newSummaryTemplateData(backupDate(), statuses, false, nil))
+	if !strings.Contains(summary, "1 complete, 0 failed, 2 skipped") || !strings.Contains(summary, "Skipped (time budget): org-b, org-c") {
+		t.Errorf("compactSummary() = %q, want the skipped projects", summary)
+	}
+}
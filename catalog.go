@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// catalogObject is the JSON index of every backup, kept under objectPrefix
+// in the primary bucket so audits don't have to list the bucket.
+var catalogObject = path.Join("_catalog", "catalog.json")
+
+// catalogUpdateAttempts bounds retries when another run updates the catalog
+// at the same time.
+const catalogUpdateAttempts = 5
+
+// CatalogEntry records one org's backup for one date.
+type CatalogEntry struct {
+	Org    string `json:"org"`
+	Date   string `json:"date"`
+	Object string `json:"object,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Bucket is the bucket the backup was stored in, if the org has one of
+	// its own instead of the catalog's
+	Bucket string `json:"bucket,omitempty"`
+
+	// ContentSHA256 is the checksum of the export's contents, which with
+	// --dedupe decides whether a backup can point to this one
+	ContentSHA256 string `json:"contentSha256,omitempty"`
+
+	// Pointer is the object that stands for this backup with --dedupe; Object
+	// is then the earlier archive it refers to
+	Pointer string `json:"pointer,omitempty"`
+
+	Status       string         `json:"status"`
+	Reason       string         `json:"reason,omitempty"`
+	EntityCounts map[string]int `json:"entityCounts,omitempty"`
+	RecordedAt   time.Time      `json:"recordedAt"`
+
+	// FailureKey is a failure's category and operation without the
+	// details of Reason, which --notify-dedupe-failures compares
+	FailureKey string `json:"failureKey,omitempty"`
+}
+
+type Catalog struct {
+	Entries []CatalogEntry `json:"entries"`
+
+	// RetentionDays is the retention the last run applied, so a run with a
+	// shorter one can preview what it would newly delete
+	RetentionDays int `json:"retentionDays,omitempty"`
+
+	// EnvRetention is the retention the last run to clean up each env
+	// applied, for envs whose retention differs from RetentionDays
+	EnvRetention map[string]int `json:"envRetention,omitempty"`
+
+	// QuietRuns counts the summaries withheld by --notify-summary-every
+	// since the last one sent
+	QuietRuns int `json:"quietRuns,omitempty"`
+}
+
+// envRetention returns the retention last applied to env, or 0 if none was
+// recorded.
+func (c *Catalog) envRetention(env string) int {
+	if days, ok := c.EnvRetention[env]; ok {
+		return days
+	}
+	return c.RetentionDays
+}
+
+// recordRetention records the retention this run applied, keeping the
+// retention of envs it didn't clean up, e.g. outside a --limit window.
+func (c *Catalog) recordRetention(days int, envs map[string]int) {
+	c.RetentionDays = days
+	for env, envDays := range envs {
+		if envDays == days {
+			delete(c.EnvRetention, env)
+			continue
+		}
+		if c.EnvRetention == nil {
+			c.EnvRetention = make(map[string]int)
+		}
+		c.EnvRetention[env] = envDays
+	}
+}
+
+// deletedBackups collects the gs:// paths retention deleted this run, so
+// their catalog entries can be dropped.
+var deletedBackups = map[string]bool{}
+var deletedBackupsMu sync.Mutex
+
+func recordDeletedBackup(gcsPath string) {
+	deletedBackupsMu.Lock()
+	defer deletedBackupsMu.Unlock()
+	deletedBackups[gcsPath] = true
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's contents.
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// updateCatalog merges this run's statuses into the catalog in gcsBucket and
+// drops entries for backups deleted by retention. The write is conditional
+// on the catalog not having changed since it was read, and retried if it
+// did, so concurrent runs don't lose each other's entries.
+func updateCatalog(gcsBucket, date string, statuses []ProjectStatus) error {
+	deletedBackupsMu.Lock()
+	defer deletedBackupsMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		catalog, generation, err := readCatalog(gcsBucket)
+		if err != nil {
+			return err
+		}
+		catalog.merge(gcsBucket, date, statuses, deletedBackups)
+		if appliedRetention > 0 {
+			catalog.recordRetention(appliedRetention, appliedEnvRetention)
+		}
+
+		err = writeCatalog(gcsBucket, catalog, generation)
+		if err == nil || !isPreconditionFailed(err) || attempt == catalogUpdateAttempts {
+			return err
+		}
+	}
+}
+
+// dropDeletedBackups drops the catalog entries of backups deleted this run,
+// with the same conditional write and retries as updateCatalog, without
+// recording the run's retention, e.g. for --prune-orphans, which applies none.
+func dropDeletedBackups(gcsBucket string) error {
+	deletedBackupsMu.Lock()
+	defer deletedBackupsMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		catalog, generation, err := readCatalog(gcsBucket)
+		if err != nil {
+			return err
+		}
+		catalog.merge(gcsBucket, "", nil, deletedBackups)
+
+		err = writeCatalog(gcsBucket, catalog, generation)
+		if err == nil || !isPreconditionFailed(err) || attempt == catalogUpdateAttempts {
+			return err
+		}
+	}
+}
+
+// merge adds or replaces the entry for each status. A skipped run, which
+// found the backup already stored, leaves an existing entry untouched, and
+// a project skipped for --max-runtime wasn't backed up and isn't recorded.
+func (c *Catalog) merge(gcsBucket, date string, statuses []ProjectStatus, deleted map[string]bool) {
+	index := make(map[string]int, len(c.Entries))
+	for i, entry := range c.Entries {
+		index[entry.Org+"/"+entry.Date] = i
+	}
+
+	now := time.Now().UTC()
+	for _, status := range statuses {
+		if status.Status == statusSkipped {
+			continue
+		}
+		entry := CatalogEntry{
+			Org:           status.Project,
+			Date:          date,
+			Object:        status.Object,
+			Bucket:        catalogBucket(status.Bucket),
+			Size:          status.UploadedBytes,
+			SHA256:        status.SHA256,
+			ContentSHA256: status.ContentSHA256,
+			Pointer:       status.Pointer,
+			Status:        status.Status,
+			EntityCounts:  status.EntityCounts,
+			RecordedAt:    now,
+		}
+		if status.Status != "Complete" {
+			entry.Reason, entry.FailureKey = status.Reason, status.FailureKey
+		}
+		// Multiple destinations each count the same archive
+		if len(status.Destinations) > 0 && status.Destinations[0].UploadedBytes > 0 {
+			entry.Size = status.Destinations[0].UploadedBytes
+		}
+
+		i, exists := index[entry.Org+"/"+entry.Date]
+		switch {
+		case !exists:
+			index[entry.Org+"/"+entry.Date] = len(c.Entries)
+			c.Entries = append(c.Entries, entry)
+		case status.Status == "Complete" && status.SHA256 == "":
+			// Already stored by an earlier run
+		default:
+			c.Entries[i] = entry
+		}
+	}
+
+	kept := c.Entries[:0]
+	for _, entry := range c.Entries {
+		name := entry.Object
+		if entry.Pointer != "" {
+			name = entry.Pointer
+		}
+		bucket := gcsBucket
+		if entry.Bucket != "" {
+			bucket = entry.Bucket
+		}
+		if name == "" || !deleted[fmt.Sprintf("gs://%s/%s", bucket, name)] {
+			kept = append(kept, entry)
+		}
+	}
+	c.Entries = kept
+	c.sort()
+}
+
+// catalogBucket returns bucket for a catalog entry's Bucket, or "" if it is
+// the primary bucket the catalog itself is kept in.
+func catalogBucket(bucket string) string {
+	if len(destinations) > 0 && bucket == destinations[0] {
+		return ""
+	}
+	return bucket
+}
+
+// sort orders the entries by org, then date.
+func (c *Catalog) sort() {
+	sort.Slice(c.Entries, func(i, j int) bool {
+		if c.Entries[i].Org != c.Entries[j].Org {
+			return c.Entries[i].Org < c.Entries[j].Org
+		}
+		return c.Entries[i].Date < c.Entries[j].Date
+	})
+}
+
+// addChecksums fills in the checksum of each repaired entry's backup. An
+// entry for the same org and date without a checksum is updated, and a
+// backup with no entry at all gets one. An entry that already has a
+// checksum, for another backup of the same day, is left alone.
+func (c *Catalog) addChecksums(repaired []CatalogEntry) {
+	index := make(map[string]int, len(c.Entries))
+	for i, entry := range c.Entries {
+		index[entry.Org+"/"+entry.Date] = i
+	}
+	now := time.Now().UTC()
+	for _, entry := range repaired {
+		i, exists := index[entry.Org+"/"+entry.Date]
+		switch {
+		case !exists:
+			entry.RecordedAt = now
+			index[entry.Org+"/"+entry.Date] = len(c.Entries)
+			c.Entries = append(c.Entries, entry)
+		case c.Entries[i].SHA256 == "" && (c.Entries[i].Object == "" || c.Entries[i].Object == entry.Object):
+			c.Entries[i].Object, c.Entries[i].Size, c.Entries[i].SHA256 = entry.Object, entry.Size, entry.SHA256
+		default:
+			log.Printf("Not recording the checksum of %s, the catalog already has one for %s on %s\n", entry.Object, entry.Org, entry.Date)
+		}
+	}
+	c.sort()
+}
+
+// recordChecksums adds repaired checksums to the catalog in gcsBucket, with
+// the same conditional write and retries as updateCatalog.
+func recordChecksums(gcsBucket string, repaired []CatalogEntry) error {
+	for attempt := 1; ; attempt++ {
+		catalog, generation, err := readCatalog(gcsBucket)
+		if err != nil {
+			return err
+		}
+		catalog.addChecksums(repaired)
+
+		err = writeCatalog(gcsBucket, catalog, generation)
+		if err == nil || !isPreconditionFailed(err) || attempt == catalogUpdateAttempts {
+			return err
+		}
+	}
+}
+
+// recordQuietRun counts a run in the catalog's QuietRuns, with the same
+// conditional write and retries as updateCatalog, and returns how many
+// summaries are now withheld. A run that isn't quiet, or the every-th quiet
+// one, resets the count and returns 0, meaning its summary is sent.
+func recordQuietRun(gcsBucket string, quiet bool, every int) (int, error) {
+	for attempt := 1; ; attempt++ {
+		catalog, generation, err := readCatalog(gcsBucket)
+		if err != nil {
+			return 0, err
+		}
+		if !quiet || catalog.QuietRuns+1 >= every {
+			catalog.QuietRuns = 0
+		} else {
+			catalog.QuietRuns++
+		}
+
+		err = writeCatalog(gcsBucket, catalog, generation)
+		if err == nil || !isPreconditionFailed(err) || attempt == catalogUpdateAttempts {
+			return catalog.QuietRuns, err
+		}
+	}
+}
+
+// ProjectChange is a project whose backup status differs from its previous
+// backup's.
+type ProjectChange struct {
+	Project string `json:"project"`
+	Alias   string `json:"alias,omitempty"`
+	Change  string `json:"change"` // "recovered" or "now failing"
+}
+
+// changesSince compares statuses with each project's latest catalog entry
+// dated before date. Projects with no earlier entry aren't reported.
+func (c *Catalog) changesSince(date string, statuses []ProjectStatus) []ProjectChange {
+	previous := make(map[string]CatalogEntry)
+	for _, entry := range c.Entries {
+		if entry.Date < date && entry.Date >= previous[entry.Org].Date {
+			previous[entry.Org] = entry
+		}
+	}
+
+	var changes []ProjectChange
+	for _, status := range statuses {
+		last, ok := previous[status.Project]
+		switch {
+		case !ok || last.Status == status.Status:
+		case status.Status == "Complete":
+			changes = append(changes, ProjectChange{Project: status.Project, Alias: status.Alias, Change: "recovered"})
+		case status.Status == "Failed":
+			changes = append(changes, ProjectChange{Project: status.Project, Alias: status.Alias, Change: "now failing"})
+		}
+	}
+	return changes
+}
+
+// runChanges returns the projects whose status changed since their previous
+// backup, as recorded in the catalog in gcsBucket. The summary is still
+// worth sending without them, so a catalog that can't be read is only logged.
+func runChanges(gcsBucket, date string, statuses []ProjectStatus) []ProjectChange {
+	catalog, _, err := readCatalog(gcsBucket)
+	if err != nil {
+		log.Printf("Failed to read catalog, not reporting changes since the last run: %v\n", err)
+		return nil
+	}
+	return catalog.changesSince(date, statuses)
+}
+
+// readCatalog returns the catalog and its object generation, or an empty
+// catalog and generation 0 if none exists yet.
+func readCatalog(gcsBucket string) (Catalog, int64, error) {
+	var catalog Catalog
+	reader, info, err := objectStore.Open(context.Background(), gcsBucket, objectKey(catalogObject))
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return catalog, 0, nil
+	}
+	if err != nil {
+		return catalog, 0, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(&catalog); err != nil {
+		return catalog, 0, fmt.Errorf("failed to parse catalog gs://%s/%s: %w", gcsBucket, objectKey(catalogObject), err)
+	}
+	return catalog, info.Generation, nil
+}
+
+// writeCatalog writes the catalog only if its generation is still
+// generation (0 meaning it must not exist yet).
+func writeCatalog(gcsBucket string, catalog Catalog, generation int64) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	opts := WriteOptions{ContentType: "application/json", GenerationMatch: generation}
+	if generation == 0 {
+		opts.DoesNotExist = true
+	}
+	_, err = objectStore.Write(context.Background(), gcsBucket, objectKey(catalogObject), bytes.NewReader(append(data, '\n')), opts)
+	return err
+}
+
+// isPreconditionFailed reports whether a conditional write lost a race.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// catalogFilter selects catalog entries for --catalog-query.
+type catalogFilter struct {
+	Org    string
+	Date   string // exact date, or a prefix such as 2024-06
+	Status string
+}
+
+// parseCatalogFilter parses a --catalog-query value: "all", or
+// comma-separated org=, date= and status= terms.
+func parseCatalogFilter(value string) (catalogFilter, error) {
+	var filter catalogFilter
+	if value == "all" {
+		return filter, nil
+	}
+	for _, term := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(term), "=")
+		if !ok || val == "" {
+			return filter, fmt.Errorf("invalid filter %q, expected org=, date= or status=", term)
+		}
+		switch key {
+		case "org":
+			filter.Org = val
+		case "date":
+			filter.Date = val
+		case "status":
+			filter.Status = val
+		default:
+			return filter, fmt.Errorf("unknown filter %q, expected org, date or status", key)
+		}
+	}
+	return filter, nil
+}
+
+func (f catalogFilter) matches(entry CatalogEntry) bool {
+	return (f.Org == "" || entry.Org == f.Org) &&
+		(f.Date == "" || strings.HasPrefix(entry.Date, f.Date)) &&
+		(f.Status == "" || strings.EqualFold(entry.Status, f.Status))
+}
+
+// queryCatalog prints the catalog entries in gcsBucket that match filter.
+func queryCatalog(w io.Writer, gcsBucket string, filter catalogFilter) error {
+	catalog, _, err := readCatalog(gcsBucket)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORG\tDATE\tSTATUS\tSIZE\tOBJECT\tSHA256")
+	for _, entry := range catalog.Entries {
+		if !filter.matches(entry) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Org, entry.Date, entry.Status, formatBytes(entry.Size), entry.Object, entry.SHA256)
+	}
+	return tw.Flush()
+}
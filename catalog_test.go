@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChangesSince(t *testing.T) {
+	catalog := Catalog{Entries: []CatalogEntry{
+		{Org: "recovering", Date: "2024-05-30", Status: "Complete"},
+		{Org: "recovering", Date: "2024-05-31", Status: "Failed"},
+		{Org: "breaking", Date: "2024-05-31", Status: "Complete"},
+		{Org: "steady", Date: "2024-05-31", Status: "Complete"},
+		{Org: "still-failing", Date: "2024-05-31", Status: "Failed"},
+		// Today's entry from an earlier attempt is not the previous run
+		{Org: "steady", Date: "2024-06-01", Status: "Failed"},
+	}}
+	statuses := []ProjectStatus{
+		{Project: "recovering", Status: "Complete"},
+		{Project: "breaking", Status: "Failed"},
+		{Project: "steady", Status: "Complete"},
+		{Project: "still-failing", Status: "Failed"},
+		{Project: "new", Status: "Failed"},
+	}
+
+	got := catalog.changesSince("2024-06-01", statuses)
+	want := []ProjectChange{
+		{Project: "recovering", Change: "recovered"},
+		{Project: "breaking", Change: "now failing"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("changesSince() = %v, want %v", got, want)
+	}
+}
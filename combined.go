@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// combinedEnv is the object prefix and file name label used for combined
+// archives. It can't clash with a project, since GCP project IDs are at
+// least 6 characters long.
+const combinedEnv = "all"
+
+// backupCombined exports every project into its own folder of a shared
+// export directory and uploads them as a single backup_all_<date>.zip. The
+// returned statuses have one entry per project plus one for the archive.
+func backupCombined(ctx context.Context, projects []string, gcsBucket, token string, retentionDays, parallel int) []ProjectStatus {
+	start := time.Now()
+	statuses := make([]ProjectStatus, len(projects))
+	for i, project := range projects {
+		statuses[i] = ProjectStatus{Project: project, Status: "Complete", Reason: "no issue", Alias: projectAlias(project), Labels: projectLabels[project], Endpoint: projectEndpoint(project), StartedAt: start}
+	}
+	archive := ProjectStatus{Project: combinedEnv, Status: "Complete", Reason: "no issue", RetentionDays: retentionDays, Bucket: gcsBucket, StartedAt: start}
+	ctx, span := tracer.Start(ctx, "backup combined")
+	defer func() { endSpan(span, archive) }()
+
+	// failAll marks the archive and every project still included in it as failed
+	failAll := func(err error) []ProjectStatus {
+		failProject(&archive, err)
+		for i := range statuses {
+			if statuses[i].Status == "Complete" {
+				statuses[i].Status = "Failed"
+				statuses[i].Reason = archive.Reason
+				statuses[i].Category = archive.Category
+				statuses[i].FailureKey = archive.FailureKey
+			}
+		}
+		return append(statuses, archive)
+	}
+
+	workDir := filepath.Join(runDir, combinedEnv)
+	if !noClean {
+		defer removeWorkDir(workDir)
+	}
+
+	// Get current date
+	today := backupDate()
+
+	// Check which destinations still need a combined backup for today
+	missing, err := missingDestinations(today, combinedEnv)
+	if err != nil {
+		return failAll(gcsError("Failed to check for existing backup in GCS", err))
+	}
+	if len(missing) == 0 {
+		log.Printf("Combined backup for %s already exists in GCS. Skipping new backup.\n", today)
+		archive.Object = existingBackupObject(today, combinedEnv)
+		return append(statuses, archive)
+	}
+
+	if err := checkExportSpace(runDir); err != nil {
+		return failAll(err)
+	}
+	exportRoot := filepath.Join(workDir, "export")
+	err = os.MkdirAll(exportRoot, dirMode)
+	if err != nil {
+		return failAll(newBackupError(ErrLocal, "Failed to create export folder", err))
+	}
+
+	// Export each project into its own subfolder, at most parallel at a time
+	workers := newSemaphore(parallel)
+	var wg sync.WaitGroup
+	for i, project := range projects {
+		workers.acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer workers.release()
+			waitStagger()
+
+			exportFolder := filepath.Join(exportRoot, project)
+			if err := os.MkdirAll(exportFolder, dirMode); err != nil {
+				failProject(&statuses[i], newBackupError(ErrLocal, "Failed to create export folder", err))
+				return
+			}
+			_, span := tracer.Start(ctx, "export "+project, trace.WithAttributes(attribute.String("apigee.org", project)))
+			if err := exportProject(&statuses[i], project, token, exportFolder, gcsBucket, today); err != nil {
+				failProject(&statuses[i], err)
+				// Leave partial exports out of the archive
+				removeWorkDir(exportFolder)
+			}
+			endSpan(span, statuses[i])
+		}()
+	}
+	wg.Wait()
+
+	// Count what each org exported; an empty org failed by
+	// --fail-on-empty-org is left out like a failed export
+	for i := range statuses {
+		if statuses[i].Status != "Complete" {
+			continue
+		}
+		exportFolder := filepath.Join(exportRoot, statuses[i].Project)
+		statuses[i].EntityCounts, err = countExportedEntities(exportFolder)
+		if err != nil {
+			warnProject(&statuses[i], "Failed to count exported entities: %v", err)
+		} else if checkEmptyOrg(&statuses[i]) {
+			removeWorkDir(exportFolder)
+		}
+	}
+
+	// Record which orgs the archive contains
+	var included []string
+	entityCounts := make(map[string]map[string]int)
+	for _, status := range statuses {
+		if status.Status == "Complete" {
+			included = append(included, status.Project)
+			entityCounts[status.Project] = status.EntityCounts
+		}
+	}
+	if len(included) == 0 {
+		return failAll(newBackupError(ErrExport, "No projects exported successfully", nil))
+	}
+	err = writeManifest(exportRoot, Manifest{Date: today, Orgs: included, Combined: true, EntityCounts: entityCounts, ExcludedEntities: excludedEntityNames()})
+	if err != nil {
+		return failAll(newBackupError(ErrLocal, "Failed to write manifest", err))
+	}
+
+	// Zip the shared export folder
+	if err := checkZipSpace(workDir, exportRoot); err != nil {
+		return failAll(err)
+	}
+	zipFile := filepath.Join(workDir, backupFileName(combinedEnv, today))
+	_, stage := tracer.Start(ctx, "zip")
+	err = zipFolder(exportRoot, zipFile)
+	endStage(stage, err)
+	if err != nil {
+		return failAll(newBackupError(ErrZip, "Failed to zip folder", err))
+	}
+	archive.SHA256, err = fileSHA256(zipFile)
+	if err != nil {
+		return failAll(newBackupError(ErrLocal, "Failed to checksum backup", err))
+	}
+	checkGrowth(&archive, zipFile, today)
+
+	// Upload the combined backup to each destination and clean up old ones
+	err = storeBackup(ctx, &archive, zipFile, combinedEnv, missing, retentionDays)
+	if archive.UploadedBytes > 0 {
+		log.Printf("Uploaded %s for the combined backup of %d projects\n", archive.Throughput(), len(included))
+	}
+	if err != nil {
+		return failAll(err)
+	}
+	archive.Object = backupObjectName(combinedEnv, today) + splitSuffix(zipFile)
+	if resumeExport {
+		for _, project := range included {
+			clearExportCache(project)
+		}
+	}
+
+	return append(statuses, archive)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// semaphore bounds how many goroutines may run a section at once.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire() { s <- struct{}{} }
+func (s semaphore) release() { <-s }
+
+// stagger is the upper bound of the random delay before each project starts,
+// which spreads parallel apigeecli and GCS requests out over time instead of
+// sending them all at once. Zero disables it.
+var stagger time.Duration
+
+// waitStagger sleeps for a random duration up to stagger.
+func waitStagger() {
+	if stagger > 0 {
+		time.Sleep(rand.N(stagger))
+	}
+}
+
+// Storage operations (uploads, cleanup deletes) share one limit, while each
+// webhook URL gets its own so a slow endpoint doesn't hold up the others.
+var uploadSem = newSemaphore(1)
+var webhookConcurrency = 1
+
+var webhookSems = map[string]semaphore{}
+var webhookSemsMu sync.Mutex
+
+func webhookSemaphore(url string) semaphore {
+	webhookSemsMu.Lock()
+	defer webhookSemsMu.Unlock()
+
+	sem, ok := webhookSems[url]
+	if !ok {
+		sem = newSemaphore(webhookConcurrency)
+		webhookSems[url] = sem
+	}
+	return sem
+}
+
+// webhookAttempts is how many times a webhook request that failed to
+// connect, or was answered with 429 or a 5xx status, is sent.
+const webhookAttempts = 3
+
+// webhookBackoff is the wait before the second attempt; it doubles after
+// each further one. A 429's Retry-After is used instead if it is longer,
+// up to maxWebhookWait.
+var (
+	webhookBackoff = time.Second
+	maxWebhookWait = 30 * time.Second
+)
+
+// postWebhook POSTs a JSON payload to url with any extra headers, throttled
+// per destination, and returns the response status code. Transient
+// failures are retried with backoff; the last one is returned.
+func postWebhook(url string, payload []byte, header http.Header) (int, error) {
+	sem := webhookSemaphore(url)
+	sem.acquire()
+	defer sem.release()
+
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, retryAfter, err := postWebhookOnce(url, payload, header)
+		transient := err != nil || statusCode == http.StatusTooManyRequests || statusCode >= 500
+		if !transient || attempt == webhookAttempts {
+			return statusCode, err
+		}
+		delay := min(max(wait, retryAfter), maxWebhookWait)
+		log.Printf("Webhook request failed (attempt %d of %d), retrying in %s: %s\n", attempt, webhookAttempts, delay, webhookFailure(statusCode, err))
+		time.Sleep(delay)
+		wait *= 2
+	}
+}
+
+// postWebhookOnce POSTs payload to url once. A large payload is sent
+// gzip-encoded if url's receiver has advertised support for it, and sent
+// again uncompressed if the receiver turns the encoding down.
+func postWebhookOnce(url string, payload []byte, header http.Header) (int, time.Duration, error) {
+	body, compressed := payload, false
+	if len(payload) >= gzipMinSize && acceptsGzip(url) {
+		var err error
+		if body, err = gzipBytes(payload); err != nil {
+			return 0, 0, err
+		}
+		compressed = true
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	learnEncoding(url, resp)
+	if compressed && resp.StatusCode == http.StatusUnsupportedMediaType && !acceptsGzip(url) {
+		return postWebhookOnce(url, payload, header)
+	}
+
+	seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return resp.StatusCode, time.Duration(seconds) * time.Second, nil
+}
+
+// webhookFailure describes a failed attempt for the retry log.
+func webhookFailure(statusCode int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("received status code: %d", statusCode)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config holds the settings that can be given in a JSON file with --config.
+// Every field also has a command-line flag, and flags that are set
+// explicitly override values from the file.
+type Config struct {
+	ProjectFile             string            `json:"projectFile"`
+	TolerantFile            bool              `json:"tolerantFile"`
+	Aliases                 map[string]string `json:"aliases"`
+	AliasKeys               bool              `json:"aliasKeys"`
+	GCSBucket               string            `json:"gcsBucket"`
+	Destinations            []string          `json:"destinations"`
+	ProjectBuckets          map[string]string `json:"projectBuckets"`
+	DestinationPolicy       string            `json:"destinationPolicy"`
+	BillingProject          string            `json:"billingProject"`
+	KMSKey                  string            `json:"kmsKey"`
+	Prefix                  string            `json:"prefix"`
+	UniqueKeys              bool              `json:"uniqueKeys"`
+	Dedupe                  bool              `json:"dedupe"`
+	StorageEndpoint         string            `json:"storageEndpoint"`
+	Token                   string            `json:"token"`
+	TokenFile               string            `json:"tokenFile"`
+	UseADC                  bool              `json:"useADC"`
+	RetentionDays           int               `json:"retentionDays"`
+	RetentionRules          []RetentionRule   `json:"retentionRules"`
+	MinKeep                 int               `json:"minKeep"`
+	SinceLastSuccess        bool              `json:"sinceLastSuccess"`
+	ManageLifecycle         bool              `json:"manageLifecycle"`
+	Limit                   int               `json:"limit"`
+	Offset                  int               `json:"offset"`
+	DiscordWebhook          string            `json:"discordWebhook"`
+	TagIDs                  []string          `json:"tagIDs"`
+	WorkspaceWebhook        string            `json:"workspaceWebhook"`
+	GenericWebhook          string            `json:"genericWebhook"`
+	WebhookSecret           string            `json:"webhookSecret"`
+	NotifyOn                string            `json:"notifyOn"`
+	AlertThreshold          float64           `json:"alertIfFailuresExceed"`
+	NotifyMentionOnRecovery bool              `json:"notifyMentionOnRecovery"`
+	NotifyDedupeFailures    bool              `json:"notifyDedupeFailures"`
+	FailOnNotifyFailure     bool              `json:"failOnNotifyFailure"`
+	SummaryCompact          bool              `json:"summaryCompact"`
+	NotifySummaryEvery      int               `json:"notifySummaryEvery"`
+	BatchSize               int               `json:"batchSize"`
+	NotifyChannelOverrides  []ChannelOverride `json:"notifyChannelOverrides"`
+	NotifySummaryPerChannel bool              `json:"notifySummaryPerChannel"`
+	NotifyIncludeLinks      bool              `json:"notifyIncludeLinks"`
+	SignedURLTTL            string            `json:"signedUrlTTL"`
+	DiscordTemplate         string            `json:"discordTemplate"`
+	WorkspaceTemplate       string            `json:"workspaceTemplate"`
+	Parallel                int               `json:"parallel"`
+	Stagger                 string            `json:"stagger"`
+	PreHook                 string            `json:"preHook"`
+	PostHook                string            `json:"postHook"`
+	HookScope               string            `json:"hookScope"`
+	PreHookFailure          string            `json:"preHookFailure"`
+	ExportTimeout           string            `json:"exportTimeout"`
+	MaxRuntime              string            `json:"maxRuntime"`
+	UploadConcurrency       int               `json:"uploadConcurrency"`
+	WebhookConcurrency      int               `json:"webhookConcurrency"`
+	LogLevel                string            `json:"logLevel"`
+	Quiet                   bool              `json:"quiet"`
+	Verbose                 bool              `json:"verbose"`
+	LogSink                 string            `json:"logSink"`
+	LogFormat               string            `json:"logFormat"`
+	LogRotate               string            `json:"logRotate"`
+	OutputFormat            string            `json:"outputFormat"`
+	IgnoreStatuses          []string          `json:"ignoreStatuses"`
+	ExcludeEntities         []string          `json:"excludeEntities"`
+	ExcludeGlobs            []string          `json:"excludeGlobs"`
+	RedactCredentials       bool              `json:"redactCredentials"`
+	WarnOnEmptyOrg          bool              `json:"warnOnEmptyOrg"`
+	WarnGrowthPct           float64           `json:"warnGrowthPct"`
+	FailOnEmptyOrg          bool              `json:"failOnEmptyOrg"`
+	CheckQuota              bool              `json:"checkQuota"`
+	ExportAnalytics         bool              `json:"exportAnalytics"`
+	ExportEnvGroups         bool              `json:"exportEnvGroups"`
+	ExportOrgKVMs           bool              `json:"exportOrgKVMs"`
+	ExportLog               bool              `json:"exportLog"`
+	UploadFailureLogs       bool              `json:"uploadFailureLogs"`
+	SkipCompress            bool              `json:"skipCompress"`
+	Progress                bool              `json:"progress"`
+	ChunkSizeMB             int               `json:"chunkSizeMB"`
+	MaxArchiveSize          string            `json:"maxArchiveSize"`
+	WorkDir                 string            `json:"workDir"`
+	MinFreeSpace            string            `json:"minFreeSpace"`
+	DirMode                 string            `json:"dirMode"`
+	NoClean                 bool              `json:"noClean"`
+	ResumeExport            bool              `json:"resumeExport"`
+	ResumeUpload            bool              `json:"resumeUpload"`
+	EntityConcurrency       int               `json:"entityConcurrency"`
+	CombinedArchive         bool              `json:"combinedArchive"`
+	Report                  string            `json:"report"`
+	ReportWebhook           string            `json:"reportWebhook"`
+	OTLPEndpoint            string            `json:"otlpEndpoint"`
+	Listen                  string            `json:"listen"`
+	Schedule                string            `json:"schedule"`
+	DrainTimeout            string            `json:"drainTimeout"`
+	LockFile                string            `json:"lockFile"`
+	Notifiers               NotifiersConfig   `json:"notifiers"`
+}
+
+// NotifiersConfig holds per-notifier overrides, settable only in the config file.
+type NotifiersConfig struct {
+	Discord   NotifierConfig `json:"discord"`
+	Workspace NotifierConfig `json:"workspace"`
+	Generic   NotifierConfig `json:"generic"`
+}
+
+// NotifierConfig enables or disables one notifier and sets which per-project
+// events it receives. Unset fields fall back to the global settings.
+type NotifierConfig struct {
+	Enabled  *bool  `json:"enabled"`
+	NotifyOn string `json:"notifyOn"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		RetentionDays:      defaultRetentionDays,
+		DestinationPolicy:  destinationPolicyAll,
+		NotifyOn:           notifyOnAll,
+		Parallel:           1,
+		UploadConcurrency:  1,
+		WebhookConcurrency: 1,
+		EntityConcurrency:  1,
+		LogLevel:           "info",
+		LogSink:            logSinkFile,
+		LogFormat:          logFormatText,
+		LogRotate:          logRotateSize,
+		OutputFormat:       outputFormatText,
+		IgnoreStatuses:     []string{"FAILED_PRECONDITION"},
+		ChunkSizeMB:        defaultChunkSizeMB,
+		DirMode:            "0700",
+		HookScope:          hookScopeProject,
+		PreHookFailure:     hookFailureFail,
+	}
+}
+
+// configPathFromArgs finds the --config value before the flags are parsed,
+// so the file can supply defaults that the remaining flags then override.
+func configPathFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// loadConfig strictly decodes a JSON config file into cfg, rejecting unknown
+// keys and mistyped values so a typo can't silently fall back to a default.
+func loadConfig(filePath string, cfg *Config) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("%s:%s: invalid JSON: %v", filePath, position(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return fmt.Errorf("%s:%s: field %q must be %s, got %s", filePath, position(data, typeErr.Offset), typeErr.Field, typeErr.Type, typeErr.Value)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			// The decoder doesn't report where the key is, so locate it by name
+			field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			offset := int64(bytes.Index(data, []byte(field)))
+			if offset < 0 {
+				offset = decoder.InputOffset()
+			}
+			return fmt.Errorf("%s:%s: unknown field %s", filePath, position(data, offset), field)
+		default:
+			return fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	if decoder.More() {
+		return fmt.Errorf("%s:%s: unexpected data after the config object", filePath, position(data, decoder.InputOffset()))
+	}
+	return nil
+}
+
+// position converts a byte offset in data into a "line:column" string.
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("%d:%d", line, column)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reasons the daemon won't start a run.
+var (
+	errRunInProgress = errors.New("a backup run is already in progress")
+	errStopping      = errors.New("the daemon is shutting down")
+)
+
+// daemon runs backups on demand over HTTP and on a schedule, one at a time,
+// and keeps the result of the last run for the status and metrics endpoints.
+type daemon struct {
+	cfg Config
+
+	// wg tracks the run in progress so shutdown can wait for it
+	wg sync.WaitGroup
+
+	mu         sync.Mutex
+	running    bool
+	stopping   bool
+	runs       int
+	failedRuns int
+	lastRun    *Report
+	lastError  string
+}
+
+// runDaemon serves the HTTP endpoints if --listen is set and starts runs on
+// the --schedule if set, until SIGTERM or SIGINT. It then stops starting
+// runs and waits up to --drain-timeout for the run in progress to finish.
+func runDaemon(cfg Config) error {
+	d := &daemon{cfg: cfg}
+
+	var drainTimeout time.Duration
+	if cfg.DrainTimeout != "" {
+		var err error
+		drainTimeout, err = time.ParseDuration(cfg.DrainTimeout)
+		if err != nil || drainTimeout < 0 {
+			return fmt.Errorf("invalid --drain-timeout %q: must be a duration such as 30m", cfg.DrainTimeout)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if cfg.Schedule != "" {
+		schedule, err := parseSchedule(cfg.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid --schedule: %w", err)
+		}
+		go d.schedule(ctx, schedule)
+	}
+
+	var server *http.Server
+	serverErr := make(chan error, 1)
+	if cfg.Listen != "" {
+		server = &http.Server{Addr: cfg.Listen, Handler: d.handler()}
+		log.Printf("Listening on %s\n", cfg.Listen)
+		go func() { serverErr <- server.ListenAndServe() }()
+	}
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, no new runs will start")
+	d.stop()
+	if server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}
+	return d.drain(drainTimeout)
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /status", d.handleStatus)
+	mux.HandleFunc("GET /metrics", d.handleMetrics)
+	mux.HandleFunc("POST /trigger", d.handleTrigger)
+	return mux
+}
+
+// schedule starts a run at each time the schedule matches, until ctx is
+// done. A run that is still going when the next one is due makes that one
+// be skipped.
+func (d *daemon) schedule(ctx context.Context, schedule *cronSchedule) {
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("Schedule %q never matches, no scheduled runs\n", d.cfg.Schedule)
+			return
+		}
+		log.Printf("Next scheduled run at %s\n", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := d.start(); err != nil {
+			log.Printf("Skipping scheduled run: %v\n", err)
+		}
+	}
+}
+
+// start begins a run in the background, unless one is running or the
+// daemon is shutting down.
+func (d *daemon) start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopping {
+		return errStopping
+	}
+	if d.running {
+		return errRunInProgress
+	}
+	d.running = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run()
+	}()
+	return nil
+}
+
+// stop makes start refuse any further runs.
+func (d *daemon) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopping = true
+}
+
+// drain waits for the run in progress to finish, giving up after timeout
+// unless it is 0.
+func (d *daemon) drain(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	d.mu.Lock()
+	running := d.running
+	d.mu.Unlock()
+	if running {
+		log.Println("Waiting for the run in progress to finish")
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-expired:
+		return fmt.Errorf("the run in progress didn't finish within the %s drain timeout", timeout)
+	}
+}
+
+// run performs one backup run. The project file and token file are read
+// again every time, so edits and refreshed tokens are picked up.
+func (d *daemon) run() {
+	runStart = time.Now()
+	resetRunState()
+
+	statuses, err := d.backup()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = false
+	d.runs++
+	if err != nil {
+		log.Printf("Backup run failed: %v\n", err)
+		d.failedRuns++
+		d.lastError = err.Error()
+		return
+	}
+	report := newReport(statuses)
+	d.lastRun = &report
+	d.lastError = ""
+}
+
+func (d *daemon) backup() ([]ProjectStatus, error) {
+	projects, labels, err := readProjectFiles(d.cfg.ProjectFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project file: %w", err)
+	}
+	projectLabels = labels
+	if err := checkAliases(projects); err != nil {
+		return nil, fmt.Errorf("invalid aliases: %w", err)
+	}
+	if err := checkRetentionLabels(projects); err != nil {
+		return nil, fmt.Errorf("invalid retention label: %w", err)
+	}
+	if err := checkEndpointLabels(projects); err != nil {
+		return nil, fmt.Errorf("invalid endpoint label: %w", err)
+	}
+	if err := checkProjectBuckets(projects, d.cfg.CombinedArchive); err != nil {
+		return nil, fmt.Errorf("invalid project bucket: %w", err)
+	}
+	token, err := loadToken(d.cfg.Token, d.cfg.TokenFile, false, d.cfg.UseADC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token: %w", err)
+	}
+	return runBackup(d.cfg, projects, token)
+}
+
+// resetRunState clears what the previous run recorded in globals.
+func resetRunState() {
+	notificationFailuresMu.Lock()
+	notificationFailures = nil
+	notificationFailuresMu.Unlock()
+
+	deletedBackupsMu.Lock()
+	deletedBackups = map[string]bool{}
+	deletedBackupsMu.Unlock()
+
+	resetListingCache()
+}
+
+// daemonStatus is the body of GET /status.
+type daemonStatus struct {
+	Running    bool    `json:"running"`
+	Runs       int     `json:"runs"`
+	FailedRuns int     `json:"failedRuns"`
+	LastRun    *Report `json:"lastRun"`
+	LastError  string  `json:"lastError,omitempty"`
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	status := daemonStatus{Running: d.running, Runs: d.runs, FailedRuns: d.failedRuns, LastRun: d.lastRun, LastError: d.lastError}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleMetrics writes the daemon's state in the Prometheus text format.
+func (d *daemon) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	running := 0
+	if d.running {
+		running = 1
+	}
+	fmt.Fprintf(w, "# HELP apigee_backup_running Whether a backup run is in progress.\n# TYPE apigee_backup_running gauge\napigee_backup_running %d\n", running)
+	fmt.Fprintf(w, "# HELP apigee_backup_runs_total Backup runs finished since the daemon started.\n# TYPE apigee_backup_runs_total counter\napigee_backup_runs_total %d\n", d.runs)
+	fmt.Fprintf(w, "# HELP apigee_backup_run_errors_total Backup runs that couldn't start.\n# TYPE apigee_backup_run_errors_total counter\napigee_backup_run_errors_total %d\n", d.failedRuns)
+	if d.lastRun == nil {
+		return
+	}
+
+	failed, skipped := countFailed(d.lastRun.Projects), countSkipped(d.lastRun.Projects)
+	fmt.Fprintf(w, "# HELP apigee_backup_last_run_timestamp_seconds When the last finished run started.\n# TYPE apigee_backup_last_run_timestamp_seconds gauge\napigee_backup_last_run_timestamp_seconds %d\n", d.lastRun.StartedAt.Unix())
+	fmt.Fprintf(w, "# HELP apigee_backup_last_run_projects Projects in the last run, by status.\n# TYPE apigee_backup_last_run_projects gauge\n")
+	fmt.Fprintf(w, "apigee_backup_last_run_projects{status=\"Complete\"} %d\napigee_backup_last_run_projects{status=\"Failed\"} %d\napigee_backup_last_run_projects{status=\"Skipped\"} %d\n", len(d.lastRun.Projects)-failed-skipped, failed, skipped)
+	fmt.Fprintf(w, "# HELP apigee_backup_last_run_uploaded_bytes Bytes uploaded by the last run.\n# TYPE apigee_backup_last_run_uploaded_bytes gauge\napigee_backup_last_run_uploaded_bytes %d\n", d.lastRun.UploadedBytes)
+	fmt.Fprintf(w, "# HELP apigee_backup_last_run_stored_bytes Bytes stored after the last run's cleanup.\n# TYPE apigee_backup_last_run_stored_bytes gauge\napigee_backup_last_run_stored_bytes %d\n", d.lastRun.StoredBytes)
+}
+
+// handleTrigger starts a run, or answers 409 Conflict if one is in progress
+// and 503 Service Unavailable while shutting down.
+func (d *daemon) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	switch err := d.start(); {
+	case errors.Is(err, errStopping):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Println("Backup run triggered over HTTP")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "backup run started")
+}
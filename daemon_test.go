@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemon(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	setGlobal(t, &runStart, runStart)
+	setGlobal(t, &projectLabels, projectLabels)
+
+	release := make(chan struct{})
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		<-release
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	projectFile := filepath.Join(t.TempDir(), "projects.txt")
+	if err := os.WriteFile(projectFile, []byte("org-a team=payments\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{cfg: Config{
+		ProjectFile:   projectFile,
+		GCSBucket:     testBucket,
+		Token:         "token",
+		RetentionDays: 30,
+		Parallel:      1,
+		WorkDir:       t.TempDir(),
+	}}
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, resp.StatusCode, body)
+		}
+		return string(body)
+	}
+	trigger := func() int {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/trigger", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if body := get("/healthz"); body != "ok\n" {
+		t.Errorf("/healthz = %q", body)
+	}
+
+	if code := trigger(); code != http.StatusAccepted {
+		t.Fatalf("first trigger = %d, want 202", code)
+	}
+	if code := trigger(); code != http.StatusConflict {
+		t.Errorf("trigger during a run = %d, want 409", code)
+	}
+	if !strings.Contains(get("/metrics"), "apigee_backup_running 1\n") {
+		t.Error("/metrics doesn't show the run in progress")
+	}
+
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var status daemonStatus
+		if err := json.Unmarshal([]byte(get("/status")), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running && status.Runs == 1 {
+			if status.LastRun == nil || len(status.LastRun.Projects) != 1 || status.LastRun.Projects[0].Status != "Complete" {
+				t.Fatalf("lastRun = %+v, want one complete project", status.LastRun)
+			}
+			if status.LastRun.Projects[0].Labels["team"] != "payments" {
+				t.Errorf("labels = %v, want team=payments", status.LastRun.Projects[0].Labels)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	metrics := get("/metrics")
+	for _, want := range []string{"apigee_backup_running 0\n", "apigee_backup_runs_total 1\n", `apigee_backup_last_run_projects{status="Complete"} 1`} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics is missing %q:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestDaemonMetrics(t *testing.T) {
+	setupBackupTest(t)
+	d := &daemon{runs: 1, lastRun: &Report{Projects: []ProjectStatus{
+		{Project: "org-a", Status: "Complete"},
+		{Project: "org-b", Status: "Failed"},
+		skippedProject("org-c"),
+		skippedProject("org-d"),
+	}}}
+	rec := httptest.NewRecorder()
+	d.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	// Projects the time budget skipped aren't counted as complete
+	for _, want := range []string{
+		`apigee_backup_last_run_projects{status="Complete"} 1` + "\n",
+		`apigee_backup_last_run_projects{status="Failed"} 1` + "\n",
+		`apigee_backup_last_run_projects{status="Skipped"} 2` + "\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics is missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestDaemonDrain(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	setGlobal(t, &runStart, runStart)
+	setGlobal(t, &projectLabels, projectLabels)
+
+	release := make(chan struct{})
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		<-release
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	projectFile := filepath.Join(t.TempDir(), "projects.txt")
+	if err := os.WriteFile(projectFile, []byte("org-a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{cfg: Config{ProjectFile: projectFile, GCSBucket: testBucket, Token: "token", RetentionDays: 30, Parallel: 1, WorkDir: t.TempDir()}}
+
+	if err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	d.stop()
+	if err := d.start(); !errors.Is(err, errStopping) {
+		t.Errorf("start() while stopping = %v, want errStopping", err)
+	}
+	if err := d.drain(10 * time.Millisecond); err == nil {
+		t.Error("drain() returned before the run finished")
+	}
+
+	close(release)
+	if err := d.drain(5 * time.Second); err != nil {
+		t.Fatalf("drain() = %v", err)
+	}
+	if d.runs != 1 || d.lastRun == nil {
+		t.Errorf("runs = %d, lastRun = %v, want the run to have finished", d.runs, d.lastRun)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// dedupe stores a small pointer to the previous backup instead of uploading
+// a new archive when the export's contents haven't changed.
+var dedupe bool
+
+// pointerSuffix is appended to a backup's object key for the pointer that
+// stands in for it. The pointer holds the key of the archive it refers to.
+const pointerSuffix = ".ref"
+
+// exportContentSHA256 returns a hex SHA-256 over the path and contents of
+// every file in an export directory, except the files that differ in every
+// backup. Unlike the archive's checksum, it is the same for two exports of
+// an unchanged org.
+func exportContentSHA256(dir string) (string, error) {
+	hash := sha256.New()
+	// WalkDir visits files in lexical order, so the result is stable
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if diffIgnored[rel] {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		fileHash := sha256.New()
+		if _, err := io.Copy(fileHash, file); err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%x\n", rel, fileHash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// identicalBackup returns the catalog entry of project's newest complete backup
+// before date, if its content checksum is contentSHA256 and its archive is
+// still stored in every bucket in buckets.
+func identicalBackup(project, date, contentSHA256 string, buckets []string) (CatalogEntry, bool, error) {
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		return CatalogEntry{}, false, err
+	}
+	var previous CatalogEntry
+	for _, entry := range catalog.Entries {
+		if entry.Org == project && entry.Date < date && entry.Status == "Complete" && entry.Date >= previous.Date {
+			previous = entry
+		}
+	}
+	if previous.ContentSHA256 != contentSHA256 || previous.Object == "" {
+		return CatalogEntry{}, false, nil
+	}
+	for _, bucket := range buckets {
+		_, err := objectStore.Stat(context.Background(), bucket, previous.Object)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return CatalogEntry{}, false, nil
+		}
+		if err != nil {
+			return CatalogEntry{}, false, err
+		}
+	}
+	return previous, true, nil
+}
+
+// writeBackupPointer stores a pointer named name that refers to target and
+// returns its size. Like an upload, it doesn't replace an existing object
+// unless forceOverwrite is set.
+func writeBackupPointer(gcsBucket, name, target string) (int64, error) {
+	opts := WriteOptions{ContentType: "text/plain", DoesNotExist: !forceOverwrite}
+	return objectStore.Write(context.Background(), gcsBucket, name, strings.NewReader(target+"\n"), opts)
+}
+
+// readBackupPointer returns the key of the archive a pointer refers to.
+func readBackupPointer(gcsBucket, name string) (string, error) {
+	reader, _, err := objectStore.Open(context.Background(), gcsBucket, name)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// resolveBackup returns the archive a backup object stands for: name itself,
+// or the target if name is a pointer.
+func resolveBackup(gcsBucket, name string) (string, error) {
+	if !strings.HasSuffix(name, pointerSuffix) {
+		return name, nil
+	}
+	target, err := readBackupPointer(gcsBucket, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read backup pointer gs://%s/%s: %w", gcsBucket, name, err)
+	}
+	return target, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupe(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	dedupe = true
+	content := "v1"
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if dir == "" {
+			return "", "", nil
+		}
+		if err := writeExport(dir, "proxies/a.zip"); err != nil {
+			return "", "", err
+		}
+		return "", "", os.WriteFile(filepath.Join(dir, "proxies/b.zip"), []byte(content), 0600)
+	}
+	backupOn := func(date string) ProjectStatus {
+		t.Helper()
+		dateOverride = date
+		status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+		if status.Status != "Complete" {
+			t.Fatalf("%s: status = %q (%s), want Complete", date, status.Status, status.Reason)
+		}
+		if err := updateCatalog(testBucket, date, []ProjectStatus{status}); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+
+	first := backupOn(day(-2))
+	if first.Pointer != "" || !store.has(testBucket, first.Object) {
+		t.Fatalf("first backup = %+v, want an uploaded archive", first)
+	}
+
+	// Unchanged: a pointer to the first archive instead of a new one
+	second := backupOn(day(-1))
+	if second.Pointer != backupObjectName("my-org", day(-1))+pointerSuffix || second.Object != first.Object || second.SHA256 != first.SHA256 {
+		t.Errorf("second backup = %+v, want a pointer to %s", second, first.Object)
+	}
+	if !strings.HasPrefix(second.Reason, "Skipped (identical to "+day(-2)) {
+		t.Errorf("second backup reason = %q", second.Reason)
+	}
+	if store.has(testBucket, backupObjectName("my-org", day(-1))) {
+		t.Error("an identical archive was uploaded")
+	}
+	if target, err := readBackupPointer(testBucket, second.Pointer); err != nil || target != first.Object {
+		t.Errorf("pointer refers to %q, %v, want %s", target, err, first.Object)
+	}
+	if exists, err := backupExistsInGCS(testBucket, day(-1), "my-org"); !exists || err != nil {
+		t.Errorf("backupExistsInGCS() for the pointer's date = %v, %v, want true", exists, err)
+	}
+
+	// Changed: a new archive
+	content = "v2"
+	third := backupOn(day(0))
+	if third.Pointer != "" || third.Object != backupObjectName("my-org", day(0)) || !store.has(testBucket, third.Object) {
+		t.Errorf("third backup = %+v, want a new archive", third)
+	}
+}
+
+func TestCleanupKeepsReferencedBackups(t *testing.T) {
+	_, store := setupBackupTest(t)
+	date := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+	archive := backupObjectName("my-org", date(-60))
+	oldPointer := backupObjectName("my-org", date(-50)) + pointerSuffix
+	newPointer := backupObjectName("my-org", date(-1)) + pointerSuffix
+	store.put(testBucket, archive, []byte("backup"))
+	store.put(testBucket, oldPointer, []byte(archive+"\n"))
+	store.put(testBucket, newPointer, []byte(archive+"\n"))
+
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 1 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want 1 deleted", deleted, err)
+	}
+	if store.has(testBucket, oldPointer) {
+		t.Error("the expired pointer was kept")
+	}
+	if !store.has(testBucket, archive) || !store.has(testBucket, newPointer) {
+		t.Error("cleanup deleted an archive a kept pointer refers to")
+	}
+
+	// Once no pointer refers to it, the archive expires like any other
+	store.put(testBucket, newPointer, []byte("my-org/other.zip\n"))
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 1 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want 1 deleted", deleted, err)
+	}
+	if store.has(testBucket, archive) {
+		t.Error("an unreferenced expired archive was kept")
+	}
+}
+
+func TestExportContentSHA256(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	for _, dir := range []string{a, b} {
+		if err := writeExport(dir, "proxies/a.zip", "kvms/k.json"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files that differ in every backup don't count
+	os.WriteFile(filepath.Join(a, manifestFileName), []byte(`{"createdAt": "2024-06-01T02:00:00Z"}`), 0600)
+	os.WriteFile(filepath.Join(b, manifestFileName), []byte(`{"createdAt": "2024-06-02T02:00:00Z"}`), 0600)
+
+	sumA, err := exportContentSHA256(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sumB, _ := exportContentSHA256(b); sumA != sumB {
+		t.Errorf("identical exports have checksums %s and %s", sumA, sumB)
+	}
+	os.WriteFile(filepath.Join(b, "kvms/k.json"), []byte("changed"), 0600)
+	if sumB, _ := exportContentSHA256(b); sumA == sumB {
+		t.Error("a changed export has the same checksum")
+	}
+}
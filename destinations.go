@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Values accepted by --destination-policy.
+const (
+	destinationPolicyAll = "all"
+	destinationPolicyAny = "any"
+)
+
+// destinations are the buckets every backup is stored in: --gcs first, then
+// each --destination. The first is the primary, used for failure logs and
+// the stored size reported for each project.
+var destinations []string
+
+var destinationPolicy = destinationPolicyAll
+
+// bucketLabel is the project file label that stores a project's backups in
+// a bucket of its own instead of --gcs, e.g. bucket=team-a-backups.
+const bucketLabel = "bucket"
+
+// projectBuckets maps project IDs to the bucket their backups are stored in
+// instead of --gcs, from --project-bucket and the config file. They take
+// precedence over a bucket label in the project file.
+var projectBuckets = map[string]string{}
+
+// DestinationStatus is the result of storing one backup in one destination.
+type DestinationStatus struct {
+	Bucket        string `json:"bucket"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason"`
+	UploadedBytes int64  `json:"uploadedBytes"`
+	StoredBytes   int64  `json:"storedBytes"`
+}
+
+// parseDestination returns the bucket named by a gs://bucket spec.
+func parseDestination(spec string) (string, error) {
+	bucket, ok := strings.CutPrefix(spec, "gs://")
+	bucket = strings.TrimSuffix(bucket, "/")
+	if !ok || bucket == "" || strings.Contains(bucket, "/") {
+		return "", fmt.Errorf("unsupported destination %q, expected gs://bucket", spec)
+	}
+	return bucket, nil
+}
+
+// parseBucket returns the bucket named by spec, given as a bucket name or
+// gs://bucket.
+func parseBucket(spec string) (string, error) {
+	bucket := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(spec), "gs://"), "/")
+	if bucket == "" || strings.ContainsAny(bucket, "/ \t") {
+		return "", fmt.Errorf("invalid bucket %q, expected a bucket name or gs://bucket", spec)
+	}
+	return bucket, nil
+}
+
+// parseProjectBucket splits a --project-bucket value of the form
+// projectID=BUCKET.
+func parseProjectBucket(value string) (string, string, error) {
+	project, spec, ok := strings.Cut(value, "=")
+	project = strings.TrimSpace(project)
+	if !ok || project == "" {
+		return "", "", fmt.Errorf("invalid project bucket %q, expected projectID=BUCKET", value)
+	}
+	bucket, err := parseBucket(spec)
+	return project, bucket, err
+}
+
+// projectBucket returns the bucket that replaces --gcs for project, or ""
+// if it has none. Labels are checked by checkProjectBuckets when the
+// project file is read.
+func projectBucket(project string) string {
+	if bucket, ok := projectBuckets[project]; ok {
+		return bucket
+	}
+	if label, ok := projectLabels[project][bucketLabel]; ok {
+		bucket, _ := parseBucket(label)
+		return bucket
+	}
+	return ""
+}
+
+// projectDestinations returns the buckets project's backups are stored in:
+// its own bucket in place of --gcs, if it has one, then each --destination.
+func projectDestinations(project string) []string {
+	bucket := projectBucket(project)
+	if bucket == "" || bucket == destinations[0] {
+		return destinations
+	}
+	return append([]string{bucket}, destinations[1:]...)
+}
+
+// envDestinations returns the buckets the backups stored under env are
+// stored in, which differ from destinations only for a project with a
+// bucket of its own.
+func envDestinations(env string) []string {
+	for project := range projectBuckets {
+		if storageEnv(project) == env {
+			return projectDestinations(project)
+		}
+	}
+	for project := range projectLabels {
+		if storageEnv(project) == env {
+			return projectDestinations(project)
+		}
+	}
+	return destinations
+}
+
+// allDestinations returns every bucket any project's backups are stored in,
+// destinations first.
+func allDestinations() []string {
+	buckets := slices.Clone(destinations)
+	var own []string
+	for project := range projectBuckets {
+		own = append(own, projectBucket(project))
+	}
+	for project := range projectLabels {
+		own = append(own, projectBucket(project))
+	}
+	slices.Sort(own)
+	for _, bucket := range own {
+		if bucket != "" && !slices.Contains(buckets, bucket) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// checkProjectBuckets makes sure every bucket label in the project file names
+// a bucket, and that no project has its own bucket with a combined archive,
+// which stores every project in one object.
+func checkProjectBuckets(projects []string, combined bool) error {
+	for _, project := range projects {
+		label, ok := projectLabels[project][bucketLabel]
+		if !ok {
+			continue
+		}
+		if _, err := parseBucket(label); err != nil {
+			return fmt.Errorf("%s: %w", project, err)
+		}
+	}
+	if combined && len(allDestinations()) > len(destinations) {
+		return errors.New("projects can't have their own bucket with --combined-archive")
+	}
+	return nil
+}
+
+// missingDestinations returns the destinations that don't yet have the
+// backup for env and date, or all of them with forceOverwrite.
+func missingDestinations(date, env string) ([]string, error) {
+	buckets := envDestinations(env)
+	if forceOverwrite {
+		return buckets, nil
+	}
+	var missing []string
+	for _, bucket := range buckets {
+		exists, err := backupExistsInGCS(bucket, date, env)
+		if err != nil {
+			return nil, fmt.Errorf("gs://%s: %w", bucket, err)
+		}
+		if !exists {
+			missing = append(missing, bucket)
+		}
+	}
+	return missing, nil
+}
+
+// existingBackupObject returns the key of env's backup for date that is
+// already in its first destination, for a run that skips the backup. For a
+// --dedupe pointer it is the archive the pointer refers to.
+func existingBackupObject(date, env string) string {
+	if uniqueKeys || dedupe || maxArchiveSize > 0 {
+		bucket := envDestinations(env)[0]
+		if name, err := latestBackup(bucket, env, date); err == nil && name != "" {
+			if target, err := resolveBackup(bucket, name); err == nil {
+				return target
+			}
+		}
+	}
+	return backupObjectName(env, date)
+}
+
+// storeBackup uploads zipFile to each bucket in missing and applies retention
+// in each, recording the per-destination results in status. Whether a failed
+// destination fails the project depends on --destination-policy.
+func storeBackup(ctx context.Context, status *ProjectStatus, zipFile, env string, missing []string, retentionDays int) error {
+	isMissing := make(map[string]bool, len(missing))
+	for _, bucket := range missing {
+		isMissing[bucket] = true
+	}
+
+	buckets := envDestinations(env)
+	var errs []error
+	var stored int
+	for i, bucket := range buckets {
+		dest := DestinationStatus{Bucket: bucket, Status: "Complete", Reason: "no issue"}
+		err := storeInDestination(ctx, status, &dest, zipFile, env, isMissing[bucket], retentionDays)
+		if err != nil {
+			dest.Status = "Failed"
+			dest.Reason = err.Error()
+			errs = append(errs, err)
+		} else {
+			stored++
+		}
+		if i == 0 {
+			status.StoredBytes = dest.StoredBytes
+		}
+		if len(buckets) > 1 {
+			status.Destinations = append(status.Destinations, dest)
+		}
+	}
+
+	switch {
+	case len(errs) == 0:
+		return nil
+	case destinationPolicy == destinationPolicyAny && stored > 0:
+		log.Printf("Stored %s in %d of %d destinations: %v\n", status.Project, stored, len(buckets), errors.Join(errs...))
+		status.Reason = fmt.Sprintf("Stored in %d of %d destinations", stored, len(buckets))
+		return nil
+	}
+	return errs[0]
+}
+
+// storeInDestination uploads zipFile to dest's bucket if upload is set, or
+// with --dedupe writes status.Pointer instead, then cleans up old backups there.
+func storeInDestination(ctx context.Context, status *ProjectStatus, dest *DestinationStatus, zipFile, env string, upload bool, retentionDays int) error {
+	var err error
+	if upload {
+		_, stage := tracer.Start(ctx, "upload")
+		stage.SetAttributes(attribute.String("gcs.bucket", dest.Bucket))
+		uploadStart := time.Now()
+		if status.Pointer != "" {
+			dest.UploadedBytes, err = writeBackupPointer(dest.Bucket, status.Pointer, status.Object)
+		} else {
+			dest.UploadedBytes, err = uploadToGCS(dest.Bucket, zipFile, env)
+		}
+		status.UploadDuration += time.Since(uploadStart)
+		status.UploadedBytes += dest.UploadedBytes
+		stage.SetAttributes(attribute.Int64("backup.uploaded_bytes", dest.UploadedBytes))
+		endStage(stage, err)
+		if isPreconditionFailed(err) {
+			return newBackupError(ErrStorage, fmt.Sprintf("Backup already uploaded by another run to gs://%s; rerun with --force to replace it", dest.Bucket), err)
+		}
+		if err != nil {
+			return gcsError(fmt.Sprintf("Failed to upload backup to gs://%s", dest.Bucket), err)
+		}
+		log.Printf("Uploaded %s to gs://%s\n", formatBytes(dest.UploadedBytes), dest.Bucket)
+		if uniqueKeys && status.Pointer == "" {
+			if err := updateLatestPointer(dest.Bucket, env, objectKey(env, filepath.Base(zipFile))+splitSuffix(zipFile)); err != nil {
+				warnProject(status, "Failed to update the latest pointer in gs://%s: %v", dest.Bucket, err)
+			}
+		}
+	}
+
+	// GCS expires old backups itself under --manage-lifecycle
+	if manageLifecycle {
+		dest.StoredBytes, err = storedBytes(dest.Bucket, env)
+		if err != nil {
+			return gcsError(fmt.Sprintf("Failed to list backups in gs://%s", dest.Bucket), err)
+		}
+		return nil
+	}
+
+	_, stage := tracer.Start(ctx, "cleanup")
+	stage.SetAttributes(attribute.String("gcs.bucket", dest.Bucket))
+	var deleted int
+	var failed []string
+	dest.StoredBytes, deleted, failed, err = cleanupOldBackups(dest.Bucket, retentionDays, env)
+	status.DeletedBackups += deleted
+	status.DeleteFailures = append(status.DeleteFailures, failed...)
+	endStage(stage, err)
+	if err != nil {
+		return gcsError(fmt.Sprintf("Failed to clean up old backups in gs://%s", dest.Bucket), err)
+	}
+	return nil
+}
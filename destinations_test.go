@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProjectBuckets(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	destinations = []string{testBucket, "dr-bucket"}
+	projectBuckets = map[string]string{"org-a": "team-a"}
+	projectLabels = map[string]map[string]string{"org-b": {bucketLabel: "gs://team-b"}}
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+	old := backupObjectName("org-a", time.Now().AddDate(0, 0, -60).Format(dateLayout))
+	store.put("team-a", old, []byte("old"))
+
+	var statuses []ProjectStatus
+	for project, want := range map[string]string{"org-a": "team-a", "org-b": "team-b", "org-c": testBucket} {
+		status := backupProject(context.Background(), project, testBucket, "token", 30)
+		if status.Status != "Complete" {
+			t.Fatalf("%s: status = %q (%s), want Complete", project, status.Status, status.Reason)
+		}
+		if status.Bucket != want {
+			t.Errorf("%s: Bucket = %q, want %q", project, status.Bucket, want)
+		}
+		// Its own bucket replaces --gcs, and --destination still applies
+		if !store.has(want, status.Object) || !store.has("dr-bucket", status.Object) {
+			t.Errorf("%s: backup not stored in gs://%s and gs://dr-bucket", project, want)
+		}
+		if want != testBucket && store.has(testBucket, status.Object) {
+			t.Errorf("%s: backup also stored in gs://%s", project, testBucket)
+		}
+		statuses = append(statuses, status)
+	}
+	if store.has("team-a", old) {
+		t.Error("retention wasn't applied in org-a's own bucket")
+	}
+
+	if err := updateCatalog(testBucket, backupDate(), statuses); err != nil {
+		t.Fatalf("updateCatalog() = %v", err)
+	}
+	catalog, _, err := readCatalog(testBucket)
+	if err != nil {
+		t.Fatalf("readCatalog() = %v", err)
+	}
+	for _, entry := range catalog.Entries {
+		want := map[string]string{"org-a": "team-a", "org-b": "team-b"}[entry.Org]
+		if entry.Bucket != want {
+			t.Errorf("catalog entry for %s has bucket %q, want %q", entry.Org, entry.Bucket, want)
+		}
+	}
+
+	if got, want := allDestinations(), []string{testBucket, "dr-bucket", "team-a", "team-b"}; !slices.Equal(got, want) {
+		t.Errorf("allDestinations() = %v, want %v", got, want)
+	}
+	if err := checkProjectBuckets([]string{"org-a", "org-b"}, true); err == nil {
+		t.Error("checkProjectBuckets() allowed own buckets with a combined archive")
+	}
+	projectLabels["org-b"][bucketLabel] = "team-b/backups"
+	if err := checkProjectBuckets([]string{"org-a", "org-b"}, false); err == nil {
+		t.Error("checkProjectBuckets() accepted a bucket label with a path")
+	}
+}
+
+func TestParseProjectBucket(t *testing.T) {
+	project, bucket, err := parseProjectBucket(" org-a = gs://team-a/ ")
+	if err != nil || project != "org-a" || bucket != "team-a" {
+		t.Errorf("parseProjectBucket() = %q, %q, %v", project, bucket, err)
+	}
+	for _, value := range []string{"org-a", "=team-a", "org-a=", "org-a=gs://team-a/backups"} {
+		if _, _, err := parseProjectBucket(value); err == nil {
+			t.Errorf("parseProjectBucket(%q) didn't fail", value)
+		}
+	}
+}
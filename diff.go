@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+
+	"cloud.google.com/go/storage"
+)
+
+// BackupDiff is what changed in a project between two of its backups, by
+// file path inside the archive and content hash.
+type BackupDiff struct {
+	Project  string   `json:"project"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+
+	// CountChanges holds the entity types whose count in the manifest changed.
+	CountChanges map[string]CountChange `json:"countChanges,omitempty"`
+
+	// The apigeecli versions that exported each backup, if recorded
+	FromApigeecli string `json:"fromApigeecli,omitempty"`
+	ToApigeecli   string `json:"toApigeecli,omitempty"`
+}
+
+// CountChange is an entity type's count in each of the compared backups.
+type CountChange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// diffIgnored are archive files that differ between any two backups and
+// say nothing about the org's configuration.
+var diffIgnored = map[string]bool{manifestFileName: true, "export.log": true}
+
+// diffBackups downloads project's backups for the dates from and to and
+// compares their contents.
+func diffBackups(gcsBucket, project, from, to string) (BackupDiff, error) {
+	fromFiles, fromManifest, err := readBackup(gcsBucket, storageEnv(project), from)
+	if err != nil {
+		return BackupDiff{}, err
+	}
+	toFiles, toManifest, err := readBackup(gcsBucket, storageEnv(project), to)
+	if err != nil {
+		return BackupDiff{}, err
+	}
+
+	diff := BackupDiff{Project: project, From: from, To: to, Added: []string{}, Removed: []string{}, Modified: []string{}}
+	diff.FromApigeecli, diff.ToApigeecli = fromManifest.ApigeecliVersion, toManifest.ApigeecliVersion
+	for name, hash := range toFiles {
+		fromHash, ok := fromFiles[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, name)
+		case fromHash != hash:
+			diff.Modified = append(diff.Modified, name)
+		}
+	}
+	for name := range fromFiles {
+		if _, ok := toFiles[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+
+	// Older backups may have no manifest, in which case counts aren't compared
+	fromCounts, toCounts := fromManifest.EntityCounts[project], toManifest.EntityCounts[project]
+	if fromCounts != nil && toCounts != nil {
+		for _, folder := range slices.Concat(mapKeys(fromCounts), mapKeys(toCounts)) {
+			if fromCounts[folder] != toCounts[folder] {
+				if diff.CountChanges == nil {
+					diff.CountChanges = make(map[string]CountChange)
+				}
+				diff.CountChanges[folder] = CountChange{From: fromCounts[folder], To: toCounts[folder]}
+			}
+		}
+	}
+	return diff, nil
+}
+
+func mapKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// readBackup reads project's newest backup for date with readArchive.
+func readBackup(gcsBucket, project, date string) (map[string]string, Manifest, error) {
+	name, err := latestBackup(gcsBucket, project, date)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	if name == "" {
+		return nil, Manifest{}, fmt.Errorf("gs://%s/%s does not exist", gcsBucket, backupObjectName(project, date))
+	}
+	name, err = resolveBackup(gcsBucket, name)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	return readArchive(gcsBucket, name)
+}
+
+// readArchive downloads a backup archive to a temporary file and returns
+// the SHA-256 of each file in it, keyed by path, along with its manifest.
+func readArchive(gcsBucket, name string) (map[string]string, Manifest, error) {
+	var manifest Manifest
+	reader, err := openBackupObject(gcsBucket, name)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, manifest, fmt.Errorf("gs://%s/%s does not exist", gcsBucket, name)
+	}
+	if err != nil {
+		return nil, manifest, err
+	}
+	defer reader.Close()
+
+	// zip needs random access, so the archive can't be read as it streams
+	file, err := os.CreateTemp(runDir, "diff-*.zip")
+	if err != nil {
+		return nil, manifest, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		return nil, manifest, fmt.Errorf("failed to download gs://%s/%s: %w", gcsBucket, name, err)
+	}
+
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, manifest, fmt.Errorf("gs://%s/%s: %w", gcsBucket, name, err)
+	}
+	hashes := make(map[string]string)
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		content, err := entry.Open()
+		if err != nil {
+			return nil, manifest, fmt.Errorf("%s in gs://%s/%s: %w", entry.Name, gcsBucket, name, err)
+		}
+		hash := sha256.New()
+		var data []byte
+		if entry.Name == manifestFileName {
+			data, err = io.ReadAll(io.TeeReader(content, hash))
+			if err == nil {
+				err = json.Unmarshal(data, &manifest)
+			}
+		} else {
+			_, err = io.Copy(hash, content)
+		}
+		content.Close()
+		if err != nil {
+			return nil, manifest, fmt.Errorf("%s in gs://%s/%s: %w", entry.Name, gcsBucket, name, err)
+		}
+		if !diffIgnored[entry.Name] {
+			hashes[entry.Name] = hex.EncodeToString(hash.Sum(nil))
+		}
+	}
+	return hashes, manifest, nil
+}
+
+// print writes a human-readable summary of the diff to w.
+func (d BackupDiff) print(w io.Writer) {
+	fmt.Fprintf(w, "%s %s -> %s: %d added, %d removed, %d modified\n", d.Project, d.From, d.To, len(d.Added), len(d.Removed), len(d.Modified))
+	if d.FromApigeecli != "" && d.ToApigeecli != "" && versionsDiffer(d.FromApigeecli, d.ToApigeecli) {
+		fmt.Fprintf(w, "Warning: exported by different apigeecli versions (%s, %s); some changes may only be format differences\n", d.FromApigeecli, d.ToApigeecli)
+	}
+	for _, name := range d.Added {
+		fmt.Fprintf(w, "+ %s\n", name)
+	}
+	for _, name := range d.Removed {
+		fmt.Fprintf(w, "- %s\n", name)
+	}
+	for _, name := range d.Modified {
+		fmt.Fprintf(w, "~ %s\n", name)
+	}
+
+	folders := make([]string, 0, len(d.CountChanges))
+	for folder := range d.CountChanges {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		change := d.CountChanges[folder]
+		fmt.Fprintf(w, "%s: %d -> %d\n", folder, change.From, change.To)
+	}
+}
+
+func writeDiff(filePath string, diff BackupDiff) error {
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, append(data, '\n'), 0644)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testArchive builds a backup archive of files, keyed by path, with a
+// manifest recording counts for project.
+func testArchive(t *testing.T, project string, counts map[string]int, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	manifest, err := json.Marshal(Manifest{Orgs: []string{project}, EntityCounts: map[string]map[string]int{project: counts}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files[manifestFileName] = string(manifest)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDiffBackups(t *testing.T) {
+	_, store := setupBackupTest(t)
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), testArchive(t, "my-org", map[string]int{"proxies": 2, "sharedflows": 1}, map[string]string{
+		"proxies/a.zip":     "a v1",
+		"proxies/b.zip":     "b v1",
+		"sharedflows/c.zip": "c v1",
+		"export.log":        "exported on the 1st",
+	}))
+	store.put(testBucket, backupObjectName("my-org", "2024-06-08"), testArchive(t, "my-org", map[string]int{"proxies": 2, "sharedflows": 1}, map[string]string{
+		"proxies/a.zip":     "a v2",
+		"proxies/d.zip":     "d v1",
+		"sharedflows/c.zip": "c v1",
+		"export.log":        "exported on the 8th",
+	}))
+
+	diff, err := diffBackups(testBucket, "my-org", "2024-06-01", "2024-06-08")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(diff.Added, []string{"proxies/d.zip"}) || !slices.Equal(diff.Removed, []string{"proxies/b.zip"}) || !slices.Equal(diff.Modified, []string{"proxies/a.zip"}) {
+		t.Errorf("diff = added %v, removed %v, modified %v", diff.Added, diff.Removed, diff.Modified)
+	}
+	if len(diff.CountChanges) != 0 {
+		t.Errorf("CountChanges = %v, want none", diff.CountChanges)
+	}
+
+	var out strings.Builder
+	diff.print(&out)
+	want := "my-org 2024-06-01 -> 2024-06-08: 1 added, 1 removed, 1 modified\n+ proxies/d.zip\n- proxies/b.zip\n~ proxies/a.zip\n"
+	if out.String() != want {
+		t.Errorf("print() = %q, want %q", out.String(), want)
+	}
+
+	if _, err := diffBackups(testBucket, "my-org", "2024-06-01", "2024-06-02"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("diffBackups() with a missing backup error = %v", err)
+	}
+}
+
+func TestDiffBackupsCounts(t *testing.T) {
+	_, store := setupBackupTest(t)
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), testArchive(t, "my-org", map[string]int{"proxies": 1}, map[string]string{"proxies/a.zip": "a"}))
+	store.put(testBucket, backupObjectName("my-org", "2024-06-08"), testArchive(t, "my-org", map[string]int{"proxies": 2, "kvms": 1}, map[string]string{"proxies/a.zip": "a", "proxies/b.zip": "b", "kvms/k.json": "k"}))
+
+	diff, err := diffBackups(testBucket, "my-org", "2024-06-01", "2024-06-08")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]CountChange{"proxies": {From: 1, To: 2}, "kvms": {From: 0, To: 1}}
+	if len(diff.CountChanges) != len(want) || diff.CountChanges["proxies"] != want["proxies"] || diff.CountChanges["kvms"] != want["kvms"] {
+		t.Errorf("CountChanges = %v, want %v", diff.CountChanges, want)
+	}
+}
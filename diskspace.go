@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"syscall"
+)
+
+// minFreeSpace, when set, is the space the work directory must have free
+// before a project is exported. A full disk otherwise shows up as confusing
+// apigeecli or zip errors halfway through.
+var minFreeSpace int64
+
+// freeSpace returns the bytes available to this process in the filesystem
+// holding dir.
+var freeSpace = func(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// checkFreeSpace fails with a local error if dir has less than need bytes
+// free, naming what the space was needed for. A filesystem that can't be
+// checked is only logged, so the check never stops a backup by itself.
+func checkFreeSpace(dir string, need int64, purpose string) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Printf("Failed to check free space in %s: %v\n", dir, err)
+		return nil
+	}
+	if free < need {
+		return newBackupError(ErrLocal, fmt.Sprintf("Insufficient disk space in %s to %s: %s free, %s needed", dir, purpose, formatBytes(free), formatBytes(need)), nil)
+	}
+	return nil
+}
+
+// checkExportSpace checks that dir has --min-free-space free before an
+// export.
+func checkExportSpace(dir string) error {
+	if minFreeSpace <= 0 {
+		return nil
+	}
+	return checkFreeSpace(dir, minFreeSpace, "export")
+}
+
+// checkZipSpace checks that dir has room for an archive of exportFolder
+// before zipping it. The archive is at most about the size of what it holds,
+// so that is the estimate.
+func checkZipSpace(dir, exportFolder string) error {
+	if minFreeSpace <= 0 {
+		return nil
+	}
+	size, err := dirSize(exportFolder)
+	if err != nil {
+		log.Printf("Failed to measure %s: %v\n", exportFolder, err)
+		return nil
+	}
+	return checkFreeSpace(dir, size, "zip the export")
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMinFreeSpace(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	minFreeSpace = 1 << 20
+	var free int64
+	setGlobal(t, &freeSpace, func(dir string) (int64, error) {
+		return free, nil
+	})
+	var exports int
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		exports++
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	// Too little space fails the project before anything is exported
+	free = 1000
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Failed" || status.Category != "local" || !strings.Contains(status.Reason, "Insufficient disk space") {
+		t.Errorf("status = %s/%s (%s), want an insufficient disk space failure", status.Status, status.Category, status.Reason)
+	}
+	if exports != 0 {
+		t.Errorf("apigeecli ran %d times, want no export", exports)
+	}
+
+	// Enough space backs up as usual
+	free = 1 << 30
+	status = backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" || !store.has(testBucket, status.Object) {
+		t.Errorf("status = %s (%s), want Complete", status.Status, status.Reason)
+	}
+}
+
+func TestCheckZipSpace(t *testing.T) {
+	setGlobal(t, &minFreeSpace, 1)
+	setGlobal(t, &freeSpace, func(dir string) (int64, error) {
+		return 10, nil
+	})
+	dir := t.TempDir()
+	if err := writeExport(dir, "proxies/a.zip"); err != nil {
+		t.Fatal(err)
+	}
+	err := checkZipSpace(t.TempDir(), dir)
+	if err == nil || !strings.Contains(err.Error(), "to zip the export") {
+		t.Errorf("checkZipSpace() = %v, want an insufficient disk space error", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// doctorCheck is one line of the --doctor report.
+type doctorCheck struct {
+	Name     string
+	Detail   string // what was found, shown when the check passed
+	Err      error  // why the check failed, nil if it passed
+	Critical bool   // whether backups can't work while the check fails
+}
+
+// lookPath finds a binary on PATH.
+var lookPath = exec.LookPath
+
+// tokenInfoURL reports the scopes and expiry of an OAuth access token.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// doctorTimeout bounds each network check, so an unreachable host fails the
+// check instead of hanging the report.
+const doctorTimeout = 10 * time.Second
+
+// runDoctor checks that the environment can run backups with cfg: the
+// binaries, local paths, bucket access, the Apigee token and the webhooks.
+// A check that depends on a failed one is skipped rather than failed again.
+func runDoctor(cfg Config, tokenStdin bool) []doctorCheck {
+	var checks []doctorCheck
+	check := func(name string, critical bool, run func() (string, error)) error {
+		detail, err := run()
+		checks = append(checks, doctorCheck{Name: name, Detail: detail, Err: err, Critical: critical})
+		return err
+	}
+
+	apigeecliErr := check("apigeecli on PATH", true, func() (string, error) {
+		path, err := lookPath("apigeecli")
+		if err != nil {
+			return "", err
+		}
+		detectApigeecliVersion()
+		if apigeecliVersion == "" {
+			return path, nil
+		}
+		return fmt.Sprintf("%s (%s)", path, apigeecliVersion), nil
+	})
+	check("zip on PATH", true, func() (string, error) {
+		return lookPath("zip")
+	})
+
+	if logSink == logSinkFile {
+		check("log file writable", true, func() (string, error) {
+			// Appending creates the file if needed and never truncates it
+			file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+			if err != nil {
+				return "", err
+			}
+			return logFilePath, file.Close()
+		})
+	}
+	check("work directory writable", true, func() (string, error) {
+		dir, err := os.MkdirTemp(cfg.WorkDir, "apigee_backup-doctor-")
+		if err != nil {
+			return "", err
+		}
+		return dir, os.Remove(dir)
+	})
+	check("notification templates", true, func() (string, error) {
+		for _, file := range []string{cfg.DiscordTemplate, cfg.WorkspaceTemplate} {
+			if _, err := loadTemplate(file); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	})
+
+	storageErr := check("GCS client", true, func() (string, error) {
+		if objectStore != nil {
+			return "", nil
+		}
+		return "", newGCSClient(context.Background(), cfg.StorageEndpoint)
+	})
+	var projects []string
+	if storageErr == nil {
+		if cfg.GCSBucket == "" {
+			check("bucket access", true, func() (string, error) {
+				return "", errors.New("no --gcs bucket is set")
+			})
+		}
+		for _, bucket := range allDestinations() {
+			if bucket == "" {
+				continue
+			}
+			check("bucket access gs://"+bucket, true, func() (string, error) {
+				if err := probeBucket(bucket); err != nil {
+					return "", err
+				}
+				return "list, write and delete", probeWrite(bucket)
+			})
+			if kmsKeyName != "" {
+				check("KMS key in gs://"+bucket, true, func() (string, error) {
+					return kmsKeyName, probeKMSKey(bucket)
+				})
+			}
+		}
+		check("project file", true, func() (string, error) {
+			var err error
+			projects, _, err = readProjectFiles(cfg.ProjectFile)
+			if err != nil {
+				return "", err
+			}
+			if len(projects) == 0 {
+				return "", fmt.Errorf("%s lists no projects", cfg.ProjectFile)
+			}
+			return fmt.Sprintf("%s, %d projects", cfg.ProjectFile, len(projects)), nil
+		})
+	}
+
+	var token string
+	tokenErr := check("Apigee token", true, func() (string, error) {
+		if cfg.UseADC {
+			if err := setupADC(context.Background()); err != nil {
+				return "", err
+			}
+		}
+		var err error
+		token, err = loadToken(cfg.Token, cfg.TokenFile, tokenStdin, cfg.UseADC)
+		if err != nil {
+			return "", err
+		}
+		return checkTokenInfo(token)
+	})
+	if tokenErr == nil && apigeecliErr == nil && len(projects) > 0 {
+		check("Apigee API access to "+projects[0], true, func() (string, error) {
+			_, _, err := runApigeecli("", token, entityUnit{}.args(entityTypes[0].List, projects[0])...)
+			return "", err
+		})
+	}
+
+	webhooks := []struct{ name, url string }{
+		{"Discord webhook", cfg.DiscordWebhook},
+		{"Google Workspace webhook", cfg.WorkspaceWebhook},
+		{"generic webhook", cfg.GenericWebhook},
+		{"report webhook", cfg.ReportWebhook},
+	}
+	for _, override := range cfg.NotifyChannelOverrides {
+		webhooks = append(webhooks, struct{ name, url string }{"Discord webhook for " + override.Label, override.Webhook})
+	}
+	for _, webhook := range webhooks {
+		if webhook.url == "" {
+			continue
+		}
+		// A broken webhook loses notifications, not backups
+		check(webhook.name+" reachable", false, func() (string, error) {
+			return checkReachable(webhook.url)
+		})
+	}
+	return checks
+}
+
+// probeWrite writes and deletes an object in bucket, since listing alone
+// doesn't show that uploads and retention will be allowed.
+func probeWrite(bucket string) error {
+	ctx := context.Background()
+	name := objectKey("_probe", "doctor")
+	if _, err := objectStore.Write(ctx, bucket, name, strings.NewReader("apigee-backup --doctor"), WriteOptions{ContentType: "text/plain"}); err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", bucket, name, err)
+	}
+	if err := objectStore.Delete(ctx, bucket, name); err != nil {
+		return fmt.Errorf("failed to delete gs://%s/%s: %w", bucket, name, err)
+	}
+	return nil
+}
+
+// checkTokenInfo asks Google whether token is a live access token with the
+// cloud-platform scope, which the Apigee management API needs.
+func checkTokenInfo(token string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	// The token goes in the body, so it can't end up in an error message
+	form := url.Values{"access_token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenInfoURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach %s: %w", tokenInfoURL, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token is invalid or expired: %s", bytes.TrimSpace(body))
+	}
+
+	var info struct {
+		Scope     string `json:"scope"`
+		ExpiresIn string `json:"expires_in"`
+		Email     string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", fmt.Errorf("unexpected token info: %w", err)
+	}
+	if !slices.Contains(strings.Fields(info.Scope), adcScope) {
+		return "", fmt.Errorf("token lacks the %s scope, it has: %s", adcScope, info.Scope)
+	}
+	seconds, _ := strconv.Atoi(info.ExpiresIn)
+	detail := fmt.Sprintf("expires in %s", time.Duration(seconds)*time.Second)
+	if info.Email != "" {
+		detail = fmt.Sprintf("%s, %s", info.Email, detail)
+	}
+	return detail, nil
+}
+
+// checkReachable makes a GET request to a webhook URL without posting
+// anything to it. Any HTTP response shows the host is reachable; receivers
+// answer GET differently, so the status code is only reported. Only the
+// host is shown, since webhook URLs embed their credentials.
+func checkReachable(webhookURL string) (string, error) {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return "", errors.New("invalid URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, webhookURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL for %s", parsed.Host)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach %s", parsed.Host)
+	}
+	resp.Body.Close()
+	return fmt.Sprintf("%s answered %d", parsed.Host, resp.StatusCode), nil
+}
+
+// printDoctorReport writes a PASS, FAIL or WARN line per check and reports
+// whether any critical check failed.
+func printDoctorReport(w io.Writer, checks []doctorCheck) bool {
+	var failed, warned int
+	for _, c := range checks {
+		switch {
+		case c.Err == nil && c.Detail == "":
+			fmt.Fprintf(w, "PASS  %s\n", c.Name)
+		case c.Err == nil:
+			fmt.Fprintf(w, "PASS  %s: %s\n", c.Name, c.Detail)
+		case c.Critical:
+			fmt.Fprintf(w, "FAIL  %s: %v\n", c.Name, c.Err)
+			failed++
+		default:
+			fmt.Fprintf(w, "WARN  %s: %v\n", c.Name, c.Err)
+			warned++
+		}
+	}
+	fmt.Fprintf(w, "\n%d checks, %d failed, %d warnings\n", len(checks), failed, warned)
+	return failed > 0
+}
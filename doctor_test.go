@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if args[0] == "--version" {
+			return "apigeecli version 2.5.1\n", "", nil
+		}
+		return "[]", "", nil
+	}
+	missing := map[string]bool{}
+	setGlobal(t, &lookPath, func(file string) (string, error) {
+		if missing[file] {
+			return "", fmt.Errorf("exec: %q: executable file not found in $PATH", file)
+		}
+		return "/usr/bin/" + file, nil
+	})
+
+	scope := adcScope
+	tokenInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("access_token") != "good-token" {
+			http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"scope": %q, "expires_in": "3599", "email": "backup@example.iam.gserviceaccount.com"}`, scope)
+	}))
+	defer tokenInfo.Close()
+	setGlobal(t, &tokenInfoURL, tokenInfo.URL)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer webhook.Close()
+
+	projectFile := filepath.Join(t.TempDir(), "projects.txt")
+	os.WriteFile(projectFile, []byte("my-org\nother-org\n"), 0600)
+	cfg := Config{ProjectFile: projectFile, GCSBucket: testBucket, Token: "good-token", DiscordWebhook: webhook.URL + "/api/webhooks/1/secret", WorkDir: t.TempDir()}
+
+	run := func() (string, bool) {
+		var out bytes.Buffer
+		failed := printDoctorReport(&out, runDoctor(cfg, false))
+		return out.String(), failed
+	}
+
+	report, failed := run()
+	if failed || strings.Contains(report, "FAIL") {
+		t.Fatalf("report with a working environment:\n%s", report)
+	}
+	for _, want := range []string{"PASS  apigeecli on PATH: /usr/bin/apigeecli (apigeecli version 2.5.1)", "PASS  Apigee API access to my-org", "2 projects", "answered 405"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report = %s\nwant it to contain %q", report, want)
+		}
+	}
+	if strings.Contains(report, "secret") {
+		t.Errorf("report shows the webhook URL:\n%s", report)
+	}
+	if store.has(testBucket, objectKey("_probe", "doctor")) {
+		t.Error("the write probe was left in the bucket")
+	}
+
+	// Critical problems fail the report, and checks that need them are skipped
+	missing["apigeecli"] = true
+	scope = "https://www.googleapis.com/auth/userinfo.email"
+	store.fail = func(op, bucket, name string) error {
+		return errorIf(op == "write", errDenied)
+	}
+	report, failed = run()
+	if !failed {
+		t.Errorf("report with critical problems didn't fail:\n%s", report)
+	}
+	for _, want := range []string{"FAIL  apigeecli on PATH", "FAIL  bucket access gs://" + testBucket, "FAIL  Apigee token: token lacks the"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report = %s\nwant it to contain %q", report, want)
+		}
+	}
+	if strings.Contains(report, "Apigee API access") {
+		t.Errorf("report checked Apigee access without apigeecli:\n%s", report)
+	}
+
+	// An unreachable webhook is only a warning
+	missing["apigeecli"] = false
+	scope = adcScope
+	store.fail = nil
+	webhook.Close()
+	report, failed = run()
+	if failed || !strings.Contains(report, "WARN  Discord webhook reachable") {
+		t.Errorf("report with an unreachable webhook:\n%s", report)
+	}
+}
+
+func TestCheckTokenInfoInvalid(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+	setGlobal(t, &tokenInfoURL, server.URL)
+
+	_, err := checkTokenInfo("expired-token")
+	if err == nil || !strings.Contains(err.Error(), "invalid or expired") {
+		t.Errorf("checkTokenInfo() = %v, want an invalid token error", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "expired-token") {
+		t.Errorf("checkTokenInfo() error %q shows the token", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// endpointLabel is the project file label that points apigeecli at the
+// control plane a project's org lives in, so one run can back up orgs
+// across control planes.
+const endpointLabel = "endpoint"
+
+// apiEndpoints are the endpoint values passed to apigeecli as --api; any
+// other value is a data residency region, passed as --region.
+var apiEndpoints = []string{"prod", "staging", "autopush"}
+
+// regionPattern matches a control plane region such as eu or me-central2.
+var regionPattern = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]$`)
+
+// validateEndpoint checks an endpoint label value.
+func validateEndpoint(value string) error {
+	if slices.Contains(apiEndpoints, value) || regionPattern.MatchString(value) {
+		return nil
+	}
+	return fmt.Errorf("invalid endpoint %q, expected prod, staging, autopush or a region such as eu", value)
+}
+
+// projectEndpoint returns the endpoint label of project, or "" for the
+// default control plane.
+func projectEndpoint(project string) string {
+	return projectLabels[project][endpointLabel]
+}
+
+// endpointArgs returns the apigeecli flags that select project's control
+// plane.
+func endpointArgs(project string) []string {
+	endpoint := projectEndpoint(project)
+	switch {
+	case endpoint == "":
+		return nil
+	case slices.Contains(apiEndpoints, endpoint):
+		return []string{"--api", endpoint}
+	}
+	return []string{"--region", endpoint}
+}
+
+// checkEndpointLabels validates the endpoint label of each project, so a
+// typo fails the run before anything is exported.
+func checkEndpointLabels(projects []string) error {
+	for _, project := range projects {
+		label, ok := projectLabels[project][endpointLabel]
+		if !ok {
+			continue
+		}
+		if err := validateEndpoint(label); err != nil {
+			return fmt.Errorf("%s: %w", project, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestProjectEndpoint(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	projectLabels = map[string]map[string]string{"eu-org": {endpointLabel: "eu"}, "staging-org": {endpointLabel: "staging"}}
+	calls := map[string][]string{}
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		calls[args[slices.Index(args, "-o")+1]] = args
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	for project, want := range map[string][]string{"eu-org": {"--region", "eu"}, "staging-org": {"--api", "staging"}, "my-org": nil} {
+		status := backupProject(context.Background(), project, testBucket, "token", 30)
+		if status.Status != "Complete" || status.Endpoint != projectLabels[project][endpointLabel] {
+			t.Errorf("%s: status = %q (%s), endpoint %q", project, status.Status, status.Reason, status.Endpoint)
+		}
+		args := calls[project]
+		if want == nil {
+			if slices.Contains(args, "--region") || slices.Contains(args, "--api") {
+				t.Errorf("%s: apigeecli %q, want the default control plane", project, args)
+			}
+		} else if i := slices.Index(args, want[0]); i < 0 || i+1 >= len(args) || args[i+1] != want[1] {
+			t.Errorf("%s: apigeecli %q, want %q", project, args, want)
+		}
+	}
+
+	if err := checkEndpointLabels([]string{"eu-org", "staging-org"}); err != nil {
+		t.Errorf("checkEndpointLabels() = %v", err)
+	}
+	for _, value := range []string{"EU", "https://eu-apigee.googleapis.com", "eu-", ""} {
+		projectLabels["bad-org"] = map[string]string{endpointLabel: value}
+		if err := checkEndpointLabels([]string{"bad-org"}); err == nil {
+			t.Errorf("checkEndpointLabels() accepted endpoint=%q", value)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// entityType describes one kind of Apigee entity and the apigeecli
+// subcommands that list and export it.
+type entityType struct {
+	Name   string   // name used to select the type on the command line
+	Label  string   // plural used in output, e.g. "42 proxies"
+	List   []string // apigeecli arguments that list the entities, before -o and -t
+	Export []string // apigeecli arguments that export the entities into the working directory
+	PerEnv bool     // whether the type is scoped to an environment and needs -e
+	EnvDir string   // folder of an environment-scoped type within env/<name>/
+
+	// ListExport types have no export command; their listing holds the
+	// entities in full and is written out one file per entity instead.
+	ListExport bool
+}
+
+var entityTypes = []entityType{
+	{Name: "apis", Label: "proxies", List: []string{"apis", "list"}, Export: []string{"apis", "export", "-f", "."}},
+	{Name: "sharedflows", Label: "sharedflows", List: []string{"sharedflows", "list"}, Export: []string{"sharedflows", "export", "-f", "."}},
+	{Name: "kvms", Label: "KVMs", List: []string{"kvms", "list"}, Export: []string{"kvms", "export"}},
+	{Name: "products", Label: "products", List: []string{"products", "list"}, Export: []string{"products", "export"}},
+	{Name: "developers", Label: "developers", List: []string{"developers", "list"}, Export: []string{"developers", "export"}},
+	{Name: "apps", Label: "apps", List: []string{"apps", "list"}, Export: []string{"apps", "export"}},
+	{Name: "envs", Label: "environments", List: []string{"environments", "list"}},
+	{Name: "targetservers", Label: "target servers", List: []string{"targetservers", "list"}, Export: []string{"targetservers", "export"}, PerEnv: true, EnvDir: "targetservers"},
+	{Name: "envkvms", Label: "environment KVMs", List: []string{"kvms", "list"}, Export: []string{"kvms", "export"}, PerEnv: true, EnvDir: "kvms"},
+	{Name: "envproxies", Label: "deployed proxies", List: []string{"apis", "list"}, PerEnv: true, EnvDir: "proxies", ListExport: true},
+}
+
+// exportable reports whether the type can be exported, rather than only
+// listed and counted.
+func (et entityType) exportable() bool {
+	return et.Export != nil || et.ListExport
+}
+
+// entityUnit is one entity type, or one entity type in one environment for
+// environment-scoped types. It is the unit of listing and per-entity export.
+type entityUnit struct {
+	Type entityType
+	Env  string
+}
+
+// Name identifies the unit, e.g. "apis" or "targetservers-prod".
+func (u entityUnit) Name() string {
+	if u.Env == "" {
+		return u.Type.Name
+	}
+	return u.Type.Name + "-" + u.Env
+}
+
+// Dir is the folder of the archive the unit is exported to: its Name, or
+// env/<name>/<type> for an environment-scoped unit, so one environment can
+// be restored on its own.
+func (u entityUnit) Dir() string {
+	if u.Env == "" {
+		return u.Name()
+	}
+	return filepath.Join("env", u.Env, u.Type.EnvDir)
+}
+
+func (u entityUnit) args(base []string, project string) []string {
+	args := append(append([]string{}, base...), "-o", project)
+	if u.Env != "" {
+		args = append(args, "-e", u.Env)
+	}
+	return append(args, endpointArgs(project)...)
+}
+
+// selectEntityTypes returns the entity types named in names, in table order.
+// An empty list selects every type.
+func selectEntityTypes(names []string) ([]entityType, error) {
+	if len(names) == 0 {
+		return entityTypes, nil
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	var selected []entityType
+	for _, et := range entityTypes {
+		if wanted[et.Name] {
+			selected = append(selected, et)
+			delete(wanted, et.Name)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown entity type %q", name)
+	}
+	return selected, nil
+}
+
+// excludedEntities are the entity types left out of every backup with
+// --exclude-entities, lowercased. With --all they name top-level entries of
+// the export; with --resume-export, entity types as in entityTypes.
+var excludedEntities = map[string]bool{}
+
+// excludedEntityNames returns the excluded entity types, sorted.
+func excludedEntityNames() []string {
+	names := make([]string, 0, len(excludedEntities))
+	for name := range excludedEntities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeExcludedEntities deletes the top-level entries of exportFolder that
+// hold an excluded entity type: a folder such as keystores/, or a file such
+// as keystores.json. Environment-scoped entries, e.g. targetservers-prod/,
+// are removed when their type is excluded.
+func removeExcludedEntities(exportFolder string) error {
+	if len(excludedEntities) == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(exportFolder)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := strings.ToLower(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		unitType, _, _ := strings.Cut(name, "-")
+		if !excludedEntities[name] && !excludedEntities[unitType] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(exportFolder, entry.Name())); err != nil {
+			return err
+		}
+		slog.Debug("Removed excluded entities", "path", filepath.Join(exportFolder, entry.Name()))
+	}
+	return nil
+}
+
+// excludedGlobs are the --exclude-glob patterns of files left out of every
+// backup, such as keystore private keys that mustn't be stored at all. A
+// pattern with a slash matches a path from the root of the export, e.g.
+// keystores/*/*.pem; one without matches a file or folder name anywhere.
+var excludedGlobs []string
+
+// validateExcludeGlob reports whether pattern is usable with path.Match.
+func validateExcludeGlob(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid --exclude-glob %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// matchesExcludedGlob reports whether rel, a slash-separated path within
+// the export, matches any of excludedGlobs.
+func matchesExcludedGlob(rel string) bool {
+	for _, pattern := range excludedGlobs {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removeExcludedGlobs deletes the files and folders of exportFolder that
+// match excludedGlobs before it is zipped, and returns how many it removed.
+func removeExcludedGlobs(exportFolder string) (int, error) {
+	if len(excludedGlobs) == 0 {
+		return 0, nil
+	}
+	var removed int
+	err := filepath.WalkDir(exportFolder, func(file string, entry os.DirEntry, err error) error {
+		if err != nil || file == exportFolder {
+			return err
+		}
+		rel, err := filepath.Rel(exportFolder, file)
+		if err != nil || !matchesExcludedGlob(filepath.ToSlash(rel)) {
+			return err
+		}
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+		slog.Debug("Removed file matching --exclude-glob", "path", file)
+		removed++
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// entityTypeNames lists the selectable entity type names, for usage text.
+func entityTypeNames() string {
+	names := make([]string, len(entityTypes))
+	for i, et := range entityTypes {
+		names[i] = et.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// entityUnits expands types into units, listing the project's environments
+// if any of the types are environment-scoped.
+func entityUnits(project, token string, types []entityType) ([]entityUnit, error) {
+	var envs []string
+	for _, et := range types {
+		if et.PerEnv {
+			var err error
+			if envs, err = listEnvironments(project, token); err != nil {
+				return nil, fmt.Errorf("failed to list environments: %w", err)
+			}
+			break
+		}
+	}
+
+	var units []entityUnit
+	for _, et := range types {
+		if !et.PerEnv {
+			units = append(units, entityUnit{Type: et})
+			continue
+		}
+		for _, env := range envs {
+			units = append(units, entityUnit{Type: et, Env: env})
+		}
+	}
+	return units, nil
+}
+
+func listEnvironments(project, token string) ([]string, error) {
+	out, _, err := runApigeecli("", token, entityUnit{}.args([]string{"environments", "list"}, project)...)
+	if err != nil {
+		return nil, err
+	}
+	var envs []string
+	if err := json.Unmarshal(bytes.TrimSpace(out), &envs); err != nil {
+		return nil, fmt.Errorf("unexpected apigeecli output: %w", err)
+	}
+	return envs, nil
+}
+
+// listEntities prints how many entities of each selected type every project
+// has, without exporting anything. It returns an error if any list failed,
+// so missing permissions show up before a real backup run.
+func listEntities(projects []string, token string, types []entityType) error {
+	var failed int
+	for _, project := range projects {
+		units, err := entityUnits(project, token, types)
+		if err != nil {
+			fmt.Printf("%s: %v\n", project, err)
+			failed++
+			continue
+		}
+
+		// Environment-scoped types are summed across environments
+		totals := make(map[string]int)
+		errs := make(map[string]error)
+		for _, unit := range units {
+			count, err := countEntities(project, token, unit)
+			if err != nil {
+				errs[unit.Type.Name] = err
+				continue
+			}
+			totals[unit.Type.Name] += count
+		}
+
+		counts := make([]string, 0, len(types))
+		for _, et := range types {
+			if err := errs[et.Name]; err != nil {
+				counts = append(counts, fmt.Sprintf("%s: %v", et.Label, err))
+				failed++
+				continue
+			}
+			counts = append(counts, fmt.Sprintf("%d %s", totals[et.Name], et.Label))
+		}
+		fmt.Printf("%s: %s\n", project, strings.Join(counts, ", "))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to list %d entity types", failed)
+	}
+	return nil
+}
+
+// countEntities runs the apigeecli list command for unit against project and
+// returns the number of entities it reported.
+func countEntities(project, token string, unit entityUnit) (int, error) {
+	out, _, err := runApigeecli("", token, unit.args(unit.Type.List, project)...)
+	if err != nil {
+		return 0, err
+	}
+	return parseEntityCount(out)
+}
+
+// apigeecliError is a failed apigeecli run, with the error status and
+// message parsed from its stderr.
+type apigeecliError struct {
+	Status     string
+	Message    string
+	RetryAfter time.Duration // wait the server asked for, if rate limited
+}
+
+func (e *apigeecliError) Error() string {
+	return e.Message
+}
+
+// apigeecliVersion is what apigeecli --version printed, recorded with every
+// backup since apigeecli's export format changes between versions. It is ""
+// if the version couldn't be determined.
+var apigeecliVersion string
+
+// apigeecliVersionMetadata is the object metadata key the version is stored under.
+const apigeecliVersionMetadata = "apigeecli-version"
+
+// detectApigeecliVersion runs apigeecli --version and sets apigeecliVersion,
+// unless an earlier run already did.
+func detectApigeecliVersion() {
+	if apigeecliVersion != "" {
+		return
+	}
+	var out, stderr bytes.Buffer
+	if err := commandRunner.Run(context.Background(), "", &out, &stderr, "apigeecli", "--version"); err != nil {
+		log.Printf("Failed to get the apigeecli version, it won't be recorded with the backups: %v\n", err)
+		return
+	}
+	apigeecliVersion, _, _ = strings.Cut(strings.TrimSpace(out.String()), "\n")
+	log.Printf("Using %s\n", apigeecliVersion)
+}
+
+// versionPattern finds the major and minor version in apigeecli --version
+// output, e.g. "apigeecli version 2.5.1 date: ...".
+var versionPattern = regexp.MustCompile(`v?(\d+)\.(\d+)`)
+
+// versionsDiffer reports whether two apigeecli versions differ in their
+// major or minor version, which is when the export format may have changed.
+// Versions that can't be parsed only differ if they aren't identical.
+func versionsDiffer(a, b string) bool {
+	matchA, matchB := versionPattern.FindStringSubmatch(a), versionPattern.FindStringSubmatch(b)
+	if matchA == nil || matchB == nil {
+		return a != b
+	}
+	return matchA[1] != matchB[1] || matchA[2] != matchB[2]
+}
+
+// isRateLimited reports whether err is an apigeecli run rejected by a quota.
+func isRateLimited(err error) bool {
+	var cliErr *apigeecliError
+	return errors.As(err, &cliErr) && cliErr.Status == statusRateLimited
+}
+
+// runApigeecli runs apigeecli with args in dir, authenticated with token,
+// and returns its stdout and stderr. A failed run returns an
+// *apigeecliError. A run rejected by a quota pauses every apigeecli run for
+// the Retry-After or a backoff and is tried again, up to rateLimitAttempts
+// times.
+func runApigeecli(dir, token string, args ...string) ([]byte, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		waitForAPI()
+		out, stderr, err := runApigeecliOnce(dir, token, args...)
+		if !isRateLimited(err) || attempt == rateLimitAttempts {
+			return out, stderr, err
+		}
+		wait := rateLimitWait(attempt, err.(*apigeecliError).RetryAfter)
+		log.Printf("Apigee API quota exhausted (attempt %d of %d), pausing for %s: %v\n", attempt, rateLimitAttempts, wait, err)
+		pauseAPI(wait)
+	}
+}
+
+// exportTimeout, when set, kills any apigeecli run that takes longer, so a
+// hung org fails as timed out instead of holding up the rest of the run.
+var exportTimeout time.Duration
+
+// errExportTimeout is returned for an apigeecli run killed by exportTimeout.
+var errExportTimeout = errors.New("apigeecli timed out")
+
+func runApigeecliOnce(dir, token string, args ...string) ([]byte, []byte, error) {
+	// The token goes through apigeecli's token cache, not its arguments
+	home, err := apigeecliTokenHome(token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pass the token to apigeecli: %w", err)
+	}
+	defer os.RemoveAll(home)
+
+	ctx := context.Background()
+	if exportTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, exportTimeout)
+		defer cancel()
+	}
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	if err := commandRunner.Run(ctx, dir, &out, &stderr, "env", append([]string{"HOME=" + home, "apigeecli"}, args...)...); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return out.Bytes(), stderr.Bytes(), fmt.Errorf("%w after the %s --export-timeout", errExportTimeout, exportTimeout)
+		}
+		status, message := parseError(stderr.String())
+		if message = strings.TrimSpace(message); message == "" {
+			message = err.Error()
+		}
+		cliErr := &apigeecliError{Status: status, Message: message}
+		if status == statusRateLimited {
+			cliErr.RetryAfter = parseRetryAfter(stderr.String())
+		}
+		return out.Bytes(), stderr.Bytes(), cliErr
+	}
+	return out.Bytes(), stderr.Bytes(), nil
+}
+
+// parseEntityCount counts the entries in apigeecli list output.
+func parseEntityCount(output []byte) (int, error) {
+	list, err := parseEntityList(output)
+	return len(list), err
+}
+
+// parseEntityList returns the entries in apigeecli list output, which is
+// either a bare JSON array or an object wrapping one, e.g. {"proxies": [...]}.
+// An empty object means there are none.
+func parseEntityList(output []byte) ([]json.RawMessage, error) {
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return nil, nil
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal(output, &list); err == nil {
+		return list, nil
+	}
+
+	var wrapped map[string]json.RawMessage
+	if err := json.Unmarshal(output, &wrapped); err != nil {
+		return nil, fmt.Errorf("unexpected apigeecli output: %w", err)
+	}
+	for _, value := range wrapped {
+		if err := json.Unmarshal(value, &list); err == nil {
+			return list, nil
+		}
+	}
+	return nil, nil
+}
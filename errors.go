@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// Failure categories. Every error that fails a project wraps one of these,
+// so callers can classify it with errors.Is.
+var (
+	ErrAuth    = errors.New("authentication or permission error")
+	ErrNetwork = errors.New("network error")
+	ErrTimeout = errors.New("timeout")
+	ErrStorage = errors.New("storage error")
+	ErrExport  = errors.New("export error")
+	ErrZip     = errors.New("zip error")
+	ErrLocal   = errors.New("local filesystem error")
+	ErrHook    = errors.New("hook error")
+)
+
+// errorCategories maps each category to the name recorded in
+// ProjectStatus.Category, in the order they are checked.
+var errorCategories = []struct {
+	err  error
+	name string
+}{
+	{ErrAuth, "auth"},
+	{ErrNetwork, "network"},
+	{ErrTimeout, "timeout"},
+	{ErrStorage, "storage"},
+	{ErrExport, "export"},
+	{ErrZip, "zip"},
+	{ErrLocal, "local"},
+	{ErrHook, "hook"},
+}
+
+// BackupError is a failed step of a backup: what was being done, the
+// failure category and the underlying error. Both the category and the
+// underlying error can be matched with errors.Is and errors.As.
+type BackupError struct {
+	Op       string
+	Category error
+	Err      error
+}
+
+func (e *BackupError) Error() string {
+	if e.Err == nil {
+		return e.Op
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *BackupError) Unwrap() []error {
+	return []error{e.Category, e.Err}
+}
+
+func newBackupError(category error, op string, err error) error {
+	return &BackupError{Op: op, Category: category, Err: err}
+}
+
+// gcsError wraps a storage error, categorising permission and network
+// problems separately from other storage failures.
+func gcsError(op string, err error) error {
+	var netErr net.Error
+	switch {
+	case isAccessDenied(err):
+		return newBackupError(ErrAuth, op+": access denied", err)
+	case errors.As(err, &netErr):
+		return newBackupError(ErrNetwork, op, err)
+	}
+	return newBackupError(ErrStorage, op, err)
+}
+
+// exportError wraps a failed apigeecli run.
+func exportError(op string, err error) error {
+	return newBackupError(exportCategory(err), op, err)
+}
+
+// exportCategory categorises a failed apigeecli run, treating rejected
+// credentials as auth errors and runs killed by --export-timeout as timeouts
+// rather than export errors.
+func exportCategory(err error) error {
+	if errors.Is(err, errExportTimeout) {
+		return ErrTimeout
+	}
+	var cliErr *apigeecliError
+	if errors.As(err, &cliErr) {
+		switch {
+		case cliErr.Status == "UNAUTHENTICATED", cliErr.Status == "PERMISSION_DENIED":
+			return ErrAuth
+		case strings.Contains(cliErr.Message, "Unauthorized"):
+			return ErrAuth
+		}
+	}
+	return ErrExport
+}
+
+// errorCategory returns the category name of err, or "" if it has none.
+func errorCategory(err error) string {
+	for _, category := range errorCategories {
+		if errors.Is(err, category.err) {
+			return category.name
+		}
+	}
+	return ""
+}
+
+// failProject logs err and marks status as failed, deriving the reason and
+// category from err.
+func failProject(status *ProjectStatus, err error) {
+	slog.Error(err.Error())
+	status.Status = "Failed"
+	status.Reason = err.Error()
+	status.Category = errorCategory(err)
+	status.FailureKey = failureKey(err)
+}
+
+// failureKey identifies what failed by err's category and operation, e.g.
+// "export: Failed to execute apigeecli command", without the wrapped
+// details, such as addresses or apigeecli's output, that change between
+// runs failing the same way. An uncategorised error is keyed by its message.
+func failureKey(err error) string {
+	var backupErr *BackupError
+	if !errors.As(err, &backupErr) {
+		return err.Error()
+	}
+	return errorCategory(err) + ": " + backupErr.Op
+}
+
+// warnProject logs a problem that doesn't fail the project and records it in
+// status.Warnings, so it shows up in notifications and the report.
+func warnProject(status *ProjectStatus, format string, args ...any) {
+	warning := fmt.Sprintf(format, args...)
+	log.Printf("%s: %s\n", status.Project, warning)
+	status.Warnings = append(status.Warnings, warning)
+}
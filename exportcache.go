@@ -0,0 +1,322 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// resumeExport exports each entity type separately and caches the results,
+// so a retry after a failed export only re-fetches the types that failed.
+var resumeExport bool
+
+// entityConcurrency is how many entity units of one project are exported
+// at once with --resume-export.
+var entityConcurrency = 1
+
+// exportCacheRoot holds the per-entity export cache. It lives outside runDir
+// so it survives the end of a failed run.
+var exportCacheRoot string
+
+// defaultExportCacheRoot is where the export cache is kept without
+// --work-dir: apigee_backup in the user's cache directory, e.g.
+// ~/.cache/apigee_backup. The cache holds KVM entries and app credentials,
+// so it doesn't go in the shared temp directory.
+func defaultExportCacheRoot() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apigee_backup"), nil
+}
+
+// checkExportCacheRoot creates dir if it doesn't exist and checks that it is
+// a directory, not a symlink, owned by this user and with mode 0700, so other
+// users can neither read the cached exports nor redirect them elsewhere.
+func checkExportCacheRoot(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("%s is a symlink", dir)
+	case !info.IsDir():
+		return fmt.Errorf("%s is not a directory", dir)
+	case info.Mode().Perm() != 0700:
+		return fmt.Errorf("%s has mode %04o, must be 0700", dir, info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not by this user", dir, stat.Uid)
+	}
+	return nil
+}
+
+// exportCacheDir returns the cache directory for project and date. Each unit
+// is exported to export/<unit> and, once complete, recorded in
+// done/<unit> with a hash of the listing it was exported against.
+func exportCacheDir(project, date string) string {
+	return filepath.Join(exportCacheRoot, project, date)
+}
+
+// exportEntities exports project one entity unit at a time, reusing units
+// cached by an earlier failed attempt, and copies the complete export into
+// exportFolder. If any unit fails the units that succeeded stay cached for
+// the next attempt.
+func exportEntities(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	var stdout, stderr []byte
+	fail := func(err error) error {
+		status.FailureLog = saveFailureLog(gcsBucket, project, date, stdout, stderr)
+		return err
+	}
+
+	// Caches from other dates are never reused
+	removeStaleExportCaches(project, date)
+	cacheDir := exportCacheDir(project, date)
+	doneDir := filepath.Join(cacheDir, "done")
+	if err := os.MkdirAll(doneDir, dirMode); err != nil {
+		return newBackupError(ErrLocal, "Failed to create export cache", err)
+	}
+
+	types := make([]entityType, 0, len(entityTypes))
+	for _, et := range entityTypes {
+		if et.exportable() && !excludedEntities[et.Name] {
+			types = append(types, et)
+		}
+	}
+	units, err := entityUnits(project, token, types)
+	if err != nil {
+		return fail(exportError("Failed to list entity types", err))
+	}
+
+	// Export up to entityConcurrency units at once; a failed unit doesn't
+	// stop the others, so they are cached for the next attempt
+	results := make([]unitResult, len(units))
+	workers := newSemaphore(entityConcurrency)
+	var wg sync.WaitGroup
+	for i, unit := range units {
+		workers.acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer workers.release()
+			results[i] = exportUnit(unit, project, token, cacheDir)
+		}()
+	}
+	wg.Wait()
+
+	// Collect the results in unit order, so logs read the same every run
+	var failed []string
+	var firstErr error
+	var reused int
+	for i, result := range results {
+		if result.ran {
+			stdout = append(stdout, fmt.Sprintf("--- %s ---\n%s", units[i].Name(), result.stdout)...)
+			stderr = append(stderr, fmt.Sprintf("--- %s ---\n%s", units[i].Name(), result.stderr)...)
+		}
+		if result.reused {
+			reused++
+		}
+		if result.warning != "" {
+			warnProject(status, "%s", result.warning)
+		}
+		if result.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", units[i].Name(), result.err))
+			var cliErr *apigeecliError
+			if errors.As(result.err, &cliErr) {
+				firstErr = cmp.Or(firstErr, result.err)
+			}
+		}
+	}
+	if reused > 0 {
+		log.Printf("Reused %d of %d cached entity exports for %s\n", reused, len(units), project)
+	}
+	if len(failed) > 0 {
+		// Categorise by the first apigeecli failure, so rejected credentials still count as auth errors
+		op := fmt.Sprintf("Failed to export %d of %d entity types (%s); rerun with --resume-export to retry only these", len(failed), len(units), strings.Join(failed, "; "))
+		return fail(&BackupError{Op: op, Category: exportCategory(firstErr)})
+	}
+
+	for _, unit := range units {
+		if err := copyDir(filepath.Join(cacheDir, "export", unit.Name()), filepath.Join(exportFolder, unit.Dir())); err != nil {
+			return newBackupError(ErrLocal, "Failed to copy cached export", err)
+		}
+	}
+	if saveExportLog {
+		if err := os.WriteFile(filepath.Join(exportFolder, "export.log"), stdout, 0600); err != nil {
+			warnProject(status, "Failed to write export log: %v", err)
+		}
+	}
+	return nil
+}
+
+// unitResult is the outcome of exporting one entity unit.
+type unitResult struct {
+	reused         bool   // the cached export was still current
+	ran            bool   // the export command ran
+	stdout, stderr []byte // the export command's output
+	warning        string // a problem that didn't fail the unit
+	err            error
+}
+
+// exportUnit exports unit into its directory under cacheDir, unless the
+// cached export was made against the same listing.
+func exportUnit(unit entityUnit, project, token, cacheDir string) unitResult {
+	unitDir := filepath.Join(cacheDir, "export", unit.Name())
+	marker := filepath.Join(cacheDir, "done", unit.Name())
+
+	// The listing is re-fetched every attempt, so a unit whose entities
+	// changed since it was cached is exported again
+	listing, _, err := runApigeecli("", token, unit.args(unit.Type.List, project)...)
+	if err != nil {
+		return unitResult{err: err}
+	}
+	sum := sha256.Sum256(listing)
+	fingerprint := hex.EncodeToString(sum[:])
+	if cached, err := os.ReadFile(marker); err == nil && string(cached) == fingerprint {
+		return unitResult{reused: true}
+	}
+
+	os.Remove(marker)
+	result := runUnitExport(unit, project, token, unitDir, listing)
+	if result.err != nil {
+		return result
+	}
+	result.err = os.WriteFile(marker, []byte(fingerprint), 0600)
+	return result
+}
+
+// runUnitExport exports unit into dir, replacing anything already there.
+// listing is the unit's listing, which is written out as the export of a
+// ListExport type. An error status in --ignore-statuses only warns.
+func runUnitExport(unit entityUnit, project, token, dir string, listing []byte) unitResult {
+	if err := os.RemoveAll(dir); err != nil {
+		return unitResult{err: err}
+	}
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return unitResult{err: err}
+	}
+	if unit.Type.ListExport {
+		entities, err := parseEntityList(listing)
+		if err == nil {
+			err = writeEntityFiles(dir, entities)
+		}
+		return unitResult{err: err}
+	}
+
+	out, errOut, err := runApigeecli(dir, token, unit.args(unit.Type.Export, project)...)
+	result := unitResult{ran: true, stdout: out, stderr: errOut}
+	var cliErr *apigeecliError
+	if errors.As(err, &cliErr) && ignoredStatuses[cliErr.Status] {
+		result.warning = fmt.Sprintf("Continuing despite %s error exporting %s: %v", cliErr.Status, unit.Name(), cliErr.Message)
+	} else if err != nil {
+		result.err = err
+	}
+	return result
+}
+
+// exportEnvFolders exports the environment-scoped entity types of project
+// into the env/<name>/<type> folders of exportFolder with apigeecli's
+// environment-scoped commands, after an organizations export --all. The
+// files --all wrote are left as they are, so the whole org can still be
+// imported from them; the env folders are what --restore-env restores.
+func exportEnvFolders(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	var types []entityType
+	for _, et := range entityTypes {
+		if et.PerEnv && et.exportable() && !excludedEntities[et.Name] {
+			types = append(types, et)
+		}
+	}
+	units, err := entityUnits(project, token, types)
+	if err != nil {
+		return exportError("Failed to list environments", err)
+	}
+	for _, unit := range units {
+		var listing []byte
+		if unit.Type.ListExport {
+			if listing, _, err = runApigeecli("", token, unit.args(unit.Type.List, project)...); err != nil {
+				return exportError("Failed to export "+unit.Name(), err)
+			}
+		}
+		result := runUnitExport(unit, project, token, filepath.Join(exportFolder, unit.Dir()), listing)
+		if result.warning != "" {
+			warnProject(status, "%s", result.warning)
+		}
+		if result.err != nil {
+			status.FailureLog = saveFailureLog(gcsBucket, project, date, result.stdout, result.stderr)
+			return exportError("Failed to export "+unit.Name(), result.err)
+		}
+	}
+	return nil
+}
+
+// clearExportCache removes project's cache once its backup is safely uploaded.
+func clearExportCache(project string) {
+	if err := os.RemoveAll(filepath.Join(exportCacheRoot, project)); err != nil {
+		log.Printf("Failed to remove export cache for %s: %v\n", project, err)
+	}
+}
+
+// removeStaleExportCaches removes project's caches for dates other than date.
+func removeStaleExportCaches(project, date string) {
+	entries, err := os.ReadDir(filepath.Join(exportCacheRoot, project))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != date {
+			removeWorkDir(filepath.Join(exportCacheRoot, project, entry.Name()))
+		}
+	}
+}
+
+// copyDir copies the regular files and directories under src into dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, dirMode)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
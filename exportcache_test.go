@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExportEntitiesConcurrency(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	setGlobal(t, &entityConcurrency, 3)
+	runner.envs = []string{"prod"}
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if args[1] == "list" {
+			return "[]", "", nil
+		}
+
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		if args[0] == "kvms" && !slices.Contains(args, "-e") {
+			return "", `{"error": {"code": 500, "message": "internal error", "status": "INTERNAL"}}`, errors.New("exit status 1")
+		}
+		return args[0] + " exported", "", writeExport(dir, args[0]+".json")
+	}
+
+	status := ProjectStatus{Project: "my-org"}
+	exportFolder := t.TempDir()
+	err := exportEntities(&status, "my-org", "token", exportFolder, testBucket, "2024-06-01")
+
+	var backupErr *BackupError
+	if !errors.As(err, &backupErr) || backupErr.Category != ErrExport {
+		t.Fatalf("exportEntities() error = %v, want an export error", err)
+	}
+	if !strings.Contains(err.Error(), "1 of 9 entity types (kvms:") {
+		t.Errorf("error = %q, want only kvms to fail", err)
+	}
+	if maxInFlight < 2 || maxInFlight > 3 {
+		t.Errorf("max concurrent exports = %d, want 2-3", maxInFlight)
+	}
+
+	// The units that succeeded are cached for the retry
+	done, err := os.ReadDir(filepath.Join(exportCacheDir("my-org", "2024-06-01"), "done"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 8 {
+		t.Errorf("%d units cached, want 8", len(done))
+	}
+}
+
+func TestExportEntitiesEnvFolders(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	runner.envs = []string{"prod", "test"}
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		switch {
+		case slices.Equal(args[:2], []string{"apis", "list"}) && slices.Contains(args, "prod"):
+			return `{"deployments": [{"apiProxy": "hello", "revision": "3"}]}`, "", nil
+		case args[1] == "list":
+			return "[]", "", nil
+		}
+		return "", "", writeExport(dir, args[0]+".json")
+	}
+
+	status := ProjectStatus{Project: "my-org"}
+	exportFolder := t.TempDir()
+	if err := exportEntities(&status, "my-org", "token", exportFolder, testBucket, "2024-06-01"); err != nil {
+		t.Fatalf("exportEntities() = %v", err)
+	}
+	for _, path := range []string{"apis/apis.json", "kvms/kvms.json", "env/prod/targetservers/targetservers.json", "env/test/kvms/kvms.json", "env/prod/proxies/hello.json"} {
+		if _, err := os.Stat(filepath.Join(exportFolder, path)); err != nil {
+			t.Errorf("export has no %s", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(exportFolder, "targetservers-prod")); err == nil {
+		t.Error("export has targetservers-prod/")
+	}
+
+	counts, err := countExportedEntities(exportFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["env/prod/targetservers"] != 1 || counts["env/test/kvms"] != 1 || counts["apis"] != 1 {
+		t.Errorf("countExportedEntities() = %v, want per-environment counts", counts)
+	}
+	if _, ok := counts["env"]; ok {
+		t.Errorf("countExportedEntities() = %v, counted env/ itself", counts)
+	}
+}
+
+func TestCheckExportCacheRoot(t *testing.T) {
+	base := t.TempDir()
+	if err := checkExportCacheRoot(filepath.Join(base, "new", "cache")); err != nil {
+		t.Errorf("checkExportCacheRoot() for a new directory = %v", err)
+	}
+
+	shared := filepath.Join(base, "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Mkdir is subject to the umask, so set the mode explicitly
+	if err := os.Chmod(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExportCacheRoot(shared); err == nil || !strings.Contains(err.Error(), "mode 0777") {
+		t.Errorf("checkExportCacheRoot() for a 0777 directory = %v, want a mode error", err)
+	}
+
+	// A symlink planted where the cache should be is refused even though
+	// its target would pass
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(filepath.Join(base, "new"), link); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExportCacheRoot(link); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("checkExportCacheRoot() for a symlink = %v, want a symlink error", err)
+	}
+}
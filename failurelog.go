@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// failuresPrefix is the bucket prefix failure logs are uploaded under.
+const failuresPrefix = "_failures"
+
+var uploadFailureLogs bool
+
+// saveFailureLog writes apigeecli's full output for a failed export next to
+// the main log file and, if enabled, uploads it to the bucket. It returns
+// where the log can be fetched from, or "" if it couldn't be saved.
+func saveFailureLog(gcsBucket, project, date string, stdout, stderr []byte) string {
+	name := fmt.Sprintf("failure-%s-%s.log", project, date)
+	localPath := filepath.Join(filepath.Dir(logFilePath), name)
+
+	content := fmt.Sprintf("=== stdout ===\n%s\n=== stderr ===\n%s\n", stdout, stderr)
+	if err := os.WriteFile(localPath, []byte(content), 0600); err != nil {
+		log.Printf("Failed to write failure log: %v\n", err)
+		return ""
+	}
+	log.Printf("Saved apigeecli output for %s to %s\n", project, localPath)
+
+	if !uploadFailureLogs {
+		return localPath
+	}
+
+	objectName := objectKey(failuresPrefix, name)
+	if _, err := uploadFile(gcsBucket, objectName, localPath, WriteOptions{ContentType: "text/plain"}); err != nil {
+		log.Printf("Failed to upload failure log: %v\n", err)
+		return localPath
+	}
+	return fmt.Sprintf("gs://%s/%s", gcsBucket, objectName)
+}
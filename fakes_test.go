@@ -0,0 +1,449 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const testBucket = "test-bucket"
+
+// errDenied is what GCS returns for a request the caller may not make.
+var errDenied = &googleapi.Error{Code: http.StatusForbidden, Message: "access denied"}
+
+// fakeRunner stands in for external programs. zip is implemented with
+// archive/zip; apigeecli calls are answered by the apigeecli func.
+type fakeRunner struct {
+	mu    sync.Mutex
+	calls [][]string
+
+	// apigeecli handles an apigeecli run in dir, writing any exported files
+	// there, and returns its stdout, stderr and exit error.
+	apigeecli func(dir string, args []string) (string, string, error)
+	// envs answers apigeecli environments list, so handlers only deal
+	// with the exports.
+	envs []string
+
+	// hook handles a hook's shell command, run with the variables in env,
+	// and returns its output and exit error.
+	hook func(env []string, command string) (string, error)
+
+	// tokens are the tokens apigeecli runs found in their token cache.
+	tokens []string
+}
+
+func (r *fakeRunner) Run(ctx context.Context, dir string, stdout, stderr io.Writer, name string, args ...string) error {
+	// env HOME=DIR apigeecli ARGS... runs apigeecli with the token cached in DIR
+	if name == "env" && len(args) > 1 && args[1] == "apigeecli" {
+		token := cachedToken(strings.TrimPrefix(args[0], "HOME="))
+		name, args = "apigeecli", args[2:]
+		r.mu.Lock()
+		r.tokens = append(r.tokens, token)
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, append([]string{name}, args...))
+	r.mu.Unlock()
+
+	switch name {
+	case "zip":
+		// zip [options] ZIPFILE . -i *
+		return fakeZip(dir, args[len(args)-4])
+	case "apigeecli":
+		if len(args) > 1 && args[0] == "environments" && args[1] == "list" {
+			return json.NewEncoder(stdout).Encode(append([]string{}, r.envs...))
+		}
+		if r.apigeecli == nil {
+			return fmt.Errorf("unexpected apigeecli %s", strings.Join(args, " "))
+		}
+		out, errOut, err := r.apigeecli(dir, args)
+		io.WriteString(stdout, out)
+		io.WriteString(stderr, errOut)
+		if ctx.Err() != nil {
+			// A real program would have been killed
+			return ctx.Err()
+		}
+		return err
+	case "env":
+		// env NAME=VALUE... sh -c COMMAND
+		i := slices.Index(args, "sh")
+		if r.hook == nil || i < 0 {
+			return fmt.Errorf("unexpected env %s", strings.Join(args, " "))
+		}
+		out, err := r.hook(args[:i], args[i+2])
+		io.WriteString(stdout, out)
+		return err
+	}
+	return fmt.Errorf("unexpected command %s", name)
+}
+
+// cachedToken returns the token in apigeecli's token cache under home, or
+// "" if there is none.
+func cachedToken(home string) string {
+	var config struct {
+		Token string `json:"token"`
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".apigeecli", "config.json"))
+	if err != nil || json.Unmarshal(data, &config) != nil {
+		return ""
+	}
+	return config.Token
+}
+
+// commands returns the names of the programs run so far.
+func (r *fakeRunner) commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for _, call := range r.calls {
+		names = append(names, call[0])
+	}
+	return names
+}
+
+func fakeZip(dir, zipFile string) error {
+	if !filepath.IsAbs(zipFile) {
+		zipFile = filepath.Join(dir, zipFile)
+	}
+	out, err := os.Create(zipFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	archive := zip.NewWriter(out)
+	err = filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || path == zipFile {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		w, err := archive.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// writeExport writes files, given as paths relative to dir, the way an
+// apigeecli export would. Runs without a directory, such as apigeecli
+// --version or a listing, export nothing, so nothing is written into the
+// package directory the tests run in.
+func writeExport(dir string, files ...string) error {
+	if dir == "" {
+		return nil
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memStorage is an in-memory Storage with GCS's error conventions.
+type memStorage struct {
+	mu         sync.Mutex
+	objects    map[string]memObject
+	generation int64
+	lifecycles map[string]storage.Lifecycle // by bucket
+	metagen    int64
+
+	// fail, if set, is consulted before each operation ("stat", "list",
+	// "open", "write", "delete", "sign" or "lifecycle") and its error
+	// returned instead.
+	fail func(op, bucket, name string) error
+}
+
+type memObject struct {
+	data       []byte
+	generation int64
+	metadata   map[string]string
+	kmsKeyName string
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string]memObject{}, lifecycles: map[string]storage.Lifecycle{}}
+}
+
+func memKey(bucket, name string) string {
+	return bucket + "/" + name
+}
+
+func (s *memStorage) injected(op, bucket, name string) error {
+	if s.fail == nil {
+		return nil
+	}
+	return s.fail(op, bucket, name)
+}
+
+// put stores an object directly, bypassing fail.
+func (s *memStorage) put(bucket, name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.objects[memKey(bucket, name)] = memObject{data: data, generation: s.generation}
+}
+
+// metadata returns an object's metadata, bypassing fail.
+func (s *memStorage) metadata(bucket, name string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[memKey(bucket, name)].metadata
+}
+
+// has reports whether an object exists, bypassing fail.
+func (s *memStorage) has(bucket, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[memKey(bucket, name)]
+	return ok
+}
+
+func (s *memStorage) Stat(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	if err := s.injected("stat", bucket, name); err != nil {
+		return ObjectInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[memKey(bucket, name)]
+	if !ok {
+		return ObjectInfo{}, storage.ErrObjectNotExist
+	}
+	return ObjectInfo{Name: name, Size: int64(len(obj.data)), Generation: obj.generation, KMSKeyName: obj.kmsKeyName, Metadata: obj.metadata}, nil
+}
+
+func (s *memStorage) List(ctx context.Context, bucket, prefix, delimiter string) ([]ObjectInfo, error) {
+	if err := s.injected("list", bucket, prefix); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var objects []ObjectInfo
+	prefixes := map[string]bool{}
+	for key, obj := range s.objects {
+		name, ok := strings.CutPrefix(key, bucket+"/")
+		if !ok || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				prefixes[name[:len(prefix)+i+len(delimiter)]] = true
+				continue
+			}
+		}
+		objects = append(objects, ObjectInfo{Name: name, Size: int64(len(obj.data)), Generation: obj.generation})
+	}
+	for p := range prefixes {
+		objects = append(objects, ObjectInfo{Prefix: p})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name+objects[i].Prefix < objects[j].Name+objects[j].Prefix
+	})
+	return objects, nil
+}
+
+func (s *memStorage) Open(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error) {
+	if err := s.injected("open", bucket, name); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[memKey(bucket, name)]
+	if !ok {
+		return nil, ObjectInfo{}, storage.ErrObjectNotExist
+	}
+	info := ObjectInfo{Name: name, Size: int64(len(obj.data)), Generation: obj.generation}
+	return io.NopCloser(bytes.NewReader(obj.data)), info, nil
+}
+
+func (s *memStorage) Write(ctx context.Context, bucket, name string, r io.Reader, opts WriteOptions) (int64, error) {
+	if err := s.injected("write", bucket, name); err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, exists := s.objects[memKey(bucket, name)]
+	if (opts.DoesNotExist && exists) || (opts.GenerationMatch != 0 && existing.generation != opts.GenerationMatch) {
+		return 0, &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "precondition failed"}
+	}
+	s.generation++
+	s.objects[memKey(bucket, name)] = memObject{data: data, generation: s.generation, metadata: opts.Metadata, kmsKeyName: memKMSKeyVersion()}
+	return int64(len(data)), nil
+}
+
+// memKMSKeyVersion is the key version GCS would report for an object written
+// with kmsKeyName.
+func memKMSKeyVersion() string {
+	if kmsKeyName == "" {
+		return ""
+	}
+	return kmsKeyName + "/cryptoKeyVersions/1"
+}
+
+func (s *memStorage) Delete(ctx context.Context, bucket, name string) error {
+	if err := s.injected("delete", bucket, name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[memKey(bucket, name)]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	delete(s.objects, memKey(bucket, name))
+	return nil
+}
+
+func (s *memStorage) SignedURL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	if err := s.injected("sign", bucket, name); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://storage.test/%s/%s?expires=%s", bucket, name, ttl), nil
+}
+
+func (s *memStorage) Lifecycle(ctx context.Context, bucket string) (storage.Lifecycle, int64, error) {
+	if err := s.injected("lifecycle", bucket, ""); err != nil {
+		return storage.Lifecycle{}, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lifecycles[bucket], s.metagen, nil
+}
+
+func (s *memStorage) SetLifecycle(ctx context.Context, bucket string, lifecycle storage.Lifecycle, metageneration int64) error {
+	if err := s.injected("lifecycle", bucket, ""); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if metageneration != s.metagen {
+		return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "metageneration mismatch"}
+	}
+	s.metagen++
+	s.lifecycles[bucket] = lifecycle
+	return nil
+}
+
+// setGlobal sets *p to value for the rest of the test.
+func setGlobal[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+// setupBackupTest points the backup at a fake runner and in-memory storage
+// with a single destination, and keeps all local files in temp directories.
+func setupBackupTest(t *testing.T) (*fakeRunner, *memStorage) {
+	t.Helper()
+	runner := &fakeRunner{}
+	store := newMemStorage()
+	setGlobal[CommandRunner](t, &commandRunner, runner)
+	setGlobal[Storage](t, &objectStore, store)
+	setGlobal(t, &destinations, []string{testBucket})
+	setGlobal(t, &destinationPolicy, destinationPolicyAll)
+	setGlobal(t, &runDir, t.TempDir())
+	setGlobal(t, &logFilePath, filepath.Join(t.TempDir(), "apigee.log"))
+	setGlobal(t, &exportCacheRoot, t.TempDir())
+	setGlobal(t, &ignoredStatuses, map[string]bool{"FAILED_PRECONDITION": true})
+	setGlobal(t, &deletedBackups, map[string]bool{})
+	setGlobal(t, &dateOverride, "")
+	setGlobal(t, &minKeepBackups, 0)
+	setGlobal(t, &sinceLastSuccess, false)
+	setGlobal(t, &manageLifecycle, false)
+	setGlobal(t, &appliedRetention, 0)
+	setGlobal(t, &appliedEnvRetention, nil)
+	setGlobal(t, &retentionRules, nil)
+	setGlobal(t, &projectLabels, map[string]map[string]string{})
+	setGlobal(t, &confirmRetention, false)
+	setGlobal(t, &deleteBackoff, 0)
+	setGlobal(t, &listBackoff, 0)
+	setGlobal(t, &rateLimitBackoff, 0)
+	setGlobal(t, &objectPrefix, "")
+	setGlobal(t, &kmsKeyName, "")
+	setGlobal(t, &notifyIncludeLinks, false)
+	setGlobal(t, &notifySummaryEvery, 0)
+	setGlobal(t, &notifyOnRecovery, false)
+	setGlobal(t, &dedupeFailures, false)
+	setGlobal(t, &failureHistory, nil)
+	setGlobal(t, &showProgress, false)
+	setGlobal(t, &maxArchiveSize, 0)
+	setGlobal(t, &exportTimeout, 0)
+	setGlobal(t, &maxRuntime, 0)
+	setGlobal(t, &runStart, time.Now())
+	setGlobal(t, &signedURLTTL, 0)
+	setGlobal(t, &uniqueKeys, false)
+	setGlobal(t, &dedupe, false)
+	setGlobal(t, &forceOverwrite, false)
+	setGlobal(t, &resumeExport, false)
+	setGlobal(t, &resumeUpload, false)
+	setGlobal(t, &excludedGlobs, nil)
+	setGlobal(t, &redactCredentials, false)
+	setGlobal(t, &exportAnalytics, false)
+	setGlobal(t, &exportEnvGroups, false)
+	setGlobal(t, &exportOrgKVMs, false)
+	setGlobal(t, &excludedEntities, map[string]bool{})
+	setGlobal(t, &warnOnEmptyOrg, false)
+	setGlobal(t, &failOnEmptyOrg, false)
+	setGlobal(t, &warnGrowthPct, 0.0)
+	setGlobal(t, &minFreeSpace, 0)
+	setGlobal(t, &preHook, "")
+	setGlobal(t, &postHook, "")
+	setGlobal(t, &hookScope, hookScopeProject)
+	setGlobal(t, &preHookFailure, hookFailureFail)
+	setGlobal(t, &apigeecliVersion, "")
+	setGlobal(t, &runSlice, nil)
+	setGlobal(t, &projectAliases, map[string]string{})
+	setGlobal(t, &aliasKeys, false)
+	setGlobal(t, &projectBuckets, map[string]string{})
+	setGlobal(t, &uploadFailureLogs, false)
+	setGlobal(t, &noClean, false)
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	t.Cleanup(func() {
+		if _, err := os.Stat("proxies"); err == nil {
+			t.Error("an apigeecli fake wrote an export into the package directory")
+		}
+	})
+	return runner, store
+}
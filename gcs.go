@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// defaultChunkSizeMB matches the storage client's own default. Each chunk is
+// retried on its own, so a dropped connection resumes from the last chunk
+// rather than restarting the whole upload.
+const defaultChunkSizeMB = 16
+
+var gcsClient *storage.Client
+var uploadChunkSize = defaultChunkSizeMB * 1024 * 1024
+
+// billingProject is billed for requests to requester-pays buckets.
+var billingProject string
+
+// objectPrefix namespaces every object key, so several teams can share a
+// bucket. Empty keeps keys at the bucket root.
+var objectPrefix string
+
+// minKeepBackups is the number of newest backups per org that cleanup
+// always retains, whatever their age.
+var minKeepBackups int
+
+// sinceLastSuccess only lets cleanup delete an org's old backups once the
+// bucket holds its backup for the run's date, so a run after failed ones
+// never prunes the newest good copy.
+var sinceLastSuccess bool
+
+// newGCSClient creates the storage client, using endpoint instead of the
+// default when set, e.g. for Private Service Connect.
+func newGCSClient(ctx context.Context, endpoint string) error {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	gcsClient = client
+	objectStore = newCachingStorage(gcsStorage{client: client})
+	return nil
+}
+
+// probeBucket checks that gcsBucket can be listed with the current endpoint
+// and billing settings, so misconfiguration fails the run before any export.
+func probeBucket(gcsBucket string) error {
+	_, err := objectStore.List(context.Background(), gcsBucket, "_probe/", "/")
+	if err == nil {
+		return nil
+	}
+	var apiErr *googleapi.Error
+	if billingProject == "" && errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "requester pays") {
+		return fmt.Errorf("gs://%s is a requester-pays bucket, set --billing-project: %w", gcsBucket, err)
+	}
+	return fmt.Errorf("gs://%s: %w", gcsBucket, err)
+}
+
+// kmsKeyName is the Cloud KMS key every object is written with, so it is
+// encrypted with a customer-managed key instead of Google's.
+var kmsKeyName string
+
+// kmsKeyPattern is the resource name of a Cloud KMS key.
+var kmsKeyPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// kmsProbeName is the object written to check that kmsKeyName can be used.
+const kmsProbeName = "kms-key"
+
+// probeKMSKey writes, checks and deletes a small object in gcsBucket, so a
+// key that doesn't exist or that the bucket's service agent can't use
+// fails the run before anything is exported, rather than every upload.
+func probeKMSKey(gcsBucket string) error {
+	ctx := context.Background()
+	name := objectKey("_probe", kmsProbeName)
+	if _, err := objectStore.Write(ctx, gcsBucket, name, strings.NewReader("kms probe"), WriteOptions{ContentType: "text/plain"}); err != nil {
+		return fmt.Errorf("gs://%s can't be written with --kms-key %s; the bucket's Cloud Storage service agent needs roles/cloudkms.cryptoKeyEncrypterDecrypter on it: %w", gcsBucket, kmsKeyName, err)
+	}
+	info, err := objectStore.Stat(ctx, gcsBucket, name)
+	if err == nil && !strings.HasPrefix(info.KMSKeyName, kmsKeyName) {
+		err = fmt.Errorf("object is encrypted with %q, not %s", info.KMSKeyName, kmsKeyName)
+	}
+	if deleteErr := objectStore.Delete(ctx, gcsBucket, name); deleteErr != nil && !errors.Is(deleteErr, storage.ErrObjectNotExist) {
+		log.Printf("Failed to delete gs://%s/%s: %v\n", gcsBucket, name, deleteErr)
+	}
+	if err != nil {
+		return fmt.Errorf("gs://%s: %w", gcsBucket, err)
+	}
+	return nil
+}
+
+// probeDestination probes a bucket backups are stored in, and its use of
+// --kms-key if set.
+func probeDestination(gcsBucket string) error {
+	if err := probeBucket(gcsBucket); err != nil {
+		return fmt.Errorf("Failed to access bucket: %w", err)
+	}
+	if kmsKeyName != "" {
+		if err := probeKMSKey(gcsBucket); err != nil {
+			return fmt.Errorf("Failed to use --kms-key: %w", err)
+		}
+	}
+	return nil
+}
+
+// objectKey joins elem into an object key under objectPrefix.
+func objectKey(elem ...string) string {
+	return path.Join(append([]string{objectPrefix}, elem...)...)
+}
+
+// uniqueKeys adds this run's time to backup names, so every run's backup
+// is kept under its own key and a latest pointer names the newest.
+var uniqueKeys bool
+
+// latestPointerName is the object in each env folder that holds the key of
+// its newest backup with --unique-keys.
+const latestPointerName = "latest"
+
+// backupFileName returns the file name of env's backup for date. With
+// uniqueKeys it ends in this run's start time, e.g. backup_my-org_2024-06-01_020000.zip.
+func backupFileName(env, date string) string {
+	if uniqueKeys {
+		return fmt.Sprintf("backup_%s_%s_%s.zip", env, date, runStart.Format("150405"))
+	}
+	return fmt.Sprintf("backup_%s_%s.zip", env, date)
+}
+
+// backupObjectName returns the object key this run's backup for env and date is stored under.
+func backupObjectName(env, date string) string {
+	return objectKey(env, backupFileName(env, date))
+}
+
+// backupExistsInGCS reports whether a backup for env and date exists. It
+// looks in env's folder listing, which cleanup later reuses. Only a listing
+// without the backup means false; a failed listing, such as a permission
+// error, is returned so the caller doesn't mistake it for a missing backup.
+// With uniqueKeys a backup from any run that day counts.
+func backupExistsInGCS(gcsBucket, date, env string) (bool, error) {
+	if uniqueKeys {
+		name, err := latestBackup(gcsBucket, env, date)
+		return name != "", err
+	}
+	objects, err := listEnv(gcsBucket, env)
+	if err != nil {
+		return false, err
+	}
+	name := backupObjectName(env, date)
+	for _, attrs := range objects {
+		// With --dedupe the day may be stored as a pointer instead, and
+		// with --max-archive-size as the index of a split archive
+		if attrs.Name == name || attrs.Name == name+pointerSuffix || attrs.Name == name+partsSuffix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// latestBackup returns the key of the newest backup of env for date, with
+// or without a --unique-keys suffix, or "" if there is none. A split
+// archive is returned as its index.
+func latestBackup(gcsBucket, env, date string) (string, error) {
+	objects, err := listEnv(gcsBucket, env)
+	if err != nil {
+		return "", err
+	}
+	var latest string
+	for _, attrs := range objects {
+		if isArchivePart(attrs.Name) {
+			continue
+		}
+		backupDate, err := parseBackupDate(attrs.Name, env)
+		// Suffixes are times of day, so the newest sorts last
+		if err == nil && backupDate.Format(dateLayout) == date && attrs.Name > latest {
+			latest = attrs.Name
+		}
+	}
+	return latest, nil
+}
+
+// listEnv returns the objects directly under env's folder. Within a run the
+// listing is cached by cachingStorage and shared by every caller.
+func listEnv(gcsBucket, env string) ([]ObjectInfo, error) {
+	return objectStore.List(context.Background(), gcsBucket, objectKey(env)+"/", "/")
+}
+
+// updateLatestPointer points env's latest object at name, unless it already
+// names a newer backup, e.g. after a backfill with --date.
+func updateLatestPointer(gcsBucket, env, name string) error {
+	pointer := objectKey(env, latestPointerName)
+	opts := WriteOptions{ContentType: "text/plain", DoesNotExist: true}
+	reader, info, err := objectStore.Open(context.Background(), gcsBucket, pointer)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+	case err != nil:
+		return err
+	default:
+		current, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(current)) >= name {
+			return nil
+		}
+		opts = WriteOptions{ContentType: "text/plain", GenerationMatch: info.Generation}
+	}
+	_, err = objectStore.Write(context.Background(), gcsBucket, pointer, strings.NewReader(name+"\n"), opts)
+	return err
+}
+
+// isAccessDenied reports whether err is a GCS authentication or permission error.
+func isAccessDenied(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden
+	}
+	return false
+}
+
+// forceOverwrite backs up and uploads even if today's backup already exists,
+// replacing it.
+var forceOverwrite bool
+
+// uploadToGCS uploads a backup zip for env and returns the number of bytes
+// written. Unless forceOverwrite is set the upload only succeeds if the
+// object doesn't exist yet, so a concurrent run's backup is never replaced.
+// A zip larger than maxArchiveSize is uploaded in parts.
+func uploadToGCS(gcsBucket, sourceFile, env string) (int64, error) {
+	opts := WriteOptions{ContentType: "application/zip", DoesNotExist: !forceOverwrite}
+	if apigeecliVersion != "" {
+		opts.Metadata = map[string]string{apigeecliVersionMetadata: apigeecliVersion}
+	}
+	name := objectKey(env, filepath.Base(sourceFile))
+	if splitSuffix(sourceFile) != "" {
+		return uploadParts(gcsBucket, name, sourceFile, opts)
+	}
+	return uploadFile(gcsBucket, name, sourceFile, opts)
+}
+
+// uploadFile uploads sourceFile to the object name as a resumable upload
+// and returns the number of bytes written.
+func uploadFile(gcsBucket, name, sourceFile string, opts WriteOptions) (int64, error) {
+	uploadSem.acquire()
+	defer uploadSem.release()
+
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if !showProgress {
+		return objectStore.Write(context.Background(), gcsBucket, name, file, opts)
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	progress := newProgressReader(file, "gs://"+gcsBucket+"/"+name, size)
+	written, err := objectStore.Write(context.Background(), gcsBucket, name, progress, opts)
+	progress.finish(err)
+	return written, err
+}
+
+// cleanupOldBackups deletes backups for env that fall outside the retention
+// period. It returns the total size of the objects still stored for env, how
+// many backups were deleted and the gs:// paths of any that couldn't be
+// deleted even after retrying. With sinceLastSuccess nothing is deleted
+// unless the backup for the run's date is stored.
+func cleanupOldBackups(gcsBucket string, retentionDays int, env string) (int64, int, []string, error) {
+	// A retention below one day would delete the backup just uploaded
+	if retentionDays < 1 {
+		return 0, 0, nil, fmt.Errorf("invalid retention of %d days", retentionDays)
+	}
+
+	// Calculate cutoff date
+	cutoffDate := time.Now().AddDate(0, 0, -retentionDays)
+	current := fmt.Sprintf("gs://%s/%s", gcsBucket, backupObjectName(env, backupDate()))
+
+	// List objects directly under the env prefix
+	objects, err := listEnv(gcsBucket, env)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to list GCS bucket: %w", err)
+	}
+	var gcsPaths []string
+	sizes := make(map[string]int64)
+	for _, attrs := range objects {
+		if attrs.Name == "" {
+			continue
+		}
+		gcsPath := fmt.Sprintf("gs://%s/%s", gcsBucket, attrs.Name)
+		if attrs.Name == objectKey(env, latestPointerName) {
+			sizes[gcsPath] = attrs.Size
+			continue
+		}
+		gcsPaths = append(gcsPaths, gcsPath)
+		sizes[gcsPath] = attrs.Size
+	}
+	if sinceLastSuccess && !hasBackupFor(gcsPaths, env, backupDate()) {
+		log.Printf("Not deleting old backups in gs://%s for %s, it has no backup for %s yet (--since-last-success)\n", gcsBucket, env, backupDate())
+		return totalSize(sizes), 0, nil, nil
+	}
+
+	// Archives that pointers being kept refer to must stay, however old
+	toDelete := selectBackupsToDelete(gcsPaths, cutoffDate, env, minKeepBackups)
+	referenced, err := referencedBackups(gcsBucket, gcsPaths, toDelete)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	// Delete old backups
+	var deleted int
+	var failed []string
+	for _, gcsPath := range toDelete {
+		// Never delete this run's backup, whatever the dates say
+		if backupBase(gcsPath) == current {
+			log.Printf("Not deleting %s, it is this run's backup\n", gcsPath)
+			continue
+		}
+		if referenced[backupBase(gcsPath)] {
+			log.Printf("Not deleting %s, a newer backup points to it\n", gcsPath)
+			continue
+		}
+		err := deleteWithRetry(gcsBucket, strings.TrimPrefix(gcsPath, fmt.Sprintf("gs://%s/", gcsBucket)))
+		switch {
+		case errors.Is(err, storage.ErrObjectNotExist):
+			log.Printf("Old backup %s was already deleted\n", gcsPath)
+			delete(sizes, gcsPath)
+			recordDeletedBackup(gcsPath)
+		case isAccessDenied(err):
+			return 0, deleted, failed, fmt.Errorf("failed to delete old backup %s: %w", gcsPath, err)
+		case err != nil:
+			// Reported in the summary, and tried again on the next run
+			log.Printf("Failed to delete old backup %s: %v\n", gcsPath, err)
+			failed = append(failed, gcsPath)
+		default:
+			log.Printf("Deleted old backup %s\n", gcsPath)
+			delete(sizes, gcsPath)
+			recordDeletedBackup(gcsPath)
+			// A split archive counts once, for its index
+			if !isArchivePart(gcsPath) {
+				deleted++
+			}
+		}
+	}
+
+	return totalSize(sizes), deleted, failed, nil
+}
+
+// hasBackupFor reports whether gcsPaths has a stored backup of env for
+// date: an archive, the index of a split one or a pointer, from any run
+// that day with --unique-keys. Parts alone are an unfinished upload.
+func hasBackupFor(gcsPaths []string, env, date string) bool {
+	return slices.ContainsFunc(gcsPaths, func(gcsPath string) bool {
+		backupDate, err := parseBackupDate(gcsPath, env)
+		return err == nil && !isArchivePart(gcsPath) && backupDate.Format(dateLayout) == date
+	})
+}
+
+// totalSize returns the sum of sizes.
+func totalSize(sizes map[string]int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// referencedBackups returns the gs:// paths of the archives referred to by
+// the pointers among gcsPaths that aren't in toDelete, without any
+// --max-archive-size suffix.
+func referencedBackups(gcsBucket string, gcsPaths, toDelete []string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, gcsPath := range gcsPaths {
+		if !strings.HasSuffix(gcsPath, pointerSuffix) || slices.Contains(toDelete, gcsPath) {
+			continue
+		}
+		target, err := resolveBackup(gcsBucket, strings.TrimPrefix(gcsPath, fmt.Sprintf("gs://%s/", gcsBucket)))
+		if err != nil {
+			return nil, err
+		}
+		referenced[fmt.Sprintf("gs://%s/%s", gcsBucket, backupBase(target))] = true
+	}
+	return referenced, nil
+}
+
+// selectBackupsToDelete returns the backups older than cutoffDate, except
+// that the minKeep newest backups are always kept regardless of age, so a
+// long gap in backups never leaves an org with no copies at all. The parts
+// and index of a split archive count as one backup.
+func selectBackupsToDelete(gcsPaths []string, cutoffDate time.Time, env string, minKeep int) []string {
+	type backup struct {
+		gcsPath string
+		date    time.Time
+	}
+
+	var backups []backup
+	for _, gcsPath := range gcsPaths {
+		date, err := parseBackupDate(gcsPath, env)
+		if err != nil {
+			log.Printf("Failed to parse date from path %s: %v\n", gcsPath, err)
+			continue
+		}
+		backups = append(backups, backup{gcsPath: gcsPath, date: date})
+	}
+
+	// Newest first, so the first minKeep backups are the ones to keep
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].date.After(backups[j].date)
+	})
+
+	var toDelete []string
+	kept := make(map[string]bool)
+	for _, b := range backups {
+		base := backupBase(b.gcsPath)
+		if kept[base] || len(kept) < minKeep {
+			kept[base] = true
+			continue
+		}
+		if b.date.Before(cutoffDate) {
+			toDelete = append(toDelete, b.gcsPath)
+		}
+	}
+	return toDelete
+}
+
+// parseBackupDate extracts the date from a backup path of the form
+// gs://bucket/env/backup_<env>_YYYY-MM-DD.zip, or with a --unique-keys
+// suffix, backup_<env>_YYYY-MM-DD_HHMMSS.zip. A --dedupe pointer, the same
+// name ending in .zip.ref, is dated like the backup it stands for, as are
+// the index and parts of a split archive.
+func parseBackupDate(gcsPath, env string) (time.Time, error) {
+	base := filepath.Base(backupBase(gcsPath))
+	prefix := fmt.Sprintf("backup_%s_", env)
+	if !strings.HasPrefix(base, prefix) || !strings.HasSuffix(base, ".zip") {
+		return time.Time{}, fmt.Errorf("not a backup for %s", env)
+	}
+	date, _, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(base, prefix), ".zip"), "_")
+	return time.Parse(dateLayout, date)
+}
+
+// listBackupEnvs returns the env prefixes directly under objectPrefix.
+func listBackupEnvs(gcsBucket string) ([]string, error) {
+	var listPrefix string
+	if objectPrefix != "" {
+		listPrefix = objectPrefix + "/"
+	}
+	objects, err := objectStore.List(context.Background(), gcsBucket, listPrefix, "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GCS bucket: %w", err)
+	}
+	var envs []string
+	for _, attrs := range objects {
+		if attrs.Prefix != "" {
+			envs = append(envs, strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, listPrefix), "/"))
+		}
+	}
+	return envs, nil
+}
+
+// listBackups returns the names of the backup objects stored for env.
+func listBackups(gcsBucket, env string) ([]string, error) {
+	backupPrefix := objectKey(env, fmt.Sprintf("backup_%s_", env))
+	objects, err := objectStore.List(context.Background(), gcsBucket, backupPrefix, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GCS bucket: %w", err)
+	}
+	var names []string
+	for _, attrs := range objects {
+		names = append(names, attrs.Name)
+	}
+	return names, nil
+}
+
+// deleteAttempts and deleteBackoff control how often a failed delete is
+// retried; the wait doubles after each attempt.
+const deleteAttempts = 4
+
+var deleteBackoff = time.Second
+
+// deleteWithRetry deletes an object, retrying transient failures with
+// exponential backoff. Not found and access denied are returned at once,
+// since retrying can't change them.
+func deleteWithRetry(gcsBucket, name string) error {
+	wait := deleteBackoff
+	for attempt := 1; ; attempt++ {
+		err := deleteObject(gcsBucket, name)
+		if err == nil || errors.Is(err, storage.ErrObjectNotExist) || isAccessDenied(err) || attempt == deleteAttempts {
+			return err
+		}
+		log.Printf("Failed to delete gs://%s/%s (attempt %d of %d), retrying in %s: %v\n", gcsBucket, name, attempt, deleteAttempts, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func deleteObject(gcsBucket, name string) error {
+	uploadSem.acquire()
+	defer uploadSem.release()
+	return objectStore.Delete(context.Background(), gcsBucket, name)
+}
+
+// parseGCSURL splits a gs://bucket/object URL into its bucket and object name.
+func parseGCSURL(url string) (string, string, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(url, "gs://"), "/")
+	if !strings.HasPrefix(url, "gs://") || !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("invalid GCS URL %q, expected gs://bucket/object", url)
+	}
+	return bucket, object, nil
+}
+
+// openGCSObject opens a gs://bucket/object URL for reading.
+func openGCSObject(url string) (io.ReadCloser, error) {
+	bucket, object, err := parseGCSURL(url)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := objectStore.Open(context.Background(), bucket, object)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%s does not exist", url)
+	}
+	return reader, err
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBackupExistsInGCS(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   bool
+		statErr    error
+		wantExists bool
+		wantErr    bool
+	}{
+		{name: "exists", existing: true, wantExists: true},
+		{name: "not found", wantExists: false},
+		{name: "access denied", statErr: errDenied, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, store := setupBackupTest(t)
+			if tt.existing {
+				store.put(testBucket, backupObjectName("my-org", "2024-06-01"), []byte("backup"))
+			}
+			store.fail = func(op, bucket, name string) error { return tt.statErr }
+
+			exists, err := backupExistsInGCS(testBucket, "2024-06-01", "my-org")
+			if exists != tt.wantExists || (err != nil) != tt.wantErr {
+				t.Errorf("backupExistsInGCS() = %v, %v, want %v, error: %v", exists, err, tt.wantExists, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCleanupOldBackups(t *testing.T) {
+	now := time.Now()
+	oldName := backupObjectName("my-org", now.AddDate(0, 0, -60).Format(dateLayout))
+	newName := backupObjectName("my-org", now.Format(dateLayout))
+
+	tests := []struct {
+		name        string
+		deleteErr   error
+		failTimes   int // how many deletes fail with deleteErr; 0 means all
+		wantDeleted int
+		wantStored  int64
+		wantFailed  bool
+		wantErr     bool
+		wantRemain  bool
+	}{
+		{name: "deleted", wantDeleted: 1, wantStored: 3},
+		{
+			name:        "deleted on retry",
+			deleteErr:   errors.New("backend error"),
+			failTimes:   2,
+			wantDeleted: 1,
+			wantStored:  3,
+		},
+		{
+			// Someone else deleted it first; it is no longer stored either way
+			name:       "already deleted",
+			deleteErr:  storage.ErrObjectNotExist,
+			wantStored: 3,
+			wantRemain: true,
+		},
+		{name: "access denied", deleteErr: errDenied, wantErr: true, wantRemain: true},
+		{
+			// Failures that outlast the retries are reported and retried on the next run
+			name:       "transient failure",
+			deleteErr:  errors.New("backend error"),
+			wantStored: 6,
+			wantFailed: true,
+			wantRemain: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, store := setupBackupTest(t)
+			store.put(testBucket, oldName, []byte("old"))
+			store.put(testBucket, newName, []byte("new"))
+			var deletes int
+			store.fail = func(op, bucket, name string) error {
+				if op != "delete" {
+					return nil
+				}
+				deletes++
+				if tt.failTimes > 0 && deletes > tt.failTimes {
+					return nil
+				}
+				return tt.deleteErr
+			}
+
+			stored, deleted, failed, err := cleanupOldBackups(testBucket, 30, "my-org")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cleanupOldBackups() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !isAccessDenied(err) {
+				t.Errorf("error %v is not an access denied error", err)
+			}
+			if deleted != tt.wantDeleted || stored != tt.wantStored {
+				t.Errorf("cleanupOldBackups() = %d stored, %d deleted, want %d, %d", stored, deleted, tt.wantStored, tt.wantDeleted)
+			}
+			if wantFailed := []string{"gs://" + testBucket + "/" + oldName}; tt.wantFailed != slices.Equal(failed, wantFailed) {
+				t.Errorf("failed = %v, want reported: %v", failed, tt.wantFailed)
+			}
+			if got := store.has(testBucket, oldName); got != tt.wantRemain {
+				t.Errorf("old backup remains = %v, want %v", got, tt.wantRemain)
+			}
+			if !store.has(testBucket, newName) {
+				t.Error("backup within retention was deleted")
+			}
+		})
+	}
+}
+
+func TestCleanupRetentionBoundary(t *testing.T) {
+	_, store := setupBackupTest(t)
+	name := func(daysAgo int) string {
+		return backupObjectName("my-org", time.Now().AddDate(0, 0, -daysAgo).Format(dateLayout))
+	}
+	for _, daysAgo := range []int{0, 6, 7} {
+		store.put(testBucket, name(daysAgo), []byte("backup"))
+	}
+
+	// Retention of 7 days keeps today and the 6 days before it
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 7, "my-org"); err != nil || deleted != 1 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want 1 deleted", deleted, err)
+	}
+	if store.has(testBucket, name(7)) {
+		t.Error("backup from 7 days ago was kept")
+	}
+	if !store.has(testBucket, name(6)) || !store.has(testBucket, name(0)) {
+		t.Error("backup within the 7 days was deleted")
+	}
+
+	for _, retention := range []int{0, -1} {
+		if _, _, _, err := cleanupOldBackups(testBucket, retention, "my-org"); err == nil {
+			t.Errorf("cleanupOldBackups() with retention %d succeeded", retention)
+		}
+	}
+	if !store.has(testBucket, name(0)) {
+		t.Error("today's backup was deleted")
+	}
+}
+
+func TestCleanupKeepsThisRunsBackup(t *testing.T) {
+	_, store := setupBackupTest(t)
+	// A backfill whose date is already past retention
+	dateOverride = time.Now().AddDate(0, 0, -60).Format(dateLayout)
+	backfill := backupObjectName("my-org", dateOverride)
+	store.put(testBucket, backfill, []byte("backup"))
+
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 0 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want none deleted", deleted, err)
+	}
+	if !store.has(testBucket, backfill) {
+		t.Error("this run's backup was deleted")
+	}
+}
+
+func TestCleanupSinceLastSuccess(t *testing.T) {
+	for _, unique := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unique keys %t", unique), func(t *testing.T) {
+			runner, store := setupBackupTest(t)
+			sinceLastSuccess = true
+			uniqueKeys = unique
+			old := backupObjectName("my-org", time.Now().AddDate(0, 0, -60).Format(dateLayout))
+			store.put(testBucket, old, []byte("last good backup"))
+
+			// Without today's backup nothing is deleted, even after a failed export
+			if stored, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 0 || stored != 16 {
+				t.Fatalf("cleanupOldBackups() = %d stored, %d deleted, %v, want nothing deleted", stored, deleted, err)
+			}
+			runner.apigeecli = func(dir string, args []string) (string, string, error) {
+				return "", "", errors.New("exit status 1")
+			}
+			if status := backupProject(context.Background(), "my-org", testBucket, "token", 30); status.Status != "Failed" {
+				t.Fatalf("status = %q, want Failed", status.Status)
+			}
+			if !store.has(testBucket, old) {
+				t.Fatal("the last good backup was deleted without a backup for today")
+			}
+
+			// Parts of an unfinished upload aren't a backup for today
+			store.put(testBucket, partName(backupObjectName("my-org", backupDate()), 1), []byte("part"))
+			if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 0 {
+				t.Fatalf("cleanupOldBackups() with only a part for today = %d deleted, %v, want nothing deleted", deleted, err)
+			}
+
+			// Once today's backup is stored, retention applies as usual
+			runner.apigeecli = func(dir string, args []string) (string, string, error) {
+				return "", "", writeExport(dir, "proxies/a.zip")
+			}
+			status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+			if status.Status != "Complete" || status.DeletedBackups != 1 || store.has(testBucket, old) {
+				t.Errorf("status = %q (%s), %d deleted, want the old backup deleted", status.Status, status.Reason, status.DeletedBackups)
+			}
+
+			// A later run, such as --clean-only, still finds today's backup,
+			// although with unique keys it is named after another run
+			store.put(testBucket, old, []byte("last good backup"))
+			runStart = runStart.Add(time.Hour)
+			if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 1 || store.has(testBucket, old) {
+				t.Errorf("cleanupOldBackups() in a later run = %d deleted, %v, want the old backup deleted", deleted, err)
+			}
+		})
+	}
+}
+
+func TestSelectBackupsToDelete(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	path := func(date string) string {
+		return "gs://" + testBucket + "/" + backupObjectName("my-org", date)
+	}
+
+	tests := []struct {
+		name    string
+		dates   []string
+		minKeep int
+		want    []string
+	}{
+		{
+			name:  "older than cutoff",
+			dates: []string{"2024-05-01", "2024-06-02", "2024-05-15"},
+			want:  []string{"2024-05-15", "2024-05-01"},
+		},
+		{
+			name:    "min keep when all are past the cutoff",
+			dates:   []string{"2024-04-01", "2024-05-01", "2024-03-01", "2024-02-01"},
+			minKeep: 2,
+			want:    []string{"2024-03-01", "2024-02-01"},
+		},
+		{
+			name:  "backup dated exactly at the cutoff is kept",
+			dates: []string{"2024-06-01", "2024-05-31"},
+			want:  []string{"2024-05-31"},
+		},
+		{
+			name:    "min keep covers all",
+			dates:   []string{"2024-04-01", "2024-05-01"},
+			minKeep: 3,
+		},
+		{
+			name:    "min keep counts recent backups",
+			dates:   []string{"2024-06-10", "2024-05-01", "2024-04-01"},
+			minKeep: 2,
+			want:    []string{"2024-04-01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths, want []string
+			for _, date := range tt.dates {
+				paths = append(paths, path(date))
+			}
+			// Names that aren't backups are ignored
+			paths = append(paths, "gs://"+testBucket+"/my-org/notes.txt")
+			for _, date := range tt.want {
+				want = append(want, path(date))
+			}
+
+			got := selectBackupsToDelete(paths, cutoff, "my-org", tt.minKeep)
+			if !slices.Equal(got, want) {
+				t.Errorf("selectBackupsToDelete() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestObjectPrefix(t *testing.T) {
+	_, store := setupBackupTest(t)
+	objectPrefix = "team-a"
+
+	oldDate := time.Now().AddDate(0, 0, -60).Format(dateLayout)
+	ours := "team-a/my-org/backup_my-org_" + oldDate + ".zip"
+	theirs := "team-b/my-org/backup_my-org_" + oldDate + ".zip"
+	unprefixed := "my-org/backup_my-org_" + oldDate + ".zip"
+	for _, name := range []string{ours, theirs, unprefixed} {
+		store.put(testBucket, name, []byte("old"))
+	}
+
+	if got := backupObjectName("my-org", oldDate); got != ours {
+		t.Errorf("backupObjectName() = %q, want %q", got, ours)
+	}
+
+	envs, err := listBackupEnvs(testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(envs, []string{"my-org"}) {
+		t.Errorf("listBackupEnvs() = %v, want [my-org]", envs)
+	}
+
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 1 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want 1 deleted", deleted, err)
+	}
+	if store.has(testBucket, ours) {
+		t.Errorf("%s was not deleted", ours)
+	}
+	if !store.has(testBucket, theirs) || !store.has(testBucket, unprefixed) {
+		t.Error("cleanup deleted backups outside the prefix")
+	}
+}
+
+func TestUniqueKeys(t *testing.T) {
+	_, store := setupBackupTest(t)
+	uniqueKeys = true
+	setGlobal(t, &runStart, time.Date(2024, 6, 1, 14, 30, 5, 0, time.UTC))
+	dateOverride = "2024-06-01"
+
+	if got, want := backupObjectName("my-org", "2024-06-01"), "my-org/backup_my-org_2024-06-01_143005.zip"; got != want {
+		t.Fatalf("backupObjectName() = %q, want %q", got, want)
+	}
+
+	// An earlier run's backup that day, and one from before --unique-keys
+	earlier := "my-org/backup_my-org_2024-06-01_020000.zip"
+	store.put(testBucket, earlier, []byte("backup"))
+	store.put(testBucket, "my-org/backup_my-org_2024-05-31.zip", []byte("backup"))
+	if exists, err := backupExistsInGCS(testBucket, "2024-06-01", "my-org"); !exists || err != nil {
+		t.Errorf("backupExistsInGCS() = %v, %v, want true", exists, err)
+	}
+	for date, want := range map[string]string{"2024-06-01": earlier, "2024-05-31": "my-org/backup_my-org_2024-05-31.zip", "2024-05-30": ""} {
+		if got, err := latestBackup(testBucket, "my-org", date); got != want || err != nil {
+			t.Errorf("latestBackup(%s) = %q, %v, want %q", date, got, err, want)
+		}
+	}
+
+	readPointer := func() string {
+		reader, _, err := store.Open(context.Background(), testBucket, "my-org/latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(reader)
+		return strings.TrimSpace(string(data))
+	}
+	if err := updateLatestPointer(testBucket, "my-org", earlier); err != nil {
+		t.Fatal(err)
+	}
+	newest := backupObjectName("my-org", "2024-06-01")
+	if err := updateLatestPointer(testBucket, "my-org", newest); err != nil {
+		t.Fatal(err)
+	}
+	// A backfill doesn't move the pointer back
+	if err := updateLatestPointer(testBucket, "my-org", "my-org/backup_my-org_2024-05-31_090000.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPointer(); got != newest {
+		t.Errorf("latest = %q, want %q", got, newest)
+	}
+
+	// Retention parses the suffixed names and leaves the pointer alone
+	old := "my-org/backup_my-org_" + time.Now().AddDate(0, 0, -60).Format(dateLayout) + "_020000.zip"
+	store.put(testBucket, old, []byte("old"))
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 3650, "my-org"); err != nil || deleted != 0 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want none deleted", deleted, err)
+	}
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 3 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want 3 deleted", deleted, err)
+	}
+	if store.has(testBucket, old) || !store.has(testBucket, "my-org/latest") {
+		t.Error("cleanup kept the old suffixed backup or deleted the latest pointer")
+	}
+}
+
+func TestProbeKMSKey(t *testing.T) {
+	_, store := setupBackupTest(t)
+	kmsKeyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	if err := probeKMSKey(testBucket); err != nil {
+		t.Fatalf("probeKMSKey() = %v", err)
+	}
+	if store.has(testBucket, objectKey("_probe", kmsProbeName)) {
+		t.Error("probeKMSKey() left its probe object behind")
+	}
+
+	store.fail = func(op, bucket, name string) error {
+		if op == "write" {
+			return &googleapi.Error{Code: http.StatusForbidden, Message: "permission denied on KMS key"}
+		}
+		return nil
+	}
+	if err := probeKMSKey(testBucket); err == nil || !strings.Contains(err.Error(), "cryptoKeyEncrypterDecrypter") {
+		t.Errorf("probeKMSKey() with an unusable key = %v", err)
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	_, store := setupBackupTest(t)
+	var out strings.Builder
+	setGlobal(t, &progressOutput, io.Writer(&out))
+	setGlobal(t, &progressInterval, 0)
+	showProgress = true
+
+	file := filepath.Join(t.TempDir(), "my-org_2024-06-01.zip")
+	os.WriteFile(file, make([]byte, 3*1024), 0600)
+	if _, err := uploadFile(testBucket, "my-org/my-org_2024-06-01.zip", file, WriteOptions{}); err != nil {
+		t.Fatalf("uploadFile() = %v", err)
+	}
+	for _, want := range []string{"Uploading gs://" + testBucket + "/my-org/my-org_2024-06-01.zip: ", "of 3.0 KiB (", "Uploaded gs://" + testBucket + "/my-org/my-org_2024-06-01.zip: 3.0 KiB of 3.0 KiB (100%)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("progress = %q, want it to contain %q", out.String(), want)
+		}
+	}
+
+	out.Reset()
+	store.fail = func(op, bucket, name string) error {
+		return errorIf(op == "write", errDenied)
+	}
+	if _, err := uploadFile(testBucket, "my-org/other.zip", file, WriteOptions{}); err == nil {
+		t.Fatal("uploadFile() = nil, want the write error")
+	}
+	if !strings.Contains(out.String(), "Upload of gs://"+testBucket+"/my-org/other.zip failed") {
+		t.Errorf("progress of a failed upload = %q", out.String())
+	}
+}
+
+func TestSplitArchive(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	maxArchiveSize = 200
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip", "proxies/b.zip", "sharedflows/c.zip", "kvms/d.json")
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	name := backupObjectName("my-org", backupDate())
+	if status.Object != name+partsSuffix {
+		t.Fatalf("Object = %q, want the index %q", status.Object, name+partsSuffix)
+	}
+	index, err := readPartsIndex(testBucket, status.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Parts) < 2 || index.SHA256 != status.SHA256 || store.has(testBucket, name) {
+		t.Fatalf("index = %+v, want several parts and the archive's checksum, and no whole archive", index)
+	}
+	for _, part := range index.Parts {
+		if part.Size > maxArchiveSize || !store.has(testBucket, part.Name) {
+			t.Errorf("part %+v is too large or missing", part)
+		}
+	}
+	if exists, err := backupExistsInGCS(testBucket, backupDate(), "my-org"); !exists || err != nil {
+		t.Errorf("backupExistsInGCS() = %v, %v, want true", exists, err)
+	}
+	if got, err := latestBackup(testBucket, "my-org", backupDate()); got != status.Object || err != nil {
+		t.Errorf("latestBackup() = %q, %v, want the index", got, err)
+	}
+
+	// Reads reassemble the parts
+	files, _, err := readArchive(testBucket, status.Object)
+	if err != nil || len(files) != 4 {
+		t.Fatalf("readArchive() = %v, %v, want the 4 exported files", files, err)
+	}
+	if sum, err := objectSHA256(testBucket, status.Object); sum != status.SHA256 || err != nil {
+		t.Errorf("objectSHA256() = %q, %v, want %q", sum, err, status.SHA256)
+	}
+	store.put(testBucket, index.Parts[1].Name, []byte("corrupted"))
+	if _, err := objectSHA256(testBucket, status.Object); err == nil || !strings.Contains(err.Error(), index.Parts[1].Name+": checksum mismatch") {
+		t.Errorf("objectSHA256() of a corrupted part = %v, want a checksum mismatch", err)
+	}
+
+	// Retention deletes the parts with their index, counting one backup
+	old := backupObjectName("my-org", time.Now().AddDate(0, 0, -60).Format(dateLayout))
+	for _, object := range []string{old + partsSuffix, partName(old, 1), partName(old, 2)} {
+		store.put(testBucket, object, []byte("old"))
+	}
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 1 {
+		t.Fatalf("cleanupOldBackups() = %d deleted, %v, want 1", deleted, err)
+	}
+	if store.has(testBucket, partName(old, 2)) || !store.has(testBucket, index.Parts[0].Name) {
+		t.Error("cleanup kept an old part or deleted one of this run's")
+	}
+
+	// --min-keep counts a split archive once, not once per part
+	minKeepBackups = 2
+	for _, object := range []string{old + partsSuffix, partName(old, 1), partName(old, 2)} {
+		store.put(testBucket, object, []byte("old"))
+	}
+	if _, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org"); err != nil || deleted != 0 {
+		t.Fatalf("cleanupOldBackups() with --min-keep=2 = %d deleted, %v, want none", deleted, err)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for s, want := range map[string]int64{"2GB": 2e9, "500MiB": 500 << 20, "1.5 KB": 1500, "4096": 4096, "10kib": 10240} {
+		if got, err := parseByteSize(s); got != want || err != nil {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "GB", "-1MB", "2XB"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("parseByteSize(%q) = nil error", s)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// signatureHeader carries the HMAC-SHA256 of the request body, as
+// "sha256=<hex>", when --webhook-secret is set.
+const signatureHeader = "X-Signature"
+
+// genericNotifier POSTs backup results as plain JSON, for receivers other
+// than Discord and Google Workspace.
+type genericNotifier struct {
+	webhookURL string
+	secret     string
+}
+
+// genericEvent is the JSON body sent by genericNotifier. Project is set for
+// "project" events, Projects and Changes for "summary" events, and Changes
+// for "recovery" events.
+type genericEvent struct {
+	Event        string          `json:"event"`
+	Date         string          `json:"date"`
+	SentAt       time.Time       `json:"sentAt"`
+	RunStartedAt time.Time       `json:"runStartedAt"`
+	Project      *ProjectStatus  `json:"project,omitempty"`
+	Projects     []ProjectStatus `json:"projects,omitempty"`
+	Alert        bool            `json:"alert,omitempty"`
+	Changes      []ProjectChange `json:"changes,omitempty"`
+}
+
+func (n genericNotifier) NotifyProject(date string, status ProjectStatus) error {
+	return n.send(genericEvent{Event: "project", Date: date, Project: &status})
+}
+
+func (n genericNotifier) NotifySummary(date string, statuses []ProjectStatus, alert bool, changes []ProjectChange) error {
+	return n.send(genericEvent{Event: "summary", Date: date, Projects: statuses, Alert: alert, Changes: changes})
+}
+
+func (n genericNotifier) NotifyRecovery(date string, recovered []ProjectChange) error {
+	return n.send(genericEvent{Event: "recovery", Date: date, Changes: recovered})
+}
+
+func (n genericNotifier) send(event genericEvent) error {
+	event.SentAt = time.Now().UTC()
+	event.RunStartedAt = runStart.UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	header := http.Header{}
+	if n.secret != "" {
+		header.Set(signatureHeader, signPayload(n.secret, body))
+	}
+
+	statusCode, err := postWebhook(n.webhookURL, body, header)
+	if err != nil {
+		return err
+	}
+
+	if statusCode < 200 || statusCode > 299 {
+		return fmt.Errorf("received status code: %d", statusCode)
+	}
+	return nil
+}
+
+// signPayload returns the X-Signature value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of the exact bytes sent, keyed with secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
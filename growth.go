@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// warnGrowthPct, when set, warns about a project whose archive is more than
+// this many percent larger than its previous backup. A sudden jump can mean
+// something is creating proxies that shouldn't exist.
+var warnGrowthPct float64
+
+// previousArchive returns the catalog entry of project's newest complete
+// backup before date that has an archive of its own, leaving out --dedupe
+// pointers, whose size is the pointer's.
+func previousArchive(catalog Catalog, project, date string) (CatalogEntry, bool) {
+	var previous CatalogEntry
+	for _, entry := range catalog.Entries {
+		if entry.Org == project && entry.Date < date && entry.Status == "Complete" && entry.Pointer == "" && entry.Size > 0 && entry.Date >= previous.Date {
+			previous = entry
+		}
+	}
+	return previous, previous.Org != ""
+}
+
+// checkGrowth warns about status's project if zipFile is more than
+// warnGrowthPct larger than the previous backup recorded in the catalog. A
+// project without an earlier backup has nothing to compare, and a catalog
+// that can't be read is only logged.
+func checkGrowth(status *ProjectStatus, zipFile, date string) {
+	if warnGrowthPct <= 0 {
+		return
+	}
+	info, err := os.Stat(zipFile)
+	if err != nil {
+		log.Printf("Failed to check the growth of %s: %v\n", status.Project, err)
+		return
+	}
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		log.Printf("Failed to read catalog, not checking the growth of %s: %v\n", status.Project, err)
+		return
+	}
+	previous, ok := previousArchive(catalog, status.Project, date)
+	if !ok {
+		return
+	}
+	growth := float64(info.Size()-previous.Size) / float64(previous.Size) * 100
+	if growth > warnGrowthPct {
+		warnProject(status, "Backup grew %.0f%% since %s, from %s to %s", growth, previous.Date, formatBytes(previous.Size), formatBytes(info.Size()))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarnGrowth(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	warnGrowthPct = 50
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip", "proxies/b.zip")
+	}
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+	// A --dedupe pointer's size isn't the backup's, so it's passed over
+	if err := writeCatalog(testBucket, Catalog{Entries: []CatalogEntry{
+		{Org: "my-org", Date: day(-2), Object: backupObjectName("my-org", day(-2)), Size: 100, Status: "Complete"},
+		{Org: "my-org", Date: day(-1), Object: backupObjectName("my-org", day(-2)), Pointer: backupObjectName("my-org", day(-1)) + pointerSuffix, Size: 10, Status: "Complete"},
+		{Org: "steady-org", Date: day(-1), Object: backupObjectName("steady-org", day(-1)), Size: 1 << 30, Status: "Complete"},
+	}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" || len(status.Warnings) != 1 {
+		t.Fatalf("status = %q (%s), warnings %q, want Complete with a growth warning", status.Status, status.Reason, status.Warnings)
+	}
+	if want := "since " + day(-2) + ", from 100 B to"; !strings.Contains(status.Warnings[0], want) {
+		t.Errorf("warning = %q, want it to contain %q", status.Warnings[0], want)
+	}
+
+	for _, project := range []string{"steady-org", "new-org"} {
+		status = backupProject(context.Background(), project, testBucket, "token", 30)
+		if status.Status != "Complete" || len(status.Warnings) != 0 {
+			t.Errorf("%s: status = %q, warnings %q, want Complete without warnings", project, status.Status, status.Warnings)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values accepted by --hook-scope.
+const (
+	hookScopeProject = "project" // around each project's backup
+	hookScopeRun     = "run"     // once before and once after the whole run
+)
+
+// Values accepted by --pre-hook-failure.
+const (
+	hookFailureFail     = "fail"     // don't back up the project, or don't start the run
+	hookFailureContinue = "continue" // warn and back up anyway
+)
+
+// preHook and postHook are shell commands run before and after each
+// project's backup, or the whole run with hookScope run. They get the
+// project, and afterwards its status, in APIGEE_BACKUP_* variables.
+var preHook, postHook string
+
+var hookScope = hookScopeProject
+
+var preHookFailure = hookFailureFail
+
+// validateHooks checks the --hook-scope and --pre-hook-failure values.
+func validateHooks(scope, failure string) error {
+	if scope != hookScopeProject && scope != hookScopeRun {
+		return fmt.Errorf("invalid --hook-scope %q, must be project or run", scope)
+	}
+	if failure != hookFailureFail && failure != hookFailureContinue {
+		return fmt.Errorf("invalid --pre-hook-failure %q, must be fail or continue", failure)
+	}
+	return nil
+}
+
+// runHook runs command with sh, with env added to its environment, and
+// logs its output and exit status. name says which hook it is in the log
+// and the returned error.
+func runHook(name, command string, env map[string]string) error {
+	args := make([]string, 0, len(env)+3)
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		args = append(args, key+"="+env[key])
+	}
+	args = append(args, "sh", "-c", command)
+
+	var output bytes.Buffer
+	start := time.Now()
+	err := commandRunner.Run(context.Background(), "", &output, &output, "env", args...)
+	if out := strings.TrimSpace(output.String()); out != "" {
+		log.Printf("%s output:\n%s\n", name, out)
+	}
+	if err != nil {
+		return newBackupError(ErrHook, name+" failed", err)
+	}
+	log.Printf("%s exited with status 0 after %s\n", name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// projectHookEnv returns the variables a project-scope hook gets. A
+// post-hook also gets the project's status.
+func projectHookEnv(hook string, status ProjectStatus, post bool) map[string]string {
+	env := map[string]string{
+		"APIGEE_BACKUP_HOOK":    hook,
+		"APIGEE_BACKUP_PROJECT": status.Project,
+		"APIGEE_BACKUP_ALIAS":   status.Alias,
+		"APIGEE_BACKUP_DATE":    backupDate(),
+		"APIGEE_BACKUP_BUCKET":  status.Bucket,
+	}
+	if post {
+		env["APIGEE_BACKUP_STATUS"] = status.Status
+		env["APIGEE_BACKUP_REASON"] = status.Reason
+		env["APIGEE_BACKUP_OBJECT"] = status.Object
+	}
+	return env
+}
+
+// backupProjectWithHooks backs up project between the project-scope pre-
+// and post-hooks. A failed pre-hook fails the project without backing it
+// up unless preHookFailure is continue, and a failed post-hook is a warning.
+func backupProjectWithHooks(ctx context.Context, project, gcsBucket, token string, retentionDays int) ProjectStatus {
+	if hookScope != hookScopeProject || (preHook == "" && postHook == "") {
+		return backupProject(ctx, project, gcsBucket, token, retentionDays)
+	}
+	status := ProjectStatus{Project: project, Status: "Complete", Reason: "no issue", Alias: projectAlias(project), Labels: projectLabels[project], RetentionDays: projectRetention(project, retentionDays), Bucket: projectDestinations(project)[0], Endpoint: projectEndpoint(project), StartedAt: time.Now()}
+
+	var preHookErr error
+	if preHook != "" {
+		preHookErr = runHook("Pre-hook for "+project, preHook, projectHookEnv("pre", status, false))
+		if preHookErr != nil && preHookFailure == hookFailureFail {
+			failProject(&status, preHookErr)
+			return status
+		}
+	}
+	status = backupProject(ctx, project, gcsBucket, token, retentionDays)
+	if preHookErr != nil {
+		warnProject(&status, "%v", preHookErr)
+	}
+	if postHook != "" {
+		if err := runHook("Post-hook for "+project, postHook, projectHookEnv("post", status, true)); err != nil {
+			warnProject(&status, "%v", err)
+		}
+	}
+	return status
+}
+
+// runHookEnv returns the variables a run-scope hook gets. A post-hook also
+// gets the run's overall status and how many projects failed.
+func runHookEnv(hook string, projects []string, statuses []ProjectStatus) map[string]string {
+	env := map[string]string{
+		"APIGEE_BACKUP_HOOK":     hook,
+		"APIGEE_BACKUP_PROJECTS": strings.Join(projects, " "),
+		"APIGEE_BACKUP_DATE":     backupDate(),
+	}
+	if hook == "post" {
+		var failed int
+		for _, status := range statuses {
+			if status.Status != "Complete" {
+				failed++
+			}
+		}
+		env["APIGEE_BACKUP_STATUS"] = "Complete"
+		if failed > 0 {
+			env["APIGEE_BACKUP_STATUS"] = "Failed"
+		}
+		env["APIGEE_BACKUP_FAILED"] = strconv.Itoa(failed)
+	}
+	return env
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProjectHooks(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	preHook, postHook = "snapshot-db", "notify-change-system"
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+	var preFails bool
+	envs := map[string][]string{}
+	runner.hook = func(env []string, command string) (string, error) {
+		envs[command] = env
+		if command == preHook && preFails {
+			return "snapshot failed\n", errors.New("exit status 3")
+		}
+		return "ok\n", nil
+	}
+
+	status := backupProjectWithHooks(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" || len(status.Warnings) != 0 {
+		t.Fatalf("status = %q (%s), warnings %q, want Complete", status.Status, status.Reason, status.Warnings)
+	}
+	for _, want := range []string{"APIGEE_BACKUP_HOOK=pre", "APIGEE_BACKUP_PROJECT=my-org", "APIGEE_BACKUP_BUCKET=" + testBucket} {
+		if !slices.Contains(envs[preHook], want) {
+			t.Errorf("pre-hook env = %q, want %s", envs[preHook], want)
+		}
+	}
+	for _, want := range []string{"APIGEE_BACKUP_HOOK=post", "APIGEE_BACKUP_STATUS=Complete", "APIGEE_BACKUP_OBJECT=" + status.Object} {
+		if !slices.Contains(envs[postHook], want) {
+			t.Errorf("post-hook env = %q, want %s", envs[postHook], want)
+		}
+	}
+
+	// A failed pre-hook fails the project without backing it up
+	preFails = true
+	status = backupProjectWithHooks(context.Background(), "other-org", testBucket, "token", 30)
+	if status.Status != "Failed" || status.Category != "hook" || !strings.Contains(status.Reason, "exit status 3") {
+		t.Errorf("status = %s/%s (%s), want a hook failure", status.Status, status.Category, status.Reason)
+	}
+	if store.has(testBucket, backupObjectName("other-org", backupDate())) {
+		t.Error("project was backed up after its pre-hook failed")
+	}
+
+	// With continue, it only warns
+	preHookFailure = hookFailureContinue
+	status = backupProjectWithHooks(context.Background(), "other-org", testBucket, "token", 30)
+	if status.Status != "Complete" || len(status.Warnings) != 1 || !strings.Contains(status.Warnings[0], "Pre-hook for other-org failed") {
+		t.Errorf("status = %q (%s), warnings %q, want Complete with a pre-hook warning", status.Status, status.Reason, status.Warnings)
+	}
+}
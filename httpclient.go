@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// version is the tool's version, set at build time with
+// -ldflags "-X main.version=v1.2.3". Without it the module version Go
+// recorded in the binary is used.
+var version string
+
+// toolVersion returns version, or the module version, or "dev" for a local
+// build.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// userAgent identifies the tool on every HTTP request it makes, so webhook
+// receivers can filter and trace its traffic.
+func userAgent() string {
+	return "apigee-backup/" + toolVersion()
+}
+
+// gzipMinSize is the smallest webhook payload that is compressed for a
+// receiver accepting gzip. Smaller ones aren't worth the receiver's effort.
+const gzipMinSize = 8 << 10
+
+// gzipURLs are the webhook URLs whose receivers advertised gzip in an
+// Accept-Encoding response header, so later requests to them may be
+// compressed.
+var gzipURLs = map[string]bool{}
+var gzipURLsMu sync.Mutex
+
+// acceptsGzip reports whether url's receiver advertised gzip support.
+func acceptsGzip(url string) bool {
+	gzipURLsMu.Lock()
+	defer gzipURLsMu.Unlock()
+	return gzipURLs[url]
+}
+
+// learnEncoding records whether the response from url advertises gzip
+// request encoding, per RFC 7694.
+func learnEncoding(url string, resp *http.Response) {
+	advertised := false
+	for _, value := range resp.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(coding, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				advertised = true
+			}
+		}
+	}
+	gzipURLsMu.Lock()
+	defer gzipURLsMu.Unlock()
+	if advertised {
+		gzipURLs[url] = true
+	} else if resp.StatusCode == http.StatusUnsupportedMediaType {
+		delete(gzipURLs, url)
+	}
+}
+
+// gzipBytes compresses data with gzip.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
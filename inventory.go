@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// inventoryRow is one stored backup in a --catalog-export listing. The
+// parts of a split archive are one backup, listed by their index with
+// their total size.
+type inventoryRow struct {
+	Org           string
+	Date          string
+	Bucket        string
+	Object        string
+	Size          int64
+	SHA256        string
+	AgeDays       int
+	RetentionDays int
+}
+
+// inventoryHeader is the first line of a --catalog-export CSV.
+var inventoryHeader = []string{"org", "date", "bucket", "object", "size", "sha256", "age_days", "retention_days"}
+
+// listInventory lists the backups stored for projects in each of their
+// buckets, or for every env in every destination when projects is empty.
+// Unlike the catalog it lists the buckets, so it shows what is actually
+// stored; checksums and retention come from the catalog.
+func listInventory(projects []string) ([]inventoryRow, error) {
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string, len(catalog.Entries))
+	for _, entry := range catalog.Entries {
+		checksums[cmp.Or(entry.Pointer, entry.Object)] = entry.SHA256
+	}
+	today, err := time.Parse(dateLayout, backupDate())
+	if err != nil {
+		return nil, err
+	}
+
+	type scope struct{ bucket, env, org string }
+	var scopes []scope
+	if len(projects) == 0 {
+		for _, bucket := range allDestinations() {
+			envs, err := listBackupEnvs(bucket)
+			if err != nil {
+				return nil, err
+			}
+			for _, env := range envs {
+				scopes = append(scopes, scope{bucket, env, env})
+			}
+		}
+	} else {
+		for _, project := range projects {
+			for _, bucket := range projectDestinations(project) {
+				scopes = append(scopes, scope{bucket, storageEnv(project), project})
+			}
+		}
+	}
+
+	var rows []inventoryRow
+	for _, s := range scopes {
+		objects, err := objectStore.List(context.Background(), s.bucket, objectKey(s.env, fmt.Sprintf("backup_%s_", s.env)), "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list gs://%s: %w", s.bucket, err)
+		}
+		backups := make(map[string]int)
+		for _, attrs := range objects {
+			date, err := parseBackupDate(attrs.Name, s.env)
+			if err != nil {
+				continue
+			}
+			base := backupBase(attrs.Name)
+			i, ok := backups[base]
+			if !ok {
+				i = len(rows)
+				backups[base] = i
+				rows = append(rows, inventoryRow{Org: s.org, Date: date.Format(dateLayout), Bucket: s.bucket, Object: attrs.Name, AgeDays: int(today.Sub(date).Hours() / 24), RetentionDays: catalog.envRetention(s.env)})
+			}
+			rows[i].Size += attrs.Size
+			if !partPattern.MatchString(attrs.Name) {
+				rows[i].Object = attrs.Name
+				rows[i].SHA256 = checksums[attrs.Name]
+			}
+		}
+	}
+	slices.SortStableFunc(rows, func(a, b inventoryRow) int {
+		return cmp.Or(cmp.Compare(a.Org, b.Org), cmp.Compare(a.Date, b.Date), cmp.Compare(a.Bucket, b.Bucket), cmp.Compare(a.Object, b.Object))
+	})
+	return rows, nil
+}
+
+// writeInventory writes rows to w as CSV with a header line.
+func writeInventory(w io.Writer, rows []inventoryRow) error {
+	out := csv.NewWriter(w)
+	out.Write(inventoryHeader)
+	for _, row := range rows {
+		retention := ""
+		if row.RetentionDays > 0 {
+			retention = strconv.Itoa(row.RetentionDays)
+		}
+		out.Write([]string{row.Org, row.Date, row.Bucket, row.Object, strconv.FormatInt(row.Size, 10), row.SHA256, strconv.Itoa(row.AgeDays), retention})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// exportInventory writes the --catalog-export CSV of projects' backups to
+// filePath, or to stdout if it is "-".
+func exportInventory(filePath string, projects []string) error {
+	rows, err := listInventory(projects)
+	if err != nil {
+		return err
+	}
+	if filePath == "-" {
+		return writeInventory(os.Stdout, rows)
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeInventory(file, rows); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
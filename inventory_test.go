@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCatalogExport(t *testing.T) {
+	_, store := setupBackupTest(t)
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+	whole := backupObjectName("my-org", day(-3))
+	split := backupObjectName("my-org", day(-1))
+	store.put(testBucket, whole, []byte("archive"))
+	store.put(testBucket, split+partsSuffix, []byte("{}"))
+	store.put(testBucket, partName(split, 1), []byte("part one"))
+	store.put(testBucket, partName(split, 2), []byte("two"))
+	store.put(testBucket, backupObjectName("other-org", day(0)), []byte("other"))
+	store.put(testBucket, "my-org/notes.txt", []byte("not a backup"))
+	if err := writeCatalog(testBucket, Catalog{RetentionDays: 30, Entries: []CatalogEntry{
+		{Org: "my-org", Date: day(-3), Object: whole, SHA256: "abc123", Status: "Complete"},
+	}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := listInventory(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []inventoryRow{
+		{Org: "my-org", Date: day(-3), Bucket: testBucket, Object: whole, Size: 7, SHA256: "abc123", AgeDays: 3, RetentionDays: 30},
+		{Org: "my-org", Date: day(-1), Bucket: testBucket, Object: split + partsSuffix, Size: 13, AgeDays: 1, RetentionDays: 30},
+		{Org: "other-org", Date: day(0), Bucket: testBucket, Object: backupObjectName("other-org", day(0)), Size: 5, RetentionDays: 30},
+	}
+	if !slices.Equal(rows, want) {
+		t.Fatalf("listInventory() = %+v\nwant %+v", rows, want)
+	}
+
+	// A project file limits it to its projects
+	rows, err = listInventory([]string{"other-org"})
+	if err != nil || len(rows) != 1 || rows[0].Org != "other-org" {
+		t.Errorf("listInventory(other-org) = %+v, %v, want only other-org's backup", rows, err)
+	}
+
+	var out bytes.Buffer
+	if err := writeInventory(&out, want[:1]); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !slices.Equal(records[0], inventoryHeader) || !slices.Equal(records[1], []string{"my-org", day(-3), testBucket, whole, "7", "abc123", "3", "30"}) {
+		t.Errorf("CSV = %q", records)
+	}
+}
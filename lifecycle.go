@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+
+	"cloud.google.com/go/storage"
+)
+
+// manageLifecycle hands retention to GCS: each run sets an age-based delete
+// rule per env in each destination's lifecycle configuration, and skips
+// deleting old backups itself.
+var manageLifecycle bool
+
+// lifecyclePrefix is the name prefix shared by env's backups, --dedupe
+// pointers and --max-archive-size parts, but not its latest pointer.
+func lifecyclePrefix(env string) string {
+	return objectKey(env, fmt.Sprintf("backup_%s_", env))
+}
+
+// lifecycleRule deletes the objects under prefix once they are a day older
+// than days, so GCS never expires a backup that cleanup would still keep:
+// cleanup goes by the date in the name, GCS by when the object was written.
+func lifecycleRule(prefix string, days int) storage.LifecycleRule {
+	return storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: int64(days + 1), MatchesPrefix: []string{prefix}},
+	}
+}
+
+// withRetentionRules returns lifecycle with a delete rule for each env in
+// retentions. A delete rule matching exactly one env's prefix is taken to
+// be one this tool set, and is replaced in place; every other rule, such as
+// one another team added, is kept as it is.
+func withRetentionRules(lifecycle storage.Lifecycle, retentions map[string]int) storage.Lifecycle {
+	wanted := make(map[string]int, len(retentions))
+	for env, days := range retentions {
+		wanted[lifecyclePrefix(env)] = days
+	}
+	var rules []storage.LifecycleRule
+	set := make(map[string]bool)
+	for _, rule := range lifecycle.Rules {
+		if rule.Action.Type == storage.DeleteAction && len(rule.Condition.MatchesPrefix) == 1 {
+			prefix := rule.Condition.MatchesPrefix[0]
+			if days, ok := wanted[prefix]; ok {
+				if !set[prefix] {
+					rules = append(rules, lifecycleRule(prefix, days))
+					set[prefix] = true
+				}
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	for _, prefix := range slices.Sorted(maps.Keys(wanted)) {
+		if !set[prefix] {
+			rules = append(rules, lifecycleRule(prefix, wanted[prefix]))
+		}
+	}
+	return storage.Lifecycle{Rules: rules}
+}
+
+// applyLifecycle sets the retention of each env in retentions as a delete
+// rule in gcsBucket's lifecycle configuration. The bucket is only updated
+// if the rules changed.
+func applyLifecycle(gcsBucket string, retentions map[string]int) error {
+	ctx := context.Background()
+	lifecycle, metageneration, err := objectStore.Lifecycle(ctx, gcsBucket)
+	if err != nil {
+		return fmt.Errorf("failed to read the lifecycle configuration of gs://%s: %w", gcsBucket, err)
+	}
+	updated := withRetentionRules(lifecycle, retentions)
+	if reflect.DeepEqual(updated, lifecycle) {
+		return nil
+	}
+	if err := objectStore.SetLifecycle(ctx, gcsBucket, updated, metageneration); err != nil {
+		return fmt.Errorf("failed to update the lifecycle configuration of gs://%s: %w", gcsBucket, err)
+	}
+	log.Printf("Updated the lifecycle delete rules of %d envs in gs://%s\n", len(retentions), gcsBucket)
+	return nil
+}
+
+// applyLifecycles applies the retention of each env in retentions to the
+// lifecycle configuration of each bucket the env is stored in.
+func applyLifecycles(retentions map[string]int) error {
+	for _, bucket := range allDestinations() {
+		stored := make(map[string]int)
+		for env, days := range retentions {
+			if slices.Contains(envDestinations(env), bucket) {
+				stored[env] = days
+			}
+		}
+		if len(stored) == 0 {
+			continue
+		}
+		if err := applyLifecycle(bucket, stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedBytes returns the total size of the objects stored for env, which
+// cleanupOldBackups reports when it runs.
+func storedBytes(gcsBucket, env string) (int64, error) {
+	objects, err := listEnv(gcsBucket, env)
+	if err != nil {
+		return 0, err
+	}
+	var stored int64
+	for _, attrs := range objects {
+		stored += attrs.Size
+	}
+	return stored, nil
+}
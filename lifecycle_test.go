@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestApplyLifecycle(t *testing.T) {
+	_, store := setupBackupTest(t)
+	logs := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: 7, MatchesPrefix: []string{"logs/"}},
+	}
+	store.lifecycles[testBucket] = storage.Lifecycle{Rules: []storage.LifecycleRule{lifecycleRule("org-a/backup_org-a_", 10), logs}}
+
+	if err := applyLifecycle(testBucket, map[string]int{"org-a": 30, "org-b": 90}); err != nil {
+		t.Fatalf("applyLifecycle() = %v", err)
+	}
+	rules := store.lifecycles[testBucket].Rules
+	if len(rules) != 3 {
+		t.Fatalf("rules = %+v, want 3", rules)
+	}
+	// org-a's rule is updated in place, other rules are left alone
+	for i, want := range []struct {
+		prefix string
+		age    int64
+	}{{"org-a/backup_org-a_", 31}, {"logs/", 7}, {"org-b/backup_org-b_", 91}} {
+		if rules[i].Condition.MatchesPrefix[0] != want.prefix || rules[i].Condition.AgeInDays != want.age {
+			t.Errorf("rule %d = %+v, want %s after %d days", i, rules[i].Condition, want.prefix, want.age)
+		}
+	}
+
+	// Unchanged rules don't update the bucket
+	metagen := store.metagen
+	if err := applyLifecycle(testBucket, map[string]int{"org-b": 90}); err != nil || store.metagen != metagen {
+		t.Errorf("applyLifecycle() with unchanged rules = %v, metageneration %d, want no update", err, store.metagen)
+	}
+}
+
+func TestManageLifecycleSkipsCleanup(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	manageLifecycle = true
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+	old := backupObjectName("my-org", time.Now().AddDate(0, 0, -60).Format(dateLayout))
+	store.put(testBucket, old, []byte("old"))
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	if !store.has(testBucket, old) || status.DeletedBackups != 0 {
+		t.Errorf("old backup deleted with --manage-lifecycle (%d deletions)", status.DeletedBackups)
+	}
+	if status.StoredBytes <= int64(len("old")) {
+		t.Errorf("StoredBytes = %d, want both backups counted", status.StoredBytes)
+	}
+}
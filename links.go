@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// notifyIncludeLinks adds the gs:// path of a project's backup to its
+// per-project success notification.
+var notifyIncludeLinks bool
+
+// signedURLTTL, when set with notifyIncludeLinks, also adds a signed https
+// URL to the backup that expires after this long.
+var signedURLTTL time.Duration
+
+// maxSignedURLTTL is the longest expiry GCS accepts for a V4 signed URL.
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// parseSignedURLTTL parses --signed-url-ttl, which is "" for no signed URLs.
+func parseSignedURLTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid --signed-url-ttl %q: must be a duration such as 15m", value)
+	}
+	if ttl > maxSignedURLTTL {
+		return 0, fmt.Errorf("invalid --signed-url-ttl %q: signed URLs can't be valid for more than 7 days", value)
+	}
+	return ttl, nil
+}
+
+// probeURLSigning signs a URL in bucket, so missing signing credentials
+// stop the run at startup rather than leaving every notification without
+// its link. Nothing is requested from GCS.
+func probeURLSigning(bucket string) error {
+	if _, err := objectStore.SignedURL(context.Background(), bucket, objectKey("_probe", "signed-url"), signedURLTTL); err != nil {
+		return fmt.Errorf("failed to sign a URL for gs://%s, --signed-url-ttl needs a service account key or a service account allowed to sign blobs: %w", bucket, err)
+	}
+	return nil
+}
+
+// withBackupLinks returns status with Link, and SignedURL if enabled, set
+// to its backup in the project's first destination. Only a complete project with a
+// stored backup gets links. A URL that can't be signed is only logged.
+func withBackupLinks(status ProjectStatus) ProjectStatus {
+	if !notifyIncludeLinks || status.Status != "Complete" || status.Object == "" {
+		return status
+	}
+	bucket := status.Bucket
+	if bucket == "" {
+		bucket = destinations[0]
+	}
+	status.Link = fmt.Sprintf("gs://%s/%s", bucket, status.Object)
+	if signedURLTTL > 0 {
+		url, err := objectStore.SignedURL(context.Background(), bucket, status.Object, signedURLTTL)
+		if err != nil {
+			log.Printf("Failed to sign a URL for %s: %v\n", status.Link, err)
+		} else {
+			status.SignedURL = url
+		}
+	}
+	return status
+}
+
+// linkLines returns the built-in message lines for status's links.
+func linkLines(status ProjectStatus) string {
+	var lines string
+	if status.Link != "" {
+		lines = fmt.Sprintf("\nBackup: `%s`", status.Link)
+	}
+	if status.SignedURL != "" {
+		lines = fmt.Sprintf("%s\nDownload (expires in %s): %s", lines, signedURLTTL, status.SignedURL)
+	}
+	return lines
+}
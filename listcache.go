@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// listAttempts and listBackoff control how often a failed listing is
+// retried; the wait doubles after each attempt.
+const listAttempts = 4
+
+var listBackoff = time.Second
+
+// cachingStorage wraps a Storage so each folder listing, a List with the
+// "/" delimiter such as an env's backups, is requested once per run. The
+// cached listing is kept up to date with this run's own writes and deletes,
+// so the existence check, cleanup and retention preview of an env share one
+// request. Changes made by other runs meanwhile aren't seen until reset.
+type cachingStorage struct {
+	Storage
+
+	mu       sync.Mutex
+	listings map[string][]ObjectInfo // by bucket and prefix
+}
+
+func newCachingStorage(s Storage) *cachingStorage {
+	return &cachingStorage{Storage: s, listings: make(map[string][]ObjectInfo)}
+}
+
+func listingKey(bucket, prefix string) string {
+	return bucket + "\x00" + prefix
+}
+
+// reset forgets every cached listing, at the start of a run.
+func (s *cachingStorage) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listings = make(map[string][]ObjectInfo)
+}
+
+func (s *cachingStorage) List(ctx context.Context, bucket, prefix, delimiter string) ([]ObjectInfo, error) {
+	if delimiter != "/" {
+		return s.listWithRetry(ctx, bucket, prefix, delimiter)
+	}
+	key := listingKey(bucket, prefix)
+	s.mu.Lock()
+	cached, ok := s.listings[key]
+	s.mu.Unlock()
+	if ok {
+		return append([]ObjectInfo(nil), cached...), nil
+	}
+
+	objects, err := s.listWithRetry(ctx, bucket, prefix, delimiter)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.listings[key] = append([]ObjectInfo(nil), objects...)
+	s.mu.Unlock()
+	return objects, nil
+}
+
+// listWithRetry lists objects, retrying transient failures with exponential
+// backoff. Access denied is returned at once, since retrying can't change it.
+func (s *cachingStorage) listWithRetry(ctx context.Context, bucket, prefix, delimiter string) ([]ObjectInfo, error) {
+	wait := listBackoff
+	for attempt := 1; ; attempt++ {
+		objects, err := s.Storage.List(ctx, bucket, prefix, delimiter)
+		if err == nil || isAccessDenied(err) || ctx.Err() != nil || attempt == listAttempts {
+			return objects, err
+		}
+		log.Printf("Failed to list gs://%s/%s (attempt %d of %d), retrying in %s: %v\n", bucket, prefix, attempt, listAttempts, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (s *cachingStorage) Write(ctx context.Context, bucket, name string, r io.Reader, opts WriteOptions) (int64, error) {
+	written, err := s.Storage.Write(ctx, bucket, name, r, opts)
+	if err != nil {
+		// A failed write may still have replaced the object, so the cached
+		// listings it belongs to can't be trusted
+		s.forget(bucket, name)
+		return written, err
+	}
+	s.update(bucket, name, func(objects []ObjectInfo, i int) []ObjectInfo {
+		info := ObjectInfo{Name: name, Size: written}
+		if i >= 0 {
+			objects[i] = info
+			return objects
+		}
+		return append(objects, info)
+	})
+	return written, nil
+}
+
+func (s *cachingStorage) Delete(ctx context.Context, bucket, name string) error {
+	err := s.Storage.Delete(ctx, bucket, name)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+	s.update(bucket, name, func(objects []ObjectInfo, i int) []ObjectInfo {
+		if i < 0 {
+			return objects
+		}
+		return append(objects[:i], objects[i+1:]...)
+	})
+	return err
+}
+
+// update applies change to every cached listing that name is directly in,
+// passing the index of its entry or -1. In a listing that rolls name up
+// into a subfolder, the subfolder is added if it is new.
+func (s *cachingStorage) update(bucket, name string, change func(objects []ObjectInfo, i int) []ObjectInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, objects := range s.listings {
+		prefix, ok := strings.CutPrefix(key, bucket+"\x00")
+		if !ok || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if slash := strings.Index(name[len(prefix):], "/"); slash >= 0 {
+			folder := name[:len(prefix)+slash+1]
+			if !containsPrefix(objects, folder) {
+				s.listings[key] = append(objects, ObjectInfo{Prefix: folder})
+			}
+			continue
+		}
+		i := -1
+		for j, object := range objects {
+			if object.Name == name {
+				i = j
+				break
+			}
+		}
+		s.listings[key] = change(objects, i)
+	}
+}
+
+// forget drops every cached listing that name would appear in.
+func (s *cachingStorage) forget(bucket, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.listings {
+		if prefix, ok := strings.CutPrefix(key, bucket+"\x00"); ok && strings.HasPrefix(name, prefix) {
+			delete(s.listings, key)
+		}
+	}
+}
+
+func containsPrefix(objects []ObjectInfo, prefix string) bool {
+	for _, object := range objects {
+		if object.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// resetListingCache forgets the listings cached by a previous run.
+func resetListingCache() {
+	if cache, ok := objectStore.(*cachingStorage); ok {
+		cache.reset()
+	}
+}
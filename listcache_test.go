@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachingStorage(t *testing.T) {
+	_, store := setupBackupTest(t)
+	var lists int
+	store.fail = func(op, bucket, name string) error {
+		if op == "list" {
+			lists++
+		}
+		return nil
+	}
+	cache := newCachingStorage(store)
+	setGlobal[Storage](t, &objectStore, cache)
+
+	today := time.Now().Format(dateLayout)
+	old := backupObjectName("my-org", time.Now().AddDate(0, 0, -60).Format(dateLayout))
+	store.put(testBucket, old, []byte("old"))
+
+	// The existence check's listing is reused by cleanup
+	if exists, err := backupExistsInGCS(testBucket, today, "my-org"); exists || err != nil {
+		t.Fatalf("backupExistsInGCS() = %v, %v, want false", exists, err)
+	}
+	if _, err := cache.Write(context.Background(), testBucket, backupObjectName("my-org", today), strings.NewReader("new backup"), WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	stored, deleted, _, err := cleanupOldBackups(testBucket, 30, "my-org")
+	if err != nil || deleted != 1 || stored != int64(len("new backup")) {
+		t.Errorf("cleanupOldBackups() = %d stored, %d deleted, %v, want the new backup stored and the old one deleted", stored, deleted, err)
+	}
+	if exists, err := backupExistsInGCS(testBucket, today, "my-org"); !exists || err != nil {
+		t.Errorf("backupExistsInGCS() after the upload = %v, %v, want true", exists, err)
+	}
+	if lists != 1 {
+		t.Errorf("listed the bucket %d times, want once", lists)
+	}
+
+	// A new folder appears in a cached listing of its parent
+	if _, err := listBackupEnvs(testBucket); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Write(context.Background(), testBucket, backupObjectName("new-org", today), strings.NewReader("x"), WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if envs, err := listBackupEnvs(testBucket); err != nil || len(envs) != 2 {
+		t.Errorf("listBackupEnvs() = %v, %v, want my-org and new-org", envs, err)
+	}
+
+	// A new run sees changes made by others
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), []byte("other run"))
+	resetListingCache()
+	if exists, err := backupExistsInGCS(testBucket, "2024-06-01", "my-org"); !exists || err != nil {
+		t.Errorf("backupExistsInGCS() after reset = %v, %v, want true", exists, err)
+	}
+}
+
+func TestCachingStorageRetriesListing(t *testing.T) {
+	_, store := setupBackupTest(t)
+	cache := newCachingStorage(store)
+
+	var lists int
+	store.fail = func(op, bucket, name string) error {
+		lists++
+		return errorIf(lists < 3, errors.New("backend error"))
+	}
+	if _, err := cache.List(context.Background(), testBucket, "my-org/", "/"); err != nil || lists != 3 {
+		t.Errorf("List() = %v after %d attempts, want success on the third", err, lists)
+	}
+
+	lists = 0
+	store.fail = func(op, bucket, name string) error {
+		lists++
+		return errDenied
+	}
+	if _, err := cache.List(context.Background(), testBucket, "other-org/", "/"); err == nil || lists != 1 {
+		t.Errorf("List() = %v after %d attempts, want access denied without retrying", err, lists)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// errLocked is returned by acquireLock when another process holds the lock.
+var errLocked = errors.New("lock is held by another run")
+
+// acquireLock takes an exclusive lock on filePath, creating it if needed, so
+// runs sharing the lock file never overlap. It doesn't wait: if another
+// process holds the lock it returns errLocked. The lock is an flock, so the
+// kernel drops it if the process dies and a stale file never blocks a run.
+func acquireLock(filePath string) (release func(), err error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", filePath, err)
+	}
+
+	// Record who holds the lock, for whoever finds the file
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
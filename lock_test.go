@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apigee-backup.lock")
+
+	release, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	if _, err := acquireLock(path); !errors.Is(err, errLocked) {
+		t.Fatalf("acquireLock() while held error = %v, want errLocked", err)
+	}
+
+	release()
+	release, err = acquireLock(path)
+	if err != nil {
+		t.Fatalf("acquireLock() after release error = %v", err)
+	}
+	release()
+}
+
+func TestRunBackupLocked(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	lockFile := filepath.Join(t.TempDir(), "apigee-backup.lock")
+	release, err := acquireLock(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	cfg := Config{GCSBucket: testBucket, RetentionDays: 30, Parallel: 1, WorkDir: t.TempDir(), LockFile: lockFile}
+	if _, err := runBackup(cfg, []string{"my-org"}, "token"); err == nil {
+		t.Fatal("runBackup() started while another run held the lock")
+	}
+	if got := runner.commands(); len(got) != 0 {
+		t.Errorf("commands = %v, want none", got)
+	}
+}
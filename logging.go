@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values accepted by --log-sink.
+const (
+	logSinkFile   = "file"
+	logSinkStdout = "stdout"
+	logSinkSyslog = "syslog"
+)
+
+// Values accepted by --log-format.
+const (
+	logFormatText = "text" // logfmt-style key=value pairs
+	logFormatJSON = "json"
+)
+
+// Values accepted by --log-rotate.
+const (
+	logRotateSize  = "size"  // when the file reaches maxLogFileSize
+	logRotateDaily = "daily" // at the first write of each day
+	logRotateBoth  = "both"
+)
+
+// logRotate is when the file sink rotates the log.
+var logRotate = logRotateSize
+
+// rotatedLogs is how many gzipped old logs are kept.
+const rotatedLogs = 10
+
+// syslogTag identifies the tool's messages in syslog and the journal.
+const syslogTag = "apigee-backup"
+
+func validateLogging(sink, format, rotate string) error {
+	switch sink {
+	case logSinkFile, logSinkStdout, logSinkSyslog:
+	default:
+		return fmt.Errorf("invalid --log-sink %q, must be one of: file, stdout, syslog", sink)
+	}
+	switch format {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid --log-format %q, must be text or json", format)
+	}
+	switch rotate {
+	case logRotateSize, logRotateDaily, logRotateBoth:
+	default:
+		return fmt.Errorf("invalid --log-rotate %q, must be one of: daily, size, both", rotate)
+	}
+	return nil
+}
+
+// rotatingFile is the log file of the file sink. Before each write it
+// checks whether the file is due for rotation under logRotate, so a
+// long-lived --schedule or --listen process rotates too, not only at start.
+type rotatingFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	day  string // the day of the file's first entry, as YYYY-MM-DD
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f := &rotatingFile{path: path}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	f.file, f.size, f.day = file, 0, time.Now().Format(dateLayout)
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		// An existing log rotates on the day after it was last written
+		f.size, f.day = info.Size(), info.ModTime().Format(dateLayout)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.due() {
+		f.file.Close()
+		if err := rotateLogs(f.path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", f.path, err)
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file should be rotated before the next write.
+func (f *rotatingFile) due() bool {
+	if f.size == 0 {
+		return false
+	}
+	bySize := f.size >= maxLogFileSize
+	byDay := f.day != time.Now().Format(dateLayout)
+	switch logRotate {
+	case logRotateDaily:
+		return byDay
+	case logRotateBoth:
+		return bySize || byDay
+	}
+	return bySize
+}
+
+// rotateLogs gzips the log at path to <name>1.log.gz, after renumbering the
+// older ones, e.g. /var/log/apigee1.log.gz to apigee2.log.gz, and removes
+// it. Only the newest rotatedLogs are kept.
+func rotateLogs(path string) error {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for i := rotatedLogs - 1; i >= 1; i-- {
+		oldLog := fmt.Sprintf("%s%d.log.gz", base, i)
+		if _, err := os.Stat(oldLog); err == nil {
+			os.Rename(oldLog, fmt.Sprintf("%s%d.log.gz", base, i+1))
+		}
+	}
+	if err := gzipFile(path, base+"1.log.gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// newLogHandler returns a handler writing records to w in format.
+func newLogHandler(format string, w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// syslogHandler formats each record with an inner text or JSON handler and
+// sends it to syslog with the severity matching its level. syslog and the
+// journal stamp messages themselves, so the record's time is left out.
+type syslogHandler struct {
+	inner  slog.Handler
+	writer *syslog.Writer
+	mu     *sync.Mutex
+	buf    *bytes.Buffer
+}
+
+func newSyslogHandler(format string, level slog.Leveler) (*syslogHandler, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	return &syslogHandler{inner: newLogHandler(format, buf, opts), writer: writer, mu: new(sync.Mutex), buf: buf}, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	message := strings.TrimSuffix(h.buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.writer.Err(message)
+	case r.Level >= slog.LevelWarn:
+		return h.writer.Warning(message)
+	case r.Level >= slog.LevelInfo:
+		return h.writer.Info(message)
+	default:
+		return h.writer.Debug(message)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithAttrs(attrs), writer: h.writer, mu: h.mu, buf: h.buf}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithGroup(name), writer: h.writer, mu: h.mu, buf: h.buf}
+}
+
+// quiet echoes only errors to the console, so a clean run prints nothing;
+// the log file still gets every line at --log-level. verbose logs at debug
+// level, including every command run with its secrets redacted.
+var quiet, verbose bool
+
+// consoleOptions returns the handler options for the console: opts, or
+// errors only with --quiet.
+func consoleOptions(opts *slog.HandlerOptions) *slog.HandlerOptions {
+	if !quiet {
+		return opts
+	}
+	return &slog.HandlerOptions{Level: slog.LevelError}
+}
+
+// teeHandler sends each record to every handler enabled for its level, so
+// the log file and the console can log at different levels.
+type teeHandler []slog.Handler
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, record.Level) {
+			errs = append(errs, handler.Handle(ctx, record.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// secretFlags are the command-line flags whose value is a secret.
+var secretFlags = map[string]bool{"-t": true, "--token": true}
+
+// commandLine returns name and args as a single line for the log, with the
+// value of every secretFlags flag replaced.
+func commandLine(name string, args []string) string {
+	words := []string{name}
+	for i, arg := range args {
+		if i > 0 && secretFlags[args[i-1]] {
+			arg = "REDACTED"
+		} else if flagName, _, ok := strings.Cut(arg, "="); ok && secretFlags[flagName] {
+			arg = flagName + "=REDACTED"
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// fatalf logs an error and exits, like log.Fatalf, but at error level so
+// it is still shown with --quiet.
+func fatalf(format string, args ...any) {
+	slog.Error(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	os.Exit(1)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLogging(t *testing.T) {
+	tests := []struct {
+		sink, format, rotate string
+		wantErr              bool
+	}{
+		{logSinkFile, logFormatText, logRotateSize, false},
+		{logSinkStdout, logFormatJSON, logRotateDaily, false},
+		{logSinkSyslog, logFormatText, logRotateBoth, false},
+		{"journald", logFormatText, logRotateSize, true},
+		{logSinkFile, "logfmt", logRotateSize, true},
+		{logSinkFile, logFormatText, "weekly", true},
+	}
+	for _, tt := range tests {
+		if err := validateLogging(tt.sink, tt.format, tt.rotate); (err != nil) != tt.wantErr {
+			t.Errorf("validateLogging(%q, %q, %q) = %v, want error %v", tt.sink, tt.format, tt.rotate, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNewLogHandlerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	slog.New(newLogHandler(logFormatJSON, &buf, nil)).Info("Backed up", "project", "my-org")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log line %q isn't JSON: %v", buf.String(), err)
+	}
+	if record["msg"] != "Backed up" || record["project"] != "my-org" || record["level"] != "INFO" {
+		t.Errorf("log record = %v", record)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	setGlobal(t, &logRotate, logRotateDaily)
+	path := filepath.Join(t.TempDir(), "apigee.log")
+	os.WriteFile(path, []byte("yesterday\n"), 0600)
+	yesterday := time.Now().AddDate(0, 0, -1)
+	os.Chtimes(path, yesterday, yesterday)
+
+	file, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { file.file.Close() }()
+	io.WriteString(file, "today\n")
+	io.WriteString(file, "still today\n")
+
+	if got, _ := os.ReadFile(path); string(got) != "today\nstill today\n" {
+		t.Errorf("log = %q, want only today's lines", got)
+	}
+	gz, err := os.Open(strings.TrimSuffix(path, ".log") + "1.log.gz")
+	if err != nil {
+		t.Fatalf("rotated log: %v", err)
+	}
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != "yesterday\n" {
+		t.Errorf("rotated log = %q, want yesterday's line", got)
+	}
+
+	// By size only, a log from yesterday isn't rotated
+	logRotate = logRotateSize
+	file.day = yesterday.Format(dateLayout)
+	io.WriteString(file, "more\n")
+	if _, err := os.Stat(strings.TrimSuffix(path, ".log") + "2.log.gz"); err == nil {
+		t.Error("log rotated by date with --log-rotate=size")
+	}
+}
+
+func TestQuietConsole(t *testing.T) {
+	setGlobal(t, &quiet, true)
+	var file, console bytes.Buffer
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	logger := slog.New(teeHandler{newLogHandler(logFormatText, &file, opts), newLogHandler(logFormatText, &console, consoleOptions(opts))})
+	logger.Debug("Running command")
+	logger.Info("Uploaded 1.0 MiB", "project", "my-org")
+	logger.Error("Failed to zip folder")
+
+	if lines := strings.Count(file.String(), "\n"); lines != 3 {
+		t.Errorf("log file has %d lines, want every line:\n%s", lines, file.String())
+	}
+	if !strings.Contains(console.String(), "Failed to zip folder") || strings.Contains(console.String(), "Uploaded") || strings.Contains(console.String(), "Running") {
+		t.Errorf("console = %q, want only the error", console.String())
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	got := commandLine("apigeecli", []string{"organizations", "export", "-o", "my-org", "-t", "ya29.secret", "--token=ya29.other"})
+	if want := "apigeecli organizations export -o my-org -t REDACTED --token=REDACTED"; got != want {
+		t.Errorf("commandLine() = %q, want %q", got, want)
+	}
+}
@@ -2,481 +2,1573 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	apigeeBackupDir      = "/tmp/apigee_backup"
 	defaultRetentionDays = 7
-	logFilePath          = "/var/log/apigee.log"
+	maxRetentionDays     = 3650             // 10 years; anything longer is almost certainly a typo
 	maxLogFileSize       = 10 * 1024 * 1024 // 10MB
+	dateLayout           = "2006-01-02"
 )
 
-var webhookURL string
+// logFilePath is where the run log is written. Failure logs are saved in
+// the same directory.
+var logFilePath = "/var/log/apigee.log"
+
 var tagIDs []string
-var workspaceWebhookURL string
+var saveExportLog bool
+
+// ignoredStatuses holds the apigeecli error statuses that are logged and
+// skipped rather than failing the project.
+var ignoredStatuses = map[string]bool{}
+
+var errorStatusPattern = regexp.MustCompile(`"status":\s*"([A-Z_]+)"`)
+
+// tooManyRequestsPattern matches a 429 that apigeecli reports as plain text.
+var tooManyRequestsPattern = regexp.MustCompile(`(?i)too many requests|"code":\s*429\b`)
+
+// runDir is this run's private work directory, created with os.MkdirTemp so
+// concurrent runs on the same host never share or delete each other's files.
+var runDir string
+
+// dateOverride replaces today's date in object keys, folders and
+// notifications when backfilling a missed day with --date.
+var dateOverride string
+
+// runStart is when this run began. Summary notifications and the report
+// are stamped with it rather than with when they are sent, and the date
+// label comes from it, so a run that crosses midnight keeps one date.
+var runStart = time.Now()
+
+// backupDate returns the date label for this run's backups.
+func backupDate() string {
+	if dateOverride != "" {
+		return dateOverride
+	}
+	return runStart.Format(dateLayout)
+}
+
+// dirMode is the permission for the work, export and date directories. They
+// hold exported secrets such as KVMs and keystores, so only the owner gets
+// access unless --dir-mode loosens it.
+var dirMode os.FileMode = 0700
+
+// noClean keeps the work directory and everything exported into it, for debugging.
+var noClean bool
+
+// logLevel controls the minimum level written to the log; plain log.Printf
+// calls are routed through slog at INFO.
+var logLevel = new(slog.LevelVar)
 
 type ProjectStatus struct {
-	Project string
-	Status  string
-	Reason  string
+	Project        string              `json:"project"`
+	Alias          string              `json:"alias,omitempty"`
+	Status         string              `json:"status"`
+	Reason         string              `json:"reason"`
+	UploadedBytes  int64               `json:"uploadedBytes"`
+	UploadDuration time.Duration       `json:"uploadDuration"`
+	StoredBytes    int64               `json:"storedBytes"`
+	FailureLog     string              `json:"failureLog,omitempty"`
+	Category       string              `json:"category,omitempty"`
+	Bucket         string              `json:"bucket,omitempty"`
+	Endpoint       string              `json:"endpoint,omitempty"`
+	FailingDays    int                 `json:"failingDays,omitempty"`
+	FailureKey     string              `json:"-"`
+	Destinations   []DestinationStatus `json:"destinations,omitempty"`
+	DeletedBackups int                 `json:"deletedBackups"`
+	DeleteFailures []string            `json:"deleteFailures,omitempty"`
+	Warnings       []string            `json:"warnings,omitempty"`
+	Object         string              `json:"object,omitempty"`
+	SHA256         string              `json:"sha256,omitempty"`
+	ContentSHA256  string              `json:"contentSha256,omitempty"`
+	Pointer        string              `json:"pointer,omitempty"`
+	RetentionDays  int                 `json:"retentionDays,omitempty"`
+	Link           string              `json:"link,omitempty"`
+	SignedURL      string              `json:"signedUrl,omitempty"`
+	EntityCounts   map[string]int      `json:"entityCounts,omitempty"`
+	Labels         map[string]string   `json:"labels,omitempty"`
+	StartedAt      time.Time           `json:"startedAt,omitzero"`
+}
+
+// Name is the project's alias, or its ID if it has none.
+func (s ProjectStatus) Name() string {
+	return displayName(s.Project, s.Alias)
+}
+
+// Throughput describes the upload size and speed, or "" if nothing was uploaded.
+func (s ProjectStatus) Throughput() string {
+	if s.UploadedBytes == 0 {
+		return ""
+	}
+	seconds := s.UploadDuration.Seconds()
+	if seconds <= 0 {
+		return formatBytes(s.UploadedBytes)
+	}
+	return fmt.Sprintf("%s in %s (%s/s)", formatBytes(s.UploadedBytes), s.UploadDuration.Round(time.Second), formatBytes(int64(float64(s.UploadedBytes)/seconds)))
+}
+
+// formatBytes renders a byte count in binary units, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func main() {
+	runStart = time.Now()
+
+	// Load the config file first so command-line flags can override it
+	cfg := defaultConfig()
+	if configFile := configPathFromArgs(os.Args[1:]); configFile != "" {
+		if err := loadConfig(configFile, &cfg); err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Command-line flags
-	projectFile := flag.String("f", "", "File containing list of Google Cloud project IDs")
-	gcsBucket := flag.String("gcs", "", "GCS bucket name")
-	token := flag.String("token", "", "Authorization token for Apigee")
-	retentionDays := flag.Int("retention", defaultRetentionDays, "Retention period in days")
-	webhook := flag.String("webhook", "", "Discord webhook URL")
-	tagid := flag.String("tagid", "", "Comma-separated list of Discord tag IDs")
-	workspaceWebhook := flag.String("workspace", "", "Google Workspace webhook URL")
+	flag.String("config", "", "JSON config file; command-line flags override its values")
+	// The first -f replaces the config file's project files, later ones add to them
+	var projectFileFlag bool
+	flag.Func("f", "File containing list of Google Cloud project IDs (local path or gs:// URL, optionally .gz); repeat, or separate with commas, to back up the projects of several files", func(value string) error {
+		if projectFileFlag {
+			value = cfg.ProjectFile + "," + value
+		}
+		cfg.ProjectFile, projectFileFlag = value, true
+		return nil
+	})
+	flag.BoolVar(&cfg.TolerantFile, "tolerant-file", cfg.TolerantFile, "Skip malformed lines in the project file with a warning instead of refusing to run")
+	flag.Func("alias", "Show a project under a friendly name in notifications, given as projectID=friendly; may be repeated", func(value string) error {
+		project, alias, err := parseAlias(value)
+		if err != nil {
+			return err
+		}
+		if cfg.Aliases == nil {
+			cfg.Aliases = make(map[string]string)
+		}
+		cfg.Aliases[project] = alias
+		return nil
+	})
+	flag.BoolVar(&cfg.AliasKeys, "alias-keys", cfg.AliasKeys, "Store each project's backups under its alias instead of its project ID")
+	flag.StringVar(&cfg.GCSBucket, "gcs", cfg.GCSBucket, "GCS bucket name")
+	flag.StringVar(&cfg.Prefix, "prefix", cfg.Prefix, "Store all objects under this key prefix in the bucket, e.g. a team name")
+	flag.BoolVar(&cfg.Dedupe, "dedupe", cfg.Dedupe, "Store a pointer to the previous backup instead of uploading an export with identical contents")
+	flag.BoolVar(&cfg.UniqueKeys, "unique-keys", cfg.UniqueKeys, "Add the run's start time to backup names so every upload keeps its own key, with a latest pointer to the newest")
+	flag.StringVar(&cfg.BillingProject, "billing-project", cfg.BillingProject, "Project billed for requests to requester-pays buckets")
+	flag.StringVar(&cfg.KMSKey, "kms-key", cfg.KMSKey, "Encrypt every object written with this Cloud KMS key (projects/P/locations/L/keyRings/R/cryptoKeys/K) instead of a Google-managed key")
+	flag.StringVar(&cfg.StorageEndpoint, "storage-endpoint", cfg.StorageEndpoint, "Custom GCS endpoint, e.g. for Private Service Connect")
+	flag.Func("destination", "Additional gs://bucket to store every backup in; may be repeated", func(value string) error {
+		cfg.Destinations = append(cfg.Destinations, value)
+		return nil
+	})
+	flag.Func("project-bucket", "Store a project's backups in its own bucket instead of --gcs, given as projectID=BUCKET; may be repeated", func(value string) error {
+		project, bucket, err := parseProjectBucket(value)
+		if err != nil {
+			return err
+		}
+		if cfg.ProjectBuckets == nil {
+			cfg.ProjectBuckets = make(map[string]string)
+		}
+		cfg.ProjectBuckets[project] = bucket
+		return nil
+	})
+	flag.StringVar(&cfg.DestinationPolicy, "destination-policy", cfg.DestinationPolicy, "With --destination: fail a project unless every destination succeeds (all) or if none succeed (any)")
+	flag.StringVar(&cfg.Token, "token", cfg.Token, "Authorization token for Apigee (insecure: visible in the process list, prefer --token-file)")
+	flag.StringVar(&cfg.TokenFile, "token-file", cfg.TokenFile, "File containing the authorization token for Apigee")
+	tokenStdin := flag.Bool("token-stdin", false, "Read the authorization token for Apigee from stdin")
+	flag.BoolVar(&cfg.UseADC, "use-adc", cfg.UseADC, "Get the Apigee token from Application Default Credentials, refreshing it as needed, instead of passing one")
+	flag.IntVar(&cfg.RetentionDays, "retention", cfg.RetentionDays, "Retention period in days")
+	flag.Func("retention-rule", "Give matching projects their own retention, as PROJECT_GLOB:DAYS (e.g. *-prod:90) or KEY=VALUE:DAYS for a project file label; may be repeated, the first match wins", func(value string) error {
+		rule, err := parseRetentionRule(value)
+		if err != nil {
+			return err
+		}
+		cfg.RetentionRules = append(cfg.RetentionRules, rule)
+		return nil
+	})
+	confirmRetentionFlag := flag.Bool("confirm-retention", false, "Apply a --retention shorter than the previous run's, even though it deletes backups the previous retention kept")
+	flag.IntVar(&cfg.MinKeep, "min-keep", cfg.MinKeep, "Always keep this many of the newest backups per project, regardless of age")
+	flag.BoolVar(&cfg.SinceLastSuccess, "since-last-success", cfg.SinceLastSuccess, "Only delete a project's old backups once its backup for today is confirmed in the bucket")
+	flag.BoolVar(&cfg.ManageLifecycle, "manage-lifecycle", cfg.ManageLifecycle, "Apply retention as age-based delete rules in each bucket's lifecycle configuration instead of deleting old backups")
+	flag.IntVar(&cfg.Limit, "limit", cfg.Limit, "Back up at most this many projects per run, starting at --offset (0 backs up all)")
+	flag.IntVar(&cfg.Offset, "offset", cfg.Offset, "Index of the first project to back up with --limit, from 0; wraps around the end of the project file")
+	flag.StringVar(&cfg.DiscordWebhook, "webhook", cfg.DiscordWebhook, "Discord webhook URL")
+	flag.Func("tagid", "Comma-separated list of Discord tag IDs", func(value string) error {
+		cfg.TagIDs = strings.Split(value, ",")
+		return nil
+	})
+	flag.IntVar(&cfg.BatchSize, "batch-size", cfg.BatchSize, "Send per-project Discord messages in batches of up to this many projects (at most 10) instead of one message each")
+	flag.Func("notify-channel-override", "Send the Discord messages of projects with a project file label to their own webhook, as KEY=VALUE=URL; may be repeated, the first match wins", func(value string) error {
+		override, err := parseChannelOverride(value)
+		if err != nil {
+			return err
+		}
+		cfg.NotifyChannelOverrides = append(cfg.NotifyChannelOverrides, override)
+		return nil
+	})
+	flag.BoolVar(&cfg.NotifySummaryPerChannel, "notify-summary-per-channel", cfg.NotifySummaryPerChannel, "Also send each --notify-channel-override webhook a summary of its own projects")
+	flag.BoolVar(&cfg.NotifyIncludeLinks, "notify-include-links", cfg.NotifyIncludeLinks, "Include the gs:// path of the uploaded backup in each project's success notification")
+	flag.StringVar(&cfg.SignedURLTTL, "signed-url-ttl", cfg.SignedURLTTL, "With --notify-include-links, also include a signed https URL to the backup that expires after this duration, e.g. 15m (needs credentials that can sign)")
+	flag.StringVar(&cfg.WorkspaceWebhook, "workspace", cfg.WorkspaceWebhook, "Google Workspace webhook URL")
+	flag.StringVar(&cfg.GenericWebhook, "generic-webhook", cfg.GenericWebhook, "URL to POST plain JSON notifications to")
+	flag.StringVar(&cfg.WebhookSecret, "webhook-secret", cfg.WebhookSecret, "Sign --generic-webhook notifications and --report-webhook reports with HMAC-SHA256 in an X-Signature header (visible in the process list, prefer webhookSecret in the config file)")
+	flag.StringVar(&cfg.NotifyOn, "notify-on", cfg.NotifyOn, "Which per-project notifications to send: all, failures or summary (final summary only)")
+	flag.Float64Var(&cfg.AlertThreshold, "alert-if-failures-exceed", cfg.AlertThreshold, "Send the final summary as an alert, with tag pings, only when more than this percentage of projects failed")
+	flag.BoolVar(&cfg.NotifyDedupeFailures, "notify-dedupe-failures", cfg.NotifyDedupeFailures, "Don't send a per-project notification for a project failing the same way as in its previous backup; the summary shows it as still failing for N days")
+	flag.BoolVar(&cfg.NotifyMentionOnRecovery, "notify-mention-on-recovery", cfg.NotifyMentionOnRecovery, "Send a \"recovered\" notification, with tag pings, when a project that failed in the previous run succeeds again")
+	flag.IntVar(&cfg.NotifySummaryEvery, "notify-summary-every", cfg.NotifySummaryEvery, "Send the summary of a run with no failures, warnings or status changes only every N such runs, counted in the catalog (default 0 sends every summary)")
+	flag.BoolVar(&cfg.SummaryCompact, "summary-compact", cfg.SummaryCompact, "Send only the complete and failed counts and the failed projects in the summary, instead of a line per project")
+	flag.BoolVar(&cfg.FailOnNotifyFailure, "fail-on-notify-failure", cfg.FailOnNotifyFailure, "Exit with status 2 if any notification couldn't be delivered, instead of only logging it")
+	flag.StringVar(&cfg.DiscordTemplate, "discord-template", cfg.DiscordTemplate, "File containing a text/template for Discord messages")
+	flag.StringVar(&cfg.WorkspaceTemplate, "workspace-template", cfg.WorkspaceTemplate, "File containing a text/template for Google Workspace messages")
+	flag.IntVar(&cfg.Parallel, "parallel", cfg.Parallel, "Number of projects to back up concurrently")
+	flag.StringVar(&cfg.PreHook, "pre-hook", cfg.PreHook, "Shell command to run before each project's backup, or the whole run with --hook-scope=run")
+	flag.StringVar(&cfg.PostHook, "post-hook", cfg.PostHook, "Shell command to run after each project's backup, or the whole run with --hook-scope=run")
+	flag.StringVar(&cfg.HookScope, "hook-scope", cfg.HookScope, "Run --pre-hook and --post-hook around each project (project) or around the whole run (run)")
+	flag.StringVar(&cfg.PreHookFailure, "pre-hook-failure", cfg.PreHookFailure, "When --pre-hook fails: fail the project, or the run with --hook-scope=run, without backing it up (fail), or warn and back up anyway (continue)")
+	flag.StringVar(&cfg.MaxRuntime, "max-runtime", cfg.MaxRuntime, "Stop starting projects once less time than the longest project so far is left of this duration (e.g. 5h30m), finishing those in progress and reporting the rest as skipped")
+	flag.StringVar(&cfg.ExportTimeout, "export-timeout", cfg.ExportTimeout, "Kill any apigeecli run that takes longer than this duration (e.g. 30m) and fail its project as timed out, so one hung org can't stall the run")
+	flag.StringVar(&cfg.Stagger, "stagger", cfg.Stagger, "Wait a random delay up to this duration (e.g. 30s) before each project starts, to avoid throttling")
+	flag.IntVar(&cfg.UploadConcurrency, "upload-concurrency", cfg.UploadConcurrency, "Maximum concurrent GCS operations")
+	flag.IntVar(&cfg.WebhookConcurrency, "webhook-concurrency", cfg.WebhookConcurrency, "Maximum concurrent requests per webhook URL")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level (debug, info, warn, error)")
+	flag.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet, "Only show errors on the console, so a clean run prints nothing; the log file still records everything")
+	flag.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "Log at debug level, including every command run, with secrets redacted")
+	flag.StringVar(&cfg.LogSink, "log-sink", cfg.LogSink, "Where to write the log: file (/var/log/apigee.log and stdout, rotated), stdout or syslog")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log line format: text (logfmt key=value pairs) or json")
+	flag.StringVar(&cfg.LogRotate, "log-rotate", cfg.LogRotate, "When to rotate and gzip the log file: size (at 10MB), daily or both")
+	flag.StringVar(&cfg.OutputFormat, "output-format", cfg.OutputFormat, "How to write the run's final project statuses to stdout: text (the log), json or yaml; with json or yaml the log goes to stderr instead")
+	flag.BoolVar(&cfg.UploadFailureLogs, "upload-failure-logs", cfg.UploadFailureLogs, "Upload apigeecli output for failed exports to gs://GCS_BUCKET/_failures/")
+	flag.Func("ignore-statuses", "Comma-separated apigeecli error statuses to log and skip instead of failing the project (default FAILED_PRECONDITION)", func(value string) error {
+		cfg.IgnoreStatuses = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("exclude-entities", "Comma-separated entity types to leave out of every backup, e.g. keystores; excluded types can't be restored", func(value string) error {
+		cfg.ExcludeEntities = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("exclude-glob", "Leave files matching this glob, e.g. '*.pem' or 'keystores/*/*.key', out of every backup; can be repeated", func(value string) error {
+		if err := validateExcludeGlob(value); err != nil {
+			return err
+		}
+		cfg.ExcludeGlobs = append(cfg.ExcludeGlobs, value)
+		return nil
+	})
+	flag.BoolVar(&cfg.RedactCredentials, "redact-credentials", cfg.RedactCredentials, "Remove consumer keys and secrets from exported developer apps before zipping; apps restored from the backup have no live credentials")
+	flag.Float64Var(&cfg.WarnGrowthPct, "warn-growth-pct", cfg.WarnGrowthPct, "Warn about a project whose archive is more than this many percent larger than its previous backup; 0 disables")
+	flag.BoolVar(&cfg.WarnOnEmptyOrg, "warn-on-empty-org", cfg.WarnOnEmptyOrg, "Warn about a project whose export has no proxies or shared flows")
+	flag.BoolVar(&cfg.FailOnEmptyOrg, "fail-on-empty-org", cfg.FailOnEmptyOrg, "Fail a project whose export has no proxies or shared flows")
+	flag.BoolVar(&cfg.CheckQuota, "check-quota", cfg.CheckQuota, "Before the run, make one Apigee API request and wait for the quota to recover if it is rate limited")
+	flag.BoolVar(&cfg.ExportAnalytics, "export-analytics", cfg.ExportAnalytics, "Also export analytics data collectors and custom report definitions")
+	flag.BoolVar(&cfg.ExportEnvGroups, "export-envgroups", cfg.ExportEnvGroups, "Also export environment group definitions")
+	flag.BoolVar(&cfg.ExportOrgKVMs, "export-org-kvms", cfg.ExportOrgKVMs, "Also export org-level KVMs and their entries")
+	flag.BoolVar(&cfg.ExportLog, "export-log", cfg.ExportLog, "Save apigeecli output as export.log inside the backup zip")
+	date := flag.String("date", "", "Label backups with this date (YYYY-MM-DD) instead of today, to backfill a missed day; the exported data is still current")
+	force := flag.Bool("force", false, "Back up and upload even if today's backup already exists, replacing it")
+	probeOnlyMode := flag.Bool("probe-only", false, "List the proxies of every project to check the token can read each org, print which are accessible or denied and exit, instead of running backups")
+	listEntitiesMode := flag.Bool("list-entities", false, "Print how many entities of each type every project has instead of running backups")
+	entities := flag.String("entities", "", "Comma-separated entity types for --list-entities (default all): "+entityTypeNames())
+	catalogQuery := flag.String("catalog-query", "", "Print catalog entries matching a filter such as org=my-org,date=2024-06,status=Failed (or all) instead of running backups")
+	catalogExport := flag.String("catalog-export", "", "Write a CSV of every stored backup (org, date, bucket, object, size, checksum, age, retention) to this file, or - for stdout, for the projects in the project file or, without one, the whole bucket, instead of running backups")
+	cleanOnlyMode := flag.Bool("clean-only", false, "Only apply retention to each project's existing backups, without exporting or uploading")
+	verifyAllMode := flag.Bool("verify-all", false, "Download every stored backup and check it against the checksum in the catalog, instead of running backups")
+	doctorMode := flag.Bool("doctor", false, "Check the binaries, log file, work directory, buckets, Apigee token and webhooks, print a pass/fail report and exit, instead of running backups")
+	repairChecksumsMode := flag.Bool("repair-checksums", false, "Download every backup that has no checksum in the catalog and record one, instead of running backups")
+	pruneOrphansMode := flag.Bool("prune-orphans", false, "Delete backups for projects no longer in the project file instead of running backups (dry run unless --yes)")
+	yes := flag.Bool("yes", false, "Confirm destructive maintenance operations and --restore")
+	diffMode := flag.Bool("diff", false, "Compare two backups of a project, given as PROJECT DATE1 DATE2 after the other flags, instead of running backups")
+	diffOutput := flag.String("diff-output", "", "With --diff, also write the diff as JSON to this file")
+	restoreMode := flag.Bool("restore", false, "Import a backup of a project, given as PROJECT DATE after the other flags, back into its org instead of running backups (dry run unless --yes)")
+	restoreEnv := flag.String("restore-env", "", "With --restore, restore only this environment's KVMs, target servers and deployments")
+	restoreTargetOrg := flag.String("restore-target-org", "", "With --restore, import into this org instead of the backup's, rewriting the references to the backup's org in the exported entities")
+	restoreConflict := flag.String("restore-conflict", conflictFail, "With --restore, what to do with an entity that already exists in the org: overwrite, skip, or fail before importing anything")
+	flag.BoolVar(&cfg.CombinedArchive, "combined-archive", cfg.CombinedArchive, "Back up all projects into a single backup_all_<date>.zip instead of one archive per project")
+	flag.StringVar(&cfg.DirMode, "dir-mode", cfg.DirMode, "Octal permissions for the work and export directories; only loosen this if another user must read them")
+	flag.BoolVar(&cfg.ResumeExport, "resume-export", cfg.ResumeExport, "Export each entity type separately and cache the results, so a retry after a failed export only re-fetches the types that failed")
+	flag.BoolVar(&cfg.ResumeUpload, "resume-upload", cfg.ResumeUpload, "Keep each archive until it is uploaded, so a rerun after a failed upload sends it again without exporting and skips parts of a split archive already in GCS")
+	flag.IntVar(&cfg.EntityConcurrency, "entity-concurrency", cfg.EntityConcurrency, "With --resume-export, how many entity types of one project to export at once")
+	flag.BoolVar(&cfg.NoClean, "no-clean", cfg.NoClean, "Keep the work directory and exported files after the run")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "OTLP/gRPC endpoint URL to export traces to, e.g. http://localhost:4317 (tracing is disabled when unset)")
+	flag.StringVar(&cfg.Report, "report", cfg.Report, "Write a JSON report of the run to this file")
+	flag.StringVar(&cfg.ReportWebhook, "report-webhook", cfg.ReportWebhook, "URL to POST the full JSON report to at the end of each run")
+	flag.StringVar(&cfg.MinFreeSpace, "min-free-space", cfg.MinFreeSpace, "Fail a project before exporting it if the work directory has less than this free, e.g. 5GB, and before zipping if it can't hold the archive (default is no check)")
+	flag.StringVar(&cfg.WorkDir, "work-dir", cfg.WorkDir, "Directory to create this run's temporary work directory in (default is the system temp directory)")
+	flag.BoolVar(&cfg.Progress, "progress", cfg.Progress, "Print the bytes uploaded, percentage and throughput of each upload to stderr every few seconds")
+	flag.BoolVar(&cfg.SkipCompress, "skip-compress", cfg.SkipCompress, "Store exported files in the archive without compressing them, to save CPU on large exports")
+	flag.StringVar(&cfg.Listen, "listen", cfg.Listen, "Stay running and serve /healthz, /status, /metrics and POST /trigger on this address, e.g. :8080")
+	flag.StringVar(&cfg.Schedule, "schedule", cfg.Schedule, "Stay running and back up on this cron schedule, e.g. \"0 2 * * *\" (minute hour day-of-month month day-of-week)")
+	flag.StringVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "With --listen or --schedule, how long to wait on SIGTERM for a run in progress to finish, e.g. 30m (default is to wait until it finishes)")
+	flag.StringVar(&cfg.LockFile, "lock-file", cfg.LockFile, "Take an exclusive lock on this file for each run, so runs sharing it never overlap; a run that finds it locked doesn't start")
+	flag.IntVar(&cfg.ChunkSizeMB, "chunk-size", cfg.ChunkSizeMB, "Resumable upload chunk size in MiB (0 uploads in a single request)")
+	flag.StringVar(&cfg.MaxArchiveSize, "max-archive-size", cfg.MaxArchiveSize, "Upload archives larger than this, e.g. 2GB or 500MiB, as numbered parts with an index (default is to never split)")
 	flag.Parse()
 
-	// Validate flags
-	if *projectFile == "" || *gcsBucket == "" || *token == "" {
-		fmt.Println("Usage: ./apigee_backup -f PROJECT_FILE --gcs=GCS_BUCKET --token=AUTH_TOKEN --retention=RETENTION_DAYS [--webhook=WEBHOOK_URL] [--tagid=TAG_IDS] [--workspace=WORKSPACE_WEBHOOK_URL]")
+	// Validate flags; maintenance modes only touch GCS and don't need a token
+	// --doctor loads the token itself, and reports a missing one
+	needsToken := !*cleanOnlyMode && !*verifyAllMode && !*repairChecksumsMode && !*pruneOrphansMode && *catalogQuery == "" && *catalogExport == "" && !*diffMode && !*doctorMode
+	if (cfg.ProjectFile == "" && *catalogQuery == "" && *catalogExport == "" && !*diffMode && !*restoreMode) || (cfg.GCSBucket == "" && !*listEntitiesMode && !*probeOnlyMode && !*doctorMode) || (needsToken && cfg.Token == "" && cfg.TokenFile == "" && !*tokenStdin && !cfg.UseADC) {
+		fmt.Println("Usage: ./apigee_backup [--config=FILE] -f PROJECT_FILE[,PROJECT_FILE...] [--tolerant-file] [--alias=PROJECT=ALIAS ...] [--alias-keys] --gcs=GCS_BUCKET [--destination=gs://BUCKET ...] [--destination-policy=all|any] [--project-bucket=PROJECT=BUCKET ...] [--prefix=PREFIX] [--unique-keys] [--dedupe] [--billing-project=PROJECT] [--kms-key=KEY] [--storage-endpoint=URL] (--token-file=FILE | --token-stdin | --token=AUTH_TOKEN | --use-adc) --retention=RETENTION_DAYS [--retention-rule=MATCH:DAYS ...] [--confirm-retention] [--min-keep=N] [--since-last-success] [--manage-lifecycle] [--limit=N [--offset=M]] [--webhook=WEBHOOK_URL] [--tagid=TAG_IDS] [--batch-size=N] [--notify-channel-override=KEY=VALUE=URL ... [--notify-summary-per-channel]] [--notify-include-links [--signed-url-ttl=DURATION]] [--workspace=WORKSPACE_WEBHOOK_URL] [--generic-webhook=URL [--webhook-secret=SECRET]] [--notify-on=all|failures|summary] [--alert-if-failures-exceed=PERCENT] [--fail-on-notify-failure] [--notify-mention-on-recovery] [--notify-dedupe-failures] [--summary-compact] [--notify-summary-every=N] [--discord-template=FILE] [--workspace-template=FILE] [--parallel=N] [--stagger=DURATION] [--pre-hook=COMMAND] [--post-hook=COMMAND] [--hook-scope=project|run] [--pre-hook-failure=fail|continue] [--export-timeout=DURATION] [--max-runtime=DURATION] [--upload-concurrency=N] [--webhook-concurrency=N] [--log-level=LEVEL] [--quiet | --verbose] [--log-sink=file|stdout|syslog] [--log-format=text|json] [--log-rotate=daily|size|both] [--output-format=text|json|yaml] [--ignore-statuses=STATUSES] [--exclude-entities=TYPES] [--exclude-glob=PATTERN ...] [--redact-credentials] [--warn-on-empty-org | --fail-on-empty-org] [--warn-growth-pct=PERCENT] [--check-quota] [--export-analytics] [--export-envgroups] [--export-org-kvms] [--export-log] [--upload-failure-logs] [--skip-compress] [--chunk-size=MIB] [--max-archive-size=SIZE] [--progress] [--combined-archive] [--work-dir=DIR] [--min-free-space=SIZE] [--dir-mode=MODE] [--no-clean] [--resume-export [--entity-concurrency=N]] [--resume-upload] [--report=FILE] [--report-webhook=URL] [--otlp-endpoint=URL] [--listen=ADDR] [--schedule=CRON] [--drain-timeout=DURATION] [--lock-file=FILE] [--date=YYYY-MM-DD] [--force] [--list-entities [--entities=TYPES]] [--probe-only] [--catalog-query=FILTER] [--catalog-export=FILE|-] [--clean-only] [--verify-all] [--repair-checksums] [--doctor] [--prune-orphans [--yes]] [--diff [--diff-output=FILE] PROJECT DATE1 DATE2] [--restore [--restore-env=NAME] [--restore-conflict=overwrite|skip|fail] [--restore-target-org=ORG] [--yes] PROJECT DATE]")
 		os.Exit(1)
 	}
 
-	// Set webhook and tag IDs
-	webhookURL = *webhook
-	if *tagid != "" {
-		tagIDs = strings.Split(*tagid, ",")
+	// A daemon reads the token again for every run
+	if (cfg.Listen != "" || cfg.Schedule != "") && *tokenStdin {
+		fmt.Println("--token-stdin can't be used with --listen or --schedule, since the token is read again for every run; use --token-file")
+		os.Exit(1)
 	}
 
-	// Set workspace webhook URL
-	workspaceWebhookURL = *workspaceWebhook
-
-	// Setup logging
-	setupLogging()
+	// Load the token once from its single source
+	var authToken string
+	var err error
+	if needsToken {
+		if cfg.UseADC {
+			if err := setupADC(context.Background()); err != nil {
+				fmt.Printf("Failed to load token: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		authToken, err = loadToken(cfg.Token, cfg.TokenFile, *tokenStdin, cfg.UseADC)
+		if err != nil {
+			fmt.Printf("Failed to load token: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	// Read project file
-	projects, err := readProjectFile(*projectFile)
-	if err != nil {
-		log.Fatalf("Failed to read project file: %v\n", err)
+	// Validate retention; 0 would delete today's backup and negatives everything
+	if cfg.RetentionDays < 1 || cfg.RetentionDays > maxRetentionDays {
+		fmt.Printf("--retention must be between 1 and %d days, got %d\n", maxRetentionDays, cfg.RetentionDays)
+		os.Exit(1)
+	}
+	for _, rule := range cfg.RetentionRules {
+		if err := validateRetentionRule(rule); err != nil {
+			fmt.Printf("Invalid retention rule: %v\n", err)
+			os.Exit(1)
+		}
 	}
+	retentionRules = cfg.RetentionRules
 
-	var statuses []ProjectStatus
-	for _, project := range projects {
-		status := backupProject(project, *gcsBucket, *token, *retentionDays)
-		statuses = append(statuses, status)
+	// Set date override for backfills; a daemon would back up every run
+	// under the same date
+	if *date != "" {
+		if cfg.Listen != "" || cfg.Schedule != "" {
+			fatalf("--date can't be used with --listen or --schedule, since every run would back up under the same date\n")
+		}
+		if err := validateBackfillDate(*date, cfg.RetentionDays); err != nil {
+			fmt.Printf("Invalid --date: %v\n", err)
+			os.Exit(1)
+		}
+		dateOverride = *date
 	}
 
-	// Send final notifications
-	sendFinalNotification(statuses)
-}
+	forceOverwrite = *force
 
-func readProjectFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+	// Set tag IDs
+	tagIDs = cfg.TagIDs
 
-	var projects []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		project := strings.TrimSpace(scanner.Text())
-		if project != "" {
-			projects = append(projects, project)
-		}
+	// Set retention floor
+	if cfg.MinKeep < 0 {
+		fmt.Println("--min-keep must not be negative")
+		os.Exit(1)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	minKeepBackups = cfg.MinKeep
+	// Lifecycle rules only know an object's age, not which backups are the
+	// newest or which archives pointers refer to
+	if cfg.ManageLifecycle && (cfg.MinKeep > 0 || cfg.Dedupe || cfg.SinceLastSuccess) {
+		fmt.Println("--manage-lifecycle can't be used with --min-keep, --dedupe or --since-last-success, which GCS lifecycle rules can't honour")
+		os.Exit(1)
 	}
+	sinceLastSuccess = cfg.SinceLastSuccess
+	manageLifecycle = cfg.ManageLifecycle
+	appliedRetention = cfg.RetentionDays
+	confirmRetention = *confirmRetentionFlag
 
-	return projects, nil
-}
+	if cfg.Limit < 0 || cfg.Offset < 0 {
+		fmt.Println("--limit and --offset must not be negative")
+		os.Exit(1)
+	}
 
-func backupProject(project, gcsBucket, token string, retentionDays int) ProjectStatus {
-	status := ProjectStatus{Project: project, Status: "Complete", Reason: "no issue"}
-	// Set ENV to the value of project
-	ENV := project
+	// Set up notifiers
+	if err := setupNotifiers(cfg); err != nil {
+		fmt.Printf("Failed to set up notifiers: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Delete the backup directory if it exists
-	if _, err := os.Stat(apigeeBackupDir); !os.IsNotExist(err) {
-		err := os.RemoveAll(apigeeBackupDir)
+	// Set backup destinations
+	destinations = []string{cfg.GCSBucket}
+	for _, spec := range cfg.Destinations {
+		bucket, err := parseDestination(spec)
 		if err != nil {
-			log.Printf("Failed to delete existing backup directory: %v\n", err)
-			status.Status = "Failed"
-			status.Reason = fmt.Sprintf("Failed to delete existing backup directory: %v", err)
-			return status
+			fmt.Printf("Invalid --destination: %v\n", err)
+			os.Exit(1)
 		}
+		destinations = append(destinations, bucket)
+	}
+	for project, spec := range cfg.ProjectBuckets {
+		bucket, err := parseBucket(spec)
+		if err != nil {
+			fmt.Printf("Invalid bucket for %s: %v\n", project, err)
+			os.Exit(1)
+		}
+		projectBuckets[project] = bucket
+	}
+	if cfg.DestinationPolicy != destinationPolicyAll && cfg.DestinationPolicy != destinationPolicyAny {
+		fmt.Printf("Invalid --destination-policy %q, must be all or any\n", cfg.DestinationPolicy)
+		os.Exit(1)
+	}
+	destinationPolicy = cfg.DestinationPolicy
+	if cfg.KMSKey != "" && !kmsKeyPattern.MatchString(cfg.KMSKey) {
+		fmt.Printf("Invalid --kms-key %q: must be projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY\n", cfg.KMSKey)
+		os.Exit(1)
 	}
 
-	// Create backup directory
-	err := os.MkdirAll(apigeeBackupDir, os.ModePerm)
+	signedURLTTL, err = parseSignedURLTTL(cfg.SignedURLTTL)
 	if err != nil {
-		log.Printf("Failed to create backup directory: %v\n", err)
-		status.Status = "Failed"
-		status.Reason = fmt.Sprintf("Failed to create backup directory: %v", err)
-		return status
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	if signedURLTTL > 0 && !cfg.NotifyIncludeLinks {
+		fmt.Println("--signed-url-ttl needs --notify-include-links")
+		os.Exit(1)
+	}
+	notifyIncludeLinks = cfg.NotifyIncludeLinks
 
-	// Get current date
-	today := time.Now().Format("2006-01-02")
+	// Set alert threshold
+	if cfg.AlertThreshold < 0 || cfg.AlertThreshold > 100 {
+		fmt.Println("--alert-if-failures-exceed must be between 0 and 100")
+		os.Exit(1)
+	}
+	alertThreshold = cfg.AlertThreshold
+	notifyOnRecovery = cfg.NotifyMentionOnRecovery
+	dedupeFailures = cfg.NotifyDedupeFailures
+	summaryCompact = cfg.SummaryCompact
+
+	// Set concurrency limits
+	if cfg.Parallel < 1 || cfg.UploadConcurrency < 1 || cfg.WebhookConcurrency < 1 || cfg.EntityConcurrency < 1 {
+		fmt.Println("--parallel, --upload-concurrency, --webhook-concurrency and --entity-concurrency must be at least 1")
+		os.Exit(1)
+	}
+	entityConcurrency = cfg.EntityConcurrency
+	uploadSem = newSemaphore(cfg.UploadConcurrency)
+	webhookConcurrency = cfg.WebhookConcurrency
+	if cfg.Stagger != "" {
+		stagger, err = time.ParseDuration(cfg.Stagger)
+		if err != nil || stagger < 0 {
+			fmt.Printf("Invalid --stagger %q: must be a duration such as 30s or 2m\n", cfg.Stagger)
+			os.Exit(1)
+		}
+	}
+	if err := validateHooks(cfg.HookScope, cfg.PreHookFailure); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if cfg.CombinedArchive && cfg.HookScope == hookScopeProject && (cfg.PreHook != "" || cfg.PostHook != "") {
+		fmt.Println("--combined-archive backs up all projects at once, so hooks need --hook-scope=run")
+		os.Exit(1)
+	}
+	preHook, postHook, hookScope, preHookFailure = cfg.PreHook, cfg.PostHook, cfg.HookScope, cfg.PreHookFailure
+	if cfg.ExportTimeout != "" {
+		exportTimeout, err = time.ParseDuration(cfg.ExportTimeout)
+		if err != nil || exportTimeout < 0 {
+			fmt.Printf("Invalid --export-timeout %q: must be a duration such as 30m or 2h\n", cfg.ExportTimeout)
+			os.Exit(1)
+		}
+	}
+	if cfg.MaxRuntime != "" {
+		maxRuntime, err = time.ParseDuration(cfg.MaxRuntime)
+		if err != nil || maxRuntime < 0 {
+			fmt.Printf("Invalid --max-runtime %q: must be a duration such as 50m or 5h30m\n", cfg.MaxRuntime)
+			os.Exit(1)
+		}
+	}
+	if maxRuntime > 0 && cfg.CombinedArchive {
+		fmt.Println("--combined-archive backs up all projects at once, so it can't stop early for --max-runtime")
+		os.Exit(1)
+	}
 
-	// Check if a backup for today already exists in GCS
-	if backupExistsInGCS(gcsBucket, today, ENV) {
-		log.Printf("Backup for %s already exists in GCS. Skipping new backup.\n", today)
-		return status
+	// Set log level
+	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		fmt.Printf("Invalid --log-level: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Quiet && cfg.Verbose {
+		fmt.Println("--quiet and --verbose can't be used together")
+		os.Exit(1)
+	}
+	if cfg.Quiet && cfg.Progress {
+		fmt.Println("--progress can't be used with --quiet")
+		os.Exit(1)
+	}
+	quiet, verbose = cfg.Quiet, cfg.Verbose
+	if verbose {
+		logLevel.Set(slog.LevelDebug)
+	}
+	if err := validateLogging(cfg.LogSink, cfg.LogFormat, cfg.LogRotate); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	logSink, logFormat, logRotate = cfg.LogSink, cfg.LogFormat, cfg.LogRotate
+	if err := validateOutputFormat(cfg.OutputFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if cfg.OutputFormat != outputFormatText && (cfg.Listen != "" || cfg.Schedule != "") {
+		fmt.Println("--output-format=json or yaml writes a single run's statuses, so it can't be used with --listen or --schedule")
+		os.Exit(1)
+	}
+	outputFormat = cfg.OutputFormat
+	if outputFormat != outputFormatText {
+		consoleOutput = os.Stderr
+	}
+	saveExportLog = cfg.ExportLog
+	exportAnalytics = cfg.ExportAnalytics
+	exportEnvGroups = cfg.ExportEnvGroups
+	exportOrgKVMs = cfg.ExportOrgKVMs
+	warnOnEmptyOrg, failOnEmptyOrg = cfg.WarnOnEmptyOrg, cfg.FailOnEmptyOrg
+	if cfg.WarnGrowthPct < 0 {
+		fmt.Println("--warn-growth-pct must not be negative")
+		os.Exit(1)
+	}
+	warnGrowthPct = cfg.WarnGrowthPct
+	for _, errorStatus := range cfg.IgnoreStatuses {
+		if errorStatus = strings.TrimSpace(errorStatus); errorStatus != "" {
+			ignoredStatuses[strings.ToUpper(errorStatus)] = true
+		}
+	}
+	for _, name := range cfg.ExcludeEntities {
+		if name = strings.TrimSpace(name); name != "" {
+			excludedEntities[strings.ToLower(name)] = true
+		}
+	}
+	for _, pattern := range cfg.ExcludeGlobs {
+		if err := validateExcludeGlob(pattern); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	excludedGlobs = cfg.ExcludeGlobs
+	redactCredentials = cfg.RedactCredentials
+	uploadFailureLogs = cfg.UploadFailureLogs
+	noClean = cfg.NoClean
+	resumeExport = cfg.ResumeExport
+	resumeUpload = cfg.ResumeUpload
+	exportCacheRoot = filepath.Join(cfg.WorkDir, "apigee_backup-cache")
+	if cfg.WorkDir == "" {
+		root, err := defaultExportCacheRoot()
+		if err != nil && (resumeExport || resumeUpload) {
+			fmt.Printf("Failed to find a directory for the export cache, set --work-dir: %v\n", err)
+			os.Exit(1)
+		}
+		exportCacheRoot = root
+	}
+	if resumeExport || resumeUpload {
+		if err := checkExportCacheRoot(exportCacheRoot); err != nil {
+			fmt.Printf("Refusing to use the export cache: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Create date folder
-	dateFolder := filepath.Join(apigeeBackupDir, today)
-	err = os.MkdirAll(dateFolder, os.ModePerm)
-	if err != nil {
-		log.Printf("Failed to create date folder: %v\n", err)
-		status.Status = "Failed"
-		status.Reason = fmt.Sprintf("Failed to create date folder: %v", err)
-		return status
+	// Set work directory permissions
+	mode, err := strconv.ParseUint(cfg.DirMode, 8, 32)
+	if err != nil || mode > 0777 {
+		fmt.Printf("Invalid --dir-mode %q: must be octal permissions such as 0700\n", cfg.DirMode)
+		os.Exit(1)
 	}
+	dirMode = os.FileMode(mode)
 
-	// Backup Apigee data using apigeecli
-	exportFolder := filepath.Join(apigeeBackupDir, "export")
-	err = os.MkdirAll(exportFolder, os.ModePerm)
-	if err != nil {
-		log.Printf("Failed to create export folder: %v\n", err)
-		status.Status = "Failed"
-		status.Reason = fmt.Sprintf("Failed to create export folder: %v", err)
-		return status
+	// Set upload chunk size
+	if cfg.ChunkSizeMB < 0 {
+		fmt.Println("--chunk-size must not be negative")
+		os.Exit(1)
+	}
+	uploadChunkSize = cfg.ChunkSizeMB * 1024 * 1024
+	if cfg.MaxArchiveSize != "" {
+		size, err := parseByteSize(cfg.MaxArchiveSize)
+		if err != nil {
+			fmt.Printf("Invalid --max-archive-size: %v\n", err)
+			os.Exit(1)
+		}
+		maxArchiveSize = size
+	}
+	if cfg.MinFreeSpace != "" {
+		size, err := parseByteSize(cfg.MinFreeSpace)
+		if err != nil {
+			fmt.Printf("Invalid --min-free-space: %v\n", err)
+			os.Exit(1)
+		}
+		minFreeSpace = size
 	}
+	skipCompress = cfg.SkipCompress
+	showProgress = cfg.Progress
+
+	// Set storage options
+	billingProject = cfg.BillingProject
+	kmsKeyName = cfg.KMSKey
+	objectPrefix = strings.Trim(cfg.Prefix, "/")
+	uniqueKeys = cfg.UniqueKeys
+	dedupe = cfg.Dedupe
+	tolerantProjectFile = cfg.TolerantFile
+	for project, alias := range cfg.Aliases {
+		projectAliases[project] = alias
+	}
+	aliasKeys = cfg.AliasKeys
 
-	// Capture the output of the command
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd := exec.Command("bash", "-c", fmt.Sprintf("cd %s && apigeecli organizations export --all -o %s -t %s", exportFolder, project, token))
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("Failed to execute apigeecli command: %v\n", err)
-		errorMessage := parseError(stderr.String())
-		if !strings.Contains(errorMessage, "FAILED_PRECONDITION") {
-			status.Status = "Failed"
-			status.Reason = errorMessage
-			sendDiscordNotification(project, today, "Failed", errorMessage)
-			sendWorkspaceNotification(project, fmt.Sprintf("apigee-%s", project), "Failed", errorMessage)
-			return status
+	// Check the environment instead of running backups. This runs before
+	// logging is set up, so a log file that can't be opened is reported
+	if *doctorMode {
+		if printDoctorReport(os.Stdout, runDoctor(cfg, *tokenStdin)) {
+			os.Exit(1)
 		}
-		log.Printf("Continuing despite FAILED_PRECONDITION error: %v\n", errorMessage)
+		return
 	}
 
-	// Zip the backup folder
-	zipFile := filepath.Join(dateFolder, fmt.Sprintf("backup_%s_%s.zip", ENV, today))
-	err = zipFolder(exportFolder, zipFile)
+	// Setup logging
+	setupLogging()
+
+	// Load notification templates
+	discordTemplate, err = loadTemplate(cfg.DiscordTemplate)
 	if err != nil {
-		log.Printf("Failed to zip folder: %v\n", err)
-		status.Status = "Failed"
-		status.Reason = fmt.Sprintf("Failed to zip folder: %v", err)
-		return status
+		fatalf("Failed to load Discord template: %v\n", err)
 	}
-
-	// Upload backup to GCS
-	err = uploadToGCS(gcsBucket, zipFile, ENV)
+	workspaceTemplate, err = loadTemplate(cfg.WorkspaceTemplate)
 	if err != nil {
-		log.Printf("Failed to upload backup to GCS: %v\n", err)
-		status.Status = "Failed"
-		status.Reason = fmt.Sprintf("Failed to upload backup to GCS: %v", err)
-		return status
+		fatalf("Failed to load Google Workspace template: %v\n", err)
 	}
 
-	// Send notifications for each project
-	sendDiscordNotification(project, today, "Complete", "no issue")
-	sendWorkspaceNotification(project, fmt.Sprintf("apigee-%s", project), "Complete", "no issue")
+	// A broken alert path fails the run only when asked to. This is deferred
+	// first so it runs after every other deferred cleanup.
+	defer func() {
+		if cfg.FailOnNotifyFailure && len(notificationFailures) > 0 {
+			log.Printf("%d notifications failed to send (--fail-on-notify-failure)\n", len(notificationFailures))
+			os.Exit(2)
+		}
+	}()
 
-	// Cleanup old backups
-	err = cleanupOldBackups(gcsBucket, retentionDays, ENV)
-	if err != nil {
-		log.Printf("Failed to clean up old backups: %v\n", err)
-		status.Status = "Failed"
-		status.Reason = fmt.Sprintf("Failed to clean up old backups: %v", err)
+	// Create GCS client
+	if err := newGCSClient(context.Background(), cfg.StorageEndpoint); err != nil {
+		fatalf("Failed to create GCS client: %v\n", err)
+	}
+	defer gcsClient.Close()
+
+	// Probe the buckets so endpoint or billing problems fail the run now
+	probed := make(map[string]bool)
+	if cfg.GCSBucket != "" {
+		for _, bucket := range allDestinations() {
+			if err := probeDestination(bucket); err != nil {
+				fatalf("%v\n", err)
+			}
+			probed[bucket] = true
+		}
+		// Links only ever point into the first destination
+		if signedURLTTL > 0 {
+			if err := probeURLSigning(destinations[0]); err != nil {
+				fatalf("Failed to use --signed-url-ttl: %v\n", err)
+			}
+		}
 	}
 
-	return status
-}
-
-func setupLogging() {
-	logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	// Read project file; --diff and --restore use its labels, such as a
+	// project's bucket, alias and endpoint, if one is given
+	var projects []string
+	projects, projectLabels, err = readProjectFiles(cfg.ProjectFile)
 	if err != nil {
-		fmt.Printf("Failed to open log file: %v\n", err)
-		os.Exit(1)
+		fatalf("Failed to read project file: %v\n", err)
 	}
-	log.SetOutput(io.MultiWriter(logFile, os.Stdout))
-
-	// Check log file size and rotate if necessary
-	stat, err := logFile.Stat()
-	if err == nil && stat.Size() >= maxLogFileSize {
-		rotateLogs()
+	if err := checkAliases(projects); err != nil {
+		fatalf("Invalid aliases: %v\n", err)
 	}
-}
-
-func rotateLogs() {
-	for i := 9; i >= 1; i-- {
-		oldLog := fmt.Sprintf("/var/log/apigee%d.zip", i)
-		newLog := fmt.Sprintf("/var/log/apigee%d.zip", i+1)
-		if _, err := os.Stat(oldLog); err == nil {
-			os.Rename(oldLog, newLog)
+	if err := checkRetentionLabels(projects); err != nil {
+		fatalf("Invalid retention label: %v\n", err)
+	}
+	if err := checkEndpointLabels(projects); err != nil {
+		fatalf("Invalid endpoint label: %v\n", err)
+	}
+	if err := checkProjectBuckets(projects, cfg.CombinedArchive); err != nil {
+		fatalf("Invalid project bucket: %v\n", err)
+	}
+	// Buckets named by labels couldn't be probed before the file was read
+	if cfg.GCSBucket != "" {
+		for _, bucket := range allDestinations() {
+			if probed[bucket] {
+				continue
+			}
+			if err := probeDestination(bucket); err != nil {
+				fatalf("%v\n", err)
+			}
 		}
 	}
-	zipCmd := exec.Command("zip", "-r", "/var/log/apigee1.zip", logFilePath)
-	zipCmd.Stdout = os.Stdout
-	zipCmd.Stderr = os.Stderr
-	zipCmd.Run()
-	os.Remove(logFilePath)
-}
 
-func sendDiscordNotification(project, date, status, reason string) {
-	if webhookURL == "" {
+	// Compare two backups instead of running backups
+	if *diffMode {
+		args := flag.Args()
+		if len(args) != 3 {
+			fatalf("--diff needs PROJECT DATE1 DATE2 after the other flags, got %d arguments\n", len(args))
+		}
+		for _, d := range args[1:] {
+			if _, err := time.Parse(dateLayout, d); err != nil {
+				fatalf("Invalid --diff date %q: must be YYYY-MM-DD\n", d)
+			}
+		}
+		diff, err := diffBackups(projectDestinations(args[0])[0], args[0], args[1], args[2])
+		if err != nil {
+			fatalf("Failed to compare backups: %v\n", err)
+		}
+		diff.print(os.Stdout)
+		if *diffOutput != "" {
+			if err := writeDiff(*diffOutput, diff); err != nil {
+				fatalf("Failed to write diff: %v\n", err)
+			}
+		}
 		return
 	}
 
-	if reason == "" {
-		reason = "no issue"
+	// Import a backup back into its org instead of running backups
+	if *restoreMode {
+		args := flag.Args()
+		if len(args) != 2 {
+			fatalf("--restore needs PROJECT DATE after the other flags, got %d arguments\n", len(args))
+		}
+		if _, err := time.Parse(dateLayout, args[1]); err != nil {
+			fatalf("Invalid --restore date %q: must be YYYY-MM-DD\n", args[1])
+		}
+		if *restoreConflict != conflictOverwrite && *restoreConflict != conflictSkip && *restoreConflict != conflictFail {
+			fatalf("Invalid --restore-conflict %q: must be overwrite, skip or fail\n", *restoreConflict)
+		}
+		opts := restoreOptions{Env: *restoreEnv, Apply: *yes, Conflict: *restoreConflict, TargetOrg: *restoreTargetOrg}
+		if err := restoreBackup(os.Stdout, projectDestinations(args[0])[0], args[0], args[1], authToken, opts); err != nil {
+			fatalf("Failed to restore backup: %v\n", err)
+		}
+		return
 	}
-
-	content := fmt.Sprintf("**%s** (`apigee-%s`) - %s", project, project, status)
-	if reason != "" {
-		content = fmt.Sprintf("%s\nReason: %s", content, reason)
+	if *restoreEnv != "" || *restoreConflict != conflictFail || *restoreTargetOrg != "" {
+		fatalf("--restore-env, --restore-conflict and --restore-target-org can only be used with --restore\n")
 	}
-	if len(tagIDs) > 0 {
-		tags := make([]string, len(tagIDs))
-		for i, id := range tagIDs {
-			tags[i] = fmt.Sprintf("<@%s>", id)
+
+	// Query the catalog instead of running backups
+	if *catalogQuery != "" {
+		filter, err := parseCatalogFilter(*catalogQuery)
+		if err != nil {
+			fatalf("Invalid --catalog-query: %v\n", err)
+		}
+		if err := queryCatalog(os.Stdout, cfg.GCSBucket, filter); err != nil {
+			fatalf("Failed to query catalog: %v\n", err)
 		}
-		tagMessage := strings.Join(tags, " ")
-		content = fmt.Sprintf("%s\n\n%s", content, tagMessage)
+		return
 	}
 
-	embed := map[string]interface{}{
-		"title":       fmt.Sprintf("Apigee Backup Notification %s", date),
-		"description": content,
-		"color":       16711680, // Red color
-		"footer": map[string]interface{}{
-			"text": "Note : Project - Apigee - Status",
-		},
+	// Export the backup inventory instead of running backups, for the
+	// project file's projects if one was given and otherwise the whole bucket
+	if *catalogExport != "" {
+		if err := exportInventory(*catalogExport, projects); err != nil {
+			fatalf("Failed to export catalog: %v\n", err)
+		}
+		return
 	}
 
-	discordMessage := map[string]interface{}{
-		"content": "",
-		"embeds":  []map[string]interface{}{embed},
+	// Check Apigee access to every project instead of running backups
+	if *probeOnlyMode {
+		if err := probeProjects(os.Stdout, projects, authToken, cfg.Parallel); err != nil {
+			fatalf("Probe failed: %v\n", err)
+		}
+		return
 	}
 
-	messageJSON, err := json.Marshal(discordMessage)
-	if err != nil {
-		log.Printf("Failed to marshal Discord message: %v\n", err)
+	// List entity counts instead of running backups
+	if *listEntitiesMode {
+		var names []string
+		if *entities != "" {
+			names = strings.Split(*entities, ",")
+		}
+		types, err := selectEntityTypes(names)
+		if err != nil {
+			fatalf("Invalid --entities: %v\n", err)
+		}
+		if err := listEntities(projects, authToken, types); err != nil {
+			fatalf("Failed to list entities: %v\n", err)
+		}
 		return
 	}
 
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(messageJSON))
-	if err != nil {
-		log.Printf("Failed to send Discord notification: %v\n", err)
+	// Prune orphaned backups instead of running backups
+	if *pruneOrphansMode {
+		if err := pruneOrphans(projects, *yes); err != nil {
+			fatalf("Failed to prune orphaned backups: %v\n", err)
+		}
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
-		log.Printf("Failed to send Discord notification, received status code: %d\n", resp.StatusCode)
+	// Apply retention without running backups
+	if *cleanOnlyMode {
+		appliedEnvRetention = envRetentions(projects, false, cfg.RetentionDays)
+		if err := checkRetentionChange(appliedEnvRetention); err != nil {
+			fatalf("%v\n", err)
+		}
+		if manageLifecycle {
+			if err := applyLifecycles(appliedEnvRetention); err != nil {
+				fatalf("%v\n", err)
+			}
+		}
+		statuses := cleanOnly(projects, cfg.RetentionDays)
+		if err := updateCatalog(cfg.GCSBucket, backupDate(), nil); err != nil {
+			log.Printf("Failed to update catalog: %v\n", err)
+		}
+		sendFinalNotification(statuses, nil)
+		publishReport(cfg, statuses)
+		printStatuses(statuses)
+		return
 	}
-}
 
-func sendWorkspaceNotification(project, dataset, status, reason string) {
-	if workspaceWebhookURL == "" {
+	// Check stored backups against their checksums without running backups
+	if *verifyAllMode {
+		statuses, err := verifyAll(projects)
+		if err != nil {
+			fatalf("Failed to verify backups: %v\n", err)
+		}
+		sendFinalNotification(statuses, nil)
+		publishReport(cfg, statuses)
+		printStatuses(statuses)
 		return
 	}
 
-	if reason == "" {
-		reason = "no issue"
+	// Record missing checksums without running backups
+	if *repairChecksumsMode {
+		statuses, err := repairChecksums(projects)
+		if err != nil {
+			fatalf("Failed to repair checksums: %v\n", err)
+		}
+		sendFinalNotification(statuses, nil)
+		publishReport(cfg, statuses)
+		printStatuses(statuses)
+		return
 	}
 
-	message := fmt.Sprintf("*Apigee Daily Backup %s*\n\n*| `Project` | `Apigee-Orgs` | `Status` | `Reason` |*\n|---|---|---|\n| `%s` | `%s` | `%s` | `%s` |", time.Now().Format("2006-01-02"), project, dataset, status, reason)
-
-	workspaceMessage := map[string]string{"text": message}
-	workspaceMessageJSON, err := json.Marshal(workspaceMessage)
+	// Trace backup runs, each under its own root span
+	shutdownTracing, err := setupTracing(context.Background(), cfg.OTLPEndpoint)
 	if err != nil {
-		log.Printf("Failed to marshal Google Workspace message: %v\n", err)
-		return
+		fatalf("Failed to set up tracing: %v\n", err)
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Printf("Failed to flush traces: %v\n", err)
+		}
+	}()
 
-	resp, err := http.Post(workspaceWebhookURL, "application/json", bytes.NewBuffer(workspaceMessageJSON))
-	if err != nil {
-		log.Printf("Failed to send Google Workspace notification: %v\n", err)
+	// Stay running and back up on demand or on a schedule
+	if cfg.Listen != "" || cfg.Schedule != "" {
+		if err := runDaemon(cfg); err != nil {
+			fatalf("Daemon stopped: %v\n", err)
+		}
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to send Google Workspace notification, received status code: %d\n", resp.StatusCode)
+	statuses, err := runBackup(cfg, projects, authToken)
+	if err != nil {
+		fatalf("%v\n", err)
 	}
+	printStatuses(statuses)
 }
 
-func sendFinalNotification(statuses []ProjectStatus) {
-	date := time.Now().Format("2006-01-02")
-
-	// Send final Discord notification
-	if webhookURL != "" {
-		content := fmt.Sprintf("**Apigee Backup Summary %s**", date)
-		for _, status := range statuses {
-			content = fmt.Sprintf("%s\n* **%s** - %s (`%s`)", content, status.Project, status.Status, status.Reason)
+// runBackup backs up projects, records the run in the catalog, sends the
+// final notification and writes the report. It returns an error only if
+// the run couldn't start.
+func runBackup(cfg Config, projects []string, authToken string) ([]ProjectStatus, error) {
+	// Don't overlap with another run using the same lock file
+	if cfg.LockFile != "" {
+		release, err := acquireLock(cfg.LockFile)
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("another run holds %s, not starting", cfg.LockFile)
 		}
-
-		embed := map[string]interface{}{
-			"title":       fmt.Sprintf("Apigee Backup Summary %s", date),
-			"description": content,
-			"color":       65280, // Green color
-			"footer": map[string]interface{}{
-				"text": "Note : Project - Status - Reason",
-			},
+		if err != nil {
+			return nil, err
 		}
+		defer release()
+	}
 
-		discordMessage := map[string]interface{}{
-			"content": "",
-			"embeds":  []map[string]interface{}{embed},
+	// Only back up this run's window of the project file
+	projects, runSlice = selectProjects(projects, cfg.Offset, cfg.Limit)
+	if runSlice != nil {
+		log.Printf("Backing up %s (--limit=%d --offset=%d)\n", strings.ToLower(runSlice.String()), cfg.Limit, cfg.Offset)
+	}
+
+	// A shorter retention must be confirmed before it deletes anything
+	appliedEnvRetention = envRetentions(projects, cfg.CombinedArchive, cfg.RetentionDays)
+	if err := checkRetentionChange(appliedEnvRetention); err != nil {
+		return nil, err
+	}
+	if manageLifecycle {
+		if err := applyLifecycles(appliedEnvRetention); err != nil {
+			return nil, err
 		}
+	}
 
-		messageJSON, err := json.Marshal(discordMessage)
-		if err != nil {
-			log.Printf("Failed to marshal final Discord message: %v\n", err)
-			return
+	detectApigeecliVersion()
+
+	if cfg.CheckQuota && len(projects) > 0 {
+		if err := checkQuota(projects[0], authToken); err != nil {
+			return nil, err
 		}
+	}
 
-		resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(messageJSON))
-		if err != nil {
-			log.Printf("Failed to send final Discord notification: %v\n", err)
-			return
+	// A run-scope pre-hook that fails stops the run before anything is exported
+	var runHookWarnings []string
+	if hookScope == hookScopeRun && preHook != "" {
+		if err := runHook("Pre-hook", preHook, runHookEnv("pre", projects, nil)); err != nil {
+			if preHookFailure == hookFailureFail {
+				return nil, err
+			}
+			runHookWarnings = append(runHookWarnings, err.Error())
 		}
-		defer resp.Body.Close()
+	}
+
+	// Create this run's work directory
+	var err error
+	runDir, err = os.MkdirTemp(cfg.WorkDir, "apigee_backup-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	// MkdirTemp always uses 0700
+	if err := os.Chmod(runDir, dirMode); err != nil {
+		return nil, fmt.Errorf("failed to set work directory permissions: %w", err)
+	}
+	if noClean {
+		log.Printf("Keeping work directory %s (--no-clean)\n", runDir)
+	} else {
+		defer removeWorkDir(runDir)
+	}
 
-		if resp.StatusCode != http.StatusNoContent {
-			log.Printf("Failed to send final Discord notification, received status code: %d\n", resp.StatusCode)
+	// Look up earlier failures before this run's backups add to the catalog
+	loadFailureHistory()
+
+	// Trace the whole run under one root span
+	ctx, runSpan := tracer.Start(context.Background(), "backup run", trace.WithAttributes(attribute.Int("backup.projects", len(projects))))
+
+	var statuses []ProjectStatus
+	if cfg.CombinedArchive {
+		// Back up all projects into a single archive
+		statuses = backupCombined(ctx, projects, cfg.GCSBucket, authToken, cfg.RetentionDays, cfg.Parallel)
+		for i := range statuses {
+			markRepeatFailure(&statuses[i])
+			notifyProject(statuses[i])
 		}
+	} else {
+		// Back up projects, at most --parallel at a time, until the time
+		// budget runs out; projects already started are always finished
+		statuses = make([]ProjectStatus, len(projects))
+		workers := newSemaphore(cfg.Parallel)
+		var budget runBudget
+		var wg sync.WaitGroup
+		for i, project := range projects {
+			workers.acquire()
+			if !budget.allows() {
+				workers.release()
+				statuses[i] = skippedProject(project)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer workers.release()
+				waitStagger()
+				start := time.Now()
+				statuses[i] = backupProjectWithHooks(ctx, project, cfg.GCSBucket, authToken, cfg.RetentionDays)
+				budget.record(time.Since(start))
+				markRepeatFailure(&statuses[i])
+				notifyProject(statuses[i])
+			}()
+		}
+		wg.Wait()
 	}
 
-	// Send final Workspace notification
-	if workspaceWebhookURL != "" {
-		content := fmt.Sprintf("*Apigee Daily Backup Summary %s*\n\n*| `Project` | `Status` | `Reason` |*\n|---|---|---|\n", date)
-		for _, status := range statuses {
-			content = fmt.Sprintf("%s| `%s` | `%s` | `%s` |\n", content, status.Project, status.Status, status.Reason)
+	if hookScope == hookScopeRun && postHook != "" {
+		if err := runHook("Post-hook", postHook, runHookEnv("post", projects, statuses)); err != nil {
+			runHookWarnings = append(runHookWarnings, err.Error())
 		}
+	}
+	// A run-scope hook's problem is shown with every project
+	for i := range statuses {
+		statuses[i].Warnings = append(statuses[i].Warnings, runHookWarnings...)
+	}
 
-		workspaceMessage := map[string]string{"text": content}
-		workspaceMessageJSON, err := json.Marshal(workspaceMessage)
+	// Compare with the previous run before the catalog records this one
+	changes := runChanges(cfg.GCSBucket, backupDate(), statuses)
+	sendRecoveryNotification(changes)
+
+	// Record this run in the catalog
+	if err := updateCatalog(cfg.GCSBucket, backupDate(), statuses); err != nil {
+		log.Printf("Failed to update catalog: %v\n", err)
+	}
+
+	// Send final notifications, unless a quiet run's summary is withheld
+	if summaryDue(cfg.GCSBucket, statuses, changes) {
+		sendFinalNotification(statuses, changes)
+	} else {
+		flushBatches()
+	}
+	runSpan.End()
+
+	// Write and send the JSON report
+	publishReport(cfg, statuses)
+
+	uploaded, _ := totalBytes(statuses)
+	log.Printf("Backup run finished in %s: %d of %d projects complete, %s uploaded\n", time.Since(runStart).Round(time.Second), len(statuses)-countFailed(statuses)-countSkipped(statuses), len(statuses), formatBytes(uploaded))
+	if skipped := countSkipped(statuses); skipped > 0 {
+		log.Printf("%d projects were skipped to stay within --max-runtime\n", skipped)
+	}
+	return statuses, nil
+}
+
+// projectLabels holds the labels given to each project in the project file.
+var projectLabels = map[string]map[string]string{}
+
+// tolerantProjectFile skips malformed lines of the project file with a
+// warning instead of refusing to run.
+var tolerantProjectFile bool
+
+// maxProjectLine is the longest project file line that is parsed. Real
+// lines are far shorter; a longer one is a malformed, e.g. generated, file.
+const maxProjectLine = 1 << 20
+
+// readProjectFiles reads every project file in the comma-separated list
+// filePaths and merges them in order. A project listed in several files is
+// backed up once, with the labels of all its lines.
+func readProjectFiles(filePaths string) ([]string, map[string]map[string]string, error) {
+	var projects []string
+	seen := make(map[string]bool)
+	labels := make(map[string]map[string]string)
+	for _, filePath := range strings.Split(filePaths, ",") {
+		if filePath = strings.TrimSpace(filePath); filePath == "" {
+			continue
+		}
+		fileProjects, fileLabels, err := readProjectFile(filePath)
 		if err != nil {
-			log.Printf("Failed to marshal final Google Workspace message: %v\n", err)
-			return
+			return nil, nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		for _, project := range fileProjects {
+			if seen[project] {
+				log.Printf("%s lists %s again, backing it up once\n", filePath, project)
+			} else {
+				projects = append(projects, project)
+				seen[project] = true
+			}
+		}
+		for project, projectLabels := range fileLabels {
+			if labels[project] == nil {
+				labels[project] = make(map[string]string)
+			}
+			maps.Copy(labels[project], projectLabels)
 		}
+	}
+	return projects, labels, nil
+}
+
+// readProjectFile reads project IDs from a local path or a gs:// URL,
+// transparently decompressing files ending in .gz. Each line is a project
+// ID optionally followed by key=value labels, which are returned by project.
+// A malformed line is an error, or skipped with tolerantProjectFile.
+func readProjectFile(filePath string) ([]string, map[string]map[string]string, error) {
+	var file io.ReadCloser
+	var err error
+	if strings.HasPrefix(filePath, "gs://") {
+		file, err = openGCSObject(filePath)
+	} else {
+		file, err = os.Open(filePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
 
-		resp, err := http.Post(workspaceWebhookURL, "application/json", bytes.NewBuffer(workspaceMessageJSON))
+	var reader io.Reader = file
+	if strings.HasSuffix(filePath, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
 		if err != nil {
-			log.Printf("Failed to send final Google Workspace notification: %v\n", err)
-			return
+			return nil, nil, fmt.Errorf("failed to decompress %s: %w", filePath, err)
 		}
-		defer resp.Body.Close()
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Failed to send final Google Workspace notification, received status code: %d\n", resp.StatusCode)
+	var projects []string
+	labels := make(map[string]map[string]string)
+	lines := bufio.NewReader(reader)
+	for line := 1; ; line++ {
+		text, err := readProjectLine(lines)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var project string
+		var lineLabels map[string]string
+		if err == nil {
+			project, lineLabels, err = parseProjectLine(text)
+		}
+		var malformed *malformedLineError
+		switch {
+		case errors.As(err, &malformed) && tolerantProjectFile:
+			log.Printf("Skipping line %d of %s: %v\n", line, filePath, err)
+			continue
+		case malformed != nil:
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		case err != nil:
+			return nil, nil, err
+		case project == "":
+			continue
+		}
+		projects = append(projects, project)
+		for key, value := range lineLabels {
+			if labels[project] == nil {
+				labels[project] = make(map[string]string)
+			}
+			labels[project][key] = value
 		}
 	}
+
+	return projects, labels, nil
 }
 
-func backupExistsInGCS(gcsBucket, date, env string) bool {
-	// Check for the backup existence in the GCS bucket
-	cmd := exec.Command("gsutil", "ls", fmt.Sprintf("gs://%s/%s/%s/", gcsBucket, env, date))
-	err := cmd.Run()
-	return err == nil
+// malformedLineError is a project file line that can't be parsed.
+type malformedLineError struct {
+	reason string
 }
 
-func uploadToGCS(gcsBucket, sourceFile, env string) error {
-	// Upload the backup to GCS
-	destDir := fmt.Sprintf("gs://%s/%s/%s", gcsBucket, env, filepath.Base(sourceFile))
-	cmd := exec.Command("gsutil", "cp", sourceFile, destDir)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func (e *malformedLineError) Error() string {
+	return e.reason
 }
 
-func cleanupOldBackups(gcsBucket string, retentionDays int, env string) error {
-	// List objects in GCS bucket
-	cmd := exec.Command("gsutil", "ls", fmt.Sprintf("gs://%s/%s/", gcsBucket, env))
-	output, err := cmd.Output()
+// readProjectLine returns the next line of r without its line ending, or
+// io.EOF after the last one. A line longer than maxProjectLine is read to
+// its end and discarded, and reported as a *malformedLineError.
+func readProjectLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	var length int
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		length += len(chunk)
+		if length <= maxProjectLine {
+			line = append(line, chunk...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if length > maxProjectLine {
+		return "", &malformedLineError{fmt.Sprintf("line is %d bytes, longer than the %d byte limit", length, maxProjectLine)}
+	}
+	return string(line), nil
+}
+
+// parseProjectLine splits a project file line into the project ID and its
+// labels. A blank line returns an empty project.
+func parseProjectLine(text string) (string, map[string]string, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+	var labels map[string]string
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return "", nil, &malformedLineError{fmt.Sprintf("invalid label %q, expected key=value", field)}
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = value
+	}
+	return fields[0], labels, nil
+}
+
+func backupProject(ctx context.Context, project, gcsBucket, token string, retentionDays int) ProjectStatus {
+	retentionDays = projectRetention(project, retentionDays)
+	status := ProjectStatus{Project: project, Status: "Complete", Reason: "no issue", Alias: projectAlias(project), Labels: projectLabels[project], RetentionDays: retentionDays, Endpoint: projectEndpoint(project), StartedAt: time.Now()}
+	ctx, span := tracer.Start(ctx, "backup "+project, trace.WithAttributes(attribute.String("apigee.org", project)))
+	defer func() { endSpan(span, status) }()
+	// Set ENV to the env the project's backups are stored under
+	ENV := storageEnv(project)
+	if bucket := projectBucket(project); bucket != "" {
+		gcsBucket = bucket
+	}
+	status.Bucket = gcsBucket
+
+	// Each project works in its own subdirectory so parallel backups don't collide
+	workDir := filepath.Join(runDir, project)
+	if !noClean {
+		defer removeWorkDir(workDir)
+	}
+
+	// Create backup directory
+	err := os.MkdirAll(workDir, dirMode)
 	if err != nil {
-		return fmt.Errorf("failed to list GCS bucket: %w", err)
+		failProject(&status, newBackupError(ErrLocal, "Failed to create backup directory", err))
+		return status
 	}
 
-	// Calculate cutoff date
-	cutoffDate := time.Now().AddDate(0, 0, -retentionDays)
+	// Get current date
+	today := backupDate()
 
-	// Parse and delete old backups
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if line == "" {
-			continue
+	// Check which destinations still need a backup for today
+	missing, err := missingDestinations(today, ENV)
+	if err != nil {
+		failProject(&status, gcsError("Failed to check for existing backup in GCS", err))
+		return status
+	}
+	if len(missing) == 0 {
+		log.Printf("Backup for %s already exists in GCS. Skipping new backup.\n", today)
+		status.Object = existingBackupObject(today, ENV)
+		return status
+	}
+
+	// An archive kept by a run whose upload failed is sent again as it is
+	if resumeUpload {
+		removeStaleExportCaches(project, today)
+		if state, ok := readPendingUpload(project, today); ok {
+			log.Printf("Resuming the upload of the archive of %s kept by an earlier run\n", project)
+			status.SHA256, status.ContentSHA256, status.EntityCounts = state.SHA256, state.ContentSHA256, state.EntityCounts
+			storeArchive(ctx, &status, filepath.Join(pendingUploadDir(project, today), state.Archive), ENV, missing, retentionDays)
+			return status
 		}
-		if isOlderThanRetention(line, cutoffDate, env) {
-			cmd := exec.Command("gsutil", "rm", line)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err := cmd.Run()
+	}
+
+	// Fail now rather than partway through the export on a full disk
+	if err := checkExportSpace(workDir); err != nil {
+		failProject(&status, err)
+		return status
+	}
+
+	// Create date folder
+	dateFolder := filepath.Join(workDir, today)
+	err = os.MkdirAll(dateFolder, dirMode)
+	if err != nil {
+		failProject(&status, newBackupError(ErrLocal, "Failed to create date folder", err))
+		return status
+	}
+
+	// Backup Apigee data using apigeecli
+	exportFolder := filepath.Join(workDir, "export")
+	err = os.MkdirAll(exportFolder, dirMode)
+	if err != nil {
+		failProject(&status, newBackupError(ErrLocal, "Failed to create export folder", err))
+		return status
+	}
+
+	_, stage := tracer.Start(ctx, "export")
+	err = exportProject(&status, project, token, exportFolder, gcsBucket, today)
+	endStage(stage, err)
+	if err != nil {
+		failProject(&status, err)
+		return status
+	}
+
+	// Record what the archive contains
+	status.EntityCounts, err = countExportedEntities(exportFolder)
+	if err != nil {
+		warnProject(&status, "Failed to count exported entities: %v", err)
+	} else if checkEmptyOrg(&status) {
+		return status
+	}
+	// An unchanged org is stored as a pointer to its previous backup
+	status.ContentSHA256, err = exportContentSHA256(exportFolder)
+	if err != nil {
+		warnProject(&status, "Failed to checksum exported content: %v", err)
+	}
+	if dedupe && status.ContentSHA256 != "" {
+		previous, identical, err := identicalBackup(project, today, status.ContentSHA256, missing)
+		if err != nil {
+			warnProject(&status, "Failed to look for an identical earlier backup, uploading anyway: %v", err)
+		}
+		if identical {
+			status.Object, status.SHA256, status.Pointer = previous.Object, previous.SHA256, backupObjectName(ENV, today)+pointerSuffix
+			err = storeBackup(ctx, &status, "", ENV, missing, retentionDays)
 			if err != nil {
-				log.Printf("Failed to delete old backup %s: %v\n", line, err)
-			} else {
-				log.Printf("Deleted old backup %s\n", line)
+				failProject(&status, err)
+				return status
+			}
+			status.Reason = fmt.Sprintf("Skipped (identical to %s)", previous.Date)
+			log.Printf("%s is unchanged since %s, stored a pointer to %s\n", project, previous.Date, previous.Object)
+			if resumeExport || resumeUpload {
+				clearExportCache(project)
 			}
+			return status
+		}
+	}
+
+	err = writeManifest(exportFolder, Manifest{Date: today, Orgs: []string{project}, EntityCounts: map[string]map[string]int{project: status.EntityCounts}, ExcludedEntities: excludedEntityNames()})
+	if err != nil {
+		failProject(&status, newBackupError(ErrLocal, "Failed to write manifest", err))
+		return status
+	}
+
+	// Zip the backup folder, keeping it past a failed upload with --resume-upload
+	zipFile := filepath.Join(dateFolder, backupFileName(ENV, today))
+	if resumeUpload {
+		zipFile = filepath.Join(pendingUploadDir(project, today), backupFileName(ENV, today))
+		if err := os.MkdirAll(filepath.Dir(zipFile), dirMode); err != nil {
+			failProject(&status, newBackupError(ErrLocal, "Failed to create upload folder", err))
+			return status
+		}
+	}
+	if err := checkZipSpace(filepath.Dir(zipFile), exportFolder); err != nil {
+		failProject(&status, err)
+		return status
+	}
+	_, stage = tracer.Start(ctx, "zip")
+	err = zipFolder(exportFolder, zipFile)
+	endStage(stage, err)
+	if err != nil {
+		failProject(&status, newBackupError(ErrZip, "Failed to zip folder", err))
+		return status
+	}
+	status.SHA256, err = fileSHA256(zipFile)
+	if err != nil {
+		failProject(&status, newBackupError(ErrLocal, "Failed to checksum backup", err))
+		return status
+	}
+	checkGrowth(&status, zipFile, today)
+	if resumeUpload {
+		if err := writeUploadState(zipFile, status); err != nil {
+			warnProject(&status, "Failed to record upload state, a failed upload will export again: %v", err)
+		}
+	}
+
+	storeArchive(ctx, &status, zipFile, ENV, missing, retentionDays)
+	return status
+}
+
+// storeArchive uploads zipFile to each destination still missing today's
+// backup, cleans up old backups, and records the stored object in status.
+func storeArchive(ctx context.Context, status *ProjectStatus, zipFile, env string, missing []string, retentionDays int) {
+	err := storeBackup(ctx, status, zipFile, env, missing, retentionDays)
+	if status.UploadedBytes > 0 {
+		log.Printf("Uploaded %s for %s\n", status.Throughput(), status.Project)
+	}
+	if err != nil {
+		failProject(status, err)
+		return
+	}
+	// Named after the archive, which a resumed upload kept from an earlier run
+	status.Object = objectKey(env, filepath.Base(zipFile)) + splitSuffix(zipFile)
+	if resumeExport || resumeUpload {
+		clearExportCache(status.Project)
+	}
+}
+
+// exportProject runs the apigeecli export for project into exportFolder. If
+// the export fails, apigeecli's output is saved to status.FailureLog and the
+// returned error is categorised as an export or auth error.
+func exportProject(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	token, err := freshToken(token)
+	if err != nil {
+		return newBackupError(ErrAuth, "Failed to get Apigee token", err)
+	}
+	if resumeExport {
+		err = exportEntities(status, project, token, exportFolder, gcsBucket, date)
+	} else if err = exportAll(status, project, token, exportFolder, gcsBucket, date); err == nil {
+		err = exportEnvFolders(status, project, token, exportFolder, gcsBucket, date)
+	}
+	if err == nil && exportAnalytics {
+		err = exportAnalyticsConfig(status, project, token, exportFolder, gcsBucket, date)
+	}
+	if err == nil {
+		err = exportOrgResources(status, project, token, exportFolder, gcsBucket, date)
+	}
+	if err != nil {
+		return err
+	}
+	if err := removeExcludedEntities(exportFolder); err != nil {
+		return newBackupError(ErrLocal, "Failed to remove excluded entities", err)
+	}
+	removed, err := removeExcludedGlobs(exportFolder)
+	if err != nil {
+		return newBackupError(ErrLocal, "Failed to remove files matching --exclude-glob", err)
+	}
+	if removed > 0 {
+		log.Printf("Left %d files or folders matching --exclude-glob out of the backup of %s\n", removed, project)
+	}
+	if redactCredentials {
+		redacted, err := redactExportCredentials(exportFolder)
+		if err != nil {
+			return newBackupError(ErrLocal, "Failed to redact credentials", err)
 		}
+		log.Printf("Redacted %d consumer keys and secrets from the backup of %s\n", redacted, project)
 	}
 	return nil
 }
 
-func isOlderThanRetention(gcsPath string, cutoffDate time.Time, env string) bool {
-	// Extract date from GCS path
-	// Assuming path format: gs://bucket/env/backup_YYYY-MM-DD.zip
-	base := filepath.Base(gcsPath)
-	dateStr := base[len(fmt.Sprintf("backup_%s_", env)) : len(base)-len(".zip")]
+// exportAll exports project with a single organizations export --all.
+func exportAll(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	// Run apigeecli directly rather than through a shell, and with the token
+	// in its token cache, so the token never ends up in a command line
+	args := append([]string{"organizations", "export", "--all", "-o", project}, endpointArgs(project)...)
+	out, stderr, err := runApigeecli(exportFolder, token, args...)
+	if err != nil {
+		var cliErr *apigeecliError
+		if !errors.As(err, &cliErr) || !ignoredStatuses[cliErr.Status] {
+			status.FailureLog = saveFailureLog(gcsBucket, project, date, out, stderr)
+			return exportError("Failed to execute apigeecli command", err)
+		}
+		warnProject(status, "Continuing despite %s error: %v", cliErr.Status, cliErr.Message)
+	}
+	slog.Debug("apigeecli export output", "project", project, "stdout", string(out))
 
-	backupDate, err := time.Parse("2006-01-02", dateStr)
+	// Keep what apigeecli reported exporting alongside the exported data
+	if saveExportLog {
+		err = os.WriteFile(filepath.Join(exportFolder, "export.log"), out, 0600)
+		if err != nil {
+			warnProject(status, "Failed to write export log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// validateBackfillDate checks that a --date value is a real YYYY-MM-DD date,
+// not in the future, and recent enough that retention wouldn't delete the
+// backfilled backup straight away.
+func validateBackfillDate(value string, retentionDays int) error {
+	parsed, err := time.Parse(dateLayout, value)
+	if err != nil || parsed.Format(dateLayout) != value {
+		return fmt.Errorf("%q is not a valid YYYY-MM-DD date", value)
+	}
+	if value > time.Now().Format(dateLayout) {
+		return fmt.Errorf("%s is in the future", value)
+	}
+	if parsed.Before(time.Now().AddDate(0, 0, -retentionDays)) {
+		return fmt.Errorf("%s is older than the %d day retention period and would be deleted immediately", value, retentionDays)
+	}
+	return nil
+}
+
+// removeWorkDir deletes a directory created by this run. It only ever
+// receives runDir or a project subdirectory of it, never a shared path.
+func removeWorkDir(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove work directory %s: %v\n", dir, err)
+	}
+}
+
+// logSink and logFormat are where and how the run log is written.
+var logSink = logSinkFile
+var logFormat = logFormatText
+
+// setupLogging routes slog, and plain log calls through it, to the
+// configured sink. Only the file sink is rotated; stdout and syslog are
+// left to whatever collects them, such as journald.
+func setupLogging() {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch logSink {
+	case logSinkStdout:
+		slog.SetDefault(slog.New(newLogHandler(logFormat, consoleOutput, consoleOptions(opts))))
+		return
+	case logSinkSyslog:
+		handler, err := newSyslogHandler(logFormat, logLevel)
+		if err != nil {
+			fmt.Printf("Failed to set up logging: %v\n", err)
+			os.Exit(1)
+		}
+		slog.SetDefault(slog.New(handler))
+		return
+	}
+
+	logFile, err := openRotatingFile(logFilePath)
 	if err != nil {
-		log.Printf("Failed to parse date from path %s: %v\n", gcsPath, err)
-		return false
+		fmt.Printf("Failed to open log file: %v\n", err)
+		os.Exit(1)
+	}
+	if quiet {
+		slog.SetDefault(slog.New(teeHandler{newLogHandler(logFormat, logFile, opts), newLogHandler(logFormat, consoleOutput, consoleOptions(opts))}))
+		return
 	}
+	handler := newLogHandler(logFormat, io.MultiWriter(logFile, consoleOutput), opts)
+	slog.SetDefault(slog.New(handler))
+}
+
+// skipCompress stores files in the archive without deflating them, trading
+// archive size for CPU time on large exports.
+var skipCompress bool
+
+// compressedSuffixes are stored as-is rather than deflated again, since
+// exported proxy and shared flow bundles are already zip files.
+const compressedSuffixes = ".zip:.jar:.gz:.tgz:.bz2:.xz:.zst:.png:.jpg:.jpeg:.gif"
 
-	return backupDate.Before(cutoffDate)
+// zipArgs returns the zip arguments that archive the current directory into zipFile.
+func zipArgs(zipFile string) []string {
+	args := []string{"-r", "-n", compressedSuffixes}
+	if skipCompress {
+		args = append(args, "-0")
+	}
+	return append(args, zipFile, ".", "-i", "*")
 }
 
 func zipFolder(sourceDir, zipFile string) error {
-	zipCmd := exec.Command("zip", "-r", zipFile, ".", "-i", "*")
-	zipCmd.Dir = sourceDir
-	zipCmd.Stdout = os.Stdout
-	zipCmd.Stderr = os.Stderr
-	return zipCmd.Run()
+	stdout := consoleOutput
+	if quiet {
+		stdout = io.Discard
+	}
+	if err := commandRunner.Run(context.Background(), sourceDir, stdout, os.Stderr, "zip", zipArgs(zipFile)...); err != nil {
+		return err
+	}
+	// zip creates the archive with the umask's permissions; it holds the same secrets as the export
+	return os.Chmod(zipFile, 0600)
 }
 
-func parseError(stderr string) string {
+// parseError extracts the error status, such as FAILED_PRECONDITION, and a
+// readable message from apigeecli's stderr. The status is "" when stderr
+// isn't a recognisable API error.
+func parseError(stderr string) (string, string) {
 	// Parsing the error message to extract meaningful information
 	var parsedError map[string]interface{}
 	if err := json.Unmarshal([]byte(stderr), &parsedError); err == nil {
 		if errorInfo, ok := parsedError["error"].(map[string]interface{}); ok {
-			if status, exists := errorInfo["status"].(string); exists && status == "FAILED_PRECONDITION" {
-				return "FAILED_PRECONDITION - Continuing without interrupting the process"
+			status, _ := errorInfo["status"].(string)
+			if code, _ := errorInfo["code"].(float64); code == http.StatusTooManyRequests && status == "" {
+				status = statusRateLimited
 			}
 			if message, exists := errorInfo["message"].(string); exists {
-				return message
+				return status, message
+			}
+			if status != "" {
+				return status, status
 			}
 		}
 	}
+	// apigeecli may print log lines around the JSON, so fall back to finding the status field
+	if match := errorStatusPattern.FindStringSubmatch(stderr); match != nil {
+		return match[1], stderr
+	}
+	if tooManyRequestsPattern.MatchString(stderr) {
+		return statusRateLimited, stderr
+	}
 	if strings.Contains(stderr, "Unauthorized - the client must authenticate itself") {
-		return "Unauthorized - the client must authenticate itself"
+		return "", "Unauthorized - the client must authenticate itself"
 	}
-	return stderr
+	return "", stderr
 }
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupProject(t *testing.T) {
+	const project = "my-org"
+
+	exportOK := func(dir string, args []string) (string, string, error) {
+		return "exported", "", writeExport(dir, "proxies/a.zip", "proxies/b.zip", "sharedflows/c.zip")
+	}
+	exportFails := func(stderr string) func(string, []string) (string, string, error) {
+		return func(dir string, args []string) (string, string, error) {
+			return "", stderr, errors.New("exit status 1")
+		}
+	}
+	denied := func(op string) func(string, string, string) error {
+		return func(gotOp, bucket, name string) error {
+			if gotOp == op {
+				return errDenied
+			}
+			return nil
+		}
+	}
+
+	// The concurrent upload case writes to the current test's store
+	var concurrentStore *memStorage
+
+	today := time.Now().Format(dateLayout)
+	object := backupObjectName(project, today)
+	oldObject := backupObjectName(project, time.Now().AddDate(0, 0, -60).Format(dateLayout))
+
+	tests := []struct {
+		name      string
+		existing  []string
+		force     bool
+		apigeecli func(dir string, args []string) (string, string, error)
+		fail      func(op, bucket, name string) error
+
+		wantStatus   string
+		wantCategory string
+		wantCommands []string
+		wantStored   bool
+		wantDeleted  int
+		wantCounts   map[string]int
+		wantLog      bool
+		wantWarnings int
+	}{
+		{
+			name:         "success",
+			apigeecli:    exportOK,
+			wantStatus:   "Complete",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantStored:   true,
+			wantCounts:   map[string]int{"proxies": 2, "sharedflows": 1},
+		},
+		{
+			name:         "already backed up",
+			existing:     []string{object},
+			wantStatus:   "Complete",
+			wantCommands: nil,
+			wantStored:   true,
+		},
+		{
+			name:         "forced over existing backup",
+			existing:     []string{object},
+			force:        true,
+			apigeecli:    exportOK,
+			wantStatus:   "Complete",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantStored:   true,
+			wantCounts:   map[string]int{"proxies": 2, "sharedflows": 1},
+		},
+		{
+			name:         "old backup past retention",
+			existing:     []string{oldObject},
+			apigeecli:    exportOK,
+			wantStatus:   "Complete",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantStored:   true,
+			wantDeleted:  1,
+			wantCounts:   map[string]int{"proxies": 2, "sharedflows": 1},
+		},
+		{
+			name:         "ignored export status",
+			apigeecli:    exportFails(`{"error": {"code": 400, "message": "org is not ready", "status": "FAILED_PRECONDITION"}}`),
+			wantStatus:   "Complete",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantStored:   true,
+			wantCounts:   map[string]int{},
+			wantWarnings: 1,
+		},
+		{
+			name:         "export rejected credentials",
+			apigeecli:    exportFails(`{"error": {"code": 401, "message": "invalid token", "status": "UNAUTHENTICATED"}}`),
+			wantStatus:   "Failed",
+			wantCategory: "auth",
+			wantCommands: []string{"apigeecli"},
+			wantLog:      true,
+		},
+		{
+			name:         "export error",
+			apigeecli:    exportFails(`{"error": {"code": 500, "message": "internal error", "status": "INTERNAL"}}`),
+			wantStatus:   "Failed",
+			wantCategory: "export",
+			wantCommands: []string{"apigeecli"},
+			wantLog:      true,
+		},
+		{
+			// A denied existence check must not be mistaken for a missing backup
+			name:         "existence check denied",
+			fail:         denied("list"),
+			wantStatus:   "Failed",
+			wantCategory: "auth",
+			wantCommands: nil,
+		},
+		{
+			name:         "upload denied",
+			apigeecli:    exportOK,
+			fail:         denied("write"),
+			wantStatus:   "Failed",
+			wantCategory: "auth",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantCounts:   map[string]int{"proxies": 2, "sharedflows": 1},
+		},
+		{
+			// Another run uploads the same backup while this one is exporting
+			name:      "concurrent upload",
+			apigeecli: exportOK,
+			fail: func(op, bucket, name string) error {
+				if op == "write" && !concurrentStore.has(bucket, name) {
+					concurrentStore.put(bucket, name, []byte("other run"))
+				}
+				return nil
+			},
+			wantStatus:   "Failed",
+			wantCategory: "storage",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantStored:   true,
+			wantCounts:   map[string]int{"proxies": 2, "sharedflows": 1},
+		},
+		{
+			// The existence check lists the same folder, so only fail after the upload
+			name:      "cleanup list fails",
+			apigeecli: exportOK,
+			fail: func(op, bucket, name string) error {
+				return errorIf(op == "list" && concurrentStore.has(bucket, object), errors.New("backend error"))
+			},
+			wantStatus:   "Failed",
+			wantCategory: "storage",
+			wantCommands: []string{"apigeecli", "apigeecli", "zip"},
+			wantStored:   true,
+			wantCounts:   map[string]int{"proxies": 2, "sharedflows": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, store := setupBackupTest(t)
+			concurrentStore = store
+			forceOverwrite = tt.force
+			runner.apigeecli = tt.apigeecli
+			for _, name := range tt.existing {
+				store.put(testBucket, name, []byte("backup"))
+			}
+			store.fail = tt.fail
+
+			status := backupProject(context.Background(), project, testBucket, "token", 30)
+
+			if status.Status != tt.wantStatus || status.Category != tt.wantCategory {
+				t.Fatalf("status = %q/%q (%s), want %q/%q", status.Status, status.Category, status.Reason, tt.wantStatus, tt.wantCategory)
+			}
+			if got := runner.commands(); !slices.Equal(got, tt.wantCommands) {
+				t.Errorf("commands = %v, want %v", got, tt.wantCommands)
+			}
+			if got := store.has(testBucket, object); got != tt.wantStored {
+				t.Errorf("backup stored = %v, want %v", got, tt.wantStored)
+			}
+			if status.DeletedBackups != tt.wantDeleted {
+				t.Errorf("DeletedBackups = %d, want %d", status.DeletedBackups, tt.wantDeleted)
+			}
+			if tt.wantDeleted > 0 && store.has(testBucket, oldObject) {
+				t.Errorf("old backup %s was not deleted", oldObject)
+			}
+			if fmt.Sprint(status.EntityCounts) != fmt.Sprint(tt.wantCounts) {
+				t.Errorf("EntityCounts = %v, want %v", status.EntityCounts, tt.wantCounts)
+			}
+			if len(status.Warnings) != tt.wantWarnings {
+				t.Errorf("Warnings = %q, want %d", status.Warnings, tt.wantWarnings)
+			}
+			if (status.FailureLog != "") != tt.wantLog {
+				t.Errorf("FailureLog = %q, want one saved: %v", status.FailureLog, tt.wantLog)
+			}
+			if tt.wantStatus == "Complete" && status.Object != object {
+				t.Errorf("Object = %q, want %q", status.Object, object)
+			}
+			if tt.wantStored && tt.apigeecli != nil && status.SHA256 == "" {
+				t.Error("SHA256 not recorded for new backup")
+			}
+			if tt.force && string(store.objects[memKey(testBucket, object)].data) == "backup" {
+				t.Error("--force didn't replace the existing backup")
+			}
+		})
+	}
+}
+
+func errorIf(cond bool, err error) error {
+	if cond {
+		return err
+	}
+	return nil
+}
+
+func TestExcludeEntities(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	excludedEntities = map[string]bool{"keystores": true, "targetservers": true}
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip", "keystores/ks1.json", "Keystores.json", "targetservers-prod/ts1.json")
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	if want := map[string]int{"proxies": 1}; fmt.Sprint(status.EntityCounts) != fmt.Sprint(want) {
+		t.Errorf("EntityCounts = %v, want %v", status.EntityCounts, want)
+	}
+	files, manifest, err := readArchive(testBucket, status.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["proxies/a.zip"]; !ok || len(files) != 1 {
+		t.Errorf("archive holds %d files, want only proxies/a.zip", len(files))
+	}
+	if !slices.Equal(manifest.ExcludedEntities, []string{"keystores", "targetservers"}) {
+		t.Errorf("manifest excludedEntities = %v, want [keystores targetservers]", manifest.ExcludedEntities)
+	}
+}
+
+func TestExcludeGlobs(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	excludedGlobs = []string{"*.pem", "keystores/*/private"}
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip", "keystores/ks1/cert.json", "keystores/ks1/private/key.json", "keystores/ks2/key.pem", "other/private/x.json")
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	files, manifest, err := readArchive(testBucket, status.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if want := []string{"keystores/ks1/cert.json", "other/private/x.json", "proxies/a.zip"}; !slices.Equal(names, want) {
+		t.Errorf("archive holds %v, want %v", names, want)
+	}
+	if !slices.Equal(manifest.ExcludedGlobs, excludedGlobs) {
+		t.Errorf("manifest excludedGlobs = %v, want %v", manifest.ExcludedGlobs, excludedGlobs)
+	}
+}
+
+func TestEmptyOrg(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "kvms/kvm1.json")
+	}
+
+	// Without either flag an empty org is backed up like any other
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" || len(status.Warnings) != 0 {
+		t.Fatalf("status = %q %v, want Complete without warnings", status.Status, status.Warnings)
+	}
+
+	forceOverwrite = true
+	warnOnEmptyOrg = true
+	status = backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" || len(status.Warnings) != 1 || !strings.Contains(status.Warnings[0], "(kvms=1 proxies=0 sharedflows=0)") {
+		t.Errorf("with --warn-on-empty-org: status = %q, warnings = %v", status.Status, status.Warnings)
+	}
+
+	failOnEmptyOrg = true
+	store.objects = map[string]memObject{}
+	status = backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Failed" || status.Category != "export" || !strings.Contains(status.Reason, "kvms=1 proxies=0 sharedflows=0") {
+		t.Errorf("with --fail-on-empty-org: status = %q/%q (%s)", status.Status, status.Category, status.Reason)
+	}
+	if store.has(testBucket, backupObjectName("my-org", backupDate())) {
+		t.Error("an empty org's backup was uploaded with --fail-on-empty-org")
+	}
+}
+
+func TestExportTimeout(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	exportTimeout = 10 * time.Millisecond
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Failed" || status.Category != "timeout" || !strings.Contains(status.Reason, "10ms --export-timeout") {
+		t.Fatalf("status = %q/%q (%s), want a timeout failure", status.Status, status.Category, status.Reason)
+	}
+	if got := statusLabel(status); got != "Timed out" {
+		t.Errorf("statusLabel() = %q, want Timed out", got)
+	}
+	if store.has(testBucket, backupObjectName("my-org", backupDate())) {
+		t.Error("a timed out export was uploaded")
+	}
+}
+
+func TestApigeecliVersion(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if args[0] == "--version" {
+			return "apigeecli version 2.5.1 date: 2024-06-01T00:00:00Z [commit: abc123]\n", "", nil
+		}
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	detectApigeecliVersion()
+	const want = "apigeecli version 2.5.1 date: 2024-06-01T00:00:00Z [commit: abc123]"
+	if apigeecliVersion != want {
+		t.Fatalf("apigeecliVersion = %q, want %q", apigeecliVersion, want)
+	}
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	if _, manifest, err := readArchive(testBucket, status.Object); err != nil || manifest.ApigeecliVersion != want {
+		t.Errorf("manifest apigeecliVersion = %q, %v, want %q", manifest.ApigeecliVersion, err, want)
+	}
+	if got := store.metadata(testBucket, status.Object)[apigeecliVersionMetadata]; got != want {
+		t.Errorf("object metadata %s = %q, want %q", apigeecliVersionMetadata, got, want)
+	}
+	if got := newReport([]ProjectStatus{status}).ApigeecliVersion; got != want {
+		t.Errorf("report apigeecliVersion = %q, want %q", got, want)
+	}
+}
+
+func TestVersionsDiffer(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"apigeecli version 2.5.1", "apigeecli version 2.5.3", false},
+		{"apigeecli version 2.5.1", "apigeecli version 2.6.0", true},
+		{"apigeecli version v1.9.0", "apigeecli version 2.0.0", true},
+		{"dev build", "dev build", false},
+		{"dev build", "apigeecli version 2.5.1", true},
+	}
+	for _, tt := range tests {
+		if got := versionsDiffer(tt.a, tt.b); got != tt.want {
+			t.Errorf("versionsDiffer(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name        string
+		stderr      string
+		wantStatus  string
+		wantMessage string
+	}{
+		{
+			name:        "json",
+			stderr:      `{"error": {"code": 400, "message": "org is not ready", "status": "FAILED_PRECONDITION"}}`,
+			wantStatus:  "FAILED_PRECONDITION",
+			wantMessage: "org is not ready",
+		},
+		{
+			name:        "json without message",
+			stderr:      `{"error": {"code": 403, "status": "PERMISSION_DENIED"}}`,
+			wantStatus:  "PERMISSION_DENIED",
+			wantMessage: "PERMISSION_DENIED",
+		},
+		{
+			name:        "json among log lines",
+			stderr:      "exporting proxies\n{\"error\": {\"status\": \"NOT_FOUND\"}}\n",
+			wantStatus:  "NOT_FOUND",
+			wantMessage: "exporting proxies\n{\"error\": {\"status\": \"NOT_FOUND\"}}\n",
+		},
+		{
+			name:        "429 without status",
+			stderr:      `{"error": {"code": 429, "message": "Quota exceeded"}}`,
+			wantStatus:  "RESOURCE_EXHAUSTED",
+			wantMessage: "Quota exceeded",
+		},
+		{
+			name:        "429 as text",
+			stderr:      "Error: 429 Too Many Requests",
+			wantStatus:  "RESOURCE_EXHAUSTED",
+			wantMessage: "Error: 429 Too Many Requests",
+		},
+		{
+			name:        "unauthorized",
+			stderr:      "Error: Unauthorized - the client must authenticate itself to get the requested response",
+			wantMessage: "Unauthorized - the client must authenticate itself",
+		},
+		{
+			name:        "plain text",
+			stderr:      "connection refused",
+			wantMessage: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, message := parseError(tt.stderr)
+			if status != tt.wantStatus || message != tt.wantMessage {
+				t.Errorf("parseError() = %q, %q, want %q, %q", status, message, tt.wantStatus, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestZipArgs(t *testing.T) {
+	setGlobal(t, &skipCompress, false)
+	if got := zipArgs("out.zip"); slices.Contains(got, "-0") {
+		t.Errorf("zipArgs() = %v, want compression", got)
+	}
+
+	skipCompress = true
+	got := zipArgs("out.zip")
+	if !slices.Contains(got, "-0") {
+		t.Errorf("zipArgs() = %v, want -0 with --skip-compress", got)
+	}
+	// fakeZip relies on the archive name's position
+	if got[len(got)-4] != "out.zip" {
+		t.Errorf("zipArgs() = %v, want the archive name fourth from last", got)
+	}
+}
+
+func TestReadProjectFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		wantProjects []string
+		tolerant     bool
+		wantLabels   map[string]map[string]string
+		wantErr      bool
+	}{
+		{
+			name:         "plain",
+			content:      "org-a\n\n  org-b  \n",
+			wantProjects: []string{"org-a", "org-b"},
+			wantLabels:   map[string]map[string]string{},
+		},
+		{
+			name:         "labels",
+			content:      "org-a team=payments env=prod\norg-b\norg-c team=search\n",
+			wantProjects: []string{"org-a", "org-b", "org-c"},
+			wantLabels: map[string]map[string]string{
+				"org-a": {"team": "payments", "env": "prod"},
+				"org-c": {"team": "search"},
+			},
+		},
+		{
+			name:    "invalid label",
+			content: "org-a team\n",
+			wantErr: true,
+		},
+		{
+			name:         "invalid label tolerated",
+			content:      "org-a team\norg-b env=prod\n",
+			tolerant:     true,
+			wantProjects: []string{"org-b"},
+			wantLabels:   map[string]map[string]string{"org-b": {"env": "prod"}},
+		},
+		{
+			name:    "over-long line",
+			content: "org-a\n" + strings.Repeat("x", maxProjectLine+1) + "\norg-b\n",
+			wantErr: true,
+		},
+		{
+			name:         "over-long line tolerated",
+			content:      "org-a\n" + strings.Repeat("x", maxProjectLine+1) + "\norg-b",
+			tolerant:     true,
+			wantProjects: []string{"org-a", "org-b"},
+			wantLabels:   map[string]map[string]string{},
+		},
+		{
+			name:         "long line within the limit",
+			content:      "org-a " + strings.Repeat("k=v ", 100000) + "\n",
+			wantProjects: []string{"org-a"},
+			wantLabels:   map[string]map[string]string{"org-a": {"k": "v"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &tolerantProjectFile, tt.tolerant)
+			path := filepath.Join(t.TempDir(), "projects.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			projects, labels, err := readProjectFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProjectFile() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !slices.Equal(projects, tt.wantProjects) {
+				t.Errorf("projects = %v, want %v", projects, tt.wantProjects)
+			}
+			if fmt.Sprint(labels) != fmt.Sprint(tt.wantLabels) && !tt.wantErr {
+				t.Errorf("labels = %v, want %v", labels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestReadProjectFiles(t *testing.T) {
+	dir := t.TempDir()
+	teamA := filepath.Join(dir, "team-a.txt")
+	teamB := filepath.Join(dir, "team-b.txt")
+	os.WriteFile(teamA, []byte("org-a team=a\norg-shared\n"), 0600)
+	os.WriteFile(teamB, []byte("org-b\norg-shared env=prod\norg-a\n"), 0600)
+
+	projects, labels, err := readProjectFiles(teamA + "," + teamB)
+	if err != nil {
+		t.Fatalf("readProjectFiles() = %v", err)
+	}
+	if want := []string{"org-a", "org-shared", "org-b"}; !slices.Equal(projects, want) {
+		t.Errorf("projects = %v, want %v", projects, want)
+	}
+	if want := map[string]map[string]string{"org-a": {"team": "a"}, "org-shared": {"env": "prod"}}; fmt.Sprint(labels) != fmt.Sprint(want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+
+	missing := filepath.Join(dir, "team-c.txt")
+	if _, _, err := readProjectFiles(teamA + "," + missing); err == nil || !strings.HasPrefix(err.Error(), missing+": ") {
+		t.Errorf("readProjectFiles() with a missing file = %v, want an error naming it", err)
+	}
+}
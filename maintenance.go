@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// pruneOrphans removes backups for envs that are no longer in the project
+// list from every bucket backups are stored in: --gcs, each --destination
+// and the projects' own buckets. The deleted backups' catalog entries are
+// dropped. Without apply it only reports what would be deleted.
+func pruneOrphans(projects []string, apply bool) error {
+	// An empty list would mark every backup as orphaned
+	if len(projects) == 0 {
+		return fmt.Errorf("project file is empty, refusing to prune")
+	}
+
+	known := make(map[string]bool, len(projects))
+	for _, project := range projects {
+		known[storageEnv(project)] = true
+	}
+
+	var failed int
+	for _, gcsBucket := range allDestinations() {
+		envs, err := listBackupEnvs(gcsBucket)
+		if err != nil {
+			return err
+		}
+		for _, env := range envs {
+			if known[env] || env == combinedEnv {
+				continue
+			}
+
+			// Only backup objects are considered, so unrelated data that
+			// happens to share the bucket is never touched
+			names, err := listBackups(gcsBucket, env)
+			if err != nil {
+				return err
+			}
+			if len(names) == 0 {
+				continue
+			}
+
+			if !apply {
+				log.Printf("[dry-run] %s is not in the project file; would delete %d backups in gs://%s\n", env, len(names), gcsBucket)
+				for _, name := range names {
+					log.Printf("[dry-run] Would delete gs://%s/%s\n", gcsBucket, name)
+				}
+				continue
+			}
+
+			log.Printf("%s is not in the project file; deleting %d backups in gs://%s\n", env, len(names), gcsBucket)
+			for _, name := range names {
+				err := deleteObject(gcsBucket, name)
+				if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+					log.Printf("Failed to delete orphaned backup gs://%s/%s: %v\n", gcsBucket, name, err)
+					failed++
+					continue
+				}
+				recordDeletedBackup(fmt.Sprintf("gs://%s/%s", gcsBucket, name))
+				if err == nil {
+					log.Printf("Deleted orphaned backup gs://%s/%s\n", gcsBucket, name)
+				}
+			}
+		}
+	}
+
+	// Drop the catalog entries of whatever was deleted, even if some
+	// deletions failed
+	if apply {
+		if err := dropDeletedBackups(destinations[0]); err != nil {
+			return fmt.Errorf("failed to update catalog: %w", err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d orphaned backups", failed)
+	}
+	return nil
+}
+
+// cleanOnly applies each project's retention to its backups in each
+// destination without exporting anything, e.g. after shortening the
+// retention period. Under --manage-lifecycle the caller has already set the
+// lifecycle rules, so nothing is deleted and only the stored size is reported.
+func cleanOnly(projects []string, retentionDays int) []ProjectStatus {
+	statuses := make([]ProjectStatus, len(projects))
+	for i, project := range projects {
+		days := projectRetention(project, retentionDays)
+		buckets := projectDestinations(project)
+		status := ProjectStatus{Project: project, Status: "Complete", Alias: projectAlias(project), Labels: projectLabels[project], RetentionDays: days, Bucket: buckets[0]}
+		if manageLifecycle {
+			stored, err := storedBytes(buckets[0], storageEnv(project))
+			if err != nil {
+				failProject(&status, gcsError(fmt.Sprintf("Failed to list backups in gs://%s", buckets[0]), err))
+			} else {
+				status.StoredBytes = stored
+				status.Reason = fmt.Sprintf("Retention of %d days set as a lifecycle rule", days)
+			}
+			statuses[i] = status
+			continue
+		}
+		for j, bucket := range buckets {
+			stored, deleted, failed, err := cleanupOldBackups(bucket, days, storageEnv(project))
+			status.DeletedBackups += deleted
+			status.DeleteFailures = append(status.DeleteFailures, failed...)
+			if err != nil {
+				failProject(&status, gcsError(fmt.Sprintf("Failed to clean up old backups in gs://%s", bucket), err))
+				continue
+			}
+			if j == 0 {
+				status.StoredBytes = stored
+			}
+		}
+		if status.Status == "Complete" {
+			status.Reason = fmt.Sprintf("Deleted %d old backups", status.DeletedBackups)
+		}
+		log.Printf("%s: deleted %d old backups\n", project, status.DeletedBackups)
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// verifyAll downloads every backup of each project in each destination and
+// checks it against the SHA-256 recorded in the catalog. A backup whose
+// checksum differs, that has no recorded checksum or that can't be read
+// fails its project.
+func verifyAll(projects []string) ([]ProjectStatus, error) {
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string, len(catalog.Entries))
+	for _, entry := range catalog.Entries {
+		if entry.Object != "" && entry.SHA256 != "" {
+			checksums[entry.Object] = entry.SHA256
+		}
+	}
+
+	statuses := make([]ProjectStatus, len(projects))
+	for i, project := range projects {
+		buckets := projectDestinations(project)
+		status := ProjectStatus{Project: project, Status: "Complete", Alias: projectAlias(project), Labels: projectLabels[project], Bucket: buckets[0]}
+		var checked int
+		var problems []string
+		for _, bucket := range buckets {
+			names, err := listBackups(bucket, storageEnv(project))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("gs://%s: %v", bucket, err))
+				continue
+			}
+			for _, name := range names {
+				// Parts are checked as their index is read
+				if isArchivePart(name) {
+					continue
+				}
+				checked++
+				// A --dedupe pointer is checked by checking its archive exists
+				if strings.HasSuffix(name, pointerSuffix) {
+					target, err := resolveBackup(bucket, name)
+					if err == nil {
+						_, err = objectStore.Stat(context.Background(), bucket, target)
+					}
+					if err != nil {
+						problems = append(problems, fmt.Sprintf("gs://%s/%s: %v", bucket, name, err))
+					}
+					continue
+				}
+				want, ok := checksums[name]
+				if !ok {
+					problems = append(problems, fmt.Sprintf("gs://%s/%s: no checksum in catalog", bucket, name))
+					continue
+				}
+				got, err := objectSHA256(bucket, name)
+				switch {
+				case err != nil:
+					problems = append(problems, fmt.Sprintf("gs://%s/%s: %v", bucket, name, err))
+				case got != want:
+					problems = append(problems, fmt.Sprintf("gs://%s/%s: checksum mismatch", bucket, name))
+				}
+			}
+		}
+
+		if len(problems) > 0 {
+			op := fmt.Sprintf("%d of %d backups failed verification (%s)", len(problems), checked, strings.Join(problems, "; "))
+			failProject(&status, newBackupError(ErrStorage, op, nil))
+		} else {
+			status.Reason = fmt.Sprintf("Verified %d backups", checked)
+			log.Printf("%s: verified %d backups\n", project, checked)
+		}
+		statuses[i] = status
+	}
+	return statuses, nil
+}
+
+// repairChecksums records a SHA-256 in the catalog for every backup in each
+// project's primary bucket that has none, such as those uploaded before the catalog
+// existed, so --verify-all can check them. Each one is downloaded to compute
+// it. A backup that can't be read fails its project.
+func repairChecksums(projects []string) ([]ProjectStatus, error) {
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]bool, len(catalog.Entries))
+	for _, entry := range catalog.Entries {
+		if entry.Object != "" && entry.SHA256 != "" {
+			checksums[entry.Object] = true
+		}
+	}
+
+	var repaired []CatalogEntry
+	statuses := make([]ProjectStatus, len(projects))
+	for i, project := range projects {
+		gcsBucket := projectDestinations(project)[0]
+		status := ProjectStatus{Project: project, Status: "Complete", Alias: projectAlias(project), Labels: projectLabels[project], Bucket: gcsBucket}
+		env := storageEnv(project)
+		names, err := listBackups(gcsBucket, env)
+		if err != nil {
+			failProject(&status, gcsError(fmt.Sprintf("Failed to list backups in gs://%s", gcsBucket), err))
+			statuses[i] = status
+			continue
+		}
+		var count int
+		var problems []string
+		for _, name := range names {
+			// A --dedupe pointer has no contents of its own to check, and
+			// split archives always have a checksum in the catalog
+			if checksums[name] || strings.HasSuffix(name, pointerSuffix) || isArchivePart(name) || strings.HasSuffix(name, partsSuffix) {
+				continue
+			}
+			date, err := parseBackupDate(name, env)
+			if err != nil {
+				continue
+			}
+			sum, err := objectSHA256(gcsBucket, name)
+			var info ObjectInfo
+			if err == nil {
+				info, err = objectStore.Stat(context.Background(), gcsBucket, name)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("gs://%s/%s: %v", gcsBucket, name, err))
+				continue
+			}
+			repaired = append(repaired, CatalogEntry{Org: project, Date: date.Format(dateLayout), Object: name, Bucket: catalogBucket(gcsBucket), Size: info.Size, SHA256: sum, Status: "Complete"})
+			count++
+		}
+
+		if len(problems) > 0 {
+			op := fmt.Sprintf("%d backups couldn't be checksummed (%s)", len(problems), strings.Join(problems, "; "))
+			failProject(&status, newBackupError(ErrStorage, op, nil))
+		} else {
+			status.Reason = fmt.Sprintf("Repaired %d checksums", count)
+		}
+		log.Printf("%s: repaired %d checksums\n", project, count)
+		statuses[i] = status
+	}
+
+	if len(repaired) > 0 {
+		if err := recordChecksums(destinations[0], repaired); err != nil {
+			return nil, fmt.Errorf("failed to record checksums in the catalog: %w", err)
+		}
+	}
+	return statuses, nil
+}
+
+// objectSHA256 downloads a backup archive and returns the hex SHA-256 of
+// its contents, which for a split archive is that of its parts joined.
+func objectSHA256(gcsBucket, name string) (string, error) {
+	uploadSem.acquire()
+	defer uploadSem.release()
+
+	reader, err := openBackupObject(gcsBucket, name)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
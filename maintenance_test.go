@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAll(t *testing.T) {
+	_, store := setupBackupTest(t)
+
+	checksum := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	good := backupObjectName("good-org", "2024-06-01")
+	corrupt := backupObjectName("bad-org", "2024-06-01")
+	unrecorded := backupObjectName("bad-org", "2024-05-31")
+	store.put(testBucket, good, []byte("good"))
+	store.put(testBucket, corrupt, []byte("corrupted"))
+	store.put(testBucket, unrecorded, []byte("old"))
+	if err := writeCatalog(testBucket, Catalog{Entries: []CatalogEntry{
+		{Org: "good-org", Date: "2024-06-01", Object: good, SHA256: checksum("good")},
+		{Org: "bad-org", Date: "2024-06-01", Object: corrupt, SHA256: checksum("original")},
+	}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := verifyAll([]string{"good-org", "bad-org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if statuses[0].Status != "Complete" || statuses[0].Reason != "Verified 1 backups" {
+		t.Errorf("good-org = %s (%s), want verified", statuses[0].Status, statuses[0].Reason)
+	}
+	bad := statuses[1]
+	if bad.Status != "Failed" || bad.Category != "storage" {
+		t.Fatalf("bad-org = %s/%s, want Failed/storage", bad.Status, bad.Category)
+	}
+	for _, want := range []string{"2 of 2 backups", corrupt + ": checksum mismatch", unrecorded + ": no checksum in catalog"} {
+		if !strings.Contains(bad.Reason, want) {
+			t.Errorf("bad-org reason %q doesn't mention %q", bad.Reason, want)
+		}
+	}
+}
+
+func TestRepairChecksums(t *testing.T) {
+	_, store := setupBackupTest(t)
+
+	recorded := backupObjectName("my-org", "2024-06-01")
+	unrecorded := backupObjectName("my-org", "2024-05-31")
+	uncatalogued := backupObjectName("my-org", "2024-05-30")
+	store.put(testBucket, recorded, []byte("recorded"))
+	store.put(testBucket, unrecorded, []byte("unrecorded"))
+	store.put(testBucket, uncatalogued, []byte("uncatalogued"))
+	if err := writeCatalog(testBucket, Catalog{Entries: []CatalogEntry{
+		{Org: "my-org", Date: "2024-06-01", Object: recorded, SHA256: "keep"},
+		{Org: "my-org", Date: "2024-05-31", Object: unrecorded, Status: "Complete"},
+	}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := repairChecksums([]string{"my-org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].Status != "Complete" || statuses[0].Reason != "Repaired 2 checksums" {
+		t.Errorf("status = %s (%s), want 2 repaired", statuses[0].Status, statuses[0].Reason)
+	}
+
+	// Every backup now verifies
+	statuses, err = verifyAll([]string{"my-org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].Status != "Failed" || !strings.Contains(statuses[0].Reason, recorded+": checksum mismatch") || strings.Contains(statuses[0].Reason, "no checksum") {
+		t.Errorf("verifyAll() after repair = %s (%s), want only the deliberately wrong checksum to fail", statuses[0].Status, statuses[0].Reason)
+	}
+
+	catalog, _, err := readCatalog(testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Entries) != 3 || catalog.Entries[0].Date != "2024-05-30" || catalog.Entries[0].Size != int64(len("uncatalogued")) {
+		t.Errorf("catalog entries = %+v, want a new sorted entry for 2024-05-30", catalog.Entries)
+	}
+}
+
+func TestPruneOrphans(t *testing.T) {
+	_, store := setupBackupTest(t)
+	destinations = []string{testBucket, "dr-bucket"}
+	projectLabels = map[string]map[string]string{"org-a": {bucketLabel: "gs://team-a"}}
+	appliedRetention = 30
+	kept := backupObjectName("org-a", "2024-06-01")
+	orphan := backupObjectName("gone-org", "2024-06-01")
+	combined := backupObjectName(combinedEnv, "2024-06-01")
+	store.put("team-a", kept, []byte("kept"))
+	store.put(testBucket, combined, []byte("combined"))
+	// gone-org was removed from the project file, and is in a mirror and a
+	// project's own bucket as well as the primary one
+	for _, bucket := range []string{testBucket, "dr-bucket", "team-a"} {
+		store.put(bucket, orphan, []byte("orphan"))
+	}
+	if err := writeCatalog(testBucket, Catalog{Entries: []CatalogEntry{
+		{Org: "gone-org", Date: "2024-06-01", Object: orphan, Status: "Complete"},
+		{Org: "org-a", Date: "2024-06-01", Object: kept, Bucket: "team-a", Status: "Complete"},
+	}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run deletes nothing
+	if err := pruneOrphans([]string{"org-a"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !store.has(testBucket, orphan) || !store.has("dr-bucket", orphan) || !store.has("team-a", orphan) {
+		t.Fatal("dry run deleted an orphaned backup")
+	}
+
+	if err := pruneOrphans([]string{"org-a"}, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{testBucket, "dr-bucket", "team-a"} {
+		if store.has(bucket, orphan) {
+			t.Errorf("orphaned backup left in gs://%s", bucket)
+		}
+	}
+	if !store.has("team-a", kept) || !store.has(testBucket, combined) {
+		t.Error("pruneOrphans() deleted a backup of a listed project or the combined archive")
+	}
+	catalog, _, err := readCatalog(testBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Entries) != 1 || catalog.Entries[0].Org != "org-a" {
+		t.Errorf("catalog entries = %+v, want only org-a's", catalog.Entries)
+	}
+	// Nothing was pruned by retention, so none is recorded
+	if catalog.RetentionDays != 0 {
+		t.Errorf("catalog retention = %d, want none recorded", catalog.RetentionDays)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// manifestFileName is written at the root of every backup archive.
+const manifestFileName = "manifest.json"
+
+// Manifest describes the contents of a backup archive.
+type Manifest struct {
+	Date      string    `json:"date"`
+	CreatedAt time.Time `json:"createdAt"`
+	Orgs      []string  `json:"orgs"`
+	Combined  bool      `json:"combined,omitempty"`
+
+	// EntityCounts maps each org to the number of entries in each top-level
+	// folder of its export, e.g. {"my-org": {"proxies": 42}}.
+	EntityCounts map[string]map[string]int `json:"entityCounts,omitempty"`
+
+	// ExcludedEntities are the entity types left out with --exclude-entities,
+	// which can't be restored from this backup.
+	ExcludedEntities []string `json:"excludedEntities,omitempty"`
+
+	// ExcludedGlobs are the --exclude-glob patterns whose matching files
+	// were deliberately left out of this backup.
+	ExcludedGlobs []string `json:"excludedGlobs,omitempty"`
+
+	// CredentialsRedacted is set when consumer keys and secrets were removed
+	// with --redact-credentials, so apps restored from this backup have no
+	// live credentials.
+	CredentialsRedacted bool `json:"credentialsRedacted,omitempty"`
+
+	// AddedEntities are the entity types exported on top of organizations
+	// export --all, e.g. envgroups with --export-envgroups.
+	AddedEntities []string `json:"addedEntities,omitempty"`
+
+	// EnvFolders is set when environment-scoped entities are in
+	// env/<name>/<type> folders, which --restore-env needs. Older backups
+	// don't have them.
+	EnvFolders bool `json:"envFolders,omitempty"`
+
+	// ApigeecliVersion is the apigeecli that exported the backup.
+	ApigeecliVersion string `json:"apigeecliVersion,omitempty"`
+}
+
+// countExportedEntities returns the number of entries in each top-level
+// folder of an export directory, as a rough count of the entities exported
+// of each type. The folders in env/<name>/ are counted instead of env/,
+// keyed by their path, e.g. "env/prod/targetservers".
+func countExportedEntities(dir string) (map[string]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if entry.Name() == "env" {
+			if err := countEnvFolders(filepath.Join(dir, "env"), counts); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		children, err := os.ReadDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		counts[entry.Name()] = len(children)
+	}
+	return counts, nil
+}
+
+// countEnvFolders adds the number of entries in each env/<name>/<type>
+// folder under envDir to counts.
+func countEnvFolders(envDir string, counts map[string]int) error {
+	envs, err := os.ReadDir(envDir)
+	if err != nil {
+		return err
+	}
+	for _, env := range envs {
+		if !env.IsDir() {
+			continue
+		}
+		types, err := os.ReadDir(filepath.Join(envDir, env.Name()))
+		if err != nil {
+			return err
+		}
+		for _, et := range types {
+			if !et.IsDir() {
+				continue
+			}
+			children, err := os.ReadDir(filepath.Join(envDir, env.Name(), et.Name()))
+			if err != nil {
+				return err
+			}
+			counts["env/"+env.Name()+"/"+et.Name()] = len(children)
+		}
+	}
+	return nil
+}
+
+// contentEntities are the export folders whose entries make a backup worth
+// having. An org with none of them exports successfully but is empty.
+var contentEntities = []string{"proxies", "sharedflows"}
+
+// warnOnEmptyOrg and failOnEmptyOrg warn about, or fail, a project whose
+// org is empty. Without either an empty org is backed up like any other.
+var warnOnEmptyOrg, failOnEmptyOrg bool
+
+// isEmptyOrg reports whether counts has no entries in any contentEntities folder.
+func isEmptyOrg(counts map[string]int) bool {
+	for _, name := range contentEntities {
+		if counts[name] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkEmptyOrg warns about, or with failOnEmptyOrg fails, a project whose
+// export has no proxies or shared flows, with its entity counts. It reports
+// whether the project was failed.
+func checkEmptyOrg(status *ProjectStatus) bool {
+	if (!warnOnEmptyOrg && !failOnEmptyOrg) || !isEmptyOrg(status.EntityCounts) {
+		return false
+	}
+	counts := make(map[string]string, len(status.EntityCounts)+len(contentEntities))
+	for _, name := range contentEntities {
+		counts[name] = "0"
+	}
+	for name, count := range status.EntityCounts {
+		counts[name] = strconv.Itoa(count)
+	}
+	message := fmt.Sprintf("Org has no proxies or shared flows (%s)", formatLabels(counts))
+	if failOnEmptyOrg {
+		failProject(status, newBackupError(ErrExport, message, nil))
+		return true
+	}
+	warnProject(status, "%s", message)
+	return false
+}
+
+func writeManifest(dir string, manifest Manifest) error {
+	if manifest.CreatedAt.IsZero() {
+		manifest.CreatedAt = time.Now().UTC()
+	}
+	manifest.ApigeecliVersion = apigeecliVersion
+	// A combined archive has each org's export in its own folder
+	folders := []string{dir}
+	if manifest.Combined {
+		folders = folders[:0]
+		for _, org := range manifest.Orgs {
+			folders = append(folders, filepath.Join(dir, org))
+		}
+	}
+	manifest.AddedEntities = addedEntityNames(folders)
+	manifest.EnvFolders = true
+	manifest.ExcludedGlobs = excludedGlobs
+	manifest.CredentialsRedacted = redactCredentials
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestFileName), append(data, '\n'), 0600)
+}
@@ -0,0 +1,911 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Values accepted by --notify-on.
+const (
+	notifyOnAll      = "all"
+	notifyOnFailures = "failures"
+	notifyOnSummary  = "summary"
+)
+
+// Notifier delivers backup results to a single destination.
+type Notifier interface {
+	NotifyProject(date string, status ProjectStatus) error
+	NotifySummary(date string, statuses []ProjectStatus, alert bool, changes []ProjectChange) error
+	// NotifyRecovery announces projects whose backup succeeded again after
+	// failing in the previous run.
+	NotifyRecovery(date string, recovered []ProjectChange) error
+}
+
+// NotificationFailure records a notification that couldn't be delivered, so
+// a broken alert path is reported separately from backup failures.
+type NotificationFailure struct {
+	Notifier string `json:"notifier"`
+	Event    string `json:"event"`
+	Project  string `json:"project,omitempty"`
+	Error    string `json:"error"`
+}
+
+var notificationFailures []NotificationFailure
+var notificationFailuresMu sync.Mutex
+
+// recordNotificationFailure logs a failed notification and keeps it for the
+// report and exit code. project is "" for the final summary.
+func recordNotificationFailure(notifier, event, project string, err error) {
+	log.Printf("Failed to send %s %s notification: %v\n", notifier, event, err)
+	notificationFailuresMu.Lock()
+	defer notificationFailuresMu.Unlock()
+	notificationFailures = append(notificationFailures, NotificationFailure{Notifier: notifier, Event: event, Project: project, Error: err.Error()})
+}
+
+// registeredNotifier is a configured Notifier and the per-project events it
+// receives. Every registered notifier receives the final summary.
+type registeredNotifier struct {
+	Notifier
+	name     string
+	notifyOn string
+}
+
+var notifiers []registeredNotifier
+
+// summaryCompact replaces the per-project lines of the built-in summary with
+// counts and the list of failed projects, for large fleets.
+var summaryCompact bool
+
+// alertThreshold is the failure rate, as a percentage of projects, that the
+// run must exceed for the final summary to be sent as an alert. Below it the
+// summary goes out as a quiet informational message.
+var alertThreshold float64
+
+// notifySummaryEvery, when above 1, withholds the final summary of a run in
+// which nothing needs attention except every this many such runs, so the
+// channel stays quiet but still shows the job is alive.
+var notifySummaryEvery int
+
+// notifyOnRecovery sends a separate "recovered" notification, pinging the
+// --tagid users on Discord, when a project that failed in the previous run
+// succeeds again.
+var notifyOnRecovery bool
+
+// ChannelOverride sends the Discord notifications of projects with a
+// project file label to their own webhook instead of --webhook.
+type ChannelOverride struct {
+	Label   string `json:"label"` // key=value
+	Webhook string `json:"webhook"`
+}
+
+// parseChannelOverride parses a --notify-channel-override value,
+// KEY=VALUE=URL. URLs can contain "=", so only the first two separate.
+func parseChannelOverride(value string) (ChannelOverride, error) {
+	key, rest, _ := strings.Cut(value, "=")
+	labelValue, url, _ := strings.Cut(rest, "=")
+	override := ChannelOverride{Label: key + "=" + labelValue, Webhook: url}
+	return override, validateChannelOverride(override)
+}
+
+func validateChannelOverride(override ChannelOverride) error {
+	if key, value, ok := strings.Cut(override.Label, "="); !ok || key == "" || value == "" {
+		return fmt.Errorf("invalid label %q in channel override, expected key=value", override.Label)
+	}
+	if !strings.HasPrefix(override.Webhook, "https://") && !strings.HasPrefix(override.Webhook, "http://") {
+		return fmt.Errorf("channel override for %s needs a webhook URL, got %q", override.Label, override.Webhook)
+	}
+	return nil
+}
+
+// setupNotifiers registers a notifier for each configured webhook, applying
+// its entry in the config's notifiers section over the global --notify-on.
+func setupNotifiers(cfg Config) error {
+	if err := validateNotifyOn("--notify-on", cfg.NotifyOn); err != nil {
+		return err
+	}
+
+	register := func(name string, configured bool, notifier Notifier, nc NotifierConfig) error {
+		if !configured || (nc.Enabled != nil && !*nc.Enabled) {
+			return nil
+		}
+		notifyOn := cfg.NotifyOn
+		if nc.NotifyOn != "" {
+			if err := validateNotifyOn(fmt.Sprintf("notifiers.%s.notifyOn", name), nc.NotifyOn); err != nil {
+				return err
+			}
+			notifyOn = nc.NotifyOn
+		}
+		notifiers = append(notifiers, registeredNotifier{Notifier: notifier, name: name, notifyOn: notifyOn})
+		return nil
+	}
+
+	if cfg.NotifySummaryEvery < 0 {
+		return errors.New("--notify-summary-every must not be negative")
+	}
+	notifySummaryEvery = cfg.NotifySummaryEvery
+
+	if cfg.BatchSize < 0 || cfg.BatchSize > discordEmbedsPerMessage {
+		return fmt.Errorf("--batch-size must be between 0 and %d", discordEmbedsPerMessage)
+	}
+	for _, override := range cfg.NotifyChannelOverrides {
+		if err := validateChannelOverride(override); err != nil {
+			return err
+		}
+	}
+	if cfg.NotifySummaryPerChannel && len(cfg.NotifyChannelOverrides) == 0 {
+		return errors.New("--notify-summary-per-channel needs at least one --notify-channel-override")
+	}
+	discord := discordNotifier{webhookURL: cfg.DiscordWebhook, overrides: cfg.NotifyChannelOverrides, summaryPerChannel: cfg.NotifySummaryPerChannel}
+	if cfg.BatchSize > 1 {
+		discord.batch = &discordBatch{size: cfg.BatchSize}
+	}
+	// Overrides alone send only the matching projects' messages to Discord
+	if err := register("discord", cfg.DiscordWebhook != "" || len(cfg.NotifyChannelOverrides) > 0, discord, cfg.Notifiers.Discord); err != nil {
+		return err
+	}
+	if err := register("workspace", cfg.WorkspaceWebhook != "", workspaceNotifier{webhookURL: cfg.WorkspaceWebhook}, cfg.Notifiers.Workspace); err != nil {
+		return err
+	}
+	return register("generic", cfg.GenericWebhook != "", genericNotifier{webhookURL: cfg.GenericWebhook, secret: cfg.WebhookSecret}, cfg.Notifiers.Generic)
+}
+
+func validateNotifyOn(name, value string) error {
+	switch value {
+	case notifyOnAll, notifyOnFailures, notifyOnSummary:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q, must be one of: all, failures, summary", name, value)
+}
+
+// wantsProject reports whether a notifier set to notifyOn should receive a
+// per-project notification for status.
+func wantsProject(notifyOn string, status ProjectStatus) bool {
+	switch notifyOn {
+	case notifyOnSummary:
+		return false
+	case notifyOnFailures:
+		return status.Status == "Failed"
+	}
+	return true
+}
+
+// notifyProject sends a per-project notification to every notifier whose
+// filter accepts it.
+func notifyProject(status ProjectStatus) {
+	if status.FailingDays > 0 {
+		log.Printf("Not notifying about %s, still failing for %d days the same way\n", status.Project, status.FailingDays)
+		return
+	}
+	date := backupDate()
+	status = withBackupLinks(status)
+	for _, notifier := range notifiers {
+		if !wantsProject(notifier.notifyOn, status) {
+			continue
+		}
+		if err := notifier.NotifyProject(date, status); err != nil {
+			recordNotificationFailure(notifier.name, "project", status.Project, err)
+		}
+	}
+}
+
+// sendFinalNotification sends the end-of-run summary to every notifier, as
+// an alert if the failure rate exceeds --alert-if-failures-exceed.
+func sendFinalNotification(statuses []ProjectStatus, changes []ProjectChange) {
+	date := backupDate()
+	failed := countFailed(statuses)
+	alert := shouldAlert(failed, len(statuses), alertThreshold)
+	if failed > 0 && !alert {
+		log.Printf("%d of %d projects failed, within the %g%% alert threshold\n", failed, len(statuses), alertThreshold)
+	}
+	for _, notifier := range notifiers {
+		if err := notifier.NotifySummary(date, statuses, alert, changes); err != nil {
+			recordNotificationFailure(notifier.name, "summary", "", err)
+		}
+	}
+}
+
+// sendRecoveryNotification sends the projects among changes that recovered
+// to every notifier, if notifyOnRecovery is set.
+func sendRecoveryNotification(changes []ProjectChange) {
+	if !notifyOnRecovery {
+		return
+	}
+	var recovered []ProjectChange
+	for _, change := range changes {
+		if change.Change == "recovered" {
+			recovered = append(recovered, change)
+		}
+	}
+	if len(recovered) == 0 {
+		return
+	}
+	date := backupDate()
+	for _, notifier := range notifiers {
+		if err := notifier.NotifyRecovery(date, recovered); err != nil {
+			recordNotificationFailure(notifier.name, "recovery", "", err)
+		}
+	}
+}
+
+// summaryDue reports whether the final summary of a backup run should be
+// sent. With notifySummaryEvery, a run with failures, warnings or status
+// changes is always sent, and any other is counted in the catalog and only
+// sent every notifySummaryEvery runs. If the count can't be kept the
+// summary is sent, so a broken catalog never silences the job.
+func summaryDue(gcsBucket string, statuses []ProjectStatus, changes []ProjectChange) bool {
+	if notifySummaryEvery <= 1 {
+		return true
+	}
+	quiet := countFailed(statuses) == 0 && countSkipped(statuses) == 0 && len(changes) == 0
+	for _, status := range statuses {
+		if len(status.Warnings) > 0 {
+			quiet = false
+		}
+	}
+	withheld, err := recordQuietRun(gcsBucket, quiet, notifySummaryEvery)
+	if err != nil {
+		log.Printf("Failed to count runs for --notify-summary-every, sending the summary: %v\n", err)
+		return true
+	}
+	if withheld > 0 {
+		log.Printf("All %d projects succeeded, not sending the summary (%d of %d quiet runs, --notify-summary-every)\n", len(statuses), withheld, notifySummaryEvery)
+		return false
+	}
+	return true
+}
+
+// flushBatches sends the per-project messages still waiting in a batch,
+// which the summary would otherwise send ahead of itself.
+func flushBatches() {
+	for _, notifier := range notifiers {
+		if discord, ok := notifier.Notifier.(discordNotifier); ok && discord.batch != nil {
+			discord.batch.flushAll()
+		}
+	}
+}
+
+func countFailed(statuses []ProjectStatus) int {
+	var failed int
+	for _, status := range statuses {
+		if status.Status == "Failed" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// shouldAlert reports whether failed out of total projects is a failure rate
+// above threshold percent.
+func shouldAlert(failed, total int, threshold float64) bool {
+	if failed == 0 || total == 0 {
+		return false
+	}
+	return float64(failed)*100/float64(total) > threshold
+}
+
+type discordNotifier struct {
+	webhookURL string        // "" if only overrides are set
+	batch      *discordBatch // nil sends each project's message straight away
+
+	// overrides route a project's messages by its labels; the first match
+	// wins. With summaryPerChannel each override's webhook also gets a
+	// summary of its own projects.
+	overrides         []ChannelOverride
+	summaryPerChannel bool
+}
+
+// channel returns the webhook for a project with labels: the first matching
+// override's, or webhookURL.
+func (n discordNotifier) channel(labels map[string]string) string {
+	for _, override := range n.overrides {
+		key, value, _ := strings.Cut(override.Label, "=")
+		if labelValue, ok := labels[key]; ok && labelValue == value {
+			return override.Webhook
+		}
+	}
+	return n.webhookURL
+}
+
+// channels returns the distinct override webhooks, in the order given.
+func (n discordNotifier) channels() []string {
+	var urls []string
+	for _, override := range n.overrides {
+		if !slices.Contains(urls, override.Webhook) && override.Webhook != n.webhookURL {
+			urls = append(urls, override.Webhook)
+		}
+	}
+	return urls
+}
+
+func (n discordNotifier) NotifyProject(date string, status ProjectStatus) error {
+	if status.Reason == "" {
+		status.Reason = "no issue"
+	}
+	reason := status.Reason
+
+	data := TemplateData{
+		ProjectStatus: status,
+		Date:          date,
+		Dataset:       fmt.Sprintf("apigee-%s", status.Project),
+		StartedAt:     status.StartedAt,
+	}
+	content, ok := renderTemplate(discordTemplate, projectTemplateName, data)
+	if !ok {
+		content = fmt.Sprintf("**%s** (`apigee-%s`) - %s", status.Name(), status.Project, statusLabel(status))
+		if reason != "" {
+			content = fmt.Sprintf("%s\nReason: %s", content, reason)
+		}
+		if len(status.Labels) > 0 {
+			content = fmt.Sprintf("%s\nLabels: %s", content, formatLabels(status.Labels))
+		}
+		content += warningLines(status.Warnings)
+		content += linkLines(status)
+	}
+	if status.FailureLog != "" {
+		content = fmt.Sprintf("%s\nLog: `%s`", content, status.FailureLog)
+	}
+	if len(tagIDs) > 0 {
+		tags := make([]string, len(tagIDs))
+		for i, id := range tagIDs {
+			tags[i] = fmt.Sprintf("<@%s>", id)
+		}
+		tagMessage := strings.Join(tags, " ")
+		content = fmt.Sprintf("%s\n\n%s", content, tagMessage)
+	}
+
+	webhookURL := n.channel(status.Labels)
+	if webhookURL == "" {
+		return nil
+	}
+	embeds := discordEmbeds(fmt.Sprintf("Apigee Backup Notification %s", date), content, "Note : Project - Apigee - Status", 16711680, status.StartedAt) // Red color
+	if n.batch != nil {
+		n.batch.add(webhookURL, status.Project, embeds)
+		return nil
+	}
+	return postDiscordMessages(webhookURL, embeds)
+}
+
+func (n discordNotifier) NotifySummary(date string, statuses []ProjectStatus, alert bool, changes []ProjectChange) error {
+	// Project messages still waiting in a batch go out before the summary
+	if n.batch != nil {
+		n.batch.flushAll()
+	}
+
+	var errs []error
+	if n.webhookURL != "" {
+		errs = append(errs, n.postSummary(n.webhookURL, date, statuses, alert, changes))
+	}
+	if !n.summaryPerChannel {
+		return errors.Join(errs...)
+	}
+	for _, webhookURL := range n.channels() {
+		var channelStatuses []ProjectStatus
+		var channelChanges []ProjectChange
+		for _, status := range statuses {
+			if n.channel(status.Labels) == webhookURL {
+				channelStatuses = append(channelStatuses, status)
+			}
+		}
+		if len(channelStatuses) == 0 {
+			continue
+		}
+		for _, change := range changes {
+			if n.channel(projectLabels[change.Project]) == webhookURL {
+				channelChanges = append(channelChanges, change)
+			}
+		}
+		channelAlert := shouldAlert(countFailed(channelStatuses), len(channelStatuses), alertThreshold)
+		errs = append(errs, n.postSummary(webhookURL, date, channelStatuses, channelAlert, channelChanges))
+	}
+	return errors.Join(errs...)
+}
+
+// postSummary sends the summary of statuses to webhookURL.
+func (n discordNotifier) postSummary(webhookURL, date string, statuses []ProjectStatus, alert bool, changes []ProjectChange) error {
+	data := newSummaryTemplateData(date, statuses, alert, changes)
+	content, ok := renderTemplate(discordTemplate, summaryTemplateName, data)
+	if !ok && summaryCompact {
+		content = compactSummary(fmt.Sprintf("**Apigee Backup Summary %s**", date), data)
+	} else if !ok {
+		content = fmt.Sprintf("**Apigee Backup Summary %s**", date) + sliceLine(data.Slice)
+		if alert {
+			content = fmt.Sprintf("%s\n**%d of %d projects failed**", content, data.FailedCount, len(statuses))
+		}
+		for _, status := range statuses {
+			content = fmt.Sprintf("%s\n* **%s** - %s (`%s`)", content, status.Name(), statusLabel(status), status.Reason)
+			if throughput := status.Throughput(); throughput != "" {
+				content = fmt.Sprintf("%s - %s", content, throughput)
+			}
+			if status.StoredBytes > 0 {
+				content = fmt.Sprintf("%s - %s stored", content, formatBytes(status.StoredBytes))
+			}
+			if status.DeletedBackups > 0 {
+				content = fmt.Sprintf("%s - %d old deleted", content, status.DeletedBackups)
+			}
+			if note := retentionNote(status); note != "" {
+				content = fmt.Sprintf("%s - %s", content, note)
+			}
+			if status.Endpoint != "" {
+				content = fmt.Sprintf("%s - endpoint %s", content, status.Endpoint)
+			}
+			content += warningLines(status.Warnings)
+		}
+		content += changesSection("**Changes since last run**", changes)
+		content += deleteFailuresSection("**Old backups that couldn't be deleted**", statuses)
+		content = fmt.Sprintf("%s\n\n**Total:** %s uploaded, %s stored", content, formatBytes(data.TotalUploadedBytes), formatBytes(data.TotalStoredBytes))
+	}
+
+	// Only ping people when the failure rate is worth their attention
+	color := 65280 // Green color
+	if alert {
+		color = 16711680 // Red color
+		if len(tagIDs) > 0 {
+			tags := make([]string, len(tagIDs))
+			for i, id := range tagIDs {
+				tags[i] = fmt.Sprintf("<@%s>", id)
+			}
+			content = fmt.Sprintf("%s\n\n%s", content, strings.Join(tags, " "))
+		}
+	}
+
+	return postDiscordEmbeds(webhookURL, fmt.Sprintf("Apigee Backup Summary %s", date), content, "Note : Project - Status - Reason", color, runStart)
+}
+
+func (n discordNotifier) NotifyRecovery(date string, recovered []ProjectChange) error {
+	// Keep the order of events: the projects' own messages come first
+	if n.batch != nil {
+		n.batch.flushAll()
+	}
+	// Like their failures, recoveries go to each project's own channel
+	var webhookURLs []string
+	contents := make(map[string]string)
+	for _, change := range recovered {
+		webhookURL := n.channel(projectLabels[change.Project])
+		if webhookURL == "" {
+			continue
+		}
+		if _, ok := contents[webhookURL]; !ok {
+			webhookURLs = append(webhookURLs, webhookURL)
+		}
+		contents[webhookURL] = fmt.Sprintf("%s✅ **%s** recovered\n", contents[webhookURL], displayName(change.Project, change.Alias))
+	}
+	var errs []error
+	for _, webhookURL := range webhookURLs {
+		content := strings.TrimSuffix(contents[webhookURL], "\n")
+		if len(tagIDs) > 0 {
+			tags := make([]string, len(tagIDs))
+			for i, id := range tagIDs {
+				tags[i] = fmt.Sprintf("<@%s>", id)
+			}
+			content = fmt.Sprintf("%s\n\n%s", content, strings.Join(tags, " "))
+		}
+		errs = append(errs, postDiscordEmbeds(webhookURL, fmt.Sprintf("Apigee Backup Recovery %s", date), content, "Note : Project - backed up again after failing", 65280, runStart)) // Green color
+	}
+	return errors.Join(errs...)
+}
+
+type workspaceNotifier struct {
+	webhookURL string
+}
+
+func (n workspaceNotifier) NotifyProject(date string, status ProjectStatus) error {
+	if status.Reason == "" {
+		status.Reason = "no issue"
+	}
+	reason := status.Reason
+
+	dataset := fmt.Sprintf("apigee-%s", status.Project)
+	data := TemplateData{
+		ProjectStatus: status,
+		Date:          date,
+		Dataset:       dataset,
+		StartedAt:     status.StartedAt,
+	}
+	message, ok := renderTemplate(workspaceTemplate, projectTemplateName, data)
+	if !ok {
+		message = fmt.Sprintf("*Apigee Daily Backup %s*\n\n*| `Project` | `Apigee-Orgs` | `Status` | `Reason` |*\n|---|---|---|\n| `%s` | `%s` | `%s` | `%s` |", date, status.Name(), dataset, statusLabel(status), reason)
+		if len(status.Labels) > 0 {
+			message = fmt.Sprintf("%s\nLabels: `%s`", message, formatLabels(status.Labels))
+		}
+		message += warningLines(status.Warnings)
+		message += linkLines(status)
+	}
+	if status.FailureLog != "" {
+		message = fmt.Sprintf("%s\nLog: `%s`", message, status.FailureLog)
+	}
+
+	workspaceMessage := map[string]string{"text": message}
+	workspaceMessageJSON, err := json.Marshal(workspaceMessage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	statusCode, err := postWebhook(n.webhookURL, workspaceMessageJSON, nil)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("received status code: %d", statusCode)
+	}
+	return nil
+}
+
+func (n workspaceNotifier) NotifySummary(date string, statuses []ProjectStatus, alert bool, changes []ProjectChange) error {
+	data := newSummaryTemplateData(date, statuses, alert, changes)
+	content, ok := renderTemplate(workspaceTemplate, summaryTemplateName, data)
+	if !ok && summaryCompact {
+		content = compactSummary(fmt.Sprintf("*Apigee Daily Backup Summary %s*", date), data)
+	} else if !ok {
+		content = fmt.Sprintf("*Apigee Daily Backup Summary %s*%s\n\n", date, sliceLine(data.Slice))
+		if alert {
+			content = fmt.Sprintf("%s*Alert: %d of %d projects failed*\n\n", content, data.FailedCount, len(statuses))
+		}
+		content = fmt.Sprintf("%s*| `Project` | `Status` | `Reason` | `Upload` | `Stored` | `Deleted` |*\n|---|---|---|---|---|---|\n", content)
+		for _, status := range statuses {
+			stored := formatBytes(status.StoredBytes)
+			if note := retentionNote(status); note != "" {
+				stored = fmt.Sprintf("%s (%s)", stored, note)
+			}
+			name := status.Name()
+			if status.Endpoint != "" {
+				name = fmt.Sprintf("%s (endpoint %s)", name, status.Endpoint)
+			}
+			content = fmt.Sprintf("%s| `%s` | `%s` | `%s` | `%s` | `%s` | `%d` |\n", content, name, statusLabel(status), status.Reason, status.Throughput(), stored, status.DeletedBackups)
+		}
+		for _, status := range statuses {
+			for _, warning := range status.Warnings {
+				content = fmt.Sprintf("%s\n⚠️ %s: %s", content, status.Name(), warning)
+			}
+		}
+		content += changesSection("*Changes since last run*", changes)
+		content += deleteFailuresSection("*Old backups that couldn't be deleted*", statuses)
+		content = fmt.Sprintf("%s\n*Total:* %s uploaded, %s stored\n", content, formatBytes(data.TotalUploadedBytes), formatBytes(data.TotalStoredBytes))
+	}
+
+	workspaceMessage := map[string]string{"text": content}
+	workspaceMessageJSON, err := json.Marshal(workspaceMessage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	statusCode, err := postWebhook(n.webhookURL, workspaceMessageJSON, nil)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("received status code: %d", statusCode)
+	}
+	return nil
+}
+
+func (n workspaceNotifier) NotifyRecovery(date string, recovered []ProjectChange) error {
+	content := fmt.Sprintf("*Apigee Daily Backup %s*\n", date)
+	for _, change := range recovered {
+		content = fmt.Sprintf("%s\n✅ `%s` recovered", content, displayName(change.Project, change.Alias))
+	}
+
+	workspaceMessage := map[string]string{"text": content}
+	workspaceMessageJSON, err := json.Marshal(workspaceMessage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	statusCode, err := postWebhook(n.webhookURL, workspaceMessageJSON, nil)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("received status code: %d", statusCode)
+	}
+	return nil
+}
+
+// compactSummary is the built-in summary format for --summary-compact:
+// totals and the failed projects only, however many projects there are.
+func compactSummary(heading string, data TemplateData) string {
+	var failed, skipped, warned []string
+	for _, status := range data.Statuses {
+		switch {
+		case status.Status == "Failed" && status.FailingDays > 0:
+			failed = append(failed, fmt.Sprintf("%s (still failing, %d days)", status.Name(), status.FailingDays))
+		case status.Status == "Failed" && status.Category == "timeout":
+			failed = append(failed, status.Name()+" (timed out)")
+		case status.Status == "Failed":
+			failed = append(failed, status.Name())
+		case status.Status == statusSkipped:
+			skipped = append(skipped, status.Name())
+		case len(status.Warnings) > 0:
+			warned = append(warned, status.Name())
+		}
+	}
+	content := fmt.Sprintf("%s%s\n%d complete, %d failed", heading, sliceLine(data.Slice), len(data.Statuses)-len(failed)-len(skipped), len(failed))
+	if len(skipped) > 0 {
+		content = fmt.Sprintf("%s, %d skipped", content, len(skipped))
+	}
+	if len(failed) > 0 {
+		content = fmt.Sprintf("%s\nFailed: %s", content, strings.Join(failed, ", "))
+	}
+	if len(skipped) > 0 {
+		content = fmt.Sprintf("%s\nSkipped (time budget): %s", content, strings.Join(skipped, ", "))
+	}
+	if len(warned) > 0 {
+		content = fmt.Sprintf("%s\n⚠️ With warnings: %s", content, strings.Join(warned, ", "))
+	}
+	content += changesSection("Changes since last run", data.Changes)
+	content += deleteFailuresSection("Old backups that couldn't be deleted", data.Statuses)
+	return fmt.Sprintf("%s\n\nTotal: %s uploaded, %s stored", content, formatBytes(data.TotalUploadedBytes), formatBytes(data.TotalStoredBytes))
+}
+
+// sliceLine names the window of projects a --limit run backed up, or is
+// empty for a run over every project.
+func sliceLine(slice *ProjectSlice) string {
+	if slice == nil {
+		return ""
+	}
+	return "\n" + slice.String()
+}
+
+// statusLabel is the status shown in built-in messages, which calls out a
+// complete backup that had warnings and a failure caused by --export-timeout.
+func statusLabel(status ProjectStatus) string {
+	switch {
+	case status.Status == "Complete" && len(status.Warnings) > 0:
+		return "Complete with warnings"
+	case status.Status == "Failed" && status.FailingDays > 0:
+		return fmt.Sprintf("Still failing (%d days)", status.FailingDays)
+	case status.Status == "Failed" && status.Category == "timeout":
+		return "Timed out"
+	}
+	return status.Status
+}
+
+// retentionNote is the retention shown for status in built-in summaries, or
+// "" unless projects can have a retention other than --retention.
+func retentionNote(status ProjectStatus) string {
+	if status.RetentionDays == 0 || !retentionOverridden() {
+		return ""
+	}
+	return fmt.Sprintf("%d days retention", status.RetentionDays)
+}
+
+// warningLines returns each warning on its own line, marked with ⚠️.
+func warningLines(warnings []string) string {
+	var lines string
+	for _, warning := range warnings {
+		lines = fmt.Sprintf("%s\n⚠️ %s", lines, warning)
+	}
+	return lines
+}
+
+// formatLabels returns labels as space-separated key=value pairs, sorted by key.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// changesSection lists the projects whose status changed since the last run
+// under heading, or returns "" if none did.
+func changesSection(heading string, changes []ProjectChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	section := "\n\n" + heading
+	for _, change := range changes {
+		section = fmt.Sprintf("%s\n%s: %s", section, displayName(change.Project, change.Alias), change.Change)
+	}
+	return section
+}
+
+// deleteFailuresSection lists the old backups retention couldn't delete
+// under heading, with their count, or returns "" if there are none.
+func deleteFailuresSection(heading string, statuses []ProjectStatus) string {
+	var failed []string
+	for _, status := range statuses {
+		failed = append(failed, status.DeleteFailures...)
+	}
+	if len(failed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n\n%s (%d)\n%s", heading, len(failed), strings.Join(failed, "\n"))
+}
+
+// Discord rejects messages over these limits with a 400, so longer text is
+// split across embeds and messages rather than sent whole.
+const (
+	discordDescriptionLimit = 4096
+	discordEmbedsPerMessage = 10
+	discordMessageLimit     = 6000
+)
+
+// postDiscordEmbeds sends description as one embed if it fits, otherwise
+// split at line breaks across numbered embeds, packed into as few messages
+// as Discord's limits allow. Each embed shows timestamp, if set, instead of
+// the time it was sent.
+func postDiscordEmbeds(webhookURL, title, description, footer string, color int, timestamp time.Time) error {
+	return postDiscordMessages(webhookURL, discordEmbeds(title, description, footer, color, timestamp))
+}
+
+// discordEmbeds returns description as one embed if it fits, otherwise
+// split at line breaks across numbered embeds.
+func discordEmbeds(title, description, footer string, color int, timestamp time.Time) []map[string]interface{} {
+	chunks := splitText(description, discordDescriptionLimit)
+	embeds := make([]map[string]interface{}, len(chunks))
+	for i, chunk := range chunks {
+		embedTitle := title
+		if len(chunks) > 1 {
+			embedTitle = fmt.Sprintf("%s (%d/%d)", title, i+1, len(chunks))
+		}
+		embed := map[string]interface{}{
+			"title":       embedTitle,
+			"description": chunk,
+			"color":       color,
+			"footer": map[string]interface{}{
+				"text": footer,
+			},
+		}
+		if !timestamp.IsZero() {
+			embed["timestamp"] = timestamp.UTC().Format(time.RFC3339)
+		}
+		embeds[i] = embed
+	}
+	return embeds
+}
+
+// discordEmbedSize is the length of an embed's text, as counted against
+// discordMessageLimit.
+func discordEmbedSize(embed map[string]interface{}) int {
+	footer, _ := embed["footer"].(map[string]interface{})
+	footerText, _ := footer["text"].(string)
+	title, _ := embed["title"].(string)
+	description, _ := embed["description"].(string)
+	return utf8.RuneCountInString(title) + utf8.RuneCountInString(description) + utf8.RuneCountInString(footerText)
+}
+
+// postDiscordMessages packs embeds into as few messages as Discord's limits
+// allow and sends them in order.
+func postDiscordMessages(webhookURL string, embeds []map[string]interface{}) error {
+	var messages [][]map[string]interface{}
+	var message []map[string]interface{}
+	var size int
+	for _, embed := range embeds {
+		embedSize := discordEmbedSize(embed)
+		if len(message) == discordEmbedsPerMessage || (len(message) > 0 && size+embedSize > discordMessageLimit) {
+			messages = append(messages, message)
+			message, size = nil, 0
+		}
+		message = append(message, embed)
+		size += embedSize
+	}
+	messages = append(messages, message)
+
+	for _, embeds := range messages {
+		discordMessage := map[string]interface{}{
+			"content": "",
+			"embeds":  embeds,
+		}
+
+		messageJSON, err := json.Marshal(discordMessage)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		statusCode, err := postWebhook(webhookURL, messageJSON, nil)
+		if err != nil {
+			return err
+		}
+
+		if statusCode != http.StatusNoContent {
+			return fmt.Errorf("received status code: %d", statusCode)
+		}
+	}
+	return nil
+}
+
+// discordBatch collects per-project Discord embeds with --batch-size, so
+// a large fleet sends one message per size projects instead of one each.
+// Each webhook has its own batch.
+type discordBatch struct {
+	size int
+
+	mu      sync.Mutex
+	pending map[string]*batchedEmbeds // by webhook URL
+}
+
+type batchedEmbeds struct {
+	projects []string
+	embeds   []map[string]interface{}
+}
+
+// add queues a project's embeds for webhookURL, and sends that webhook's
+// batch once it holds size projects.
+func (b *discordBatch) add(webhookURL, project string, embeds []map[string]interface{}) {
+	b.mu.Lock()
+	if b.pending == nil {
+		b.pending = make(map[string]*batchedEmbeds)
+	}
+	batch := b.pending[webhookURL]
+	if batch == nil {
+		batch = &batchedEmbeds{}
+		b.pending[webhookURL] = batch
+	}
+	batch.projects = append(batch.projects, project)
+	batch.embeds = append(batch.embeds, embeds...)
+	full := len(batch.projects) >= b.size
+	b.mu.Unlock()
+	if full {
+		b.flush(webhookURL)
+	}
+}
+
+// flush sends every embed queued for webhookURL. A batch that can't be
+// delivered is recorded as a failed notification for each of its projects.
+func (b *discordBatch) flush(webhookURL string) {
+	b.mu.Lock()
+	batch := b.pending[webhookURL]
+	delete(b.pending, webhookURL)
+	b.mu.Unlock()
+	if batch == nil || len(batch.projects) == 0 {
+		return
+	}
+	if err := postDiscordMessages(webhookURL, batch.embeds); err != nil {
+		for _, project := range batch.projects {
+			recordNotificationFailure("discord", "project", project, err)
+		}
+	}
+}
+
+// flushAll sends the queued embeds of every webhook.
+func (b *discordBatch) flushAll() {
+	b.mu.Lock()
+	webhookURLs := slices.Sorted(maps.Keys(b.pending))
+	b.mu.Unlock()
+	for _, webhookURL := range webhookURLs {
+		b.flush(webhookURL)
+	}
+}
+
+// splitText splits text into chunks of at most limit characters, breaking at
+// newlines where possible and mid-line only for a line longer than limit.
+func splitText(text string, limit int) []string {
+	var chunks []string
+	var current strings.Builder
+	var currentLen int
+	for _, line := range strings.Split(text, "\n") {
+		lineLen := utf8.RuneCountInString(line)
+		if currentLen > 0 && currentLen+1+lineLen > limit {
+			chunks = append(chunks, current.String())
+			current.Reset()
+			currentLen = 0
+		}
+		for lineLen > limit {
+			runes := []rune(line)
+			chunks = append(chunks, string(runes[:limit]))
+			line = string(runes[limit:])
+			lineLen -= limit
+		}
+		if currentLen > 0 {
+			current.WriteByte('\n')
+			currentLen++
+		}
+		current.WriteString(line)
+		currentLen += lineLen
+	}
+	return append(chunks, current.String())
+}
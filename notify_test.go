@@ -0,0 +1,388 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompactSummaryWarnings(t *testing.T) {
+	data := newSummaryTemplateData("2024-06-01", []ProjectStatus{
+		{Project: "org-a", Status: "Complete"},
+		{Project: "org-b", Status: "Complete", Warnings: []string{"Continuing despite FAILED_PRECONDITION error: org is not ready"}},
+		{Project: "org-c", Status: "Failed", Warnings: []string{"Failed to write export log: disk full"}},
+	}, false, nil)
+
+	got := compactSummary("Summary", data)
+	for _, want := range []string{"2 complete, 1 failed", "Failed: org-c", "⚠️ With warnings: org-b\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("compactSummary() = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestStatusLabel(t *testing.T) {
+	tests := []struct {
+		status ProjectStatus
+		want   string
+	}{
+		{ProjectStatus{Status: "Complete"}, "Complete"},
+		{ProjectStatus{Status: "Complete", Warnings: []string{"w"}}, "Complete with warnings"},
+		{ProjectStatus{Status: "Failed", Warnings: []string{"w"}}, "Failed"},
+	}
+	for _, tt := range tests {
+		if got := statusLabel(tt.status); got != tt.want {
+			t.Errorf("statusLabel(%+v) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestDiscordBatch(t *testing.T) {
+	setGlobal(t, &webhookBackoff, 0)
+	setGlobal(t, &tagIDs, nil)
+	setGlobal(t, &notificationFailures, nil)
+
+	var mu sync.Mutex
+	var messages []int // embeds per message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message struct {
+			Embeds []json.RawMessage `json:"embeds"`
+		}
+		json.NewDecoder(r.Body).Decode(&message)
+		mu.Lock()
+		messages = append(messages, len(message.Embeds))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier := discordNotifier{webhookURL: server.URL, batch: &discordBatch{size: 3}}
+	for _, project := range []string{"org-a", "org-b", "org-c", "org-d"} {
+		if err := notifier.NotifyProject("2024-06-01", ProjectStatus{Project: project, Status: "Failed", Reason: "boom"}); err != nil {
+			t.Fatalf("NotifyProject(%s) = %v", project, err)
+		}
+	}
+	if len(messages) != 1 || messages[0] != 3 {
+		t.Fatalf("messages before the summary = %v, want one with 3 embeds", messages)
+	}
+
+	if err := notifier.NotifySummary("2024-06-01", nil, false, nil); err != nil {
+		t.Fatalf("NotifySummary() = %v", err)
+	}
+	if len(messages) != 3 || messages[1] != 1 || messages[2] != 1 {
+		t.Errorf("messages = %v, want the last project flushed before the summary", messages)
+	}
+
+	// A batch that can't be delivered is a failed notification per project
+	notifier.batch.add("http://127.0.0.1:0", "org-e", discordEmbeds("t", "d", "f", 0, runStart))
+	notifier.batch.flush("http://127.0.0.1:0")
+	if len(notificationFailures) != 1 || notificationFailures[0].Project != "org-e" {
+		t.Errorf("notificationFailures = %+v, want one for org-e", notificationFailures)
+	}
+}
+
+func TestBackupLinks(t *testing.T) {
+	_, store := setupBackupTest(t)
+	status := ProjectStatus{Project: "my-org", Status: "Complete", Object: backupObjectName("my-org", "2024-06-01")}
+
+	if got := withBackupLinks(status); got.Link != "" {
+		t.Errorf("withBackupLinks() without --notify-include-links = %+v, want no links", got)
+	}
+
+	notifyIncludeLinks = true
+	got := withBackupLinks(status)
+	if want := "gs://" + testBucket + "/" + status.Object; got.Link != want || got.SignedURL != "" {
+		t.Errorf("withBackupLinks() = %q, %q, want %q and no signed URL", got.Link, got.SignedURL, want)
+	}
+	if lines := linkLines(got); !strings.Contains(lines, "`"+got.Link+"`") {
+		t.Errorf("linkLines() = %q, want the gs:// path", lines)
+	}
+	if got := withBackupLinks(ProjectStatus{Project: "my-org", Status: "Failed"}); got.Link != "" {
+		t.Errorf("withBackupLinks() of a failed project = %q, want no link", got.Link)
+	}
+
+	signedURLTTL = 15 * time.Minute
+	if got := withBackupLinks(status); !strings.HasPrefix(got.SignedURL, "https://") {
+		t.Errorf("withBackupLinks() with --signed-url-ttl = %q, want a signed URL", got.SignedURL)
+	}
+
+	// Without signing credentials the gs:// path is still sent
+	store.fail = func(op, bucket, name string) error {
+		return errorIf(op == "sign", errors.New("unable to detect default GoogleAccessID"))
+	}
+	if got := withBackupLinks(status); got.Link == "" || got.SignedURL != "" {
+		t.Errorf("withBackupLinks() when signing fails = %q, %q, want only the gs:// path", got.Link, got.SignedURL)
+	}
+	if err := probeURLSigning(testBucket); err == nil {
+		t.Error("probeURLSigning() = nil, want an error when signing fails")
+	}
+}
+
+func TestParseSignedURLTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"15m", 15 * time.Minute, false},
+		{"168h", 7 * 24 * time.Hour, false},
+		{"169h", 0, true},
+		{"0s", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSignedURLTTL(tt.value)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseSignedURLTTL(%q) = %v, %v, want %v (error: %v)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSummaryDue(t *testing.T) {
+	setupBackupTest(t)
+	notifySummaryEvery = 3
+	green := []ProjectStatus{{Project: "org-a", Status: "Complete"}}
+	failed := []ProjectStatus{{Project: "org-a", Status: "Failed"}}
+
+	var got []bool
+	for _, statuses := range [][]ProjectStatus{green, green, green, green, failed, green} {
+		got = append(got, summaryDue(testBucket, statuses, nil))
+	}
+	want := []bool{false, false, true, false, true, false}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("summaryDue() over the runs = %v, want %v", got, want)
+	}
+	warned := []ProjectStatus{{Project: "org-a", Status: "Complete", Warnings: []string{"w"}}}
+	if !summaryDue(testBucket, warned, nil) {
+		t.Error("summaryDue() of a run with warnings = false, want true")
+	}
+}
+
+func TestRecoveryNotification(t *testing.T) {
+	setupBackupTest(t)
+	setGlobal(t, &webhookBackoff, 0)
+	setGlobal(t, &tagIDs, []string{"123"})
+
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message struct {
+			Embeds []struct {
+				Description string `json:"description"`
+			} `json:"embeds"`
+		}
+		json.NewDecoder(r.Body).Decode(&message)
+		mu.Lock()
+		for _, embed := range message.Embeds {
+			bodies = append(bodies, embed.Description)
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	setGlobal(t, &notifiers, []registeredNotifier{{Notifier: discordNotifier{webhookURL: server.URL}, name: "discord", notifyOn: notifyOnAll}})
+
+	changes := []ProjectChange{{Project: "org-a", Change: "recovered"}, {Project: "org-b", Change: "now failing"}}
+	sendRecoveryNotification(changes)
+	if len(bodies) != 0 {
+		t.Fatalf("sent %q without --notify-mention-on-recovery", bodies)
+	}
+
+	notifyOnRecovery = true
+	sendRecoveryNotification(changes)
+	if len(bodies) != 1 || !strings.Contains(bodies[0], "✅ **org-a** recovered") || !strings.Contains(bodies[0], "<@123>") || strings.Contains(bodies[0], "org-b") {
+		t.Errorf("recovery notification = %q, want org-a recovered with the tag ping", bodies)
+	}
+
+	sendRecoveryNotification(changes[1:])
+	if len(bodies) != 1 {
+		t.Errorf("sent %q without any recovered project", bodies[1:])
+	}
+}
+
+func TestChannelOverrides(t *testing.T) {
+	setGlobal(t, &webhookBackoff, 0)
+	setGlobal(t, &tagIDs, nil)
+	setGlobal(t, &projectLabels, map[string]map[string]string{"org-a": {"team": "payments"}})
+
+	channel := func() (*httptest.Server, *[]string) {
+		var mu sync.Mutex
+		var descriptions []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var message struct {
+				Embeds []struct {
+					Description string `json:"description"`
+				} `json:"embeds"`
+			}
+			json.NewDecoder(r.Body).Decode(&message)
+			mu.Lock()
+			for _, embed := range message.Embeds {
+				descriptions = append(descriptions, embed.Description)
+			}
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(server.Close)
+		return server, &descriptions
+	}
+	global, globalMessages := channel()
+	payments, paymentsMessages := channel()
+
+	override, err := parseChannelOverride("team=payments=" + payments.URL + "/hook?wait=true")
+	if err != nil || override.Label != "team=payments" || override.Webhook != payments.URL+"/hook?wait=true" {
+		t.Fatalf("parseChannelOverride() = %+v, %v", override, err)
+	}
+	for _, value := range []string{"team=" + payments.URL, "=payments=" + payments.URL, "team=payments=not-a-url"} {
+		if _, err := parseChannelOverride(value); err == nil {
+			t.Errorf("parseChannelOverride(%q) = nil error", value)
+		}
+	}
+
+	notifier := discordNotifier{webhookURL: global.URL, batch: &discordBatch{size: 2}, overrides: []ChannelOverride{{Label: "team=payments", Webhook: payments.URL}}, summaryPerChannel: true}
+	statuses := []ProjectStatus{
+		{Project: "org-a", Status: "Failed", Reason: "boom", Labels: map[string]string{"team": "payments"}},
+		{Project: "org-b", Status: "Failed", Reason: "boom"},
+	}
+	for _, status := range statuses {
+		if err := notifier.NotifyProject("2024-06-01", status); err != nil {
+			t.Fatalf("NotifyProject(%s) = %v", status.Project, err)
+		}
+	}
+	if err := notifier.NotifySummary("2024-06-01", statuses, true, nil); err != nil {
+		t.Fatalf("NotifySummary() = %v", err)
+	}
+	if err := notifier.NotifyRecovery("2024-06-01", []ProjectChange{{Project: "org-a", Change: "recovered"}}); err != nil {
+		t.Fatalf("NotifyRecovery() = %v", err)
+	}
+
+	if len(*paymentsMessages) != 3 || !strings.Contains((*paymentsMessages)[0], "org-a") || strings.Contains((*paymentsMessages)[1], "org-b") || !strings.Contains((*paymentsMessages)[2], "org-a** recovered") {
+		t.Errorf("payments channel = %q, want org-a's message, a summary of org-a only and its recovery", *paymentsMessages)
+	}
+	if len(*globalMessages) != 2 || !strings.Contains((*globalMessages)[0], "org-b") || !strings.Contains((*globalMessages)[1], "org-a") {
+		t.Errorf("global channel = %q, want org-b's message and the full summary", *globalMessages)
+	}
+}
+
+func TestWebhookEncoding(t *testing.T) {
+	setGlobal(t, &gzipURLs, map[string]bool{})
+	var encodings, agents []string
+	var rejectGzip bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		agents = append(agents, r.Header.Get("User-Agent"))
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if rejectGzip {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			body = reader
+		}
+		var payload map[string]string
+		if err := json.NewDecoder(body).Decode(&payload); err != nil || len(payload["content"]) < gzipMinSize {
+			t.Errorf("payload didn't decode: %v", err)
+		}
+		if !rejectGzip {
+			w.Header().Set("Accept-Encoding", "gzip, identity")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	payload, _ := json.Marshal(map[string]string{"content": strings.Repeat("org-a Complete\n", gzipMinSize)})
+
+	// Plain until the receiver advertises gzip, then compressed
+	for range 2 {
+		if code, err := postWebhook(server.URL, payload, nil); code != http.StatusNoContent || err != nil {
+			t.Fatalf("postWebhook() = %d, %v", code, err)
+		}
+	}
+	// A receiver that turns gzip down gets the payload again uncompressed
+	rejectGzip = true
+	if code, err := postWebhook(server.URL, payload, nil); code != http.StatusNoContent || err != nil {
+		t.Fatalf("postWebhook() after gzip was rejected = %d, %v", code, err)
+	}
+	if want := []string{"", "gzip", "gzip", ""}; !slices.Equal(encodings, want) {
+		t.Errorf("Content-Encoding of requests = %q, want %q", encodings, want)
+	}
+	if !strings.HasPrefix(agents[0], "apigee-backup/") {
+		t.Errorf("User-Agent = %q, want apigee-backup/VERSION", agents[0])
+	}
+}
+
+func TestDedupeFailures(t *testing.T) {
+	setupBackupTest(t)
+	setGlobal(t, &webhookBackoff, 0)
+	dedupeFailures = true
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+	const reason = "Failed to execute apigeecli command: PERMISSION_DENIED"
+	// The same failure's details differ between runs
+	failure := func(port int) error {
+		return newBackupError(ErrExport, "Failed to execute apigeecli command", fmt.Errorf("dial tcp 10.0.0.1:%d: connection refused", port))
+	}
+	key := failureKey(failure(0))
+	if err := writeCatalog(testBucket, Catalog{Entries: []CatalogEntry{
+		{Org: "org-a", Date: day(-4), Status: "Failed", Reason: "Failed to zip folder"},
+		{Org: "org-a", Date: day(-3), Status: "Failed", Reason: reason},
+		{Org: "org-a", Date: day(-2), Status: "Failed", Reason: failure(41001).Error(), FailureKey: key},
+		{Org: "org-a", Date: day(-1), Status: "Failed", Reason: failure(41002).Error(), FailureKey: key},
+		{Org: "org-b", Date: day(-1), Status: "Failed", Reason: "Failed to zip folder", FailureKey: "zip: Failed to zip folder"},
+		{Org: "org-c", Date: day(-2), Status: "Failed", Reason: reason},
+		{Org: "org-c", Date: day(-1), Status: "Complete"},
+	}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	loadFailureHistory()
+
+	var mu sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	setGlobal(t, &notifiers, []registeredNotifier{{Notifier: genericNotifier{webhookURL: server.URL}, name: "generic", notifyOn: notifyOnAll}})
+
+	var statuses []ProjectStatus
+	for _, project := range []string{"org-a", "org-b", "org-c"} {
+		status := ProjectStatus{Project: project}
+		failProject(&status, failure(41003))
+		markRepeatFailure(&status)
+		notifyProject(status)
+		statuses = append(statuses, status)
+	}
+	// Only org-a failed the same way last time, even with a different port
+	// each run, and an entry without a key matches by its reason; a new
+	// failure or a failure after a success is notified
+	if statuses[0].FailingDays != 3 || statuses[1].FailingDays != 0 || statuses[2].FailingDays != 0 {
+		t.Errorf("FailingDays = %d, %d, %d, want 3, 0, 0", statuses[0].FailingDays, statuses[1].FailingDays, statuses[2].FailingDays)
+	}
+	if len(sent) != 2 || strings.Contains(strings.Join(sent, ""), "org-a") {
+		t.Errorf("sent %d notifications %q, want org-b's and org-c's only", len(sent), sent)
+	}
+	if label := statusLabel(statuses[0]); label != "Still failing (3 days)" {
+		t.Errorf("statusLabel() = %q, want Still failing (3 days)", label)
+	}
+	summary := compactSummary("Summary", newSummaryTemplateData(backupDate(), statuses, false, nil))
+	if !strings.Contains(summary, "org-a (still failing, 3 days)") {
+		t.Errorf("compactSummary() = %q, want org-a still failing", summary)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// exportEnvGroups and exportOrgKVMs also export org-level resources that
+// organizations export --all leaves out in some apigeecli versions.
+var exportEnvGroups, exportOrgKVMs bool
+
+// envGroupsType is exported with --export-envgroups. Like the analytics
+// types, its list output holds the full definitions, hostnames included.
+var envGroupsType = entityType{Name: "envgroups", Label: "environment groups", List: []string{"envgroups", "list"}}
+
+// orgKVMsType is exported with --export-org-kvms. Without -e, kvms export
+// writes the org-scoped maps and their entries into the working directory.
+var orgKVMsType = entityType{Name: "orgkvms", Label: "org KVMs", List: []string{"kvms", "list"}, Export: []string{"kvms", "export"}}
+
+// exportOrgResources writes the enabled org-level resources into their own
+// folders of exportFolder, envgroups/<name>.json and orgkvms/, so they are
+// counted in the manifest like any other entity type. --resume-export
+// already exports org KVMs as one of its entity types, so they aren't
+// exported again.
+func exportOrgResources(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	if exportEnvGroups {
+		if err := exportEnvGroupDefinitions(status, project, token, exportFolder, gcsBucket, date); err != nil {
+			return err
+		}
+	}
+	if exportOrgKVMs && !resumeExport {
+		return exportOrgKVMEntries(status, project, token, exportFolder, gcsBucket, date)
+	}
+	return nil
+}
+
+func exportEnvGroupDefinitions(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	unit := entityUnit{Type: envGroupsType}
+	out, stderr, err := runApigeecli("", token, unit.args(envGroupsType.List, project)...)
+	if err != nil {
+		return orgResourceError(status, envGroupsType, project, gcsBucket, date, out, stderr, err)
+	}
+	entities, err := parseEntityList(out)
+	if err != nil {
+		return exportError("Failed to export "+envGroupsType.Label, err)
+	}
+	if err := writeEntityFiles(filepath.Join(exportFolder, envGroupsType.Name), entities); err != nil {
+		return newBackupError(ErrLocal, "Failed to write "+envGroupsType.Label, err)
+	}
+	return nil
+}
+
+func exportOrgKVMEntries(status *ProjectStatus, project, token, exportFolder, gcsBucket, date string) error {
+	dir := filepath.Join(exportFolder, orgKVMsType.Name)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return newBackupError(ErrLocal, "Failed to write "+orgKVMsType.Label, err)
+	}
+	unit := entityUnit{Type: orgKVMsType}
+	out, stderr, err := runApigeecli(dir, token, unit.args(orgKVMsType.Export, project)...)
+	if err != nil {
+		// Don't leave a partial export in the archive
+		os.RemoveAll(dir)
+		return orgResourceError(status, orgKVMsType, project, gcsBucket, date, out, stderr, err)
+	}
+	return nil
+}
+
+// orgResourceError returns the error for a failed export of et, saving
+// apigeecli's output as the failure log. An error status in
+// --ignore-statuses only warns and returns nil, so the type is skipped.
+func orgResourceError(status *ProjectStatus, et entityType, project, gcsBucket, date string, out, stderr []byte, err error) error {
+	var cliErr *apigeecliError
+	if errors.As(err, &cliErr) && ignoredStatuses[cliErr.Status] {
+		warnProject(status, "Continuing despite %s error exporting %s: %v", cliErr.Status, et.Label, cliErr.Message)
+		return nil
+	}
+	status.FailureLog = saveFailureLog(gcsBucket, project, date, out, stderr)
+	return exportError("Failed to export "+et.Label, err)
+}
+
+// addedEntityNames returns the entity types this run exports on top of
+// organizations export --all that are in any of the export folders dirs, for
+// the manifest. A type skipped because of an ignored error status has no
+// folder, so it isn't listed.
+func addedEntityNames(dirs []string) []string {
+	var added []string
+	if exportAnalytics {
+		for _, et := range analyticsTypes {
+			added = append(added, et.Name)
+		}
+	}
+	if exportEnvGroups {
+		added = append(added, envGroupsType.Name)
+	}
+	if exportOrgKVMs && !resumeExport {
+		added = append(added, orgKVMsType.Name)
+	}
+
+	var names []string
+	for _, name := range added {
+		for _, dir := range dirs {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
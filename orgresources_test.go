@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestExportOrgResources(t *testing.T) {
+	tests := []struct {
+		name         string
+		kvms         func(dir string) (string, string, error)
+		wantStatus   string
+		wantCounts   map[string]int
+		wantAdded    []string
+		wantWarnings int
+	}{
+		{
+			name: "exported",
+			kvms: func(dir string) (string, string, error) {
+				return "", "", writeExport(dir, "org_my-org_kvmfile_0.json")
+			},
+			wantStatus: "Complete",
+			wantCounts: map[string]int{"envgroups": 2, "orgkvms": 1, "proxies": 1},
+			wantAdded:  []string{"envgroups", "orgkvms"},
+		},
+		{
+			name: "ignored status",
+			kvms: func(dir string) (string, string, error) {
+				return "", `{"error": {"code": 400, "message": "not allowed", "status": "FAILED_PRECONDITION"}}`, errors.New("exit status 1")
+			},
+			wantStatus:   "Complete",
+			wantCounts:   map[string]int{"envgroups": 2, "proxies": 1},
+			wantAdded:    []string{"envgroups"},
+			wantWarnings: 1,
+		},
+		{
+			name: "failed",
+			kvms: func(dir string) (string, string, error) {
+				return "", `{"error": {"code": 500, "message": "internal error", "status": "INTERNAL"}}`, errors.New("exit status 1")
+			},
+			wantStatus: "Failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, _ := setupBackupTest(t)
+			exportEnvGroups = true
+			exportOrgKVMs = true
+			runner.apigeecli = func(dir string, args []string) (string, string, error) {
+				switch args[0] {
+				case "organizations":
+					return "", "", writeExport(dir, "proxies/a.zip")
+				case "envgroups":
+					return `{"environmentGroups": [{"name": "prod", "hostnames": ["api.example.com"]}, {"name": "test"}]}`, "", nil
+				case "kvms":
+					return tt.kvms(dir)
+				}
+				return "", "", fmt.Errorf("unexpected apigeecli %v", args)
+			}
+
+			status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+			if status.Status != tt.wantStatus {
+				t.Fatalf("status = %q (%s), want %q", status.Status, status.Reason, tt.wantStatus)
+			}
+			if tt.wantCounts == nil {
+				return
+			}
+			if fmt.Sprint(status.EntityCounts) != fmt.Sprint(tt.wantCounts) {
+				t.Errorf("EntityCounts = %v, want %v", status.EntityCounts, tt.wantCounts)
+			}
+			if len(status.Warnings) != tt.wantWarnings {
+				t.Errorf("Warnings = %v, want %d", status.Warnings, tt.wantWarnings)
+			}
+			files, manifest, err := readArchive(testBucket, status.Object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := files["envgroups/prod.json"]; !ok {
+				t.Error("archive has no envgroups/prod.json")
+			}
+			// A type skipped for an ignored status isn't listed
+			if !slices.Equal(manifest.AddedEntities, tt.wantAdded) {
+				t.Errorf("manifest addedEntities = %v, want %v", manifest.AddedEntities, tt.wantAdded)
+			}
+		})
+	}
+}
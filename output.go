@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values accepted by --output-format.
+const (
+	outputFormatText = "text" // the log lines, as they always were
+	outputFormatJSON = "json"
+	outputFormatYAML = "yaml"
+)
+
+// outputFormat is how the run's final statuses are written to stdout.
+// With json or yaml they are the only thing on stdout, so the output can be
+// piped; log lines and tool output go to consoleOutput instead.
+var outputFormat = outputFormatText
+
+// consoleOutput is where log lines and zip's output are echoed: stdout,
+// or stderr when stdout is kept for --output-format.
+var consoleOutput io.Writer = os.Stdout
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case outputFormatText, outputFormatJSON, outputFormatYAML:
+		return nil
+	}
+	return fmt.Errorf("invalid --output-format %q, must be one of: text, json, yaml", format)
+}
+
+// writeStatuses writes statuses to w in outputFormat. The text format
+// writes nothing, since the log has already reported every project.
+func writeStatuses(w io.Writer, statuses []ProjectStatus) error {
+	if statuses == nil {
+		statuses = []ProjectStatus{}
+	}
+	switch outputFormat {
+	case outputFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	case outputFormatYAML:
+		return writeYAML(w, statuses)
+	}
+	return nil
+}
+
+// printStatuses writes statuses to stdout in outputFormat.
+func printStatuses(statuses []ProjectStatus) {
+	if err := writeStatuses(os.Stdout, statuses); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the %s summary: %v\n", outputFormat, err)
+	}
+}
+
+// writeYAML writes v as block-style YAML. v is encoded as JSON first, so
+// its json tags decide the keys, their order and what is omitted, exactly
+// as in the JSON report.
+func writeYAML(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	node, err := readYAMLNode(decoder)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	writeYAMLNode(&b, node, "", "")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// yamlMap is a JSON object with its keys in their original order.
+type yamlMap struct {
+	keys   []string
+	values []any
+}
+
+// readYAMLNode reads the next JSON value from decoder as a yamlMap, a
+// []any or a scalar.
+func readYAMLNode(decoder *json.Decoder) (any, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		var m yamlMap
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readYAMLNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			m.keys = append(m.keys, key.(string))
+			m.values = append(m.values, value)
+		}
+		_, err = decoder.Token()
+		return m, err
+	case json.Delim('['):
+		list := []any{}
+		for decoder.More() {
+			value, err := readYAMLNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = decoder.Token()
+		return list, err
+	}
+	return token, nil
+}
+
+// writeYAMLNode writes node at indent. first replaces indent on the first
+// line, so a mapping inside a sequence starts on the "- " line.
+func writeYAMLNode(b *strings.Builder, node any, indent, first string) {
+	switch node := node.(type) {
+	case yamlMap:
+		if len(node.keys) == 0 {
+			fmt.Fprintf(b, "%s{}\n", first)
+			return
+		}
+		for i, key := range node.keys {
+			prefix := indent
+			if i == 0 {
+				prefix = first
+			}
+			b.WriteString(prefix + yamlScalar(key) + ":")
+			writeYAMLValue(b, node.values[i], indent+"  ")
+		}
+	case []any:
+		if len(node) == 0 {
+			fmt.Fprintf(b, "%s[]\n", first)
+			return
+		}
+		for i, item := range node {
+			prefix := indent
+			if i == 0 {
+				prefix = first
+			}
+			writeYAMLNode(b, item, indent+"  ", prefix+"- ")
+		}
+	default:
+		fmt.Fprintf(b, "%s%s\n", first, yamlScalar(node))
+	}
+}
+
+// writeYAMLValue writes the value of a mapping key whose "key:" has just
+// been written: a scalar or empty collection on the same line, anything
+// else on the lines below.
+func writeYAMLValue(b *strings.Builder, value any, indent string) {
+	switch v := value.(type) {
+	case yamlMap:
+		if len(v.keys) > 0 {
+			b.WriteString("\n")
+			writeYAMLNode(b, v, indent, indent)
+			return
+		}
+	case []any:
+		if len(v) > 0 {
+			b.WriteString("\n")
+			writeYAMLNode(b, v, indent, indent)
+			return
+		}
+	}
+	writeYAMLNode(b, value, indent, " ")
+}
+
+// yamlPlain matches strings that YAML reads back unchanged without quotes.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./@+-]*$`)
+
+// yamlReserved are plain words YAML would read as something other than a string.
+var yamlReserved = map[string]bool{"true": true, "false": true, "null": true, "yes": true, "no": true, "on": true, "off": true, "y": true, "n": true}
+
+func yamlScalar(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if yamlPlain.MatchString(v) && !yamlReserved[strings.ToLower(v)] {
+			return v
+		}
+		// YAML's double-quoted style accepts Go's escapes
+		return strconv.Quote(v)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteStatuses(t *testing.T) {
+	statuses := []ProjectStatus{
+		{Project: "my-org", Status: "Complete", Reason: "no issue", UploadedBytes: 2048, UploadDuration: 2 * time.Second, EntityCounts: map[string]int{"proxies": 3}, Labels: map[string]string{"team": "payments"}},
+		{Project: "other-org", Status: "Failed", Reason: "Failed to export: quota: 429", Category: "export", Warnings: []string{"yes", ""}},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{outputFormatText, ""},
+		{outputFormatYAML, `- project: my-org
+  status: Complete
+  reason: "no issue"
+  uploadedBytes: 2048
+  uploadDuration: 2000000000
+  storedBytes: 0
+  deletedBackups: 0
+  entityCounts:
+    proxies: 3
+  labels:
+    team: payments
+- project: other-org
+  status: Failed
+  reason: "Failed to export: quota: 429"
+  uploadedBytes: 0
+  uploadDuration: 0
+  storedBytes: 0
+  category: export
+  deletedBackups: 0
+  warnings:
+    - "yes"
+    - ""
+`},
+	}
+	for _, tt := range tests {
+		setGlobal(t, &outputFormat, tt.format)
+		var out strings.Builder
+		if err := writeStatuses(&out, statuses); err != nil {
+			t.Fatalf("writeStatuses(%s) = %v", tt.format, err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("writeStatuses(%s) =\n%s\nwant\n%s", tt.format, out.String(), tt.want)
+		}
+	}
+
+	setGlobal(t, &outputFormat, outputFormatJSON)
+	var out strings.Builder
+	if err := writeStatuses(&out, statuses); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []ProjectStatus
+	if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil || len(decoded) != 2 || decoded[1].Reason != statuses[1].Reason {
+		t.Errorf("JSON output = %s (%v), want the statuses", out.String(), err)
+	}
+
+	// An empty run is an empty list, not null
+	out.Reset()
+	setGlobal(t, &outputFormat, outputFormatYAML)
+	if err := writeStatuses(&out, nil); err != nil || out.String() != "[]\n" {
+		t.Errorf("writeStatuses(yaml, nil) = %q, %v, want []", out.String(), err)
+	}
+}
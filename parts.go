@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxArchiveSize, when set, uploads an archive larger than it as parts of
+// at most this many bytes, <name>.part001 and so on, followed by an index
+// <name>.parts listing them. Some transfer and archive tools can't handle
+// single objects of many gigabytes.
+var maxArchiveSize int64
+
+// partsSuffix is appended to a backup's object key for the index of a
+// split archive. The index is written after every part, so a backup only
+// exists once all its parts do.
+const partsSuffix = ".parts"
+
+// partSHA256Metadata is the metadata key of a part's SHA-256 with
+// --resume-upload, so a part left by an interrupted run can be recognised
+// as the same one the run would upload.
+const partSHA256Metadata = "sha256"
+
+// partPattern matches the object key of one part of a split archive.
+var partPattern = regexp.MustCompile(`\.zip\.part\d{3,}$`)
+
+// partsIndex is the contents of a split archive's index.
+type partsIndex struct {
+	Size   int64         `json:"size"`
+	SHA256 string        `json:"sha256"`
+	Parts  []archivePart `json:"parts"`
+}
+
+type archivePart struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// byteUnits are the suffixes parseByteSize accepts, longest first so KiB
+// isn't read as K followed by iB.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as 2GB, 500MiB or 1048576. KB, MB and GB
+// are decimal, KiB, MiB and GiB binary, and a bare number is bytes.
+func parseByteSize(s string) (int64, error) {
+	number, unit := strings.TrimSpace(s), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(u.suffix)) {
+			number, unit = strings.TrimSpace(number[:len(number)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 2GB or 500MiB", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// isArchivePart reports whether name is one part of a split archive rather
+// than a backup of its own.
+func isArchivePart(name string) bool {
+	return partPattern.MatchString(name)
+}
+
+// backupBase returns the key of the backup an object belongs to: name
+// without a pointer, index or part suffix.
+func backupBase(name string) string {
+	name = partPattern.ReplaceAllString(name, ".zip")
+	return strings.TrimSuffix(strings.TrimSuffix(name, pointerSuffix), partsSuffix)
+}
+
+// splitSuffix returns partsSuffix if zipFile is too large to upload as one
+// object, or "" if it isn't.
+func splitSuffix(zipFile string) string {
+	if maxArchiveSize <= 0 {
+		return ""
+	}
+	info, err := os.Stat(zipFile)
+	if err != nil || info.Size() <= maxArchiveSize {
+		return ""
+	}
+	return partsSuffix
+}
+
+func partName(name string, i int) string {
+	return fmt.Sprintf("%s.part%03d", name, i)
+}
+
+// uploadParts uploads sourceFile to name's parts and then its index,
+// returning the number of bytes written. Parts always replace existing
+// objects, since parts without an index are left over from a failed
+// upload, except that --resume-upload keeps a part already uploaded with
+// the same checksum; the index, like a whole archive, is only written if
+// it doesn't exist yet unless forceOverwrite is set.
+func uploadParts(gcsBucket, name, sourceFile string, opts WriteOptions) (int64, error) {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	index := partsIndex{Size: info.Size()}
+	whole := sha256.New()
+	partOpts := opts
+	partOpts.DoesNotExist = false
+	var written int64
+	for offset, i := int64(0), 1; offset < info.Size(); offset, i = offset+maxArchiveSize, i+1 {
+		part := archivePart{Name: partName(name, i), Size: min(maxArchiveSize, info.Size()-offset)}
+		hash := sha256.New()
+		var reader io.Reader = io.TeeReader(io.NewSectionReader(file, offset, part.Size), io.MultiWriter(hash, whole))
+		opts := partOpts
+		if resumeUpload {
+			// The checksum is needed before uploading, to compare with a
+			// part already uploaded and to record with a new one
+			if _, err := io.Copy(io.Discard, reader); err != nil {
+				return written, err
+			}
+			part.SHA256 = hex.EncodeToString(hash.Sum(nil))
+			if partUploaded(gcsBucket, part) {
+				log.Printf("Part gs://%s/%s was already uploaded, skipping it\n", gcsBucket, part.Name)
+				index.Parts = append(index.Parts, part)
+				continue
+			}
+			reader = io.NewSectionReader(file, offset, part.Size)
+			opts.Metadata = maps.Clone(partOpts.Metadata)
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]string)
+			}
+			opts.Metadata[partSHA256Metadata] = part.SHA256
+		}
+		n, err := uploadPart(gcsBucket, part, reader, opts)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("part %d: %w", i, err)
+		}
+		part.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		index.Parts = append(index.Parts, part)
+	}
+	index.SHA256 = hex.EncodeToString(whole.Sum(nil))
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return written, err
+	}
+	opts.ContentType = "application/json"
+	n, err := objectStore.Write(context.Background(), gcsBucket, name+partsSuffix, bytes.NewReader(data), opts)
+	return written + n, err
+}
+
+func uploadPart(gcsBucket string, part archivePart, reader io.Reader, opts WriteOptions) (int64, error) {
+	uploadSem.acquire()
+	defer uploadSem.release()
+
+	if !showProgress {
+		return objectStore.Write(context.Background(), gcsBucket, part.Name, reader, opts)
+	}
+	progress := newProgressReader(reader, "gs://"+gcsBucket+"/"+part.Name, part.Size)
+	written, err := objectStore.Write(context.Background(), gcsBucket, part.Name, progress, opts)
+	progress.finish(err)
+	return written, err
+}
+
+// partUploaded reports whether part is already in gcsBucket with the same
+// size and checksum, as an interrupted --resume-upload run leaves it.
+func partUploaded(gcsBucket string, part archivePart) bool {
+	info, err := objectStore.Stat(context.Background(), gcsBucket, part.Name)
+	return err == nil && info.Size == part.Size && info.Metadata[partSHA256Metadata] == part.SHA256
+}
+
+// readPartsIndex reads the index of a split archive.
+func readPartsIndex(gcsBucket, name string) (partsIndex, error) {
+	var index partsIndex
+	reader, _, err := objectStore.Open(context.Background(), gcsBucket, name)
+	if err != nil {
+		return index, err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(&index); err != nil {
+		return index, fmt.Errorf("invalid index gs://%s/%s: %w", gcsBucket, name, err)
+	}
+	return index, nil
+}
+
+// openBackupObject opens a backup archive for reading. A split archive's
+// index is read as its parts joined back together, and each part is
+// checked against the checksum in the index as it is read.
+func openBackupObject(gcsBucket, name string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(name, partsSuffix) {
+		reader, _, err := objectStore.Open(context.Background(), gcsBucket, name)
+		return reader, err
+	}
+	index, err := readPartsIndex(gcsBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	return &partsReader{bucket: gcsBucket, parts: index.Parts}, nil
+}
+
+// partsReader reads the parts of a split archive one after another.
+type partsReader struct {
+	bucket  string
+	parts   []archivePart
+	current io.ReadCloser
+	hash    hash.Hash
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for len(r.parts) > 0 {
+		part := r.parts[0]
+		if r.current == nil {
+			reader, _, err := objectStore.Open(context.Background(), r.bucket, part.Name)
+			if err != nil {
+				return 0, fmt.Errorf("gs://%s/%s: %w", r.bucket, part.Name, err)
+			}
+			r.current, r.hash = reader, sha256.New()
+		}
+		n, err := r.current.Read(p)
+		r.hash.Write(p[:n])
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != part.SHA256 {
+				return n, fmt.Errorf("gs://%s/%s: checksum mismatch", r.bucket, part.Name)
+			}
+			r.parts = r.parts[1:]
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
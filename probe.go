@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// probeResult is the outcome of probing one project's Apigee access.
+type probeResult struct {
+	proxies int
+	err     error
+}
+
+// probeProjects lists the proxies of every project, up to parallel at once,
+// and writes whether each org is accessible, denied or failed for another
+// reason, without exporting anything. It returns an error if any project
+// isn't accessible, so permission gaps fail the command.
+func probeProjects(w io.Writer, projects []string, token string, parallel int) error {
+	results := make([]probeResult, len(projects))
+	sem := newSemaphore(parallel)
+	var wg sync.WaitGroup
+	for i, project := range projects {
+		sem.acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.release()
+			results[i].proxies, results[i].err = countEntities(project, token, entityUnit{Type: entityTypes[0]})
+		}()
+	}
+	wg.Wait()
+
+	var denied, failed int
+	for i, result := range results {
+		switch {
+		case result.err == nil:
+			fmt.Fprintf(w, "%s: accessible (%d proxies)\n", projects[i], result.proxies)
+		case errors.Is(exportCategory(result.err), ErrAuth):
+			fmt.Fprintf(w, "%s: denied: %v\n", projects[i], result.err)
+			denied++
+		default:
+			fmt.Fprintf(w, "%s: failed: %v\n", projects[i], result.err)
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "\n%d accessible, %d denied, %d failed\n", len(projects)-denied-failed, denied, failed)
+
+	if denied+failed > 0 {
+		return fmt.Errorf("%d of %d projects aren't accessible", denied+failed, len(projects))
+	}
+	return nil
+}
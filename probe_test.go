@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProbeProjects(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		switch args[3] {
+		case "denied-org":
+			return "", `{"error": {"code": 403, "message": "Permission denied on resource", "status": "PERMISSION_DENIED"}}`, errors.New("exit status 1")
+		case "broken-org":
+			return "", `{"error": {"code": 500, "message": "internal error", "status": "INTERNAL"}}`, errors.New("exit status 1")
+		}
+		return `["a", "b"]`, "", nil
+	}
+
+	var out strings.Builder
+	err := probeProjects(&out, []string{"my-org", "denied-org", "broken-org"}, "token", 2)
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 projects") {
+		t.Errorf("probeProjects() = %v, want 2 of 3 projects inaccessible", err)
+	}
+	for _, want := range []string{"my-org: accessible (2 proxies)\n", "denied-org: denied: ", "broken-org: failed: ", "1 accessible, 1 denied, 1 failed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output = %s\nwant it to contain %q", out.String(), want)
+		}
+	}
+	for _, call := range runner.calls {
+		if !slices.Equal(call[1:3], []string{"apis", "list"}) {
+			t.Errorf("ran apigeecli %v, want only apis list", call[1:])
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// showProgress reports the throughput of each upload while it runs.
+var showProgress bool
+
+// progressOutput receives the progress lines. It is stderr rather than the
+// log, so a long upload doesn't fill the log file with them.
+var progressOutput io.Writer = os.Stderr
+
+// progressInterval is how often a running upload reports its progress.
+var progressInterval = 5 * time.Second
+
+// progressReader counts the bytes read from r as it is uploaded to object
+// and reports them to progressOutput every progressInterval.
+type progressReader struct {
+	r      io.Reader
+	object string
+	total  int64 // the size of the upload, 0 if unknown
+	read   int64
+	start  time.Time
+	last   time.Time
+}
+
+func newProgressReader(r io.Reader, object string, total int64) *progressReader {
+	now := time.Now()
+	return &progressReader{r: r, object: object, total: total, start: now, last: now}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		fmt.Fprintf(progressOutput, "Uploading %s: %s\n", p.object, p.progress())
+	}
+	return n, err
+}
+
+// finish reports the end of the upload, which failed if err is set.
+func (p *progressReader) finish(err error) {
+	if err != nil {
+		fmt.Fprintf(progressOutput, "Upload of %s failed after %s\n", p.object, p.progress())
+		return
+	}
+	fmt.Fprintf(progressOutput, "Uploaded %s: %s\n", p.object, p.progress())
+}
+
+// progress describes the bytes read so far, e.g.
+// "1.5 GiB of 4.0 GiB (37%), 12.0 MiB/s".
+func (p *progressReader) progress() string {
+	done := formatBytes(p.read)
+	if p.total > 0 {
+		done = fmt.Sprintf("%s of %s (%d%%)", done, formatBytes(p.total), p.read*100/p.total)
+	}
+	seconds := time.Since(p.start).Seconds()
+	if seconds <= 0 {
+		return done
+	}
+	return fmt.Sprintf("%s, %s/s", done, formatBytes(int64(float64(p.read)/seconds)))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusRateLimited is the error status of a request rejected with 429 Too
+// Many Requests because a management API quota is exhausted.
+const statusRateLimited = "RESOURCE_EXHAUSTED"
+
+// rateLimitAttempts is how many times an apigeecli run that hit a quota is
+// tried before its error is returned.
+const rateLimitAttempts = 5
+
+var (
+	// rateLimitBackoff is the first wait after a 429 without a Retry-After;
+	// it doubles with each further attempt
+	rateLimitBackoff = 15 * time.Second
+
+	// maxRateLimitWait caps any single wait, however long the server asks for
+	maxRateLimitWait = 5 * time.Minute
+)
+
+// retryAfterPatterns find how long the server asked to wait, either from a
+// Retry-After header apigeecli printed or from a RetryInfo error detail.
+var retryAfterPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)retry-after"?\s*[:=]?\s*"?(\d+)`),
+	regexp.MustCompile(`"retryDelay":\s*"(\d+(?:\.\d+)?)s"`),
+}
+
+// parseRetryAfter returns the wait requested in apigeecli's stderr, or 0.
+func parseRetryAfter(stderr string) time.Duration {
+	for _, pattern := range retryAfterPatterns {
+		if match := pattern.FindStringSubmatch(stderr); match != nil {
+			if seconds, err := strconv.ParseFloat(match[1], 64); err == nil {
+				return time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+	return 0
+}
+
+// apiPause holds back every apigeecli run until a quota is expected to have
+// recovered, so parallel projects don't keep hitting it in the meantime.
+var apiPause struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// pauseAPI holds back apigeecli runs for d, unless they already are for longer.
+func pauseAPI(d time.Duration) {
+	apiPause.mu.Lock()
+	defer apiPause.mu.Unlock()
+	if until := time.Now().Add(d); until.After(apiPause.until) {
+		apiPause.until = until
+	}
+}
+
+// waitForAPI blocks until any pause set by pauseAPI is over.
+func waitForAPI() {
+	apiPause.mu.Lock()
+	until := apiPause.until
+	apiPause.mu.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+// rateLimitWait returns how long to pause after attempt was rate limited:
+// the server's Retry-After if it gave one and it is longer than the backoff.
+func rateLimitWait(attempt int, retryAfter time.Duration) time.Duration {
+	wait := rateLimitBackoff << (attempt - 1)
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	return min(wait, maxRateLimitWait)
+}
+
+// checkQuota is the --check-quota preflight. The management API doesn't
+// report quota usage, so it makes one cheap request against project: if
+// that is rate limited, runApigeecli pauses and retries it as it would
+// during the run, and the run only starts once a request gets through.
+func checkQuota(project, token string) error {
+	_, _, err := runApigeecli("", token, entityUnit{}.args(entityTypes[0].List, project)...)
+	if isRateLimited(err) {
+		return fmt.Errorf("Apigee API quota for %s is still exhausted after %d attempts: %w", project, rateLimitAttempts, err)
+	}
+	if err != nil {
+		// Not a quota problem; the run reports it with the project
+		log.Printf("Quota check request for %s failed: %v\n", project, err)
+		return nil
+	}
+	log.Printf("Quota check for %s passed\n", project)
+	return nil
+}
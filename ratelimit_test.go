@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rateLimitedStderr = `{"error": {"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED"}}`
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   time.Duration
+	}{
+		{"Retry-After: 30\n" + rateLimitedStderr, 30 * time.Second},
+		{`{"error": {"code": 429, "details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "1.5s"}]}}`, 1500 * time.Millisecond},
+		{rateLimitedStderr, 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.stderr); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	setGlobal(t, &rateLimitBackoff, 10*time.Second)
+	setGlobal(t, &maxRateLimitWait, time.Minute)
+	tests := []struct {
+		attempt    int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{1, 0, 10 * time.Second},
+		{3, 0, 40 * time.Second},
+		{1, 30 * time.Second, 30 * time.Second},
+		{3, 5 * time.Second, 40 * time.Second},
+		{5, 0, time.Minute},
+		{1, time.Hour, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := rateLimitWait(tt.attempt, tt.retryAfter); got != tt.want {
+			t.Errorf("rateLimitWait(%d, %s) = %s, want %s", tt.attempt, tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestRunApigeecliRateLimited(t *testing.T) {
+	tests := []struct {
+		name        string
+		limited     int // how many runs are rate limited before one succeeds
+		wantRuns    int
+		wantLimited bool
+	}{
+		{name: "recovers", limited: 2, wantRuns: 3},
+		{name: "gives up", limited: 10, wantRuns: rateLimitAttempts, wantLimited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, _ := setupBackupTest(t)
+			runs := 0
+			runner.apigeecli = func(dir string, args []string) (string, string, error) {
+				runs++
+				if runs <= tt.limited {
+					return "", rateLimitedStderr, errors.New("exit status 1")
+				}
+				return "[]", "", nil
+			}
+
+			_, _, err := runApigeecli("", "token", "apis", "list", "-o", "my-org")
+			if runs != tt.wantRuns || isRateLimited(err) != tt.wantLimited {
+				t.Errorf("runApigeecli() ran %d times, error %v; want %d runs, rate limited: %v", runs, err, tt.wantRuns, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", rateLimitedStderr, errors.New("exit status 1")
+	}
+	if err := checkQuota("my-org", "token"); err == nil || !strings.Contains(err.Error(), "still exhausted") {
+		t.Errorf("checkQuota() with the quota exhausted = %v", err)
+	}
+
+	// Other failures are left for the run to report
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", `{"error": {"code": 403, "status": "PERMISSION_DENIED"}}`, errors.New("exit status 1")
+	}
+	if err := checkQuota("my-org", "token"); err != nil {
+		t.Errorf("checkQuota() with a permission error = %v, want nil", err)
+	}
+}
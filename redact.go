@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// redactCredentials strips consumer keys and secrets from the exported JSON
+// before zipping, for teams that need the app and product topology in a
+// backup but not live credentials.
+var redactCredentials bool
+
+// credentialFields are the JSON fields removed with --redact-credentials,
+// wherever they appear in an exported object.
+var credentialFields = []string{"consumerKey", "consumerSecret"}
+
+// redactExportCredentials removes credentialFields from every JSON file under
+// exportFolder and returns how many values it removed. Only files that held
+// credentials are rewritten, and files that aren't valid JSON are left as
+// they are.
+func redactExportCredentials(exportFolder string) (int, error) {
+	var redacted int
+	err := filepath.WalkDir(exportFolder, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.EqualFold(filepath.Ext(file), ".json") {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var doc any
+		if decoder.Decode(&doc) != nil {
+			return nil
+		}
+		n := redactValue(doc)
+		if n == 0 {
+			return nil
+		}
+		redacted += n
+		data, err = json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(file, append(data, '\n'), 0600)
+	})
+	return redacted, err
+}
+
+// redactValue removes credentialFields from v and the objects nested in it,
+// returning how many it removed.
+func redactValue(v any) int {
+	var n int
+	switch v := v.(type) {
+	case map[string]any:
+		for _, field := range credentialFields {
+			if _, ok := v[field]; ok {
+				delete(v, field)
+				n++
+			}
+		}
+		for _, child := range v {
+			n += redactValue(child)
+		}
+	case []any:
+		for _, child := range v {
+			n += redactValue(child)
+		}
+	}
+	return n
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactExportCredentials(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"apps.json":     `[{"name": "mobile", "credentials": [{"consumerKey": "live-key", "consumerSecret": "live-secret", "apiProducts": [{"apiproduct": "gold"}], "expiresAt": -1}]}]`,
+		"products.json": `[{"name": "gold"}]`,
+		"notes.json":    `not json`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	redacted, err := redactExportCredentials(dir)
+	if err != nil || redacted != 2 {
+		t.Fatalf("redactExportCredentials() = %d, %v, want 2", redacted, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "apps.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "live-") {
+		t.Errorf("apps.json still has credentials: %s", data)
+	}
+	var apps []struct {
+		Credentials []struct {
+			APIProducts []map[string]string `json:"apiProducts"`
+			ExpiresAt   json.Number         `json:"expiresAt"`
+		} `json:"credentials"`
+	}
+	if err := json.Unmarshal(data, &apps); err != nil || len(apps) != 1 || len(apps[0].Credentials) != 1 {
+		t.Fatalf("apps.json = %s, %v, want the app with its credential", data, err)
+	}
+	if credential := apps[0].Credentials[0]; len(credential.APIProducts) != 1 || credential.ExpiresAt != "-1" {
+		t.Errorf("credential = %+v, want its products and expiry kept", credential)
+	}
+	for _, name := range []string{"products.json", "notes.json"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != files[name] {
+			t.Errorf("%s = %s, want it untouched", name, data)
+		}
+	}
+}
+
+func TestRedactCredentialsManifest(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	redactCredentials = true
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+	if status.Status != "Complete" {
+		t.Fatalf("status = %q (%s), want Complete", status.Status, status.Reason)
+	}
+	_, manifest, err := readArchive(testBucket, status.Object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.CredentialsRedacted {
+		t.Error("manifest doesn't record that credentials were redacted")
+	}
+}
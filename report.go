@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Report is the machine-readable summary of a run written by --report.
+type Report struct {
+	Date          string          `json:"date"`
+	StartedAt     time.Time       `json:"startedAt"`
+	UploadedBytes int64           `json:"uploadedBytes"`
+	StoredBytes   int64           `json:"storedBytes"`
+	Projects      []ProjectStatus `json:"projects"`
+
+	// Slice is the window of the project file backed up with --limit.
+	Slice *ProjectSlice `json:"slice,omitempty"`
+
+	// ApigeecliVersion is the apigeecli that exported this run's backups.
+	ApigeecliVersion string `json:"apigeecliVersion,omitempty"`
+
+	// NotificationFailures lists notifications that couldn't be delivered;
+	// these don't change any project's status.
+	NotificationFailures []NotificationFailure `json:"notificationFailures,omitempty"`
+}
+
+func newReport(statuses []ProjectStatus) Report {
+	uploaded, stored := totalBytes(statuses)
+	notificationFailuresMu.Lock()
+	defer notificationFailuresMu.Unlock()
+	return Report{
+		Date:                 backupDate(),
+		StartedAt:            runStart,
+		UploadedBytes:        uploaded,
+		StoredBytes:          stored,
+		Projects:             statuses,
+		Slice:                runSlice,
+		ApigeecliVersion:     apigeecliVersion,
+		NotificationFailures: notificationFailures,
+	}
+}
+
+// totalBytes sums the bytes uploaded this run and stored in GCS across all projects.
+func totalBytes(statuses []ProjectStatus) (int64, int64) {
+	var uploaded, stored int64
+	for _, status := range statuses {
+		uploaded += status.UploadedBytes
+		stored += status.StoredBytes
+	}
+	return uploaded, stored
+}
+
+// publishReport writes the run's report to the --report file and POSTs it
+// to the --report-webhook, if set. A report that can't be delivered to the
+// webhook is recorded as a notification failure.
+func publishReport(cfg Config, statuses []ProjectStatus) {
+	report := newReport(statuses)
+	if cfg.Report != "" {
+		if err := writeReport(cfg.Report, report); err != nil {
+			log.Printf("Failed to write report: %v\n", err)
+		}
+	}
+	if cfg.ReportWebhook != "" {
+		if err := sendReport(cfg.ReportWebhook, cfg.WebhookSecret, report); err != nil {
+			recordNotificationFailure("report webhook", "report", "", err)
+		}
+	}
+}
+
+// sendReport POSTs report as JSON to url, signed like the generic webhook
+// if secret is set. Any 2xx response counts as delivered.
+func sendReport(url, secret string, report Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	header := http.Header{}
+	if secret != "" {
+		header.Set(signatureHeader, signPayload(secret, body))
+	}
+	statusCode, err := postWebhook(url, body, header)
+	if err != nil {
+		return err
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return fmt.Errorf("received status code: %d", statusCode)
+	}
+	return nil
+}
+
+func writeReport(filePath string, report Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, append(data, '\n'), 0644)
+}
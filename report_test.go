@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSendReport(t *testing.T) {
+	setGlobal(t, &webhookBackoff, 0)
+
+	var mu sync.Mutex
+	var requests int
+	var got Report
+	var signature, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		signature, contentType = r.Header.Get(signatureHeader), r.Header.Get("Content-Type")
+		if signature != signPayload("secret", body) {
+			t.Errorf("%s = %q, want the body's signature", signatureHeader, signature)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	report := Report{Date: "2024-06-01", UploadedBytes: 42, Projects: []ProjectStatus{{Project: "my-org", Status: "Complete"}}}
+	if err := sendReport(server.URL, "secret", report); err != nil {
+		t.Fatalf("sendReport() = %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("sent %d requests, want a retry after the 503", requests)
+	}
+	if got.Date != report.Date || got.UploadedBytes != 42 || len(got.Projects) != 1 || got.Projects[0].Project != "my-org" {
+		t.Errorf("received report %+v, want %+v", got, report)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+}
+
+func TestPostWebhookRetries(t *testing.T) {
+	setGlobal(t, &webhookBackoff, 0)
+	tests := []struct {
+		name         string
+		status       int
+		wantRequests int
+	}{
+		{name: "client error", status: http.StatusBadRequest, wantRequests: 1},
+		{name: "rate limited", status: http.StatusTooManyRequests, wantRequests: webhookAttempts},
+		{name: "server error", status: http.StatusBadGateway, wantRequests: webhookAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests++
+				mu.Unlock()
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			statusCode, err := postWebhook(server.URL, []byte("{}"), nil)
+			if err != nil || statusCode != tt.status {
+				t.Errorf("postWebhook() = %d, %v, want %d", statusCode, err, tt.status)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("sent %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+)
+
+// restoreKind is a kind of entity --restore imports. restoreKinds is in
+// import order, so every entity is imported after the entities it refers to.
+type restoreKind struct {
+	Name  string   // e.g. "apis"
+	Label string   // singular used in output, e.g. "proxy"
+	Dirs  []string // folders holding it, relative to the org's export or, for PerEnv kinds, env/<name>/
+	Files []string // files at the root of the org's export holding it, in the --all layout
+
+	PerEnv bool
+	Format string
+
+	// Import imports the entity staged in the directory or file after -f
+	Import []string
+	// List lists the entities of the kind already in the org
+	List []string
+
+	// An entity that already exists is overwritten by importing it again if
+	// Reimport is set, e.g. a bundle, which becomes a new revision, or by
+	// deleting it with Delete -n NAME first. Keep says why it is never
+	// overwritten if neither can be done safely.
+	Reimport bool
+	Delete   []string
+	Keep     string
+
+	// After are the kinds it can refer to, which are imported before it
+	After []string
+}
+
+const (
+	restoreBundle     = "bundle"     // one <name>.zip per entity
+	restoreList       = "list"       // JSON files listing entities
+	restoreKVM        = "kvm"        // apigeecli KVM files, one or more per KVM
+	restoreDeployment = "deployment" // one <proxy>.json per deployed proxy
+)
+
+var restoreKinds = []restoreKind{
+	{Name: "kvms", Label: "KVM", Dirs: []string{"kvms", "orgkvms"}, Format: restoreKVM, Import: []string{"kvms", "import", "-f"}, List: []string{"kvms", "list"}, Delete: []string{"kvms", "delete"}},
+	{Name: "envkvms", Label: "environment KVM", Dirs: []string{"kvms"}, PerEnv: true, Format: restoreKVM, Import: []string{"kvms", "import", "-f"}, List: []string{"kvms", "list"}, Delete: []string{"kvms", "delete"}},
+	{Name: "targetservers", Label: "target server", Dirs: []string{"targetservers"}, PerEnv: true, Format: restoreList, Import: []string{"targetservers", "import", "-f"}, List: []string{"targetservers", "list"}, Delete: []string{"targetservers", "delete"}},
+	{Name: "sharedflows", Label: "shared flow", Dirs: []string{"sharedflows"}, Format: restoreBundle, Import: []string{"sharedflows", "import", "-f"}, List: []string{"sharedflows", "list"}, Reimport: true, After: []string{"kvms", "envkvms", "targetservers"}},
+	{Name: "apis", Label: "proxy", Dirs: []string{"apis", "proxies"}, Format: restoreBundle, Import: []string{"apis", "import", "-f"}, List: []string{"apis", "list"}, Reimport: true, After: []string{"kvms", "envkvms", "targetservers", "sharedflows"}},
+	{Name: "products", Label: "product", Dirs: []string{"products"}, Files: []string{"products.json"}, Format: restoreList, Import: []string{"products", "import", "-f"}, List: []string{"products", "list"}, Delete: []string{"products", "delete"}, After: []string{"apis"}},
+	{Name: "developers", Label: "developer", Dirs: []string{"developers"}, Files: []string{"developers.json"}, Format: restoreList, Import: []string{"developers", "import", "-f"}, List: []string{"developers", "list"}, Keep: "deleting a developer deletes its apps"},
+	{Name: "deployments", Label: "deployment of", Dirs: []string{"proxies"}, PerEnv: true, Format: restoreDeployment, List: []string{"apis", "list"}, Reimport: true, After: []string{"envkvms", "targetservers", "sharedflows", "apis"}},
+}
+
+// The --restore-conflict policies for an entity that already exists in the org.
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictFail      = "fail"
+)
+
+// restoreOptions are the settings of one --restore.
+type restoreOptions struct {
+	// Env restores only this environment's folder of the backup
+	Env string
+	// Apply imports the entities; otherwise they are only listed
+	Apply bool
+	// Conflict is the policy for entities that already exist in the org
+	Conflict string
+	// TargetOrg imports into this org instead of the backup's own
+	TargetOrg string
+}
+
+// restoreEntity is one entity of a backup, with the files it is imported from.
+type restoreEntity struct {
+	Kind restoreKind
+	Env  string
+	Name string
+
+	// Files hold a bundle or KVM
+	Files []string
+	// Data is a listed entity or deployment, and Wrap the key its file
+	// wrapped the list in, if any
+	Data json.RawMessage
+	Wrap string
+}
+
+// key identifies the entity among those listed in the org.
+func (e restoreEntity) key() string {
+	return e.Kind.Name + "/" + e.Env + "/" + e.Name
+}
+
+func (e restoreEntity) String() string {
+	if e.Env == "" {
+		return e.Kind.Label + " " + e.Name
+	}
+	return fmt.Sprintf("%s %s in %s", e.Kind.Label, e.Name, e.Env)
+}
+
+// restoreBackup imports project's newest backup for date back into its org,
+// or opts.TargetOrg, one entity at a time in dependency order, and prints
+// each entity's outcome to w. It returns an error if any entity failed to
+// import.
+func restoreBackup(w io.Writer, gcsBucket, project, date, token string, opts restoreOptions) error {
+	dir, err := os.MkdirTemp(runDir, "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// A project backed up with --combined-archive has no archive of its own
+	env := storageEnv(project)
+	name, err := latestBackup(gcsBucket, env, date)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		combined, err := latestBackup(gcsBucket, combinedEnv, date)
+		if err != nil {
+			return err
+		}
+		if combined != "" {
+			env = combinedEnv
+			fmt.Fprintf(w, "%s has no backup of its own for %s, restoring it from gs://%s/%s\n", project, date, gcsBucket, combined)
+		}
+	}
+
+	root := filepath.Join(dir, "archive")
+	manifest, err := extractBackup(gcsBucket, env, date, root)
+	if err != nil {
+		return err
+	}
+	if manifest.Combined {
+		if !slices.Contains(manifest.Orgs, project) {
+			return fmt.Errorf("the combined backup of %s doesn't include %s (it has %s)", date, project, strings.Join(manifest.Orgs, ", "))
+		}
+		root = filepath.Join(root, project)
+	}
+	detectApigeecliVersion()
+	if manifest.ApigeecliVersion != "" && apigeecliVersion != "" && versionsDiffer(manifest.ApigeecliVersion, apigeecliVersion) {
+		fmt.Fprintf(w, "Warning: the backup was exported by %s, but %s is installed; imports may fail if the export format changed\n", manifest.ApigeecliVersion, apigeecliVersion)
+	}
+	envs, err := restoreEnvs(root, manifest, opts.Env)
+	if err != nil {
+		return err
+	}
+	org := project
+	if opts.TargetOrg != "" && opts.TargetOrg != project {
+		org = opts.TargetOrg
+		mentions, err := remapOrg(root, project, org)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite references to %s: %w", project, err)
+		}
+		for _, file := range mentions {
+			fmt.Fprintf(w, "Not rewritten: %s mentions %s outside a resource path; check it before using %s\n", file, project, org)
+		}
+	}
+	entities, err := loadRestoreEntities(root, org, envs, opts.Env == "")
+	if err != nil {
+		return err
+	}
+	if opts.Env == "" {
+		for _, apps := range []string{"apps", "apps.json"} {
+			if _, err := os.Stat(filepath.Join(root, apps)); err == nil {
+				fmt.Fprintln(w, "Skipping apps, which have to be imported with apigeecli apps import once their developers are restored")
+				break
+			}
+		}
+	}
+
+	// Nothing is imported unless every conflict is covered by the policy
+	existing, err := listExisting(entities, org, token)
+	if err != nil {
+		return err
+	}
+	var conflicts int
+	for _, entity := range entities {
+		if existing[entity.key()] {
+			conflicts++
+			if opts.Conflict == conflictFail {
+				fmt.Fprintf(w, "%s already exists in %s\n", entity, org)
+			}
+		}
+	}
+	if conflicts > 0 && opts.Conflict == conflictFail {
+		return fmt.Errorf("%d of %d entities already exist in %s; rerun with --restore-conflict=skip or --restore-conflict=overwrite", conflicts, len(entities), org)
+	}
+
+	stage := filepath.Join(dir, "stage")
+	imported := make(map[string]bool)
+	outcomes := make(map[string]int)
+	var failed []restoreEntity
+	var dependent int
+	for _, entity := range entities {
+		outcome, reason := "created", ""
+		if existing[entity.key()] {
+			switch {
+			case opts.Conflict == conflictSkip:
+				outcome, reason = "skipped", " (already exists)"
+			case entity.Kind.Keep != "":
+				outcome, reason = "skipped", fmt.Sprintf(" (already exists, and %s)", entity.Kind.Keep)
+			default:
+				outcome = "overwritten"
+			}
+		}
+		if !opts.Apply {
+			verb := map[string]string{"created": "create", "overwritten": "overwrite", "skipped": "skip"}[outcome]
+			fmt.Fprintf(w, "[dry-run] Would %s %s%s\n", verb, entity, reason)
+			outcomes[outcome]++
+			continue
+		}
+		if outcome != "skipped" {
+			if err := importEntity(entity, org, token, stage, outcome == "overwritten", imported); err != nil {
+				outcome, reason = "failed", ": "+err.Error()
+				if causes := failedDependencies(entity, failed); len(causes) > 0 {
+					reason += fmt.Sprintf(" (it may refer to %s, which failed)", strings.Join(causes, ", "))
+					dependent++
+				}
+				failed = append(failed, entity)
+			} else if entity.Kind.Name == "apis" {
+				imported[entity.Name] = true
+			}
+		}
+		fmt.Fprintf(w, "%s %s%s\n", outcome, entity, reason)
+		outcomes[outcome]++
+	}
+
+	summary := fmt.Sprintf("%d created, %d overwritten, %d skipped", outcomes["created"], outcomes["overwritten"], outcomes["skipped"])
+	if !opts.Apply {
+		fmt.Fprintf(w, "[dry-run] Would restore %d entities into %s (%s); rerun with --yes to import them\n", len(entities), org, summary)
+		return nil
+	}
+	fmt.Fprintf(w, "Restored %d entities into %s: %s, %d failed\n", len(entities), org, summary, outcomes["failed"])
+	if dependent > 0 {
+		fmt.Fprintf(w, "%d of the failed entities may have failed because an entity they refer to did; fix those first and rerun with --restore-conflict=skip\n", dependent)
+	}
+	if outcomes["failed"] > 0 {
+		return fmt.Errorf("failed to restore %d of %d entities", outcomes["failed"], len(entities))
+	}
+	return nil
+}
+
+// failedDependencies returns the failed entities, of the kinds entity can
+// refer to, that are in its environment or the org.
+func failedDependencies(entity restoreEntity, failed []restoreEntity) []string {
+	var causes []string
+	for _, dependency := range failed {
+		if slices.Contains(entity.Kind.After, dependency.Kind.Name) && (dependency.Env == "" || dependency.Env == entity.Env) {
+			causes = append(causes, dependency.String())
+		}
+	}
+	return causes
+}
+
+// listExisting lists the entities of org of each kind and environment that
+// entities has, and returns the keys of those that already exist there.
+func listExisting(entities []restoreEntity, org, token string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	listed := make(map[string]bool)
+	for _, entity := range entities {
+		scope := entity.Kind.Name + "/" + entity.Env
+		if listed[scope] {
+			continue
+		}
+		listed[scope] = true
+
+		args := append(slices.Clone(entity.Kind.List), "-o", org)
+		if entity.Env != "" {
+			args = append(args, "-e", entity.Env)
+		}
+		out, _, err := runApigeecli("", token, append(args, endpointArgs(org)...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the %ss in %s: %w", entity.Kind.Label, org, err)
+		}
+		list, err := parseEntityList(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the %ss in %s: %w", entity.Kind.Label, org, err)
+		}
+		for _, item := range list {
+			// Some lists are of names, others of the entities
+			var name string
+			if json.Unmarshal(item, &name) != nil {
+				name = entityName(item)
+			}
+			existing[restoreEntity{Kind: entity.Kind, Env: entity.Env, Name: name}.key()] = true
+		}
+	}
+	return existing, nil
+}
+
+// extractBackup downloads the newest backup in env for date and unzips it
+// into dir, returning its manifest.
+func extractBackup(gcsBucket, env, date, dir string) (Manifest, error) {
+	var manifest Manifest
+	name, err := latestBackup(gcsBucket, env, date)
+	if err != nil {
+		return manifest, err
+	}
+	if name == "" {
+		return manifest, fmt.Errorf("gs://%s/%s does not exist", gcsBucket, backupObjectName(env, date))
+	}
+	if name, err = resolveBackup(gcsBucket, name); err != nil {
+		return manifest, err
+	}
+	reader, err := openBackupObject(gcsBucket, name)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return manifest, fmt.Errorf("gs://%s/%s does not exist", gcsBucket, name)
+	}
+	if err != nil {
+		return manifest, err
+	}
+	defer reader.Close()
+
+	// zip needs random access, so the archive can't be read as it streams
+	file, err := os.CreateTemp(runDir, "restore-*.zip")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to download gs://%s/%s: %w", gcsBucket, name, err)
+	}
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return manifest, fmt.Errorf("gs://%s/%s: %w", gcsBucket, name, err)
+	}
+
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		// An archive can't write outside dir, whoever made it
+		if !filepath.IsLocal(entry.Name) {
+			return manifest, fmt.Errorf("gs://%s/%s has an unsafe path %s", gcsBucket, name, entry.Name)
+		}
+		if err := extractFile(entry, filepath.Join(dir, entry.Name)); err != nil {
+			return manifest, fmt.Errorf("%s in gs://%s/%s: %w", entry.Name, gcsBucket, name, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return manifest, fmt.Errorf("gs://%s/%s has no manifest: %w", gcsBucket, name, err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest in gs://%s/%s: %w", gcsBucket, name, err)
+	}
+	return manifest, nil
+}
+
+func extractFile(entry *zip.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return err
+	}
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// restoreEnvs returns the environments in the backup at root to restore:
+// only env with --restore-env, otherwise all of them.
+func restoreEnvs(root string, manifest Manifest, env string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var envs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			envs = append(envs, entry.Name())
+		}
+	}
+	if env == "" {
+		return envs, nil
+	}
+	if !manifest.EnvFolders {
+		return nil, errors.New("the backup has no per-environment folders, so --restore-env can't restore one environment from it")
+	}
+	if !slices.Contains(envs, env) {
+		return nil, fmt.Errorf("the backup has no environment %s (it has %s)", env, cmp.Or(strings.Join(envs, ", "), "none"))
+	}
+	return []string{env}, nil
+}
+
+// remapOrg rewrites the references to the org from in the export at root to
+// the org to, for --restore-target-org: the resource paths Apigee entities
+// embed, organizations/<from>/..., in JSON files and in the text files of
+// bundles, and the org in the names of org KVM files, which apigeecli reads
+// it from. It returns the files that still mention from afterwards, e.g. in
+// a hostname, which can't be rewritten without knowing what it points at.
+func remapOrg(root, from, to string) ([]string, error) {
+	// Org names are lowercase letters, digits and hyphens, so a longer name
+	// starting with from is another org
+	resourcePath := regexp.MustCompile(`organizations/` + regexp.QuoteMeta(from) + `([^a-z0-9-]|$)`)
+	mention := regexp.MustCompile(`(^|[^a-z0-9-])` + regexp.QuoteMeta(from) + `([^a-z0-9-]|$)`)
+	rewrite := func(data []byte) []byte {
+		return resourcePath.ReplaceAll(data, []byte("organizations/"+to+"${1}"))
+	}
+
+	var mentions []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == manifestFileName || rel == "export.log" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".zip":
+			var files []string
+			if data, files, err = remapBundle(data, rewrite, mention); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			for _, file := range files {
+				mentions = append(mentions, rel+" ("+file+")")
+			}
+		case ".json":
+			data = rewrite(data)
+			if mention.Match(data) {
+				mentions = append(mentions, rel)
+			}
+		default:
+			return nil
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		if name := entry.Name(); strings.HasPrefix(name, "org_"+from+"_") {
+			return os.Rename(path, filepath.Join(filepath.Dir(path), "org_"+to+"_"+strings.TrimPrefix(name, "org_"+from+"_")))
+		}
+		return nil
+	})
+	return mentions, err
+}
+
+// remapBundle rewrites the text files of a proxy or shared flow bundle with
+// rewrite, returning the new bundle and the files that still match mention.
+func remapBundle(data []byte, rewrite func([]byte) []byte, mention *regexp.Regexp) ([]byte, []string, error) {
+	bundle, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	out := zip.NewWriter(&buf)
+	var mentions []string
+	for _, entry := range bundle.File {
+		content, err := entry.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Policies, resources and endpoints are text; anything else, such
+		// as a JAR, is left alone
+		if utf8.Valid(data) && !bytes.ContainsRune(data, 0) {
+			data = rewrite(data)
+			if mention.Match(data) {
+				mentions = append(mentions, entry.Name)
+			}
+		}
+		w, err := out.CreateHeader(&zip.FileHeader{Name: entry.Name, Method: entry.Method, Modified: entry.Modified})
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), mentions, nil
+}
+
+// loadRestoreEntities returns the entities of the export at root of org, in
+// import order. Environment-scoped kinds are loaded from env/<name>/ for
+// each of envs, and the org-level kinds only if orgLevel is set.
+func loadRestoreEntities(root, org string, envs []string, orgLevel bool) ([]restoreEntity, error) {
+	var entities []restoreEntity
+	for _, kind := range restoreKinds {
+		if !kind.PerEnv {
+			if orgLevel {
+				loaded, err := loadKind(kind, root, org, "")
+				if err != nil {
+					return nil, err
+				}
+				entities = append(entities, loaded...)
+			}
+			continue
+		}
+		for _, env := range envs {
+			loaded, err := loadKind(kind, filepath.Join(root, "env", env), org, env)
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, loaded...)
+		}
+	}
+	return entities, nil
+}
+
+func loadKind(kind restoreKind, base, org, env string) ([]restoreEntity, error) {
+	var paths []string
+	for _, dir := range kind.Dirs {
+		entries, err := os.ReadDir(filepath.Join(base, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				paths = append(paths, filepath.Join(base, dir, entry.Name()))
+			}
+		}
+	}
+	for _, file := range kind.Files {
+		path := filepath.Join(base, file)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	var entities []restoreEntity
+	byName := make(map[string]int)
+	for _, path := range paths {
+		file := filepath.Base(path)
+		switch kind.Format {
+		case restoreBundle, restoreKVM:
+			var name string
+			if kind.Format == restoreBundle {
+				if filepath.Ext(file) != ".zip" {
+					continue
+				}
+				name = strings.TrimSuffix(file, ".zip")
+			} else {
+				if filepath.Ext(file) != ".json" {
+					continue
+				}
+				name = kvmName(file, org, env)
+			}
+			// A KVM's entries may be spread over several files
+			if i, ok := byName[name]; ok {
+				entities[i].Files = append(entities[i].Files, path)
+				continue
+			}
+			byName[name] = len(entities)
+			entities = append(entities, restoreEntity{Kind: kind, Env: env, Name: name, Files: []string{path}})
+
+		case restoreList, restoreDeployment:
+			if filepath.Ext(file) != ".json" {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			list, wrap, err := splitEntities(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for i, entity := range list {
+				name := entityName(entity)
+				if name == "" {
+					name = fmt.Sprintf("%s[%d]", strings.TrimSuffix(file, ".json"), i)
+				}
+				entities = append(entities, restoreEntity{Kind: kind, Env: env, Name: name, Data: entity, Wrap: wrap})
+			}
+		}
+	}
+	return entities, nil
+}
+
+// splitEntities returns the entities in a JSON file holding one entity, a
+// list of them or an object wrapping a list, e.g. {"developer": [...]},
+// along with the key of the wrapping object.
+func splitEntities(data []byte) ([]json.RawMessage, string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err == nil {
+		return list, "", nil
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, "", fmt.Errorf("not an entity or a list of entities: %w", err)
+	}
+	if len(object) == 1 {
+		for key, value := range object {
+			if err := json.Unmarshal(value, &list); err == nil {
+				return list, key, nil
+			}
+		}
+	}
+	return []json.RawMessage{data}, "", nil
+}
+
+// entityName returns the name of an exported entity: its name, a
+// developer's email or a deployment's proxy.
+func entityName(entity json.RawMessage) string {
+	var named struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		APIProxy string `json:"apiProxy"`
+	}
+	json.Unmarshal(entity, &named)
+	return cmp.Or(named.Name, named.Email, named.APIProxy)
+}
+
+// kvmName returns the KVM that an apigeecli KVM file holds entries of,
+// from its name: org_<org>_<kvm>_kvmfile_<n>.json, or env_<env>_... for an
+// environment KVM. Other files are named after the KVM.
+func kvmName(file, org, env string) string {
+	name := strings.TrimSuffix(file, ".json")
+	if env == "" {
+		name = strings.TrimPrefix(name, "org_"+org+"_")
+	} else {
+		name = strings.TrimPrefix(name, "env_"+env+"_")
+	}
+	if i := strings.LastIndex(name, "_kvmfile_"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// importEntity imports entity into org with apigeecli, staging its files in
+// their own directory under stage first so nothing else is imported with
+// it. With overwrite the entity already exists and is replaced. imported
+// holds the proxies imported by this restore, which are deployed at their
+// new revision rather than the one in the backup.
+func importEntity(entity restoreEntity, org, token, stage string, overwrite bool, imported map[string]bool) error {
+	if err := os.MkdirAll(stage, dirMode); err != nil {
+		return err
+	}
+	if overwrite && !entity.Kind.Reimport {
+		args := append(slices.Clone(entity.Kind.Delete), "-n", entity.Name, "-o", org)
+		if entity.Env != "" {
+			args = append(args, "-e", entity.Env)
+		}
+		if _, _, err := runApigeecli("", token, append(args, endpointArgs(org)...)...); err != nil {
+			return fmt.Errorf("failed to delete the existing %s: %w", entity.Kind.Label, err)
+		}
+	}
+	dir, err := os.MkdirTemp(stage, entity.Kind.Name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var args []string
+	switch entity.Kind.Format {
+	case restoreBundle, restoreKVM:
+		for _, file := range entity.Files {
+			if err := copyFile(file, filepath.Join(dir, filepath.Base(file))); err != nil {
+				return err
+			}
+		}
+		args = append(slices.Clone(entity.Kind.Import), dir)
+
+	case restoreList:
+		var data []byte
+		if entity.Wrap == "" {
+			data, err = json.Marshal([]json.RawMessage{entity.Data})
+		} else {
+			data, err = json.Marshal(map[string][]json.RawMessage{entity.Wrap: {entity.Data}})
+		}
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(dir, entity.Kind.Name+".json")
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			return err
+		}
+		args = append(slices.Clone(entity.Kind.Import), file)
+
+	case restoreDeployment:
+		revision, err := deployRevision(entity, org, token, imported)
+		if err != nil {
+			return err
+		}
+		args = []string{"apis", "deploy", "-n", entity.Name, "-v", revision}
+		if overwrite {
+			// Replace the revision that is deployed now
+			args = append(args, "--ovr")
+		}
+	}
+
+	args = append(args, "-o", org)
+	if entity.Env != "" && entity.Kind.Format != restoreKVM {
+		args = append(args, "-e", entity.Env)
+	}
+	_, _, err = runApigeecli(dir, token, append(args, endpointArgs(org)...)...)
+	return err
+}
+
+// deployRevision returns the revision of a proxy to deploy: the one in the
+// backup, or the newest if the proxy was imported by this restore, since an
+// import creates a new revision.
+func deployRevision(entity restoreEntity, org, token string, imported map[string]bool) (string, error) {
+	if !imported[entity.Name] {
+		var deployment struct {
+			Revision string `json:"revision"`
+		}
+		if err := json.Unmarshal(entity.Data, &deployment); err != nil || deployment.Revision == "" {
+			return "", errors.New("the backup has no revision for it")
+		}
+		return deployment.Revision, nil
+	}
+
+	args := append([]string{"apis", "get", "-n", entity.Name, "-o", org}, endpointArgs(org)...)
+	out, _, err := runApigeecli("", token, args...)
+	if err != nil {
+		return "", err
+	}
+	var proxy struct {
+		LatestRevisionID string `json:"latestRevisionId"`
+	}
+	if err := json.Unmarshal(out, &proxy); err != nil || proxy.LatestRevisionID == "" {
+		return "", fmt.Errorf("unexpected apigeecli output for the imported proxy: %s", out)
+	}
+	return proxy.LatestRevisionID, nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// restoreArchive builds a backup archive of files, keyed by path, with
+// manifest at its root.
+func restoreArchive(t *testing.T, manifest Manifest, files map[string]string) []byte {
+	t.Helper()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	w, err := archive.Create(manifestFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var restoreFiles = map[string]string{
+	"kvms/org_my-org_config_kvmfile_0.json":         `{"keyValueEntries": [{"name": "a", "value": "1"}]}`,
+	"kvms/org_my-org_config_kvmfile_1.json":         `{"keyValueEntries": [{"name": "b", "value": "2"}]}`,
+	"sharedflows/common.zip":                        "common bundle",
+	"proxies/hello.zip":                             "hello bundle",
+	"products.json":                                 `[{"name": "gold"}, {"name": "silver"}]`,
+	"developers.json":                               `{"developer": [{"email": "dev@example.com"}]}`,
+	"apps.json":                                     `[{"name": "app"}]`,
+	"env/prod/kvms/env_prod_secrets_kvmfile_0.json": `{"keyValueEntries": []}`,
+	"env/prod/targetservers/targetservers.json":     `[{"name":"backend","host":"backend.example.com"}]`,
+	"env/prod/proxies/hello.json":                   `{"apiProxy": "hello", "revision": "7"}`,
+	"env/test/targetservers/targetservers.json":     `[{"name": "test-backend"}]`,
+}
+
+// restoreRunner records the apigeecli commands of a restore other than
+// listings and --version, with the names of the files each import staged.
+// Listings of the org and --version are answered from existing, keyed by
+// command; listings are otherwise empty.
+func restoreRunner(runner *fakeRunner, existing map[string]string) *[]string {
+	var mu sync.Mutex
+	var commands []string
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		command := strings.Join(args, " ")
+		if args[0] == "--version" {
+			return existing[command], "", nil
+		}
+		if args[1] == "list" {
+			return cmp.Or(existing[command], "[]"), "", nil
+		}
+		if i := slices.Index(args, "-f"); i >= 0 {
+			path := args[i+1]
+			command = strings.Replace(command, path, "STAGED", 1)
+			if entries, err := os.ReadDir(path); err == nil {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				command += " [" + strings.Join(names, " ") + "]"
+			} else {
+				data, _ := os.ReadFile(path)
+				command += " " + string(data)
+			}
+		}
+		mu.Lock()
+		commands = append(commands, command)
+		mu.Unlock()
+		if args[1] == "get" {
+			return `{"revision": ["1"], "latestRevisionId": "1"}`, "", nil
+		}
+		return "", "", nil
+	}
+	return &commands
+}
+
+func TestRestoreBackup(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	commands := restoreRunner(runner, nil)
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true}, restoreFiles))
+
+	// Without --yes nothing is imported
+	var out strings.Builder
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("dry run ran %v", *commands)
+	}
+	if !strings.Contains(out.String(), "[dry-run] Would create target server backend in prod\n") || !strings.Contains(out.String(), "[dry-run] Would restore 10 entities into my-org (10 created, 0 overwritten, 0 skipped);") {
+		t.Errorf("dry run output = %q", out.String())
+	}
+
+	out.Reset()
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Apply: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kvms import -f STAGED -o my-org [org_my-org_config_kvmfile_0.json org_my-org_config_kvmfile_1.json]",
+		"kvms import -f STAGED -o my-org [env_prod_secrets_kvmfile_0.json]",
+		`targetservers import -f STAGED -o my-org -e prod [{"name":"backend","host":"backend.example.com"}]`,
+		`targetservers import -f STAGED -o my-org -e test [{"name":"test-backend"}]`,
+		"sharedflows import -f STAGED -o my-org [common.zip]",
+		"apis import -f STAGED -o my-org [hello.zip]",
+		`products import -f STAGED -o my-org [{"name":"gold"}]`,
+		`products import -f STAGED -o my-org [{"name":"silver"}]`,
+		`developers import -f STAGED -o my-org {"developer":[{"email":"dev@example.com"}]}`,
+		// The imported proxy is deployed at its new revision
+		"apis get -n hello -o my-org",
+		"apis deploy -n hello -v 1 -o my-org -e prod",
+	}
+	if !slices.Equal(*commands, want) {
+		t.Errorf("commands =\n%s\nwant\n%s", strings.Join(*commands, "\n"), strings.Join(want, "\n"))
+	}
+	for _, line := range []string{"Skipping apps", "created KVM config\n", "created developer dev@example.com\n", "created deployment of hello in prod\n", "Restored 10 entities into my-org: 10 created, 0 overwritten, 0 skipped, 0 failed\n"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output has no %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestRestoreEnv(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	commands := restoreRunner(runner, nil)
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true}, restoreFiles))
+
+	var out strings.Builder
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Env: "prod", Apply: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Only prod's entities, and the proxy stays at the revision it was deployed at
+	want := []string{
+		"kvms import -f STAGED -o my-org [env_prod_secrets_kvmfile_0.json]",
+		`targetservers import -f STAGED -o my-org -e prod [{"name":"backend","host":"backend.example.com"}]`,
+		"apis deploy -n hello -v 7 -o my-org -e prod",
+	}
+	if !slices.Equal(*commands, want) {
+		t.Errorf("commands =\n%s\nwant\n%s", strings.Join(*commands, "\n"), strings.Join(want, "\n"))
+	}
+	if strings.Contains(out.String(), "Skipping apps") {
+		t.Errorf("output mentions apps for one environment:\n%s", out.String())
+	}
+
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Env: "dev"}); err == nil || !strings.Contains(err.Error(), "no environment dev (it has prod, test)") {
+		t.Errorf("restoreBackup() for a missing environment = %v", err)
+	}
+
+	store.put(testBucket, backupObjectName("my-org", "2024-05-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}}, map[string]string{"targetservers-prod/ts.json": "[]"}))
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-05-01", "token", restoreOptions{Env: "prod"}); err == nil || !strings.Contains(err.Error(), "no per-environment folders") {
+		t.Errorf("restoreBackup() for a backup without env folders = %v", err)
+	}
+}
+
+func TestRestoreApigeecliVersion(t *testing.T) {
+	const exported = "apigeecli version 2.5.1 date: 2024-06-01T00:00:00Z"
+	tests := []struct {
+		installed   string
+		wantWarning bool
+	}{
+		{"apigeecli version 2.5.3 date: 2024-07-01T00:00:00Z", false},
+		{"apigeecli version 2.6.0 date: 2024-09-01T00:00:00Z", true},
+		// An installed version that can't be determined isn't compared
+		{"", false},
+	}
+	for _, tt := range tests {
+		runner, store := setupBackupTest(t)
+		restoreRunner(runner, map[string]string{"--version": tt.installed})
+		store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true, ApigeecliVersion: exported}, restoreFiles))
+
+		var out strings.Builder
+		if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		want := "Warning: the backup was exported by " + exported + ", but " + tt.installed + " is installed;"
+		if got := strings.Contains(out.String(), want); got != tt.wantWarning {
+			t.Errorf("installed %q: output =\n%s\nwant warning %v", tt.installed, out.String(), tt.wantWarning)
+		}
+	}
+}
+
+func TestRestoreEndpoint(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	restoreRunner(runner, nil)
+	record := runner.apigeecli
+	var calls [][]string
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if args[0] != "--version" {
+			calls = append(calls, args)
+		}
+		return record(dir, args)
+	}
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true}, restoreFiles))
+
+	// The project file's endpoint label picks the org's control plane, as
+	// main reads it before restoring
+	projectFile := filepath.Join(t.TempDir(), "projects.txt")
+	if err := os.WriteFile(projectFile, []byte("my-org endpoint=eu\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if _, projectLabels, err = readProjectFiles(projectFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup(&strings.Builder{}, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Apply: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) == 0 {
+		t.Fatal("restoreBackup() ran no apigeecli commands")
+	}
+	for _, args := range calls {
+		if i := slices.Index(args, "--region"); i < 0 || i+1 >= len(args) || args[i+1] != "eu" {
+			t.Errorf("apigeecli %q, want --region eu", args)
+		}
+	}
+}
+
+func TestRestoreDependencyFailure(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	restoreRunner(runner, nil)
+	record := runner.apigeecli
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		record(dir, args)
+		if args[0] == "sharedflows" && args[1] == "import" || args[0] == "apis" && args[1] != "list" {
+			return "", "", errors.New("INVALID_ARGUMENT")
+		}
+		return "", "", nil
+	}
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true}, restoreFiles))
+
+	var out strings.Builder
+	err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Apply: true})
+	if err == nil || !strings.Contains(err.Error(), "failed to restore 3 of 10 entities") {
+		t.Errorf("restoreBackup() = %v, want 3 failed entities", err)
+	}
+	// The shared flow failed on its own; the proxy and its deployment may
+	// have failed because of it
+	for _, line := range []string{
+		"failed shared flow common: ",
+		"failed proxy hello: ",
+		"INVALID_ARGUMENT (it may refer to shared flow common, which failed)\n",
+		"INVALID_ARGUMENT (it may refer to shared flow common, proxy hello, which failed)\n",
+		"created product gold\n",
+		"2 of the failed entities may have failed because an entity they refer to did;",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output has no %q:\n%s", line, out.String())
+		}
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "failed shared flow common") && strings.Contains(line, "may refer") {
+			t.Errorf("the shared flow is reported as failing because of a dependency: %s", line)
+		}
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	existing := map[string]string{
+		"targetservers list -o my-org -e prod": `["backend"]`,
+		"apis list -o my-org":                  `{"proxies": [{"name": "hello"}]}`,
+		"developers list -o my-org":            `{"developer": [{"email": "dev@example.com"}]}`,
+		"apis list -o my-org -e prod":          `{"deployments": [{"apiProxy": "hello", "revision": "3"}]}`,
+	}
+	tests := []struct {
+		conflict    string
+		wantErr     string
+		wantOutput  []string
+		wantImports []string
+	}{
+		{
+			conflict:    conflictFail,
+			wantErr:     "4 of 10 entities already exist in my-org",
+			wantOutput:  []string{"target server backend in prod already exists in my-org\n", "deployment of hello in prod already exists in my-org\n"},
+			wantImports: nil,
+		},
+		{
+			conflict:   conflictSkip,
+			wantOutput: []string{"skipped proxy hello (already exists)\n", "created product gold\n", "Restored 10 entities into my-org: 6 created, 0 overwritten, 4 skipped, 0 failed\n"},
+			wantImports: []string{
+				"kvms import -f STAGED -o my-org [org_my-org_config_kvmfile_0.json org_my-org_config_kvmfile_1.json]",
+				"kvms import -f STAGED -o my-org [env_prod_secrets_kvmfile_0.json]",
+				`targetservers import -f STAGED -o my-org -e test [{"name":"test-backend"}]`,
+				"sharedflows import -f STAGED -o my-org [common.zip]",
+				`products import -f STAGED -o my-org [{"name":"gold"}]`,
+				`products import -f STAGED -o my-org [{"name":"silver"}]`,
+			},
+		},
+		{
+			conflict: conflictOverwrite,
+			wantOutput: []string{
+				"overwritten target server backend in prod\n",
+				"skipped developer dev@example.com (already exists, and deleting a developer deletes its apps)\n",
+				"Restored 10 entities into my-org: 6 created, 3 overwritten, 1 skipped, 0 failed\n",
+			},
+			wantImports: []string{
+				"kvms import -f STAGED -o my-org [org_my-org_config_kvmfile_0.json org_my-org_config_kvmfile_1.json]",
+				"kvms import -f STAGED -o my-org [env_prod_secrets_kvmfile_0.json]",
+				// A target server is replaced, a bundle gets a new revision
+				"targetservers delete -n backend -o my-org -e prod",
+				`targetservers import -f STAGED -o my-org -e prod [{"name":"backend","host":"backend.example.com"}]`,
+				`targetservers import -f STAGED -o my-org -e test [{"name":"test-backend"}]`,
+				"sharedflows import -f STAGED -o my-org [common.zip]",
+				"apis import -f STAGED -o my-org [hello.zip]",
+				`products import -f STAGED -o my-org [{"name":"gold"}]`,
+				`products import -f STAGED -o my-org [{"name":"silver"}]`,
+				"apis get -n hello -o my-org",
+				"apis deploy -n hello -v 1 --ovr -o my-org -e prod",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conflict, func(t *testing.T) {
+			runner, store := setupBackupTest(t)
+			commands := restoreRunner(runner, existing)
+			store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true}, restoreFiles))
+
+			var out strings.Builder
+			err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Apply: true, Conflict: tt.conflict})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("restoreBackup() = %v, want %q", err, tt.wantErr)
+			}
+			for _, line := range tt.wantOutput {
+				if !strings.Contains(out.String(), line) {
+					t.Errorf("output has no %q:\n%s", line, out.String())
+				}
+			}
+			if !slices.Equal(*commands, tt.wantImports) {
+				t.Errorf("commands =\n%s\nwant\n%s", strings.Join(*commands, "\n"), strings.Join(tt.wantImports, "\n"))
+			}
+		})
+	}
+}
+
+func TestRestoreTargetOrg(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	commands := restoreRunner(runner, nil)
+
+	var bundle bytes.Buffer
+	zw := zip.NewWriter(&bundle)
+	for name, content := range map[string]string{
+		"apiproxy/policies/callout.xml":   "<URL>https://apigee.googleapis.com/v1/organizations/my-org/environments/prod</URL>",
+		"apiproxy/targets/default.xml":    "<URL>https://backend.my-org.example.com</URL>",
+		"apiproxy/resources/java/lib.jar": "my-org\x00organizations/my-org/",
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	files := map[string]string{
+		"kvms/org_my-org_config_kvmfile_0.json":     `{"keyValueEntries": []}`,
+		"proxies/hello.zip":                         bundle.String(),
+		"products.json":                             `[{"name": "gold", "scopes": ["organizations/my-org/scopes/read"]}, {"name": "my-org-silver"}]`,
+		"env/prod/targetservers/targetservers.json": `[{"name": "backend", "host": "backend.my-org.internal"}]`,
+	}
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}, EnvFolders: true}, files))
+
+	// Keep the rewritten bundle the proxy import was given
+	record := runner.apigeecli
+	var imported map[string]string
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		if args[0] == "apis" && args[1] == "import" {
+			bundle, err := zip.OpenReader(filepath.Join(args[3], "hello.zip"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported = make(map[string]string)
+			for _, entry := range bundle.File {
+				content, _ := entry.Open()
+				data, _ := io.ReadAll(content)
+				imported[entry.Name] = string(data)
+			}
+			bundle.Close()
+		}
+		return record(dir, args)
+	}
+
+	var out strings.Builder
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Apply: true, TargetOrg: "sandbox"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kvms import -f STAGED -o sandbox [org_sandbox_config_kvmfile_0.json]",
+		`targetservers import -f STAGED -o sandbox -e prod [{"name":"backend","host":"backend.my-org.internal"}]`,
+		"apis import -f STAGED -o sandbox [hello.zip]",
+		`products import -f STAGED -o sandbox [{"name":"gold","scopes":["organizations/sandbox/scopes/read"]}]`,
+		`products import -f STAGED -o sandbox [{"name":"my-org-silver"}]`,
+	}
+	if !slices.Equal(*commands, want) {
+		t.Errorf("commands =\n%s\nwant\n%s", strings.Join(*commands, "\n"), strings.Join(want, "\n"))
+	}
+
+	if got := imported["apiproxy/policies/callout.xml"]; got != "<URL>https://apigee.googleapis.com/v1/organizations/sandbox/environments/prod</URL>" {
+		t.Errorf("imported callout.xml = %q, want the org rewritten", got)
+	}
+	if got := imported["apiproxy/resources/java/lib.jar"]; got != "my-org\x00organizations/my-org/" {
+		t.Errorf("imported lib.jar = %q, want it unchanged", got)
+	}
+
+	// Hostnames can't be rewritten safely, so they are only reported
+	for _, line := range []string{
+		"Not rewritten: proxies/hello.zip (apiproxy/targets/default.xml) mentions my-org",
+		"Not rewritten: env/prod/targetservers/targetservers.json mentions my-org",
+		"Restored 5 entities into sandbox:",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output has no %q:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "products.json") || strings.Contains(out.String(), "callout.xml") {
+		t.Errorf("output reports references that were rewritten or name another org:\n%s", out.String())
+	}
+}
+
+func TestRestoreCombined(t *testing.T) {
+	runner, store := setupBackupTest(t)
+	commands := restoreRunner(runner, nil)
+	files := map[string]string{"other-org/proxies/other.zip": "other bundle"}
+	for name, content := range restoreFiles {
+		files["my-org/"+name] = content
+	}
+	store.put(testBucket, backupObjectName(combinedEnv, "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org", "other-org"}, Combined: true, EnvFolders: true}, files))
+
+	// my-org has no archive of its own, so its folder of the combined one is restored
+	var out strings.Builder
+	if err := restoreBackup(&out, testBucket, "my-org", "2024-06-01", "token", restoreOptions{Apply: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "my-org has no backup of its own for 2024-06-01, restoring it from gs://"+testBucket+"/"+backupObjectName(combinedEnv, "2024-06-01")+"\n") {
+		t.Errorf("output doesn't name the combined backup:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Restored 10 entities into my-org: 10 created,") {
+		t.Errorf("output =\n%s\nwant my-org's 10 entities restored", out.String())
+	}
+	if !slices.Contains(*commands, "apis import -f STAGED -o my-org [hello.zip]") || strings.Contains(strings.Join(*commands, "\n"), "other.zip") {
+		t.Errorf("commands =\n%s\nwant my-org's proxy only", strings.Join(*commands, "\n"))
+	}
+
+	if err := restoreBackup(&out, testBucket, "third-org", "2024-06-01", "token", restoreOptions{}); err == nil || !strings.Contains(err.Error(), "doesn't include third-org (it has my-org, other-org)") {
+		t.Errorf("restoreBackup() of an org not in the combined backup = %v", err)
+	}
+}
+
+func TestRestoreUnsafePath(t *testing.T) {
+	_, store := setupBackupTest(t)
+	store.put(testBucket, backupObjectName("my-org", "2024-06-01"), restoreArchive(t, Manifest{Orgs: []string{"my-org"}}, map[string]string{"../escape.json": "{}"}))
+
+	err := restoreBackup(&strings.Builder{}, testBucket, "my-org", "2024-06-01", "token", restoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unsafe path") {
+		t.Errorf("restoreBackup() = %v, want an unsafe path error", err)
+	}
+	if _, err := os.Stat(filepath.Join(os.TempDir(), "escape.json")); err == nil {
+		t.Error("the archive wrote outside the restore directory")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionLabel is the project file label that gives a project its own
+// retention in days, e.g. retention=90.
+const retentionLabel = "retention"
+
+// RetentionRule gives the projects it matches their own retention, instead
+// of --retention. Project is a glob matched against the project ID, e.g.
+// "*-prod", and Label a key=value label from the project file. A rule sets
+// exactly one of them.
+type RetentionRule struct {
+	Project string `json:"project,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Days    int    `json:"days"`
+}
+
+// retentionRules are tried in order; the first that matches a project sets
+// its retention, unless the project has a retention label.
+var retentionRules []RetentionRule
+
+// parseRetentionRule parses a --retention-rule value, MATCH:DAYS. MATCH is a
+// label if it contains "=", which project IDs can't, and a glob otherwise.
+func parseRetentionRule(value string) (RetentionRule, error) {
+	match, days, ok := cutLast(value, ":")
+	n, err := strconv.Atoi(strings.TrimSpace(days))
+	if !ok || err != nil {
+		return RetentionRule{}, fmt.Errorf("invalid retention rule %q, expected PROJECT_GLOB:DAYS or KEY=VALUE:DAYS", value)
+	}
+	rule := RetentionRule{Project: strings.TrimSpace(match), Days: n}
+	if strings.Contains(rule.Project, "=") {
+		rule.Label, rule.Project = rule.Project, ""
+	}
+	return rule, validateRetentionRule(rule)
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func validateRetentionRule(rule RetentionRule) error {
+	if (rule.Project == "") == (rule.Label == "") {
+		return fmt.Errorf("retention rule %+v must match either a project or a label", rule)
+	}
+	if _, err := path.Match(rule.Project, ""); err != nil {
+		return fmt.Errorf("invalid project pattern %q in retention rule", rule.Project)
+	}
+	if key, value, ok := strings.Cut(rule.Label, "="); rule.Label != "" && (!ok || key == "" || value == "") {
+		return fmt.Errorf("invalid label %q in retention rule, expected key=value", rule.Label)
+	}
+	return validRetention(rule.Days)
+}
+
+// validRetention checks a retention in days, which must leave today's
+// backup alone and shouldn't be a typo.
+func validRetention(days int) error {
+	if days < 1 || days > maxRetentionDays {
+		return fmt.Errorf("retention must be between 1 and %d days, got %d", maxRetentionDays, days)
+	}
+	return nil
+}
+
+func (r RetentionRule) matches(project string) bool {
+	if r.Label != "" {
+		key, value, _ := strings.Cut(r.Label, "=")
+		labelValue, ok := projectLabels[project][key]
+		return ok && labelValue == value
+	}
+	matched, _ := path.Match(r.Project, project)
+	return matched
+}
+
+// projectRetention returns project's retention in days: its retention label,
+// then the first matching rule, then defaultDays. Labels are checked by
+// checkRetentionLabels when the project file is read.
+func projectRetention(project string, defaultDays int) int {
+	if label, ok := projectLabels[project][retentionLabel]; ok {
+		if days, err := strconv.Atoi(label); err == nil {
+			return days
+		}
+	}
+	for _, rule := range retentionRules {
+		if rule.matches(project) {
+			return rule.Days
+		}
+	}
+	return defaultDays
+}
+
+// checkRetentionLabels makes sure every retention label in the project file
+// is a valid retention, so a typo can't delete a project's backups.
+func checkRetentionLabels(projects []string) error {
+	for _, project := range projects {
+		label, ok := projectLabels[project][retentionLabel]
+		if !ok {
+			continue
+		}
+		days, err := strconv.Atoi(label)
+		if err != nil {
+			return fmt.Errorf("%s has retention=%q, which isn't a number of days", project, label)
+		}
+		if err := validRetention(days); err != nil {
+			return fmt.Errorf("%s: %w", project, err)
+		}
+	}
+	return nil
+}
+
+// retentionOverridden reports whether any project can have a retention other
+// than --retention, so summaries show each project's.
+func retentionOverridden() bool {
+	if len(retentionRules) > 0 {
+		return true
+	}
+	for _, labels := range projectLabels {
+		if _, ok := labels[retentionLabel]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// appliedRetention is the retention in days this run applies, and
+// appliedEnvRetention the retention of each env it applies retention to.
+// They are recorded in the catalog, so the next run can tell if an env's
+// retention was shortened.
+var appliedRetention int
+var appliedEnvRetention map[string]int
+
+// confirmRetention lets a run apply a retention shorter than the previous
+// run's, after checkRetentionChange has shown what it would delete.
+var confirmRetention bool
+
+// RetentionPreview is how many of an env's backups, across all
+// destinations, a new retention would delete that the old one kept.
+type RetentionPreview struct {
+	Env   string
+	Count int
+	Bytes int64
+}
+
+// previewRetention returns, for each env with any, the backups that a
+// retention of newDays would delete and one of oldDays keeps. Envs with
+// nothing newly deleted are left out.
+func previewRetention(envs []string, oldDays, newDays int) ([]RetentionPreview, error) {
+	oldCutoff := time.Now().AddDate(0, 0, -oldDays)
+	newCutoff := time.Now().AddDate(0, 0, -newDays)
+
+	var previews []RetentionPreview
+	for _, env := range envs {
+		preview := RetentionPreview{Env: env}
+		for _, bucket := range envDestinations(env) {
+			objects, err := listEnv(bucket, env)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list gs://%s/%s: %w", bucket, objectKey(env), err)
+			}
+			var gcsPaths []string
+			sizes := make(map[string]int64, len(objects))
+			for _, attrs := range objects {
+				if attrs.Name == "" || attrs.Name == objectKey(env, latestPointerName) {
+					continue
+				}
+				gcsPath := fmt.Sprintf("gs://%s/%s", bucket, attrs.Name)
+				gcsPaths = append(gcsPaths, gcsPath)
+				sizes[gcsPath] = attrs.Size
+			}
+
+			kept := make(map[string]bool)
+			for _, gcsPath := range selectBackupsToDelete(gcsPaths, oldCutoff, env, minKeepBackups) {
+				kept[gcsPath] = true
+			}
+			for _, gcsPath := range selectBackupsToDelete(gcsPaths, newCutoff, env, minKeepBackups) {
+				if !kept[gcsPath] {
+					preview.Count++
+					preview.Bytes += sizes[gcsPath]
+				}
+			}
+		}
+		if preview.Count > 0 {
+			previews = append(previews, preview)
+		}
+	}
+	return previews, nil
+}
+
+// checkRetentionChange compares each env's new retention in days with the
+// one recorded in the catalog by the previous run. If one is shorter and
+// would delete backups the previous retention kept, they are logged per
+// env, and the run is refused unless confirmRetention is set. A catalog
+// that can't be read is only logged, so it never stops backups.
+func checkRetentionChange(retentions map[string]int) error {
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		log.Printf("Failed to read catalog, not checking for a shorter retention: %v\n", err)
+		return nil
+	}
+
+	var count int
+	var bytes int64
+	var shortened []string
+	envs := make([]string, 0, len(retentions))
+	for env := range retentions {
+		envs = append(envs, env)
+	}
+	slices.Sort(envs)
+	for _, env := range envs {
+		oldDays, newDays := catalog.envRetention(env), retentions[env]
+		if oldDays == 0 || newDays >= oldDays {
+			continue
+		}
+		previews, err := previewRetention([]string{env}, oldDays, newDays)
+		if err != nil {
+			return fmt.Errorf("failed to preview retention change: %w", err)
+		}
+		for _, preview := range previews {
+			log.Printf("%s: %d backups (%s) would be deleted by the new retention of %d days, down from %d\n", preview.Env, preview.Count, formatBytes(preview.Bytes), newDays, oldDays)
+			count += preview.Count
+			bytes += preview.Bytes
+			shortened = append(shortened, preview.Env)
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if !confirmRetention {
+		return fmt.Errorf("retention was shortened for %s, which would delete %d backups (%s) that the previous retention kept; run with --confirm-retention to apply it", strings.Join(shortened, ", "), count, formatBytes(bytes))
+	}
+	log.Printf("Retention shortened for %s, deleting %d backups (%s) (--confirm-retention)\n", strings.Join(shortened, ", "), count, formatBytes(bytes))
+	return nil
+}
+
+// envRetentions returns the retention in days of each env a run over
+// projects applies retention to. The combined archive always uses days.
+func envRetentions(projects []string, combined bool, days int) map[string]int {
+	if combined {
+		return map[string]int{combinedEnv: days}
+	}
+	retentions := make(map[string]int, len(projects))
+	for _, project := range projects {
+		retentions[storageEnv(project)] = projectRetention(project, days)
+	}
+	return retentions
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckRetentionChange(t *testing.T) {
+	_, store := setupBackupTest(t)
+	date := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+	for _, offset := range []int{0, -2, -4, -5} {
+		store.put(testBucket, backupObjectName("my-org", date(offset)), []byte("1234"))
+	}
+	store.put(testBucket, backupObjectName("other-org", date(-1)), []byte("1234"))
+
+	// Without a recorded retention there is nothing to compare with
+	if err := checkRetentionChange(map[string]int{"my-org": 3, "other-org": 3}); err != nil {
+		t.Fatalf("checkRetentionChange() without a recorded retention = %v", err)
+	}
+
+	appliedRetention = 7
+	if err := updateCatalog(testBucket, date(0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRetentionChange(map[string]int{"my-org": 14, "other-org": 14}); err != nil {
+		t.Errorf("checkRetentionChange() with a longer retention = %v", err)
+	}
+
+	previews, err := previewRetention([]string{"my-org", "other-org"}, 7, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previews) != 1 || previews[0] != (RetentionPreview{Env: "my-org", Count: 2, Bytes: 8}) {
+		t.Errorf("previewRetention() = %+v, want 2 backups of my-org", previews)
+	}
+
+	err = checkRetentionChange(map[string]int{"my-org": 3, "other-org": 3})
+	if err == nil || !strings.Contains(err.Error(), "--confirm-retention") {
+		t.Errorf("checkRetentionChange() with a shorter retention = %v, want a confirmation error", err)
+	}
+	confirmRetention = true
+	if err := checkRetentionChange(map[string]int{"my-org": 3, "other-org": 3}); err != nil {
+		t.Errorf("checkRetentionChange() with --confirm-retention = %v", err)
+	}
+
+	// Once the run under the new retention is recorded, it needs no confirmation
+	confirmRetention = false
+	appliedRetention = 3
+	if err := updateCatalog(testBucket, date(0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRetentionChange(map[string]int{"my-org": 3, "other-org": 3}); err != nil {
+		t.Errorf("checkRetentionChange() after the change was applied = %v", err)
+	}
+}
+
+func TestProjectRetention(t *testing.T) {
+	_, store := setupBackupTest(t)
+	projectLabels = map[string]map[string]string{
+		"shop-prod":  {"retention": "30"},
+		"pay-prod":   {},
+		"search-dev": {"env": "staging"},
+	}
+	for _, value := range []string{"*-prod:90", "env=staging:14"} {
+		rule, err := parseRetentionRule(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		retentionRules = append(retentionRules, rule)
+	}
+
+	for project, want := range map[string]int{"shop-prod": 30, "pay-prod": 90, "search-dev": 14, "other": 7} {
+		if got := projectRetention(project, 7); got != want {
+			t.Errorf("projectRetention(%s) = %d, want %d", project, got, want)
+		}
+	}
+
+	// Each env is cleaned up with its own retention
+	date := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Format(dateLayout)
+	}
+	for _, project := range []string{"pay-prod", "other"} {
+		store.put(testBucket, backupObjectName(project, date(-20)), []byte("old"))
+	}
+	statuses := cleanOnly([]string{"pay-prod", "other"}, 7)
+	if statuses[0].DeletedBackups != 0 || statuses[0].RetentionDays != 90 || statuses[1].DeletedBackups != 1 || statuses[1].RetentionDays != 7 {
+		t.Errorf("cleanOnly() = %+v, want pay-prod kept for 90 days and other's backup deleted", statuses)
+	}
+	if note := retentionNote(statuses[0]); note != "90 days retention" {
+		t.Errorf("retentionNote() = %q, want 90 days retention", note)
+	}
+
+	// Shortening one env's retention needs confirmation
+	appliedRetention = 7
+	appliedEnvRetention = envRetentions([]string{"pay-prod", "other"}, false, 7)
+	if err := updateCatalog(testBucket, date(0), nil); err != nil {
+		t.Fatal(err)
+	}
+	err := checkRetentionChange(map[string]int{"pay-prod": 7, "other": 7})
+	if err == nil || !strings.Contains(err.Error(), "--confirm-retention") {
+		t.Errorf("checkRetentionChange() shortening pay-prod = %v, want a confirmation error", err)
+	}
+	if err := checkRetentionChange(appliedEnvRetention); err != nil {
+		t.Errorf("checkRetentionChange() with unchanged retentions = %v", err)
+	}
+
+	for _, value := range []string{"*-prod", "*-prod:0", "[:90", "env=:90"} {
+		if _, err := parseRetentionRule(value); err == nil {
+			t.Errorf("parseRetentionRule(%q) = nil, want an error", value)
+		}
+	}
+	projectLabels["shop-prod"]["retention"] = "90d"
+	if err := checkRetentionLabels([]string{"shop-prod"}); err == nil {
+		t.Error("checkRetentionLabels() with retention=90d = nil, want an error")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os/exec"
+	"time"
+)
+
+// CommandRunner runs an external program, such as apigeecli or zip, in dir
+// with its output sent to stdout and stderr. A non-zero exit is returned as
+// an error, and the program is killed if ctx is done before it exits.
+type CommandRunner interface {
+	Run(ctx context.Context, dir string, stdout, stderr io.Writer, name string, args ...string) error
+}
+
+// commandRunner runs every external program the backup uses.
+var commandRunner CommandRunner = execRunner{}
+
+// execRunner runs programs from PATH.
+type execRunner struct{}
+
+// killWaitDelay is how long a killed program's output is still read, so a
+// child process left holding its pipes can't keep Run from returning.
+const killWaitDelay = 5 * time.Second
+
+func (execRunner) Run(ctx context.Context, dir string, stdout, stderr io.Writer, name string, args ...string) error {
+	slog.Debug("Running command", "command", commandLine(name, args), "dir", dir)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = killWaitDelay
+	return cmd.Run()
+}
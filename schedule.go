@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week. Each field is the set of values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// Like cron, when both day fields are restricted a time matches if
+	// either of them does
+	domRestricted, dowRestricted bool
+}
+
+// cronFields are the bounds of each field, in order.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+// parseSchedule parses a cron expression such as "0 2 * * *". Each field
+// accepts *, a value, a range a-b, a step */n or a-b/n, or a comma-separated
+// list of these. Day of week 7 is Sunday, like 0.
+func parseSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		bounds := cronFields[i]
+		max := bounds.max
+		if i == 4 {
+			max = 7
+		}
+		set, err := parseCronField(field, bounds.min, max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bounds.name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &cronSchedule{
+		minute:        sets[0],
+		hour:          sets[1],
+		dom:           sets[2],
+		month:         sets[3],
+		dow:           sets[4],
+		domRestricted: fields[2] != "*",
+		dowRestricted: fields[4] != "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", from)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time after t that matches the schedule, in t's
+// location, or the zero time if none does within four years (e.g. 31 February).
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(4, 0, 0); t.Before(end); {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom[t.Day()]
+	dow := s.dow[int(t.Weekday())]
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Saturday
+	from := time.Date(2024, 6, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 6, 1, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{"45 10 * * *", time.Date(2024, 6, 1, 10, 45, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 6, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 2 * * 1-5", time.Date(2024, 6, 3, 2, 0, 0, 0, time.UTC)},
+		{"0 2 * * 7", time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 15 * 1", time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			schedule, err := parseSchedule(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.next(from); !got.Equal(tt.want) {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{"", "0 2 * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "fmt"
+
+// ProjectSlice is the window of the project file a run backed up with
+// --limit, so a large fleet can be spread over several runs.
+type ProjectSlice struct {
+	Offset int `json:"offset"` // index of the first project, from 0
+	Count  int `json:"count"`  // projects in the window
+	Total  int `json:"total"`  // projects in the file
+}
+
+// runSlice is the window this run backs up, or nil if it backs up every project.
+var runSlice *ProjectSlice
+
+// selectProjects returns at most limit projects starting at offset, and
+// the slice they make up. The window wraps around the end of the list, so
+// runs with offsets 0, N, 2N and so on cover every project even when the
+// count isn't a multiple of N. A limit of 0 selects every project.
+func selectProjects(projects []string, offset, limit int) ([]string, *ProjectSlice) {
+	if limit == 0 || len(projects) == 0 {
+		return projects, nil
+	}
+	slice := &ProjectSlice{Offset: offset % len(projects), Count: min(limit, len(projects)), Total: len(projects)}
+	selected := make([]string, slice.Count)
+	for i := range selected {
+		selected[i] = projects[(slice.Offset+i)%len(projects)]
+	}
+	return selected, slice
+}
+
+// String describes the slice with 1-based positions, e.g. "Projects 101-200 of 500".
+func (s ProjectSlice) String() string {
+	first, last := s.Offset+1, s.Offset+s.Count
+	if last <= s.Total {
+		return fmt.Sprintf("Projects %d-%d of %d", first, last, s.Total)
+	}
+	return fmt.Sprintf("Projects %d-%d and 1-%d of %d", first, s.Total, last-s.Total, s.Total)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSelectProjects(t *testing.T) {
+	projects := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		name          string
+		offset, limit int
+		want          []string
+		wantSlice     string
+	}{
+		{name: "no limit", offset: 3, want: projects},
+		{name: "first window", limit: 2, want: []string{"a", "b"}, wantSlice: "Projects 1-2 of 5"},
+		{name: "middle window", offset: 2, limit: 2, want: []string{"c", "d"}, wantSlice: "Projects 3-4 of 5"},
+		{name: "wraps around", offset: 4, limit: 2, want: []string{"e", "a"}, wantSlice: "Projects 5-5 and 1-1 of 5"},
+		{name: "offset past the end", offset: 7, limit: 2, want: []string{"c", "d"}, wantSlice: "Projects 3-4 of 5"},
+		{name: "limit above the count", offset: 1, limit: 10, want: []string{"b", "c", "d", "e", "a"}, wantSlice: "Projects 2-5 and 1-1 of 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, slice := selectProjects(projects, tt.offset, tt.limit)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selectProjects() = %v, want %v", got, tt.want)
+			}
+			var gotSlice string
+			if slice != nil {
+				gotSlice = slice.String()
+			}
+			if gotSlice != tt.wantSlice {
+				t.Errorf("slice = %q, want %q", gotSlice, tt.wantSlice)
+			}
+		})
+	}
+}
+
+func TestRunBackupLimit(t *testing.T) {
+	runner, _ := setupBackupTest(t)
+	runner.apigeecli = func(dir string, args []string) (string, string, error) {
+		return "", "", writeExport(dir, "proxies/a.zip")
+	}
+
+	cfg := defaultConfig()
+	cfg.GCSBucket = testBucket
+	cfg.Limit, cfg.Offset = 2, 1
+	statuses, err := runBackup(cfg, []string{"org-a", "org-b", "org-c"}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, status := range statuses {
+		got = append(got, status.Project)
+	}
+	if !slices.Equal(got, []string{"org-b", "org-c"}) {
+		t.Errorf("backed up %v, want [org-b org-c]", got)
+	}
+
+	report := newReport(statuses)
+	if report.Slice == nil || *report.Slice != (ProjectSlice{Offset: 1, Count: 2, Total: 3}) {
+		t.Errorf("report slice = %+v, want offset 1, count 2, total 3", report.Slice)
+	}
+	summary := compactSummary("Summary", newSummaryTemplateData(report.Date, statuses, false, nil))
+	if !strings.Contains(summary, "Projects 2-3 of 3") {
+		t.Errorf("compactSummary() = %q, want it to name the slice", summary)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Storage is the object store backups are kept in. Errors follow the GCS
+// client's conventions: storage.ErrObjectNotExist for a missing object and
+// *googleapi.Error for a rejected request, so callers can classify them the
+// same way whatever the implementation.
+type Storage interface {
+	// Stat returns the attributes of an object.
+	Stat(ctx context.Context, bucket, name string) (ObjectInfo, error)
+	// List returns the objects whose names start with prefix. With a
+	// delimiter, names containing it after the prefix are rolled up into
+	// one entry with only Prefix set, as in a directory listing.
+	List(ctx context.Context, bucket, prefix, delimiter string) ([]ObjectInfo, error)
+	// Open returns a reader for an object and its attributes.
+	Open(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error)
+	// Write stores the contents of r as an object and returns the number of
+	// bytes written.
+	Write(ctx context.Context, bucket, name string, r io.Reader, opts WriteOptions) (int64, error)
+	Delete(ctx context.Context, bucket, name string) error
+	// SignedURL returns an https URL that allows anyone to download an
+	// object until ttl has passed.
+	SignedURL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error)
+	// Lifecycle returns a bucket's lifecycle configuration and its
+	// metageneration, which SetLifecycle takes as a precondition so a
+	// concurrent change isn't overwritten.
+	Lifecycle(ctx context.Context, bucket string) (storage.Lifecycle, int64, error)
+	SetLifecycle(ctx context.Context, bucket string, lifecycle storage.Lifecycle, metageneration int64) error
+}
+
+// ObjectInfo describes an object, or a rolled-up prefix in a listing.
+type ObjectInfo struct {
+	Name       string
+	Prefix     string
+	Size       int64
+	Generation int64
+	KMSKeyName string // the Cloud KMS key version that encrypts the object, if any
+	Metadata   map[string]string
+}
+
+// WriteOptions are the optional settings of a write. Either precondition
+// makes the write fail with 412 Precondition Failed if it doesn't hold.
+type WriteOptions struct {
+	ContentType     string
+	DoesNotExist    bool
+	GenerationMatch int64
+	Metadata        map[string]string
+}
+
+// objectStore is the Storage used for every bucket operation. It is set by
+// newGCSClient.
+var objectStore Storage
+
+// gcsStorage is the Storage backed by Google Cloud Storage.
+type gcsStorage struct {
+	client *storage.Client
+}
+
+// bucket returns a handle for name that bills requests to billingProject
+// when set, as requester-pays buckets require.
+func (s gcsStorage) bucket(name string) *storage.BucketHandle {
+	bucket := s.client.Bucket(name)
+	if billingProject != "" {
+		bucket = bucket.UserProject(billingProject)
+	}
+	return bucket
+}
+
+func (s gcsStorage) Stat(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	attrs, err := s.bucket(bucket).Object(name).Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return objectInfo(attrs), nil
+}
+
+func (s gcsStorage) List(ctx context.Context, bucket, prefix, delimiter string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	it := s.bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, objectInfo(attrs))
+	}
+}
+
+func (s gcsStorage) Open(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error) {
+	reader, err := s.bucket(bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return reader, ObjectInfo{Name: name, Size: reader.Attrs.Size, Generation: reader.Attrs.Generation}, nil
+}
+
+func (s gcsStorage) Write(ctx context.Context, bucket, name string, r io.Reader, opts WriteOptions) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	obj := s.bucket(bucket).Object(name)
+	switch {
+	case opts.DoesNotExist:
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	case opts.GenerationMatch != 0:
+		obj = obj.If(storage.Conditions{GenerationMatch: opts.GenerationMatch})
+	default:
+		// An unconditional write is overwritten with identical content on
+		// retry, so it is safe to retry even without preconditions
+		obj = obj.Retryer(storage.WithPolicy(storage.RetryAlways))
+	}
+
+	writer := obj.NewWriter(ctx)
+	writer.ChunkSize = uploadChunkSize
+	writer.ContentType = opts.ContentType
+	writer.Metadata = opts.Metadata
+	writer.KMSKeyName = kmsKeyName
+
+	written, err := io.Copy(writer, r)
+	if err != nil {
+		// Cancelling before Close abandons the upload instead of committing it
+		cancel()
+		writer.Close()
+		return written, err
+	}
+	if err := writer.Close(); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+func (s gcsStorage) Delete(ctx context.Context, bucket, name string) error {
+	return s.bucket(bucket).Object(name).Delete(ctx)
+}
+
+func (s gcsStorage) SignedURL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	opts := &storage.SignedURLOptions{Scheme: storage.SigningSchemeV4, Method: http.MethodGet, Expires: time.Now().Add(ttl)}
+	if billingProject != "" {
+		opts.QueryParameters = url.Values{"userProject": {billingProject}}
+	}
+	// The signer is detected from the client's credentials: a service
+	// account key signs locally, otherwise the IAM signBlob API is used
+	return s.bucket(bucket).SignedURL(name, opts)
+}
+
+func (s gcsStorage) Lifecycle(ctx context.Context, bucket string) (storage.Lifecycle, int64, error) {
+	attrs, err := s.bucket(bucket).Attrs(ctx)
+	if err != nil {
+		return storage.Lifecycle{}, 0, err
+	}
+	return attrs.Lifecycle, attrs.MetaGeneration, nil
+}
+
+func (s gcsStorage) SetLifecycle(ctx context.Context, bucket string, lifecycle storage.Lifecycle, metageneration int64) error {
+	handle := s.bucket(bucket).If(storage.BucketConditions{MetagenerationMatch: metageneration})
+	_, err := handle.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle})
+	return err
+}
+
+func objectInfo(attrs *storage.ObjectAttrs) ObjectInfo {
+	return ObjectInfo{Name: attrs.Name, Prefix: attrs.Prefix, Size: attrs.Size, Generation: attrs.Generation, KMSKeyName: attrs.KMSKeyName, Metadata: attrs.Metadata}
+}
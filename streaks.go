@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dedupeFailures leaves out the per-project notification of a project that
+// fails the same way as in its previous backups, and shows it as
+// still failing in the summary instead, so a week-long failure doesn't ping
+// every night.
+var dedupeFailures bool
+
+// failureStreakStart returns the date project started failing the way
+// status did, if its latest catalog entry before date failed the same way:
+// with the same failure key, or, for entries recorded before keys were, the
+// same reason. A different failure, or a complete backup, ends the streak.
+func failureStreakStart(catalog Catalog, status ProjectStatus, date string) (string, bool) {
+	var entries []CatalogEntry
+	for _, entry := range catalog.Entries {
+		if entry.Org == status.Project && entry.Date < date {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b CatalogEntry) int { return strings.Compare(a.Date, b.Date) })
+	start := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		same := entry.FailureKey == status.FailureKey || entry.FailureKey == "" && entry.Reason == status.Reason
+		if entry.Status != "Failed" || !same {
+			break
+		}
+		start = entries[i].Date
+	}
+	return start, start != ""
+}
+
+// failureHistory is the catalog as it was when the run started, which
+// markRepeatFailure looks up earlier failures in. It is nil if
+// dedupeFailures isn't set or the catalog couldn't be read.
+var failureHistory *Catalog
+
+// loadFailureHistory reads the catalog into failureHistory once per run,
+// before any project is backed up. A catalog that can't be read is only
+// logged, so failures are notified as usual.
+func loadFailureHistory() {
+	failureHistory = nil
+	if !dedupeFailures {
+		return
+	}
+	catalog, _, err := readCatalog(destinations[0])
+	if err != nil {
+		log.Printf("Failed to read catalog, notifying about every failure: %v\n", err)
+		return
+	}
+	failureHistory = &catalog
+}
+
+// markRepeatFailure sets status's FailingDays if its project failed the same
+// way in its previous backup in failureHistory.
+func markRepeatFailure(status *ProjectStatus) {
+	if failureHistory == nil || status.Status != "Failed" {
+		return
+	}
+	today := backupDate()
+	start, ok := failureStreakStart(*failureHistory, *status, today)
+	if !ok {
+		return
+	}
+	from, err := time.Parse(dateLayout, start)
+	if err != nil {
+		return
+	}
+	to, err := time.Parse(dateLayout, today)
+	if err != nil {
+		return
+	}
+	status.FailingDays = int(to.Sub(from).Hours()/24) + 1
+}
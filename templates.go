@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// Names of the blocks a notification template file may define. A file can
+// define either or both; any block left undefined falls back to the
+// built-in message format.
+const (
+	projectTemplateName = "project"
+	summaryTemplateName = "summary"
+)
+
+var discordTemplate *template.Template
+var workspaceTemplate *template.Template
+
+// TemplateData is the data passed to user-supplied notification templates.
+// Per-project messages populate the embedded ProjectStatus and Dataset,
+// while the final summary populates Statuses.
+type TemplateData struct {
+	ProjectStatus
+	Date               string
+	Dataset            string
+	Statuses           []ProjectStatus
+	TotalUploadedBytes int64
+	TotalStoredBytes   int64
+	FailedCount        int
+	Alert              bool
+	Changes            []ProjectChange
+	Slice              *ProjectSlice // the window of projects backed up with --limit
+
+	// StartedAt is when the project's backup started in per-project
+	// messages, and when the run started in the summary.
+	StartedAt time.Time
+}
+
+func newSummaryTemplateData(date string, statuses []ProjectStatus, alert bool, changes []ProjectChange) TemplateData {
+	uploaded, stored := totalBytes(statuses)
+	return TemplateData{
+		Date:               date,
+		Statuses:           statuses,
+		TotalUploadedBytes: uploaded,
+		TotalStoredBytes:   stored,
+		FailedCount:        countFailed(statuses),
+		Alert:              alert,
+		Changes:            changes,
+		Slice:              runSlice,
+		StartedAt:          runStart,
+	}
+}
+
+// templateFuncs are the helper functions available to notification templates.
+var templateFuncs = template.FuncMap{
+	"bytes": formatBytes,
+}
+
+func loadTemplate(filePath string) (*template.Template, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(filepath.Base(filePath)).Option("missingkey=error").Funcs(templateFuncs).ParseFiles(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl.Lookup(projectTemplateName) == nil && tmpl.Lookup(summaryTemplateName) == nil {
+		return nil, fmt.Errorf("template %s must define a %q or %q block", filePath, projectTemplateName, summaryTemplateName)
+	}
+
+	// Execute against sample data so field typos fail now rather than mid-run
+	sample := ProjectStatus{Project: "example-project", Status: "Complete", Reason: "no issue"}
+	data := TemplateData{
+		ProjectStatus: sample,
+		Date:          "2006-01-02",
+		Dataset:       "apigee-example-project",
+		Statuses:      []ProjectStatus{sample},
+	}
+	for _, name := range []string{projectTemplateName, summaryTemplateName} {
+		if tmpl.Lookup(name) == nil {
+			continue
+		}
+		if err := tmpl.ExecuteTemplate(io.Discard, name, data); err != nil {
+			return nil, fmt.Errorf("template %s: %w", filePath, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// renderTemplate executes the named block of tmpl. It reports false when
+// no custom template applies, so the caller can use its built-in format.
+func renderTemplate(tmpl *template.Template, name string, data TemplateData) (string, bool) {
+	if tmpl == nil || tmpl.Lookup(name) == nil {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("Failed to render %s template %s, using default format: %v\n", name, tmpl.Name(), err)
+		return "", false
+	}
+	return buf.String(), true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is backed by the global provider, which is a no-op until
+// setupTracing installs an exporting one.
+var tracer = otel.Tracer("apigee-backup")
+
+// setupTracing exports spans via OTLP/gRPC to endpoint, a URL such as
+// http://localhost:4317. With no endpoint tracing stays a no-op. The
+// returned function flushes pending spans and must be called before exit.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "apigee-backup"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// endSpan records the outcome of a project or stage span and ends it.
+func endSpan(span trace.Span, status ProjectStatus) {
+	span.SetAttributes(
+		attribute.String("apigee.org", status.Project),
+		attribute.String("backup.status", status.Status),
+		attribute.Int64("backup.uploaded_bytes", status.UploadedBytes),
+		attribute.Int64("backup.stored_bytes", status.StoredBytes),
+	)
+	if status.Status == "Failed" {
+		span.SetStatus(codes.Error, status.Reason)
+	}
+	span.End()
+}
+
+// endStage ends a stage span, marking it failed if err is set.
+func endStage(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// resumeUpload keeps each project's archive until it is uploaded, so a
+// rerun after a failed upload sends the same archive again instead of
+// exporting anew, and skips the parts of a split archive already in GCS.
+var resumeUpload bool
+
+// uploadState is what a kept archive was made from, so a rerun can check
+// the archive and report the same status as the run that made it.
+type uploadState struct {
+	// Archive is the kept archive's file name, which the object it is
+	// uploaded as is named after. With --unique-keys it ends in the start
+	// time of the run that made it, so a rerun keeps that run's key.
+	Archive       string         `json:"archive"`
+	SHA256        string         `json:"sha256"`
+	ContentSHA256 string         `json:"contentSha256,omitempty"`
+	EntityCounts  map[string]int `json:"entityCounts,omitempty"`
+}
+
+// uploadStateFile is the name of the state written next to a kept archive.
+const uploadStateFile = "upload.json"
+
+// pendingUploadDir returns where project's archive for date is kept until
+// it is uploaded. It lives in the export cache, which outlasts a failed run
+// and is cleared along with it once the backup is stored.
+func pendingUploadDir(project, date string) string {
+	return filepath.Join(exportCacheDir(project, date), "upload")
+}
+
+// writeUploadState records the kept archive zipFile and status's checksums
+// next to it.
+func writeUploadState(zipFile string, status ProjectStatus) error {
+	state := uploadState{Archive: filepath.Base(zipFile), SHA256: status.SHA256, ContentSHA256: status.ContentSHA256, EntityCounts: status.EntityCounts}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(filepath.Dir(zipFile), uploadStateFile), data, 0600)
+}
+
+// readPendingUpload returns the state of project's kept archive for date,
+// if an earlier run left one that still matches its recorded checksum. An
+// archive that doesn't is removed, so the backup starts over.
+func readPendingUpload(project, date string) (uploadState, bool) {
+	dir := pendingUploadDir(project, date)
+	data, err := os.ReadFile(filepath.Join(dir, uploadStateFile))
+	if err != nil {
+		return uploadState{}, false
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil || state.SHA256 == "" || state.Archive == "" || filepath.Base(state.Archive) != state.Archive {
+		log.Printf("Discarding unreadable upload state for %s: %v\n", project, err)
+		removeWorkDir(dir)
+		return uploadState{}, false
+	}
+	sum, err := fileSHA256(filepath.Join(dir, state.Archive))
+	if err != nil || sum != state.SHA256 {
+		log.Printf("Discarding kept archive for %s, it doesn't match its checksum\n", project)
+		removeWorkDir(dir)
+		return uploadState{}, false
+	}
+	return state, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeUpload(t *testing.T) {
+	for _, unique := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unique keys %t", unique), func(t *testing.T) {
+			runner, store := setupBackupTest(t)
+			maxArchiveSize = 200
+			resumeUpload = true
+			uniqueKeys = unique
+			var exports int
+			runner.apigeecli = func(dir string, args []string) (string, string, error) {
+				exports++
+				return "", "", writeExport(dir, "proxies/a.zip", "proxies/b.zip", "sharedflows/c.zip", "kvms/d.json")
+			}
+			name := backupObjectName("my-org", backupDate())
+			store.fail = func(op, bucket, object string) error {
+				return errorIf(op == "write" && object == partName(name, 2), errDenied)
+			}
+
+			status := backupProject(context.Background(), "my-org", testBucket, "token", 30)
+			if status.Status != "Failed" || exports != 1 {
+				t.Fatalf("status = %q (%s) after %d exports, want Failed after 1", status.Status, status.Reason, exports)
+			}
+			first, err := objectStore.Stat(context.Background(), testBucket, partName(name, 1))
+			if err != nil || first.Metadata[partSHA256Metadata] == "" {
+				t.Fatalf("first part = %+v, %v, want it uploaded with its checksum", first, err)
+			}
+
+			// The rerun uploads the kept archive under the first run's key,
+			// even though its own start time names unique keys differently,
+			// leaving the part already uploaded
+			store.fail = nil
+			runStart = runStart.Add(time.Hour)
+			status = backupProject(context.Background(), "my-org", testBucket, "token", 30)
+			if status.Status != "Complete" || exports != 1 {
+				t.Fatalf("status = %q (%s) after %d exports, want Complete without exporting again", status.Status, status.Reason, exports)
+			}
+			if status.Object != name+partsSuffix || len(status.EntityCounts) == 0 {
+				t.Errorf("Object = %q, EntityCounts = %v, want the index %s and the kept counts", status.Object, status.EntityCounts, name+partsSuffix)
+			}
+			if info, err := objectStore.Stat(context.Background(), testBucket, partName(name, 1)); err != nil || info.Generation != first.Generation {
+				t.Errorf("first part was uploaded again")
+			}
+			if sum, err := objectSHA256(testBucket, status.Object); sum != status.SHA256 || err != nil {
+				t.Errorf("objectSHA256() = %q, %v, want %q", sum, err, status.SHA256)
+			}
+			if _, err := os.Stat(pendingUploadDir("my-org", backupDate())); !os.IsNotExist(err) {
+				t.Errorf("kept archive wasn't removed after the upload: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadPendingUploadMismatch(t *testing.T) {
+	setupBackupTest(t)
+	dir := pendingUploadDir("my-org", backupDate())
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "backup.zip"), []byte("truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeUploadState(filepath.Join(dir, "backup.zip"), ProjectStatus{SHA256: strings.Repeat("0", 64)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readPendingUpload("my-org", backupDate()); ok {
+		t.Error("readPendingUpload() accepted an archive that doesn't match its checksum")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("mismatched archive wasn't removed: %v", err)
+	}
+}